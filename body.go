@@ -0,0 +1,142 @@
+package http2
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// StreamBody returns a reader of the DATA frames received on the given
+// stream, which are then buffered until read instead of being returned by
+// ReadFrame, so that the body of a stream can be read lazily while the
+// frames of the connection are read concurrently. The received bytes are
+// returned to the flow control window of the stream as they are read,
+// which limits the buffered ones to the window.
+//
+// Reading returns io.EOF once the END_STREAM flag was received and the
+// buffered bytes are read, even after the stream is half-closed by the
+// remote endpoint, or a StreamError if the stream is reset. Closing the
+// reader releases the bytes not read. The HEADERS frames of the stream
+// are still returned by ReadFrame, as are its RST_STREAM frames.
+func (c *Conn) StreamBody(streamID uint32) (io.ReadCloser, error) {
+	stream := c.stream(streamID)
+	if stream == nil {
+		return nil, fmt.Errorf("stream %d does not exist", streamID)
+	}
+	if c.tunnel(streamID) != nil {
+		return nil, fmt.Errorf("stream %d is a tunnel", streamID)
+	}
+
+	c.bodyL.Lock()
+	defer c.bodyL.Unlock()
+
+	if _, ok := c.bodies[streamID]; ok {
+		return nil, fmt.Errorf("body of stream %d already read", streamID)
+	}
+
+	b := newStreamBody(c, streamID)
+	switch StreamState(atomic.LoadInt32((*int32)(&stream.state))) {
+	case StateHalfClosedRemote, StateClosed:
+		b.err = io.EOF
+	default:
+		c.bodies[streamID] = b
+	}
+	return b, nil
+}
+
+func newStreamBody(c *Conn, streamID uint32) *requestBody {
+	b := &requestBody{conn: c, streamID: streamID}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (c *Conn) body(streamID uint32) *requestBody {
+	c.bodyL.Lock()
+	defer c.bodyL.Unlock()
+
+	return c.bodies[streamID]
+}
+
+func (c *Conn) removeBody(streamID uint32) {
+	c.bodyL.Lock()
+	delete(c.bodies, streamID)
+	c.bodyL.Unlock()
+}
+
+// closeBodies fails the stream bodies of the connection with err.
+func (c *Conn) closeBodies(err error) {
+	c.bodyL.Lock()
+	bodies := c.bodies
+	c.bodies = make(map[uint32]*requestBody)
+	c.bodyL.Unlock()
+
+	for _, b := range bodies {
+		b.closeWithError(err)
+	}
+}
+
+// failStreams fails the tunnels and stream bodies affected by an error
+// reading the connection: the ones of the streams reset for a StreamError
+// or a StreamErrorList, or else all of them.
+func (c *Conn) failStreams(err error) {
+	switch e := err.(type) {
+	case StreamError:
+		c.failStream(e)
+	case StreamErrorList:
+		for _, se := range e {
+			c.failStream(*se)
+		}
+	default:
+		c.closeTunnels(err)
+		c.closeBodies(err)
+	}
+}
+
+func (c *Conn) failStream(err StreamError) {
+	if t := c.tunnel(err.StreamID); t != nil {
+		c.removeTunnel(err.StreamID)
+		t.fail(err)
+	}
+	if b := c.body(err.StreamID); b != nil {
+		c.removeBody(err.StreamID)
+		b.closeWithError(err)
+	}
+}
+
+// bodyFrame buffers a DATA frame read by ReadFrame into the body of its
+// stream, if any, reporting whether the frame was consumed. The body
+// ends with the stream.
+func (c *Conn) bodyFrame(frame Frame) bool {
+	b := c.body(frame.Stream())
+	if b == nil {
+		return false
+	}
+
+	consumed := false
+	switch v := frame.(type) {
+	case *DataFrame:
+		n, err := c.readHeldData(v, b)
+		// The padding is not read from the body.
+		if pad := n - v.DataLen; pad > 0 {
+			c.releaseData(v.StreamID, pad)
+		}
+		if err != nil {
+			b.closeWithError(err)
+		} else if v.EndStream {
+			b.closeWithError(io.EOF)
+		}
+		consumed = true
+	case *HeadersFrame:
+		if v.EndStream {
+			b.closeWithError(io.EOF)
+		}
+	case *RSTStreamFrame:
+		b.closeWithError(StreamError{fmt.Errorf("stream %d reset by peer", v.StreamID), v.ErrCode, v.StreamID, ReasonPeerReset})
+	}
+
+	if s := c.stream(frame.Stream()); s == nil || !s.readable() {
+		c.removeBody(frame.Stream())
+	}
+	return consumed
+}
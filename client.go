@@ -169,7 +169,10 @@ func (c *Conn) clientHandshake() error {
 		if !state.NegotiatedProtocolIsMutual || state.NegotiatedProtocol != ProtocolTLS {
 			return HandshakeError(fmt.Sprintf("bad protocol %s", state.NegotiatedProtocol))
 		}
-	} else {
+		if err := c.checkTLS(state); err != nil {
+			return err
+		}
+	} else if !c.config.PriorKnowledge {
 		upgradeFunc := c.upgradeFunc
 		if upgradeFunc == nil {
 			upgradeFunc = func() error {
@@ -195,15 +198,7 @@ func (c *Conn) clientHandshake() error {
 	// The server connection preface consists of a potentially empty
 	// SETTINGS frame (Section 6.5) that MUST be the first frame the server
 	// sends in the HTTP/2 connection.
-	if firstFrame, err := c.readFrame(); err == nil {
-		if settings, ok := firstFrame.(*SettingsFrame); !ok || settings.Ack {
-			return errBadConnPreface
-		}
-	} else {
-		return err
-	}
-
-	return nil
+	return c.readPrefaceSettings()
 }
 
 func (c *Conn) clientUpgrade(req *http.Request) (err error) {
@@ -250,7 +245,7 @@ func (c *Conn) clientUpgrade(req *http.Request) (err error) {
 				binary.BigEndian.PutUint16(payload[i:i+2], uint16(setting.ID))
 				binary.BigEndian.PutUint32(payload[i+2:i+6], setting.Value)
 			}
-			encodedSettings = base64.URLEncoding.EncodeToString(payload)
+			encodedSettings = base64.RawURLEncoding.EncodeToString(payload)
 		}
 
 		req.Header["HTTP2-Settings"] = []string{encodedSettings}
@@ -2,10 +2,17 @@ package http2
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -39,18 +46,119 @@ type Conn struct {
 	streamL sync.RWMutex
 	streams map[uint32]*stream
 
-	closing int32
-	closed  int32
-	closeCh chan struct{}
+	// The streams in the dependency tree, by ID, and a counter
+	// incremented each time the tree is changed.
+	priorityL    sync.RWMutex
+	priorityTree map[uint32]*stream
+	priorityGen  uint64
+
+	// Priorities received in PRIORITY_UPDATE frames for idle
+	// streams, applied when the streams are opened.
+	pendingPriority map[uint32]PriorityParam
+
+	resetRate *rateCounter
+	// controlRate counts the PING and SETTINGS frames to acknowledge.
+	controlRate *rateCounter
+
+	windowUpdateRatio float32
+
+	// The pending window increments, by stream ID,
+	// sent when windowUpdateTimer fires.
+	windowUpdateL     sync.Mutex
+	windowUpdates     map[uint32]int
+	windowUpdateTimer *time.Timer
+
+	stats *statsQueue
+
+	streamStalls, connStalls stallCounter
+
+	// The CONNECT tunnels, by stream ID, whose frames are
+	// consumed by ReadFrame.
+	tunnelL sync.Mutex
+	tunnels map[uint32]*tunnel
+
+	// The stream bodies returned by StreamBody, by stream ID,
+	// whose DATA frames are consumed by ReadFrame.
+	bodyL  sync.Mutex
+	bodies map[uint32]*requestBody
+
+	// The streams opened by the remote endpoint when AcceptStreams is
+	// set, waiting for AcceptStream instead of being returned by ReadFrame,
+	// until a GOAWAY frame is sent and goAwaySentCh closed.
+	acceptL      sync.Mutex
+	acceptClosed bool
+	acceptCh     chan *Stream
+	goAwaySentCh chan struct{}
+	goAwayOnce   sync.Once
+
+	windowTuner *windowTuner
+
+	// The streams initiated by the remote endpoint and recently reset by
+	// this one, in order, whose frames still in flight are ignored.
+	resetL       sync.Mutex
+	resetStreams map[uint32]struct{}
+	resetOrder   []uint32
+
+	// The timings of the streams recently closed, in order.
+	timingL       sync.Mutex
+	closedTimings map[uint32]StreamTiming
+	timingOrder   []uint32
+
+	pingID     uint64
+	lastRead   int64
+	lastActive int64
+	pingL      sync.Mutex
+	pings      map[[8]byte]chan struct{}
+
+	// rtt is the smoothed round-trip time of the PING frames acknowledged,
+	// in nanoseconds, or zero before the first one.
+	rtt int64
+
+	closing  int32
+	closed   int32
+	closeCh  chan struct{}
+	closeErr atomic.Value
+
+	// stopAccepting is set by StopAccepting, after which the new streams
+	// are refused and the connection is not closed once idle.
+	stopAccepting int32
+
+	// The deadlines set by SetReadDeadline and SetWriteDeadline.
+	readDeadline  deadline
+	writeDeadline deadline
+
+	// cause is the first error closing the connection, returned by Err.
+	causeL sync.Mutex
+	cause  error
 
 	settingsCh chan Settings
 
+	// settingsAckCh is signaled when a SETTINGS frame is acknowledged,
+	// once settingsAckL, held while it is taken from settingsCh and its
+	// values are applied, is released. updateL serializes the calls to
+	// UpdateSettings.
+	settingsAckCh chan struct{}
+	settingsAckL  sync.Mutex
+	updateL       sync.Mutex
+
+	// The timers of the SETTINGS frames sent and not acknowledged yet,
+	// in order, and the numbers of frames sent and acknowledged.
+	settingsL      sync.Mutex
+	settingsTimers []*time.Timer
+	settingsSent,
+	settingsAcked uint64
+
 	*connState
 	remote *connState
 
 	idCh    chan struct{}
 	idState int32
 	idTimer *time.Timer
+
+	// headerStart is the time, in Unix nanoseconds, the header block
+	// being received started, of which headerTimer bounds the duration.
+	headerStart int64
+	headerTimer *time.Timer
 }
 
 // A Config structure is used to configure a HTTP/2 client or server connection.
@@ -59,17 +167,248 @@ type Config struct {
 	// connection settings exchange. If nil, empty settings is used.
 	InitialSettings Settings
 
+	// PriorKnowledge specifies that a client connection that is not a TLS
+	// one starts HTTP/2 by sending the connection preface at once, without
+	// the HTTP/1.1 Upgrade, defined in RFC 7540 section 3.4. Server
+	// connections accept both, as told by the first received octets.
+	PriorKnowledge bool
+
 	// HandshakeTimeout specifies the duration for the handshake to complete.
 	HandshakeTimeout time.Duration
 
-	// AllowLowTLSVersion controls whether a server allows the client's
-	// TLSVersion is lower than TLS 1.2.
+	// SettingsTimeout specifies the duration to wait for the remote
+	// endpoint to acknowledge a SETTINGS frame, after which the connection
+	// is closed with a GOAWAY frame of type SETTINGS_TIMEOUT.
+	// If zero, acknowledgements are waited for indefinitely.
+	SettingsTimeout time.Duration
+
+	// AllowLowTLSVersion controls whether a connection over TLS is
+	// allowed to negotiate a TLS version lower than TLS 1.2, which is
+	// otherwise closed with INADEQUATE_SECURITY, as are the ones
+	// negotiating a cipher suite of the black list of RFC 7540.
 	AllowLowTLSVersion bool
 
 	// ReadBufSize and WriteBufSize specify I/O buffer sizes. If the buffer
 	// size is zero, then a default value of 4096 is used. The I/O buffer sizes
 	// do not limit the size of the frames that can be sent or received.
 	ReadBufSize, WriteBufSize int
+
+	// MaxQueuedFrames and MaxQueuedBytes limit the number of frames queued
+	// to be written, and the bytes of the DATA frames among them. Writing a
+	// frame blocks while the queue is full, until the frames queued before
+	// are written. The control frames, i.e. SETTINGS, PING, RST_STREAM,
+	// WINDOW_UPDATE, PRIORITY and GOAWAY frames, are not counted and always
+	// queued, ahead of the other frames. If zero or negative, the queue is
+	// not limited.
+	MaxQueuedFrames, MaxQueuedBytes int
+
+	// MaxResetStreams and ResetStreamWindow limit the number of streams
+	// that the remote endpoint may open and then reset before any frame was
+	// sent on them within the window (CVE-2023-44487). When the limit is
+	// exceeded, the connection is closed with a GOAWAY frame of type
+	// ENHANCE_YOUR_CALM. If zero, a default value of 100 per second is used.
+	// If MaxResetStreams is negative, the number of streams is not limited.
+	MaxResetStreams   int
+	ResetStreamWindow time.Duration
+
+	// MaxControlFrames and ControlFrameWindow limit the number of PING and
+	// SETTINGS frames without the ACK flag that the remote endpoint may
+	// send within the window, each one being acknowledged. When the limit
+	// is exceeded, the connection is closed with a GOAWAY frame of type
+	// ENHANCE_YOUR_CALM. If zero, a default value of 100 per second is used.
+	// If MaxControlFrames is negative, the number of frames is not limited.
+	// The acknowledgements of the frames sent by this endpoint, like the
+	// ones of the keepalive pings, are not counted.
+	MaxControlFrames   int
+	ControlFrameWindow time.Duration
+
+	// MaxContinuationFrames and MaxHeaderBlockSize limit the number of
+	// CONTINUATION frames and the octets of a header block received before
+	// the END_HEADERS flag (CVE-2024-27316). When a limit is exceeded, the
+	// connection is closed with a GOAWAY frame of type ENHANCE_YOUR_CALM.
+	// If zero, default values of 1000 frames and 1MB are used. If negative,
+	// the header blocks are not limited.
+	MaxContinuationFrames int
+	MaxHeaderBlockSize    int
+
+	// DisableHeaderIndexing makes the HPACK encoder write the header fields
+	// not found in its tables as literals without indexing, defined in RFC
+	// 7541 section 6.2.2, so that no dynamic table is kept for the header
+	// blocks sent, trading compression for bounded memory. The dynamic
+	// table used to decode the received header blocks is bounded by the
+	// SETTINGS_HEADER_TABLE_SIZE of the InitialSettings, and can be reduced
+	// with SetDecoderTableSize.
+	DisableHeaderIndexing bool
+
+	// WindowUpdateRatio specifies the ratio of a receive flow-control
+	// window, between 0 and 1, down to which it is consumed before a
+	// WINDOW_UPDATE frame restores it. A higher ratio sends more frequent
+	// and smaller updates, keeping the remote endpoint from waiting for
+	// window when exchanging small messages; a lower one sends fewer
+	// updates, suiting bulk transfers. If not within (0, 1), a default
+	// value of 0.5 is used.
+	WindowUpdateRatio float64
+
+	// WindowUpdateDelay specifies the duration over which the window
+	// increments of the streams and of the connection are coalesced,
+	// sending fewer and larger WINDOW_UPDATE frames when reading at a high
+	// throughput. An increment reaching the window size is sent at once.
+	// If zero, WINDOW_UPDATE frames are sent as soon as the bytes are
+	// returned.
+	WindowUpdateDelay time.Duration
+
+	// MaxStreamBufferSize limits the octets of DATA frames received on a
+	// stream and not consumed yet. If positive, no WINDOW_UPDATE frame
+	// grows the receive window of a stream beyond it, so that the remote
+	// endpoint stops sending on the stream while the buffered octets reach
+	// it, including when the window would be auto-tuned. The remote
+	// endpoint may still send up to the InitialWindowSize advertised in the
+	// settings when it is larger.
+	//
+	// StrictStreamBuffer makes it a hard limit: a stream of which the
+	// buffered octets exceed it is reset with FLOW_CONTROL_ERROR. It is to
+	// be used with an InitialWindowSize not larger than MaxStreamBufferSize,
+	// or a compliant remote endpoint might overrun it.
+	MaxStreamBufferSize int
+	StrictStreamBuffer  bool
+
+	// AutoTuneWindow enables growing the receive flow control windows up to
+	// the maximum window size when the measured bandwidth-delay product of
+	// the connection exceeds them, and shrinking them back when idle.
+	// If false, the windows keep their initial size.
+	AutoTuneWindow bool
+
+	// KeepaliveInterval specifies the duration without reading any frame
+	// after which a PING frame is sent to check the connection is alive.
+	// If zero, no keepalive is sent.
+	KeepaliveInterval time.Duration
+
+	// KeepaliveTimeout specifies the duration to wait for the keepalive
+	// ACK before closing the connection with ErrKeepaliveTimeout.
+	// If zero, a default value of 20 seconds is used.
+	KeepaliveTimeout time.Duration
+
+	// IdleTimeout specifies the duration without any active stream, nor
+	// any HEADERS or DATA frame read or written, after which a GOAWAY
+	// frame is sent and the connection is closed with ErrIdleTimeout.
+	// If zero, the connection never times out.
+	IdleTimeout time.Duration
+
+	// MaxLifetime specifies the duration after the handshake after which
+	// the connection is retired regardless of its activity, e.g. to spread
+	// the clients of load-balanced servers fairly: it is shut down
+	// gracefully as by Shutdown, sending a GOAWAY frame and closing once
+	// the active streams are done, and no new stream can be opened on
+	// it. If zero, the lifetime is unlimited.
+	MaxLifetime time.Duration
+
+	// ConnectHandler is called in its own goroutine for each CONNECT
+	// request received by a server connection, defined in RFC 7540
+	// section 8.3, after the tunnel is established with a 200 response.
+	// The DATA frames of the tunnel stream are consumed by ReadFrame and
+	// read from the tunnel. If nil, CONNECT requests are returned by
+	// ReadFrame like any other, as are the extended CONNECT requests
+	// carrying a :protocol pseudo-header field.
+	ConnectHandler func(authority string, tunnel io.ReadWriteCloser)
+
+	// WebSocketHandler is called in its own goroutine for each extended
+	// CONNECT request of a WebSocket received by a server connection,
+	// carrying a :protocol pseudo-header field of "websocket" as defined
+	// in RFC 8441, with its header block and the stream as a net.Conn,
+	// once established with a 200 response. The WebSocket protocol then
+	// runs over the DATA frames of the stream. Clients only send them once
+	// SETTINGS_ENABLE_CONNECT_PROTOCOL is enabled by the InitialSettings.
+	// If nil, these requests are returned by ReadFrame like any other.
+	WebSocketHandler func(header Header, conn net.Conn)
+
+	// AcceptStreams makes the streams opened by the client on a server
+	// connection returned by AcceptStream, as raw streams, instead of
+	// their HEADERS frames being returned by ReadFrame.
+	AcceptStreams bool
+
+	// OnNewStream, if non-nil, is called by a server connection with the
+	// header block of each stream opened by the client, once decoded and
+	// before the HEADERS frame is returned by ReadFrame, to reject requests
+	// early, e.g. for admission control. If it returns an error, the stream
+	// is reset with the ErrCode of a StreamError, or with REFUSED_STREAM
+	// for other errors, and the frame is not returned. It is called by
+	// ReadFrame, so it must be fast, and must not retain or modify the
+	// header.
+	OnNewStream func(streamID uint32, header Header) error
+
+	// OnSendSettings, if non-nil, is called with the settings of each
+	// SETTINGS frame to be sent but the acknowledgements, including the
+	// first one carrying the InitialSettings and the ones of UpdateSettings,
+	// and returns the settings sent instead, which apply once acknowledged.
+	// It is meant for testing the interoperability with other endpoints.
+	// The returned settings are validated as by Settings.SetValue, unknown
+	// identifiers being sent as they are: if a value is out of range, the
+	// frame is not sent and the write fails with the error of SetValue.
+	// The settings given may be modified.
+	OnSendSettings func(settings Settings) Settings
+
+	// ReadHeaderTimeout specifies the duration to receive a header block,
+	// from its HEADERS or PUSH_PROMISE frame to the END_HEADERS flag. As no
+	// other frame is interleaved with the CONTINUATION frames of a header
+	// block, the connection is closed with ErrReadHeaderTimeout when it is
+	// exceeded. If zero, header blocks are waited for indefinitely.
+	ReadHeaderTimeout time.Duration
+
+	// ReadBodyTimeout specifies the duration that reading a body, with
+	// StreamBody, from a tunnel, the request body of a handler served by
+	// HTTPHandler, or the response body of a Transport, waits for a DATA
+	// frame while no byte is buffered.
+	// When it is exceeded, the stream is reset with CANCEL and the read
+	// fails with a StreamError wrapping ErrReadBodyTimeout, so that slow
+	// senders do not hold the stream. If zero, bodies are waited for
+	// indefinitely.
+	ReadBodyTimeout time.Duration
+
+	// Stats receives the events of the connection, to collect its metrics.
+	// If nil, they are discarded.
+	Stats ConnStats
+
+	// FrameLogger, if non-nil, is called with each frame read, once
+	// parsed, with the direction "recv", and with each frame written,
+	// before it is serialized, with the direction "send". It is called
+	// from the read and write loops of the connection, so it must be fast
+	// and must not retain or modify the frame, nor read the payload of
+	// DATA frames. FormatFrame formats the frames for debugging.
+	FrameLogger func(dir string, frame Frame)
+
+	// OnStateChange, if non-nil, is called after each transition of the
+	// state of a stream, including its opening or reservation from the
+	// "idle" state and its closing. It is called without holding any of
+	// the locks of the connection, from the goroutine making the
+	// transition, which can be its read or write loop; it must be fast,
+	// and must not write frames.
+	OnStateChange func(streamID uint32, from, to StreamState)
+
+	// FlowControlStallThreshold specifies the duration that writing DATA
+	// frames waits for a flow-control window, from which it is counted as
+	// a stall by SendWindowStalls and Stats. If zero, all waits are counted.
+	FlowControlStallThreshold time.Duration
+
+	// FlowControlTimeout specifies the duration that writing a DATA frame
+	// waits for the flow-control windows of its stream and of the
+	// connection, after which WriteFrame fails with ErrFlowControlTimeout;
+	// the frame is not sent, or its end is not, when it was split by the
+	// windows. If zero, writes wait until a window is available or the
+	// stream is closed.
+	FlowControlTimeout time.Duration
+
+	// DisableBufferPool disables the pooling of the buffers through which
+	// the payloads of received DATA frames are copied out, by HTTPHandler,
+	// Transport and the stream bodies, allocating a buffer for each frame
+	// instead. This is meant to debug uses of a buffer after it is given
+	// back to the pool.
+	DisableBufferPool bool
+
+	// NewWriteScheduler returns the WriteScheduler used to order frames
+	// of different streams. If nil, NewExtensiblePriorityWriteScheduler is
+	// used when InitialSettings disable the RFC 7540 priorities with
+	// SettingNoRFC7540Priorities, and NewPriorityWriteScheduler otherwise.
+	NewWriteScheduler func(*Conn) WriteScheduler
 }
 
 var defaultConfig = Config{}
@@ -98,16 +437,55 @@ func newConn(rwc io.ReadWriteCloser, server bool, config *Config) *Conn {
 
 	conn.buf = bufio.NewReadWriter(bufio.NewReaderSize(rwc, readBufSize), bufio.NewWriterSize(rwc, conn.config.WriteBufSize))
 	conn.frameReader = newFrameReader(conn.buf.Reader, readBufSize)
+	conn.frameReader.trailer = conn.isTrailer
+	conn.frameReader.connectProtocol = conn.connectProtocol
+	if conn.config.ReadHeaderTimeout > 0 {
+		conn.headerTimer = time.AfterFunc(conn.config.ReadHeaderTimeout, conn.readHeaderTimeout)
+		conn.headerTimer.Stop()
+		conn.frameReader.headerBlock = conn.headerBlock
+	}
+	conn.frameReader.maxContinuations = configLimit(conn.config.MaxContinuationFrames, 1000)
+	conn.frameReader.maxHeaderBlockSize = configLimit(conn.config.MaxHeaderBlockSize, 1<<20)
 	conn.frameWriter = newFrameWriter(conn.buf.Writer)
-	conn.writeQueue = &writeQueue{ch: make(chan Frame, 1)}
+	conn.frameWriter.direct = rwc
+	conn.frameWriter.SetIndexing(!conn.config.DisableHeaderIndexing)
+	newWriteScheduler := conn.config.NewWriteScheduler
+	if newWriteScheduler == nil {
+		newWriteScheduler = NewPriorityWriteScheduler
+		if conn.config.InitialSettings.NoRFC7540Priorities() {
+			newWriteScheduler = NewExtensiblePriorityWriteScheduler
+		}
+	}
+	conn.writeQueue = newWriteQueue(newWriteScheduler(conn), conn.config.MaxQueuedFrames, conn.config.MaxQueuedBytes)
 	conn.connStream = &stream{conn: conn, id: 0, weight: defaultWeight}
 	w := int(defaultInitialWindowSize)
 	conn.connStream.recvFlow = &flowController{s: conn.connStream, win: w, winUpperBound: w, processedWin: w}
 	conn.connStream.sendFlow = &remoteFlowController{s: conn.connStream, winCh: make(chan int, 1)}
 	conn.connStream.sendFlow.incrementInitialWindow(w)
 	conn.streams = make(map[uint32]*stream)
+	conn.priorityTree = make(map[uint32]*stream)
+	conn.pendingPriority = make(map[uint32]PriorityParam)
+	conn.tunnels = make(map[uint32]*tunnel)
+	conn.bodies = make(map[uint32]*requestBody)
+	conn.acceptCh = make(chan *Stream, acceptBacklog)
+	conn.goAwaySentCh = make(chan struct{})
+	conn.windowUpdates = make(map[uint32]int)
+	conn.resetStreams = make(map[uint32]struct{})
+	conn.closedTimings = make(map[uint32]StreamTiming)
+	conn.stats = newStatsQueue(conn.config.Stats)
+	conn.windowUpdateRatio = 0.5
+	if r := conn.config.WindowUpdateRatio; r > 0 && r < 1 {
+		conn.windowUpdateRatio = float32(r)
+	}
+	conn.resetRate = newRateCounter(conn.config.MaxResetStreams, conn.config.ResetStreamWindow, 100, time.Second)
+	conn.controlRate = newRateCounter(conn.config.MaxControlFrames, conn.config.ControlFrameWindow, 100, time.Second)
+	if conn.config.AutoTuneWindow {
+		conn.windowTuner = &windowTuner{conn: conn}
+	}
+	conn.pings = make(map[[8]byte]chan struct{})
 	conn.closeCh = make(chan struct{})
 	conn.settingsCh = make(chan Settings, 4)
+	conn.settingsAckCh = make(chan struct{}, 1)
 	conn.connState = &connState{conn: conn, server: server}
 	conn.remote = &connState{conn: conn, server: !server}
 	if server {
@@ -140,21 +518,85 @@ func (c *Conn) NumActiveStreams() uint32 {
 	return atomic.LoadUint32(&c.numStreams) + atomic.LoadUint32(&c.remote.numStreams)
 }
 
-// NextStreamID returns the next generated stream id.
+// NumLocalStreams returns the number of active streams initiated by this
+// endpoint, limited by the MAX_CONCURRENT_STREAMS setting of the remote one.
+func (c *Conn) NumLocalStreams() uint32 {
+	return atomic.LoadUint32(&c.numStreams)
+}
+
+// NumRemoteStreams returns the number of active streams initiated by the
+// remote endpoint, limited by the MAX_CONCURRENT_STREAMS setting of this one.
+// The streams opened beyond the limit are refused with REFUSED_STREAM.
+func (c *Conn) NumRemoteStreams() uint32 {
+	return atomic.LoadUint32(&c.remote.numStreams)
+}
+
+// RangeStreams calls fn for each stream of the connection in ascending order
+// of stream ID, with its state and the available receive and send flow control
+// windows. If fn returns false, RangeStreams stops the iteration.
 //
+// The streams are collected under the lock of the connection, so that fn
+// sees a consistent set of streams and may itself call methods of the Conn.
+func (c *Conn) RangeStreams(fn func(id uint32, state StreamState, recvWin, sendWin uint32) bool) {
+	c.streamL.RLock()
+	streams := make([]*stream, 0, len(c.streams))
+	for _, stream := range c.streams {
+		streams = append(streams, stream)
+	}
+	c.streamL.RUnlock()
+
+	sort.Slice(streams, func(i, j int) bool { return streams[i].id < streams[j].id })
+
+	for _, stream := range streams {
+		var recvWin, sendWin uint32
+		if stream.recvFlow != nil {
+			if w := stream.recvFlow.window(); w > 0 {
+				recvWin = uint32(w)
+			}
+		}
+		if stream.sendFlow != nil {
+			if w := stream.sendFlow.available(); w > 0 {
+				sendWin = uint32(w)
+			}
+		}
+		state := StreamState(atomic.LoadInt32((*int32)(&stream.state)))
+		if !fn(stream.id, state, recvWin, sendWin) {
+			return
+		}
+	}
+}
+
+// NextStreamID returns the next generated stream id, or
+// ErrStreamIDsExhausted once the last one was used.
 func (c *Conn) NextStreamID() (uint32, error) {
 again:
 	select {
 	case <-c.closeCh:
 		return 0, ErrClosed
 	case <-c.idCh:
+		// Stream 1 is used by the upgrade request, unless the client
+		// starts HTTP/2 with prior knowledge.
+		streamID := c.nextStreamID
+		if streamID == 1 && !c.config.PriorKnowledge {
+			streamID += 2
+		}
+
+		// Long-lived connections can result in an endpoint exhausting the
+		// available range of stream identifiers.  An endpoint that is
+		// unable to establish a new stream identifier can send a GOAWAY
+		// frame, new streams being opened on a new connection.
+		if streamID > maxStreamID {
+			c.idCh <- struct{}{}
+			if _, sent := c.remote.goAway.Load().(*GoAwayFrame); !sent {
+				c.writeFrame(&GoAwayFrame{LastStreamID: c.LastStreamID(), ErrCode: ErrCodeNo})
+			}
+			return 0, ErrStreamIDsExhausted
+		}
+
 		const cancelTimeout = 1 * time.Second
 		c.idTimer.Reset(cancelTimeout)
 		atomic.StoreInt32(&c.idState, 1)
-		if c.nextStreamID > 1 {
-			return c.nextStreamID, nil
-		}
-		return c.nextStreamID + 2, nil
+		return streamID, nil
 	case <-c.idTimer.C:
 		select {
 		case <-c.closeCh:
@@ -168,18 +610,219 @@ again:
 	}
 }
 
+// CanOpenStream reports whether a new stream can be opened on the
+// connection, which is not closed or shutting down, has not sent or
+// received a GOAWAY frame, and has stream IDs left. A connection that
+// cannot is to be replaced by a new one for the following streams.
+func (c *Conn) CanOpenStream() bool {
+	if c.Closed() || atomic.LoadInt32(&c.closing) == 1 || c.goAway.Load() != nil || c.remote.goAway.Load() != nil {
+		return false
+	}
+	// The next stream ID follows the last one used.
+	last := atomic.LoadUint32(&c.lastStreamID)
+	return last == 0 || last+2 <= maxStreamID
+}
+
 // LastStreamID returns the ID of the remote-stream last successfully created.
 func (c *Conn) LastStreamID() uint32 {
 	return atomic.LoadUint32(&c.remote.lastStreamID)
 }
 
-// Settings returns the local-side http2settings.
+// StreamContext returns the context of the given stream, which is canceled
+// when the stream is closed. It returns false if the stream does not exist.
+func (c *Conn) StreamContext(streamID uint32) (context.Context, bool) {
+	stream := c.stream(streamID)
+	if stream == nil {
+		return nil, false
+	}
+	return stream.ctx, true
+}
+
+// BindStreamContext ties the given stream to ctx. When ctx is done before
+// the stream is closed, the stream context is canceled, and the stream is
+// reset with a RST_STREAM frame of type CANCEL, so that the remote endpoint
+// stops the work associated with it.
+func (c *Conn) BindStreamContext(streamID uint32, ctx context.Context) error {
+	stream := c.stream(streamID)
+	if stream == nil {
+		return fmt.Errorf("stream %d does not exist", streamID)
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.cancelCtx()
+			c.writeFrame(&RSTStreamFrame{streamID, ErrCodeCancel})
+		case <-stream.closeCh:
+		}
+	}()
+
+	return nil
+}
+
+// StreamTiming returns the times the given stream was opened, sent or
+// received its first DATA frame, and was closed. The timings of the
+// streams recently closed are kept. It returns false if the stream does
+// not exist.
+func (c *Conn) StreamTiming(streamID uint32) (StreamTiming, bool) {
+	if stream := c.stream(streamID); stream != nil {
+		return stream.timing(), true
+	}
+
+	c.timingL.Lock()
+	defer c.timingL.Unlock()
+
+	timing, ok := c.closedTimings[streamID]
+	return timing, ok
+}
+
+// StreamPriority returns the resolved priority of the given stream,
+// that is the stream it depends on and its weight within the
+// dependency tree. Exclusive is never set, since exclusivity only
+// applies at the time a stream is reprioritized.
+func (c *Conn) StreamPriority(streamID uint32) (Priority, bool) {
+	stream := c.stream(streamID)
+	if stream == nil {
+		return Priority{}, false
+	}
+
+	c.priorityL.RLock()
+	defer c.priorityL.RUnlock()
+
+	if stream.parent == nil {
+		return Priority{}, false
+	}
+	return Priority{StreamDependency: stream.parent.id, Weight: stream.weight}, true
+}
+
+// StreamPriorityParam returns the priority of the given stream in
+// the Extensible Priority Scheme, defined in RFC 9218.
+func (c *Conn) StreamPriorityParam(streamID uint32) (PriorityParam, bool) {
+	stream := c.stream(streamID)
+	if stream == nil {
+		return PriorityParam{}, false
+	}
+
+	c.priorityL.RLock()
+	defer c.priorityL.RUnlock()
+
+	return stream.priorityParam, true
+}
+
+// maxPendingPriorityUpdates limits the number of idle streams
+// whose priority is kept until they are opened.
+const maxPendingPriorityUpdates = 100
+
+func (c *Conn) setPriorityParam(streamID uint32, p PriorityParam) {
+	stream := c.stream(streamID)
+
+	c.priorityL.Lock()
+	defer c.priorityL.Unlock()
+
+	if stream != nil {
+		stream.priorityParam = p
+	} else if len(c.pendingPriority) < maxPendingPriorityUpdates {
+		c.pendingPriority[streamID] = p
+	}
+}
+
+// Settings returns the local settings in effect, like LocalSettings.
 func (c *Conn) Settings() Settings {
-	return c.settings.Load().(Settings)
+	return c.LocalSettings()
+}
+
+// LocalSettings returns a copy of the local settings in effect, which are
+// the ones sent in SETTINGS frames acknowledged by the remote endpoint.
+// Settings sent but not acknowledged yet are not included. The values not
+// explicitly set fall back to the defaults returned by Settings.Value.
+func (c *Conn) LocalSettings() Settings {
+	return c.localSettings().clone()
 }
 
-// RemoteSettings returns the remote-side http2settings.
+// RemoteSettings returns a copy of the remote settings in effect, which
+// are the ones received in the SETTINGS frames acknowledged last. The
+// values not explicitly set fall back to the defaults returned by
+// Settings.Value.
 func (c *Conn) RemoteSettings() Settings {
+	return c.remoteSettings().clone()
+}
+
+// UpdateSettings changes the local settings of the established connection,
+// sending a SETTINGS frame with the values differing from the ones in
+// effect, validated as by Settings.SetValue. The settings take effect
+// once acknowledged, when a change of the initial window size is applied
+// to the flow-control windows of the existing streams. It waits for the
+// acknowledgement, which is processed by ReadFrame, so the connection
+// must be read while waiting for it. Concurrent calls are serialized,
+// each one waiting for the SETTINGS frames sent before to be acknowledged.
+func (c *Conn) UpdateSettings(settings Settings) error {
+	cur := c.LocalSettings()
+
+	var diff Settings
+	for _, setting := range settings {
+		if err := diff.SetValue(setting.ID, setting.Value); err != nil {
+			return err
+		}
+		switch {
+		case setting.ID == SettingEnablePush && setting.Value == 1 && c.server:
+			return errors.New("server not allowed to enable push")
+		case setting.ID == SettingEnableConnectProtocol && setting.Value == 0 && cur.ConnectProtocolEnabled():
+			return errors.New("ENABLE_CONNECT_PROTOCOL cannot be disabled after being enabled")
+		}
+	}
+
+	c.updateL.Lock()
+	defer c.updateL.Unlock()
+
+	if err := c.waitSettingsAck(); err != nil {
+		return err
+	}
+
+	cur = c.LocalSettings()
+	changed := diff[:0]
+	for _, setting := range diff {
+		if cur.Value(setting.ID) != setting.Value {
+			changed = append(changed, setting)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	if err := c.WriteFrame(&SettingsFrame{Settings: changed}); err != nil {
+		return err
+	}
+	return c.waitSettingsAck()
+}
+
+// waitSettingsAck waits for the SETTINGS frames sent to be acknowledged.
+func (c *Conn) waitSettingsAck() error {
+	for c.settingsPending() {
+		select {
+		case <-c.settingsAckCh:
+		case <-c.closeCh:
+			return ErrClosed
+		}
+	}
+	return nil
+}
+
+// settingsPending reports whether SETTINGS frames sent are not
+// acknowledged yet, or their values not applied yet.
+func (c *Conn) settingsPending() bool {
+	c.settingsAckL.Lock()
+	defer c.settingsAckL.Unlock()
+
+	return len(c.settingsCh) > 0
+}
+
+// localSettings and remoteSettings return the settings in effect without
+// copying them, as they are replaced rather than modified once stored.
+func (c *Conn) localSettings() Settings {
+	return c.settings.Load().(Settings)
+}
+
+func (c *Conn) remoteSettings() Settings {
 	return c.remote.settings.Load().(Settings)
 }
 
@@ -189,6 +832,16 @@ func (c *Conn) GoAwayReceived() (bool, *GoAwayFrame) {
 	return received, goAway
 }
 
+// LastGoAway returns the last GOAWAY received from the remote connection,
+// including its debug data. It returns the zero value if no GOAWAY was received.
+// It is safe to call after the connection has been closed.
+func (c *Conn) LastGoAway() GoAwayFrame {
+	if goAway, received := c.goAway.Load().(*GoAwayFrame); received {
+		return *goAway
+	}
+	return GoAwayFrame{}
+}
+
 // GoAwaySent returns whether or not a GOAWAY was sent to the remote connection.
 func (c *Conn) GoAwaySent() (bool, *GoAwayFrame) {
 	goAway, sent := c.remote.goAway.Load().(*GoAwayFrame)
@@ -196,7 +849,157 @@ func (c *Conn) GoAwaySent() (bool, *GoAwayFrame) {
 }
 
 func (c *Conn) goingAway() bool {
-	return c.remote.goAway.Load() != nil || c.goAway.Load() != nil
+	if c.goAway.Load() != nil {
+		return true
+	}
+	goAway, sent := c.remote.goAway.Load().(*GoAwayFrame)
+	return sent && !c.draining(goAway)
+}
+
+// draining returns whether the GOAWAY frame sent is the first one of a
+// graceful shutdown, or the one of StopAccepting, and new streams are
+// refused.
+func (c *Conn) draining(goAway *GoAwayFrame) bool {
+	if atomic.LoadInt32(&c.stopAccepting) == 1 {
+		return true
+	}
+	return goAway.LastStreamID == maxStreamID && goAway.ErrCode == ErrCodeNo
+}
+
+// StopAccepting stops a server connection from accepting new streams,
+// while the ones opened so far are still served, e.g. for an in-place
+// upgrade: a GOAWAY frame with the last stream ID processed is sent, and
+// the streams the client still opens are refused with REFUSED_STREAM.
+// Unlike Shutdown, the connection is not closed once the active streams
+// are done, which NumActiveStreams tells, but with Close, CloseTimeout or
+// Shutdown.
+func (c *Conn) StopAccepting() error {
+	if !c.server {
+		return errors.New("http2: StopAccepting called by client")
+	}
+	if atomic.LoadInt32(&c.closing) == 1 {
+		return ErrClosed
+	}
+	if !atomic.CompareAndSwapInt32(&c.stopAccepting, 0, 1) {
+		return nil
+	}
+	return c.WriteFrame(&GoAwayFrame{LastStreamID: c.LastStreamID(), ErrCode: ErrCodeNo})
+}
+
+// isTrailer reports whether a header block received on the stream is a
+// trailing one, sent after the final header block.
+func (c *Conn) isTrailer(streamID uint32) bool {
+	stream := c.stream(streamID)
+	return stream != nil && stream.sawHeaders
+}
+
+// connectProtocol reports whether a server enabled the extended CONNECT
+// protocol with the SETTINGS_ENABLE_CONNECT_PROTOCOL setting, defined in
+// RFC 8441 section 3, so that the requests received can carry a
+// :protocol pseudo-header field. The client can send them once it has
+// received the initial settings, possibly before acknowledging them; the
+// setting cannot be disabled afterwards.
+func (c *Conn) connectProtocol() bool {
+	if !c.server {
+		return false
+	}
+	return c.config.InitialSettings.ConnectProtocolEnabled() || c.localSettings().ConnectProtocolEnabled()
+}
+
+func informational(status string) bool {
+	return len(status) == 3 && status[0] == '1'
+}
+
+// setContentLength sets the content-length of the message of which the
+// final header block is received on the stream. A request or response
+// that includes message content can include a content-length header
+// field, with multiple values only if they are identical. A response to
+// a HEAD request or with a 204 or 304 status code is defined to have no
+// content, and can have a non-zero content-length.
+func (s *stream) setContentLength(v *HeadersFrame) error {
+	s.contentLength = -1
+	values, ok := v.Header["content-length"]
+	if !ok {
+		return nil
+	}
+	if !s.conn.server {
+		if status := v.Status(); status == "204" || status == "304" || atomic.LoadUint32(&s.headRequest) == 1 {
+			return nil
+		}
+	}
+
+	n := int64(-1)
+	for _, vv := range values {
+		for _, value := range strings.Split(vv, ",") {
+			m, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil || m < 0 || (n >= 0 && m != n) {
+				return StreamError{MalformedError(fmt.Sprintf("bad content-length %q", strings.Join(values, ","))), ErrCodeProtocol, s.id, ReasonProtocol}
+			}
+			n = m
+		}
+	}
+	s.contentLength = n
+	return s.checkContentLength(0, v.EndStream)
+}
+
+// checkContentLength adds the n octets of a DATA frame received on the
+// stream, verifying they do not exceed the content-length, and match it
+// once the stream ends. A request or response is malformed if the value
+// of a content-length header field does not equal the sum of the DATA
+// frame payload lengths that form the content, defined in RFC 7540
+// section 8.1.2.6, which is treated as a stream error of type
+// PROTOCOL_ERROR.
+func (s *stream) checkContentLength(n int, endStream bool) error {
+	if s.contentLength < 0 {
+		return nil
+	}
+	s.dataReceived += int64(n)
+	if s.dataReceived > s.contentLength || (endStream && s.dataReceived != s.contentLength) {
+		err := MalformedError(fmt.Sprintf("content-length %d does not match DATA length %d", s.contentLength, s.dataReceived))
+		return StreamError{err, ErrCodeProtocol, s.id, ReasonProtocol}
+	}
+	return nil
+}
+
+// checkResponse validates a header block written by a server on the
+// stream. Any number of interim responses precede exactly one final
+// response, which is followed by the DATA frames and the trailers.
+func (s *stream) checkResponse(frame Frame) error {
+	if v, ok := frame.(*HeadersFrame); ok && !v.Trailer {
+		status := v.Status()
+		switch {
+		case s.sentFinal:
+			return errors.New("final response already written")
+		case !informational(status):
+			s.sentFinal = true
+			return nil
+
+		// HTTP/2 removes support for the 101 (Switching Protocols)
+		// informational status code.
+		case status == "101":
+			return errors.New("101 status not allowed")
+
+		// An interim response MUST NOT carry END_STREAM.
+		case v.EndStream:
+			return errors.New("interim response cannot end the stream")
+		}
+		s.sentInterim = true
+		return nil
+	}
+	if s.sentInterim && !s.sentFinal {
+		return fmt.Errorf("%s frame written before the final response", frame.Type())
+	}
+	return nil
+}
+
+// missingStreamError returns the error writing a frame on a stream that
+// does not exist, which is a GoAwayError for a stream the remote endpoint
+// did not process before sending a GOAWAY frame.
+func (c *Conn) missingStreamError(streamID uint32) error {
+	if goAway, received := c.goAway.Load().(*GoAwayFrame); received && streamID > goAway.LastStreamID && c.usedStreamID(streamID) {
+		return GoAwayError{goAway.ErrCode, goAway.LastStreamID, streamID}
+	}
+	return fmt.Errorf("stream %d does not exist", streamID)
 }
 
 func (c *Conn) stream(streamID uint32) *stream {
@@ -211,6 +1014,69 @@ func (c *Conn) addStream(stream *stream) {
 	c.streamL.Lock()
 	c.streams[stream.id] = stream
 	c.streamL.Unlock()
+
+	c.active()
+
+	c.stats.streamOpened(stream.id)
+
+	// All streams are initially assigned a non-exclusive
+	// dependency on stream 0x0.
+	c.priorityL.Lock()
+	if stream.parent == nil {
+		stream.attach(c.connStream)
+	}
+	if p, ok := c.pendingPriority[stream.id]; ok {
+		stream.priorityParam = p
+		delete(c.pendingPriority, stream.id)
+	}
+	c.priorityL.Unlock()
+}
+
+// maxResetStreams is the number of reset streams
+// whose frames in flight are ignored.
+const maxResetStreams = 128
+
+// addResetStream records a stream of the remote endpoint reset by this one.
+func (c *Conn) addResetStream(streamID uint32) {
+	c.resetL.Lock()
+	defer c.resetL.Unlock()
+
+	if _, ok := c.resetStreams[streamID]; ok {
+		return
+	}
+	c.resetStreams[streamID] = struct{}{}
+	c.resetOrder = append(c.resetOrder, streamID)
+	if len(c.resetOrder) > maxResetStreams {
+		delete(c.resetStreams, c.resetOrder[0])
+		c.resetOrder = c.resetOrder[1:]
+	}
+}
+
+// maxClosedTimings is the number of closed
+// streams whose timings are kept.
+const maxClosedTimings = 128
+
+// addClosedTiming records the timing of a closed stream.
+func (c *Conn) addClosedTiming(streamID uint32, timing StreamTiming) {
+	c.timingL.Lock()
+	defer c.timingL.Unlock()
+
+	c.closedTimings[streamID] = timing
+	c.timingOrder = append(c.timingOrder, streamID)
+	if len(c.timingOrder) > maxClosedTimings {
+		delete(c.closedTimings, c.timingOrder[0])
+		c.timingOrder = c.timingOrder[1:]
+	}
+}
+
+// resetStream reports whether a stream of the remote endpoint was reset
+// recently by this one.
+func (c *Conn) resetStream(streamID uint32) bool {
+	c.resetL.Lock()
+	defer c.resetL.Unlock()
+
+	_, ok := c.resetStreams[streamID]
+	return ok
 }
 
 func (c *Conn) removeStream(stream *stream) {
@@ -218,8 +1084,18 @@ func (c *Conn) removeStream(stream *stream) {
 	delete(c.streams, stream.id)
 	c.streamL.Unlock()
 
+	// The connection window allocated to a DATA frame that is not
+	// written is returned for the other streams.
+	if s := c.writeQueue.remove(stream.id); s != nil {
+		if data, ok := s.Frame.(*DataFrame); ok {
+			if n := dataFlowLen(data.DataLen, int(data.PadLen)); n > 0 {
+				c.connStream.sendFlow.incrementWindow(n)
+			}
+		}
+	}
+
 	if c.goingAway() && c.NumActiveStreams() == 0 {
-		c.Flush()
+		c.queueFlush()
 	}
 }
 
@@ -233,28 +1109,30 @@ type connState struct {
 	goAway atomic.Value
 }
 
-var errClosedStream = ConnError{errors.New("closed stream"), ErrCodeProtocol}
-
 func (s *connState) idleStream(streamID uint32) (*stream, error) {
 	// Receivers of a GOAWAY frame MUST NOT open
 	// additional streams on the connection, although a new connection can
 	// be established for new streams.
 	if goAway, received := s.conn.goAway.Load().(*GoAwayFrame); received {
-		return nil, ConnError{
-			fmt.Errorf("received a GOAWAY frame with last stream id %d", goAway.LastStreamID),
-			ErrCodeProtocol,
-		}
+		return nil, GoAwayError{goAway.ErrCode, goAway.LastStreamID, streamID}
 	}
 
 	if !s.validStreamID(streamID) {
 		return nil, ConnError{fmt.Errorf("bad stream id %d", streamID), ErrCodeProtocol}
 	}
 
+	// The identifier of a newly established stream MUST be numerically
+	// greater than all streams that the initiating endpoint has opened or
+	// reserved.
 	if streamID < s.nextStreamID {
-		return nil, errClosedStream
+		return nil, ConnError{fmt.Errorf("stream id %d not greater than the previous streams", streamID), ErrCodeProtocol}
 	}
 
-	if atomic.LoadUint32(&s.numStreams)+1 > s.settings.Load().(Settings).MaxConcurrentStreams() {
+	// The streams initiated by this endpoint are limited by the setting of
+	// the remote one. The ones initiated by the remote endpoint are
+	// refused once opened, by the caller.
+	local := s.conn.connState == s
+	if local && atomic.LoadUint32(&s.numStreams)+1 > s.conn.remoteSettings().MaxConcurrentStreams() {
 		return nil, ConnError{errors.New("maximum streams exceeded"), ErrCodeRefusedStream}
 	}
 
@@ -266,7 +1144,11 @@ func (s *connState) idleStream(streamID uint32) (*stream, error) {
 		wio:     make(chan struct{}, 1),
 		werr:    make(chan error),
 		closeCh: make(chan struct{}),
+
+		contentLength: -1,
 	}
+	stream.ctx, stream.cancelCtx = context.WithCancel(context.Background())
+	stream.priorityParam = PriorityParam{Urgency: defaultUrgency}
 	stream.wio <- struct{}{}
 	s.nextStreamID = streamID + 2
 	atomic.StoreUint32(&s.lastStreamID, streamID)
@@ -278,8 +1160,13 @@ func (s *connState) validStreamID(streamID uint32) bool {
 	return s.server == ((streamID&1) == 0) && streamID > 0
 }
 
+// usedStreamID reports whether the stream was opened or reserved before.
+func (s *connState) usedStreamID(streamID uint32) bool {
+	return s.validStreamID(streamID) && streamID <= atomic.LoadUint32(&s.lastStreamID)
+}
+
 func (s *connState) applySettings(settings Settings) (err error) {
-	cur := s.settings.Load().(Settings)
+	cur := s.settings.Load().(Settings).clone()
 	local := s.conn.connState == s
 	for _, setting := range settings {
 		switch setting.ID {
@@ -291,7 +1178,7 @@ func (s *connState) applySettings(settings Settings) (err error) {
 						errors.New("server sent SETTINGS frame with ENABLE_PUSH specified"),
 						ErrCodeProtocol,
 					}
-				case !local && !s.server:
+				case !local && s.server:
 					return ConnError{
 						errors.New("client received SETTINGS frame with ENABLE_PUSH specified for remote server"),
 						ErrCodeProtocol,
@@ -299,8 +1186,17 @@ func (s *connState) applySettings(settings Settings) (err error) {
 				}
 			}
 		case SettingMaxConcurrentStreams:
+		case SettingEnableConnectProtocol:
+			// A sender MUST NOT send a SETTINGS_ENABLE_CONNECT_PROTOCOL
+			// parameter with the value of 0 after previously sending a value of 1.
+			if setting.Value == 0 && cur.ConnectProtocolEnabled() {
+				return ConnError{
+					errors.New("ENABLE_CONNECT_PROTOCOL disabled after being enabled"),
+					ErrCodeProtocol,
+				}
+			}
 		case SettingInitialWindowSize:
-			delta := int(setting.Value) - int(cur.InitialWindowSize())
+			delta := Settings{setting}.InitialWindowSizeDelta(cur)
 			if local {
 				err = s.conn.setInitialRecvWindow(delta)
 			} else {
@@ -313,7 +1209,7 @@ func (s *connState) applySettings(settings Settings) (err error) {
 			if local {
 				s.conn.frameReader.SetMaxHeaderTableSize(setting.Value)
 			} else {
-				s.conn.frameWriter.SetMaxHeaderTableSize(setting.Value)
+				s.conn.frameWriter.setHeaderTableSize(setting.Value)
 			}
 		case SettingMaxHeaderListSize:
 			if local {
@@ -352,21 +1248,110 @@ func (c *Conn) WriteFrame(frame Frame) error {
 		return errors.New("frame must be non-nil")
 	}
 
+	if c.writeDeadlineExceeded() {
+		return os.ErrDeadlineExceeded
+	}
+
 	return c.writeFrame(frame)
 }
 
+// WriteFrom writes the bytes read from r until EOF as DATA frames of the
+// stream, the last one ending the stream. Each chunk of at most the
+// maximum frame size allowed by the remote endpoint is read into a
+// buffer, then written along with its frame header without being copied
+// again, once the flow-control windows allow it. Short reads are
+// gathered into full chunks. If reading r fails, the stream is reset with
+// INTERNAL_ERROR and the error is returned. It returns the number of
+// bytes written.
+func (c *Conn) WriteFrom(streamID uint32, r io.Reader) (int64, error) {
+	buf := make([]byte, c.remoteSettings().MaxFrameSize())
+
+	var written int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			c.WriteFrame(&RSTStreamFrame{StreamID: streamID, ErrCode: ErrCodeInternal})
+			return written, err
+		}
+		data := &DataFrame{StreamID: streamID, Data: &dataChunk{buf[:n]}, DataLen: n, EndStream: eof}
+		if err = c.WriteFrame(data); err != nil {
+			return written, err
+		}
+		written += int64(n)
+		if eof {
+			return written, nil
+		}
+	}
+}
+
+// WriteTrailer writes the trailers of the stream, after its header block
+// and DATA frames. The trailing HEADERS frame ends the stream.
+func (c *Conn) WriteTrailer(streamID uint32, trailer Header) error {
+	return c.WriteFrame(&HeadersFrame{StreamID: streamID, Header: trailer, EndStream: true, Trailer: true})
+}
+
+// CloseSend ends the sending side of the stream with an empty DATA frame,
+// half-closing it. The frames of the stream are still read until the
+// remote endpoint ends it too, while the writes on it fail.
+func (c *Conn) CloseSend(streamID uint32) error {
+	return c.WriteFrame(&DataFrame{StreamID: streamID, EndStream: true})
+}
+
 func (c *Conn) writeFrame(frame Frame) (err error) {
+	// DATA frames and header blocks are split to fit in the maximum frame
+	// size allowed by the remote endpoint, the other frames are rejected.
+	if err = checkFrameLen(frame, c.remoteSettings().MaxFrameSize()); err != nil {
+		return
+	}
+
+	// Unknown frames are written as they are,
+	// even if their type is a defined one.
+	if _, ok := frame.(*UnknownFrame); ok {
+		c.writeQueue.add(frame, false)
+		return
+	}
+
 	switch frame.Type() {
 	case FrameData:
 		stream := c.stream(frame.Stream())
 		if stream == nil {
-			return fmt.Errorf("stream %d does not exist", frame.Stream())
+			return c.missingStreamError(frame.Stream())
+		}
+		if c.server {
+			if err = stream.checkResponse(frame); err != nil {
+				break
+			}
 		}
 		if _, err = stream.transition(false, FrameData, false); err == nil {
 			return stream.write(frame)
 		}
 	case FrameHeaders:
+		v := frame.(*HeadersFrame)
+		if v.HasPriority() && v.StreamDependency == v.StreamID {
+			return fmt.Errorf("stream %d cannot depend on itself", v.StreamID)
+		}
+		if v.Trailer {
+			if !v.EndStream {
+				return errors.New("trailers must end the stream")
+			}
+			for k := range v.Header {
+				if len(k) > 0 && k[0] == ':' {
+					return errTrailerPseudo
+				}
+			}
+		}
+		// A client MUST NOT send a :protocol pseudo-header field unless
+		// the server enabled the extended CONNECT protocol.
+		if !c.server && v.Header.Protocol() != "" && !c.remoteSettings().ConnectProtocolEnabled() {
+			return errors.New("extended CONNECT protocol not enabled by the server")
+		}
 		stream := c.stream(frame.Stream())
+		// A stream of the remote endpoint no longer known was closed,
+		// e.g. reset while its response was being written.
+		if stream == nil && c.remote.usedStreamID(frame.Stream()) {
+			return c.missingStreamError(frame.Stream())
+		}
 		if stream == nil {
 			defer func() {
 				if atomic.CompareAndSwapInt32(&c.idState, 1, 0) {
@@ -378,24 +1363,61 @@ func (c *Conn) writeFrame(frame Frame) (err error) {
 				break
 			}
 		}
+		if c.server && !stream.local() {
+			if err = stream.checkResponse(frame); err != nil {
+				break
+			}
+		}
+		if !c.server && v.Method() == "HEAD" {
+			atomic.StoreUint32(&stream.headRequest, 1)
+		}
+
 		if _, err = stream.transition(false, FrameHeaders, false); err == nil {
+			if v.HasPriority() {
+				if err = stream.setPriority(v.Priority); err != nil {
+					break
+				}
+			}
 			return stream.write(frame)
 		}
 	case FramePriority:
-		//
+		if v := frame.(*PriorityFrame); v.StreamDependency == v.StreamID {
+			return fmt.Errorf("stream %d cannot depend on itself", v.StreamID)
+		}
+		if stream := c.stream(frame.Stream()); stream != nil {
+			err = stream.setPriority(frame.(*PriorityFrame).Priority)
+		}
+		if err == nil {
+			c.writeQueue.add(frame, true)
+		}
 	case FrameRSTStream:
 		stream := c.stream(frame.Stream())
 		if stream == nil {
 			return
 		}
-		if _, err = stream.transition(false, FrameRSTStream, false); err == nil {
+		// Resetting a closed stream does nothing, as for the
+		// streams no longer known.
+		var from StreamState
+		if from, err = stream.transition(false, FrameRSTStream, false); err == nil {
 			c.writeQueue.add(frame, true)
+		} else if from == StateClosed {
+			err = nil
 		}
 	case FrameSettings:
 		v := frame.(*SettingsFrame)
 		if v.Ack {
 			return errors.New("not allowed to send ACK settings frame")
 		}
+		if hook := c.config.OnSendSettings; hook != nil {
+			var settings Settings
+			for _, setting := range hook(v.Settings.clone()) {
+				if err := settings.SetValue(setting.ID, setting.Value); err != nil {
+					return err
+				}
+			}
+			v = &SettingsFrame{Settings: settings}
+			frame = v
+		}
 
 		// If the sender of a SETTINGS frame does not receive an acknowledgement
 		// within a reasonable amount of time, it MAY issue a connection error
@@ -421,7 +1443,7 @@ func (c *Conn) writeFrame(frame Frame) (err error) {
 			err = ConnError{fmt.Errorf("stream %d is not active", frame.Stream()), ErrCodeProtocol}
 			break
 		}
-		if !c.RemoteSettings().PushEnabled() {
+		if !c.remoteSettings().PushEnabled() {
 			err = ConnError{errors.New("server push not allowed"), ErrCodeProtocol}
 			break
 		}
@@ -443,6 +1465,34 @@ func (c *Conn) writeFrame(frame Frame) (err error) {
 			return errors.New("not allowed to send ACK ping frame")
 		}
 		c.writeQueue.add(frame, true)
+	case FrameAltSvc:
+		if !c.server {
+			return errors.New("not allowed to send ALTSVC frame from client")
+		}
+		if err = frame.(*AltSvcFrame).validate(); err != nil {
+			return
+		}
+		c.writeQueue.add(frame, false)
+	case FrameOrigin:
+		if !c.server {
+			return errors.New("not allowed to send ORIGIN frame from client")
+		}
+		if err = frame.(*OriginFrame).validate(); err != nil {
+			return
+		}
+		c.writeQueue.add(frame, false)
+	case FramePriorityUpdate:
+		if c.server {
+			return errors.New("not allowed to send PRIORITY_UPDATE frame from server")
+		}
+		v := frame.(*PriorityUpdateFrame)
+		if err = v.validate(); err != nil {
+			return
+		}
+		if stream := c.stream(v.PrioritizedStreamID); stream != nil {
+			c.setPriorityParam(stream.id, ParsePriorityParam(v.PriorityFieldValue))
+		}
+		c.writeQueue.add(frame, false)
 	case FrameGoAway:
 		// An endpoint MAY send multiple GOAWAY frames if circumstances change.
 		// For instance, an endpoint that sends GOAWAY with NO_ERROR during
@@ -459,6 +1509,7 @@ func (c *Conn) writeFrame(frame Frame) (err error) {
 		}
 
 		c.remote.goAway.Store(frame)
+		c.goAwayOnce.Do(func() { close(c.goAwaySentCh) })
 
 		var streams []*stream
 
@@ -476,6 +1527,11 @@ func (c *Conn) writeFrame(frame Frame) (err error) {
 
 		c.writeQueue.add(frame, true)
 	case FrameWindowUpdate:
+		// The legal range for the increment to the flow-control
+		// window is 1 to 2^31-1 (2,147,483,647) octets.
+		if frame.(*WindowUpdateFrame).WindowSizeIncrement == 0 {
+			return errors.New("window size increment must be > 0")
+		}
 		if frame.Stream() == 0 {
 			err = c.connStream.recvFlow.incrementWindow(int(frame.(*WindowUpdateFrame).WindowSizeIncrement))
 		} else if stream := c.stream(frame.Stream()); stream != nil {
@@ -492,17 +1548,120 @@ func (c *Conn) writeFrame(frame Frame) (err error) {
 	return
 }
 
-// Flush sends buffered frame to the remote connection.
+// Flush writes the frames queued so far to the remote connection, and
+// flushes the buffered writer. It blocks until they are written, which
+// includes the frames of streams waiting for their turn, and returns the
+// error flushing the writer, or ErrClosed if the connection is closed
+// first. Frames queued after the call may be written along with them.
+// When the queue is bounded by MaxQueuedFrames or MaxQueuedBytes, Flush
+// is not counted and never waits for room.
 func (c *Conn) Flush() error {
-	c.writeQueue.add(nil, false)
-	return nil
-}
+	if c.Closed() {
+		return ErrClosed
+	}
+
+	f := &flushFrame{done: make(chan struct{})}
+	c.writeQueue.barrier(f)
+
+	select {
+	case <-f.done:
+		return f.err
+	case <-c.closeCh:
+		return ErrClosed
+	}
+}
+
+// queueFlush queues the flush of the buffered writer,
+// without waiting for it.
+func (c *Conn) queueFlush() {
+	c.writeQueue.add(nil, false)
+}
+
+// Ping sends a PING frame and waits for the matching ACK, returning the
+// round-trip time. Concurrent pings are correlated by their payload.
+// The ACK is processed by ReadFrame, so the connection must be read
+// while waiting for it.
+func (c *Conn) Ping(ctx context.Context) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], atomic.AddUint64(&c.pingID, 1))
+
+	ack := make(chan struct{})
+
+	c.pingL.Lock()
+	c.pings[data] = ack
+	c.pingL.Unlock()
+
+	defer func() {
+		c.pingL.Lock()
+		delete(c.pings, data)
+		c.pingL.Unlock()
+	}()
+
+	start := time.Now()
+
+	if err := c.WriteFrame(&PingFrame{Data: data}); err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-ack:
+		d := time.Since(start)
+		c.sampleRTT(d)
+		return d, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-c.closeCh:
+		return 0, ErrClosed
+	}
+}
 
 // Closed returns whether or not this connection was closed.
 func (c *Conn) Closed() bool {
 	return atomic.LoadInt32(&c.closed) == 1
 }
 
+// Done returns a channel closed once the connection is closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.closeCh
+}
+
+// Err returns nil if Done is not yet closed, and otherwise the cause of
+// closing the connection: a ConnError with the code of the GOAWAY frame
+// sent or received because of an error, ErrIdleTimeout or
+// ErrKeepaliveTimeout, the error reading the underlying connection, or
+// ErrClosed if it was closed by Close or Shutdown.
+func (c *Conn) Err() error {
+	select {
+	case <-c.closeCh:
+	default:
+		return nil
+	}
+
+	c.causeL.Lock()
+	defer c.causeL.Unlock()
+
+	if c.cause != nil {
+		return c.cause
+	}
+	if err, ok := c.closeErr.Load().(error); ok {
+		return err
+	}
+	return ErrClosed
+}
+
+// setCause records the error closing the connection, if it is the first one.
+func (c *Conn) setCause(err error) {
+	c.causeL.Lock()
+	if c.cause == nil {
+		c.cause = err
+	}
+	c.causeL.Unlock()
+}
+
 // Close closed this connection by sending GOAWAY frame.
 func (c *Conn) Close() error {
 	const defaultCloseTimeout = 3 * time.Second
@@ -513,6 +1672,33 @@ func (c *Conn) Close() error {
 // ErrClosed represents connection already closed error.
 var ErrClosed = errors.New("http2: connection has been closed")
 
+// ErrStreamIDsExhausted is returned by NextStreamID once the stream IDs
+// of the connection are exhausted, after which a GOAWAY frame is sent.
+var ErrStreamIDsExhausted = errors.New("http2: stream IDs exhausted")
+
+// ErrIdleTimeout is returned by ReadFrame when the connection was
+// closed because it was idle for the IdleTimeout of its Config.
+var ErrIdleTimeout = errors.New("http2: idle timeout")
+
+// ErrFlowControlTimeout is returned by WriteFrame when a DATA frame
+// waited for a flow-control window longer than the FlowControlTimeout
+// of its Config.
+var ErrFlowControlTimeout = errors.New("http2: flow control timeout")
+
+// ErrReadHeaderTimeout is returned by ReadFrame when the connection was
+// closed because a header block was not received within the
+// ReadHeaderTimeout of its Config.
+var ErrReadHeaderTimeout = errors.New("http2: read header timeout")
+
+// ErrReadBodyTimeout is the error of a StreamError returned when reading
+// a body waited for a DATA frame longer than the ReadBodyTimeout of the
+// Config.
+var ErrReadBodyTimeout = errors.New("http2: read body timeout")
+
+// ErrKeepaliveTimeout is returned by ReadFrame when the connection was
+// closed because the keepalive PING frame was not acknowledged in time.
+var ErrKeepaliveTimeout = errors.New("http2: keepalive timeout")
+
 // CloseTimeout closes this connection by sending GOAWAY
 // frame and waits for shutdown to finish.
 //
@@ -534,7 +1720,7 @@ func (c *Conn) CloseTimeout(timeout time.Duration) error {
 		// providing that circumstances permit it.
 		c.writeFrame(&GoAwayFrame{LastStreamID: c.LastStreamID(), ErrCode: ErrCodeNo})
 
-		c.Flush()
+		c.queueFlush()
 
 		if timeout <= 0 {
 			return c.close()
@@ -551,6 +1737,147 @@ func (c *Conn) CloseTimeout(timeout time.Duration) error {
 	return ErrClosed
 }
 
+// shutdownDelay is the duration between the two GOAWAY frames of Shutdown,
+// allowing streams initiated by the remote endpoint before it received the
+// first one to arrive.
+var shutdownDelay = time.Second
+
+// Shutdown gracefully shuts down the connection without interrupting
+// active streams. It first sends a GOAWAY frame with the maximum stream
+// identifier, refusing new streams from then on, and after a short delay
+// a second GOAWAY frame with the last processed stream identifier. It then
+// waits for all active streams to be closed, and returns when the connection
+// has been closed.
+//
+// If ctx expires first, the connection is closed and ctx.Err() is returned.
+func (c *Conn) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&c.closing, 0, 1) {
+		select {
+		case <-c.closeCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return ErrClosed
+	}
+
+	c.handshakeL.Lock()
+	if !c.handshakeComplete {
+		c.handshakeL.Unlock()
+		return c.close()
+	}
+	c.handshakeL.Unlock()
+
+	// A server that is attempting to gracefully shut down a connection
+	// SHOULD send an initial GOAWAY frame with the last stream identifier
+	// set to 2^31-1 and a NO_ERROR code.  This signals to the client that
+	// a shutdown is imminent and that initiating further requests is
+	// prohibited.  After allowing time for any in-flight stream creation
+	// (at least one round-trip time), the server can send another GOAWAY
+	// frame with an updated last stream identifier.
+	lastStreamID := c.LastStreamID()
+
+	// After StopAccepting, the streams are refused already,
+	// up to the last stream identifier sent.
+	if goAway, sent := c.remote.goAway.Load().(*GoAwayFrame); sent && atomic.CompareAndSwapInt32(&c.stopAccepting, 1, 0) {
+		lastStreamID = goAway.LastStreamID
+	} else {
+		c.writeFrame(&GoAwayFrame{LastStreamID: maxStreamID, ErrCode: ErrCodeNo})
+
+		select {
+		case <-c.flush():
+		case <-c.closeCh:
+			return nil
+		case <-ctx.Done():
+			c.close()
+			return ctx.Err()
+		}
+
+		timer := time.NewTimer(shutdownDelay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-c.closeCh:
+			return nil
+		case <-ctx.Done():
+			c.close()
+			return ctx.Err()
+		}
+	}
+
+	// Once the GOAWAY frame is flushed, the connection
+	// is closed as soon as no stream is active.
+	c.writeFrame(&GoAwayFrame{LastStreamID: lastStreamID, ErrCode: ErrCodeNo})
+	c.flush()
+
+	select {
+	case <-c.closeCh:
+		return nil
+	case <-ctx.Done():
+		c.close()
+		return ctx.Err()
+	}
+}
+
+// flush queues a flushFrame behind the control frames written so far,
+// and returns a channel closed once they have been flushed.
+func (c *Conn) flush() <-chan struct{} {
+	f := &flushFrame{done: make(chan struct{})}
+	c.writeQueue.add(f, true)
+	return f.done
+}
+
+// SetEncoderTableSize limits the size of the HPACK dynamic table used to
+// encode header blocks to max, even if the remote endpoint allows a larger
+// one with SETTINGS_HEADER_TABLE_SIZE. The new size is signaled with a dynamic
+// table size update at the beginning of the next header block.
+func (c *Conn) SetEncoderTableSize(max uint32) {
+	c.writeQueue.add(&tableSizeFrame{max}, true)
+}
+
+// SetDecoderTableSize limits the size of the HPACK dynamic table used to
+// decode header blocks to max, sending it with SETTINGS_HEADER_TABLE_SIZE
+// as by UpdateSettings. Once the settings are acknowledged, a smaller size
+// is applied by evicting the entries exceeding it, and the remote endpoint
+// MUST signal it with a dynamic table size update at the beginning of the
+// next header block, defined in RFC 7541 section 4.2, or the connection is
+// closed with a COMPRESSION_ERROR. A max of 0 disables the dynamic table.
+func (c *Conn) SetDecoderTableSize(max uint32) error {
+	var settings Settings
+	if err := settings.SetHeaderTableSize(max); err != nil {
+		return err
+	}
+	return c.UpdateSettings(settings)
+}
+
+// tableSizeFrame is a pseudo frame setting the limit
+// of the HPACK encoder dynamic table size.
+type tableSizeFrame struct {
+	limit uint32
+}
+
+func (f *tableSizeFrame) Type() FrameType   { return frameTableSize }
+func (f *tableSizeFrame) Stream() uint32    { return 0 }
+func (f *tableSizeFrame) EndOfStream() bool { return false }
+
+const frameTableSize FrameType = 0xfe
+
+// flushFrame is a pseudo frame flushing the frames written before it.
+type flushFrame struct {
+	done chan struct{}
+	err  error
+
+	// waiting holds the streams of which the frame queued before
+	// a barrier are to be written first.
+	waiting map[uint32]bool
+}
+
+func (f *flushFrame) Type() FrameType   { return frameFlush }
+func (f *flushFrame) Stream() uint32    { return 0 }
+func (f *flushFrame) EndOfStream() bool { return false }
+
+const frameFlush FrameType = 0xff
+
 func (c *Conn) close() error {
 	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
 		return ErrClosed
@@ -569,7 +1896,14 @@ func (c *Conn) close() error {
 		}
 	}
 	close(c.closeCh)
+	c.writeQueue.close()
 	c.idTimer.Stop()
+	c.windowUpdateL.Lock()
+	if c.windowUpdateTimer != nil {
+		c.windowUpdateTimer.Stop()
+	}
+	c.windowUpdateL.Unlock()
+	c.stats.close()
 	return c.rwc.Close()
 }
 
@@ -589,6 +1923,170 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return nil
 }
 
+// settingsWritten starts the timer waiting for the
+// acknowledgement of a SETTINGS frame written.
+func (c *Conn) settingsWritten() {
+	timeout := c.config.SettingsTimeout
+	if timeout <= 0 {
+		return
+	}
+
+	c.settingsL.Lock()
+	defer c.settingsL.Unlock()
+
+	c.settingsSent++
+	seq := c.settingsSent
+	c.settingsTimers = append(c.settingsTimers, time.AfterFunc(timeout, func() {
+		c.settingsL.Lock()
+		acked := c.settingsAcked >= seq
+		c.settingsL.Unlock()
+
+		// If the sender of a SETTINGS frame does not receive an
+		// acknowledgement within a reasonable amount of time, it MAY issue
+		// a connection error (Section 5.4.1) of type SETTINGS_TIMEOUT.
+		if !acked {
+			c.handleErr(ConnError{errors.New("SETTINGS frame not acknowledged in time"), ErrCodeSettingsTimeout})
+		}
+	}))
+}
+
+// settingsAcknowledged stops the timer of the oldest SETTINGS frame
+// written, acknowledged by the remote endpoint.
+func (c *Conn) settingsAcknowledged() {
+	if c.config.SettingsTimeout <= 0 {
+		return
+	}
+
+	c.settingsL.Lock()
+	defer c.settingsL.Unlock()
+
+	c.settingsAcked++
+	if len(c.settingsTimers) > 0 {
+		c.settingsTimers[0].Stop()
+		c.settingsTimers = c.settingsTimers[1:]
+	}
+}
+
+// active records that a stream is opened, or that a HEADERS or
+// DATA frame is read or written, for the idle timeout.
+func (c *Conn) active() {
+	if c.config.IdleTimeout > 0 {
+		atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	}
+}
+
+func (c *Conn) idleTimeout() {
+	timeout := c.config.IdleTimeout
+
+	atomic.CompareAndSwapInt64(&c.lastActive, 0, time.Now().UnixNano())
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-c.closeCh:
+			return
+		case <-timer.C:
+		}
+
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+		if idle < timeout {
+			timer.Reset(timeout - idle)
+			continue
+		}
+		if c.NumActiveStreams() > 0 {
+			timer.Reset(timeout)
+			continue
+		}
+
+		c.closeErr.Store(ErrIdleTimeout)
+		c.Close()
+		return
+	}
+}
+
+func (c *Conn) maxLifetime() {
+	timer := time.NewTimer(c.config.MaxLifetime)
+	defer timer.Stop()
+
+	select {
+	case <-c.closeCh:
+	case <-timer.C:
+		c.Shutdown(context.Background())
+	}
+}
+
+// headerBlock starts or stops the timer of the header block being
+// received, called by the frame reader with the read lock held.
+func (c *Conn) headerBlock(start bool) {
+	if !start {
+		atomic.StoreInt64(&c.headerStart, 0)
+		c.headerTimer.Stop()
+		return
+	}
+
+	atomic.StoreInt64(&c.headerStart, time.Now().UnixNano())
+	c.headerTimer.Reset(c.config.ReadHeaderTimeout)
+}
+
+func (c *Conn) readHeaderTimeout() {
+	start := atomic.LoadInt64(&c.headerStart)
+	if start == 0 || c.Closed() {
+		return
+	}
+	if d := time.Since(time.Unix(0, start)); d < c.config.ReadHeaderTimeout {
+		c.headerTimer.Reset(c.config.ReadHeaderTimeout - d)
+		return
+	}
+
+	c.closeErr.Store(ErrReadHeaderTimeout)
+	c.close()
+}
+
+func (c *Conn) keepalive() {
+	const defaultKeepaliveTimeout = 20 * time.Second
+
+	interval := c.config.KeepaliveInterval
+	timeout := c.config.KeepaliveTimeout
+	if timeout <= 0 {
+		timeout = defaultKeepaliveTimeout
+	}
+
+	atomic.CompareAndSwapInt64(&c.lastRead, 0, time.Now().UnixNano())
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-c.closeCh:
+			return
+		case <-timer.C:
+		}
+
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastRead)))
+		if idle < interval {
+			timer.Reset(interval - idle)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		_, err := c.Ping(ctx)
+		cancel()
+
+		if err != nil {
+			if err == context.DeadlineExceeded {
+				c.closeErr.Store(ErrKeepaliveTimeout)
+				c.close()
+			}
+			return
+		}
+
+		timer.Reset(interval)
+	}
+}
+
 func (c *Conn) writeLoop() {
 	var (
 		frame Frame
@@ -601,8 +2099,12 @@ loop:
 		case frame = <-c.writeQueue.get():
 			flush := !c.writeQueue.set()
 
-			if frame == nil {
+			if _, ok := frame.(*flushFrame); frame == nil || ok {
 				err = c.buf.Flush()
+				if f, ok := frame.(*flushFrame); ok {
+					f.err = err
+					close(f.done)
+				}
 				if flush && c.goingAway() && c.NumActiveStreams() == 0 && !c.writeQueue.set() {
 					c.close()
 					return
@@ -613,9 +2115,23 @@ loop:
 				continue loop
 			}
 
+			if f, ok := frame.(*tableSizeFrame); ok {
+				c.frameWriter.setHeaderTableSizeLimit(f.limit)
+				if flush {
+					if err = c.buf.Flush(); err != nil {
+						c.handleErr(err)
+					}
+				}
+				continue loop
+			}
+
 			var settingsSyn bool
 
-			switch frame.Type() {
+			// The frame of a stream is changed by its writer
+			// once written, so its type is read beforehand.
+			frameType := frame.Type()
+
+			switch frameType {
 			case FrameSettings:
 				v := frame.(*SettingsFrame)
 				settingsSyn = !v.Ack
@@ -628,8 +2144,23 @@ loop:
 				}
 			}
 
-			fmt.Println(c.frameWriter.buf)
-			err = c.frameWriter.WriteFrame(frame)
+			if logger := c.config.FrameLogger; logger != nil {
+				if s, ok := frame.(*stream); ok {
+					logger("send", s.Frame)
+				} else {
+					logger("send", frame)
+				}
+			}
+
+			if err = c.frameWriter.WriteFrame(frame); err == nil {
+				c.stats.frameWritten(frameType, c.frameWriter.written)
+				if settingsSyn {
+					c.settingsWritten()
+				}
+			}
+			if frameType == FrameData || frameType == FrameHeaders {
+				c.active()
+			}
 
 			if flush {
 				if err == nil {
@@ -657,65 +2188,28 @@ loop:
 	}
 }
 
-type writeQueue struct {
-	sync.Mutex
-	cbuf, buf []Frame
-	ch        chan Frame
-}
-
-func (w *writeQueue) get() <-chan Frame {
-	return w.ch
-}
-
-func (w *writeQueue) set() bool {
-	w.Lock()
-	defer w.Unlock()
-
-	if len(w.cbuf) > 0 {
-		select {
-		case w.ch <- w.cbuf[0]:
-			w.cbuf = w.cbuf[1:]
-		default:
-		}
-		return true
-	} else if len(w.buf) > 0 {
-		select {
-		case w.ch <- w.buf[0]:
-			w.buf = w.buf[1:]
-		default:
-		}
-		return true
+// ReadFrame reads a frame from the connection.
+// The frames of CONNECT tunnels are not returned, nor are the
+// DATA frames of the stream bodies returned by StreamBody, nor
+// the HEADERS frames of the streams returned by AcceptStream.
+func (c *Conn) ReadFrame() (Frame, error) {
+	if err := c.Handshake(); err != nil {
+		return nil, err
 	}
-	return false
-}
-
-func (w *writeQueue) add(frame Frame, control bool) {
-	w.Lock()
-	defer w.Unlock()
 
-	if control {
-		w.cbuf = append(w.cbuf, frame)
-		select {
-		case w.ch <- w.cbuf[0]:
-			w.cbuf = w.cbuf[1:]
-		default:
+	for {
+		frame, err := c.nextFrame()
+		if err != nil {
+			c.failStreams(err)
+			return frame, err
 		}
-	} else {
-		w.buf = append(w.buf, frame)
-		select {
-		case w.ch <- w.buf[0]:
-			w.buf = w.buf[1:]
-		default:
+		if !c.tunnelFrame(frame) && !c.acceptFrame(frame) && !c.bodyFrame(frame) {
+			return frame, nil
 		}
 	}
 }
 
-// ReadFrame reads a frame from the connection.
-func (c *Conn) ReadFrame() (Frame, error) {
-	if err := c.Handshake(); err != nil {
-		return nil, err
-	}
-
+func (c *Conn) nextFrame() (Frame, error) {
 	c.rio.Lock()
 	defer c.rio.Unlock()
 
@@ -733,10 +2227,18 @@ func (c *Conn) ReadFrame() (Frame, error) {
 		return frame, nil
 	}
 
-	return c.readFrame()
+	frame, err := c.readFrame()
+	if err != nil && (err == ErrClosed || c.Closed()) {
+		if closeErr, ok := c.closeErr.Load().(error); ok {
+			err = closeErr
+		}
+	}
+	return frame, err
 }
 
 func (c *Conn) readFrame() (frame Frame, err error) {
+	var headerErr error
+
 	if c.lastData != nil {
 		err = c.lastData.returnBytesLocked()
 		c.lastData = nil
@@ -746,19 +2248,47 @@ func (c *Conn) readFrame() (frame Frame, err error) {
 	}
 
 again:
+	headerErr = nil
+
 	if frame, err = c.frameReader.ReadFrame(); err != nil {
-		goto exit
+		// A header block exceeding the header list size: the
+		// frame is handled to refuse the stream.
+		_, ok := err.(StreamError)
+		if ok && frame == nil && c.frameReader.frameType == FrameData {
+			// The discarded payload of an oversized DATA frame is
+			// still counted toward the connection flow-control window.
+			if dataLen := c.frameReader.frameLen(); dataLen > 0 {
+				if ferr := c.connStream.recvFlow.consumeBytes(dataLen); ferr != nil {
+					err = ferr
+				} else if ferr = c.connStream.recvFlow.returnBytes(dataLen); ferr != nil {
+					err = ferr
+				}
+			}
+		}
+		if !ok || frame == nil {
+			goto exit
+		}
+		headerErr, err = err, nil
+	}
+
+	atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+	if t := frame.Type(); t == FrameData || t == FrameHeaders {
+		c.active()
+	}
+	c.stats.frameRead(frame.Type(), c.frameReader.frameLen())
+	if logger := c.config.FrameLogger; logger != nil {
+		logger("recv", frame)
 	}
 
 	// After sending a GOAWAY frame, the sender can discard frames for
 	// streams initiated by the receiver with identifiers higher than the
 	// identified last stream.
-	if goAway, sent := c.remote.goAway.Load().(*GoAwayFrame); sent {
+	if goAway, sent := c.remote.goAway.Load().(*GoAwayFrame); sent && !c.draining(goAway) {
 		if c.remote.validStreamID(frame.Stream()) && frame.Stream() > goAway.LastStreamID {
 			// Flow-controlled frames (i.e., DATA) MUST be counted toward the
 			// connection flow-control window.
-			if dataFrame, ok := frame.(*DataFrame); ok {
-				if dataLen := dataFrame.DataLen + int(dataFrame.PadLen); dataLen > 0 {
+			if _, ok := frame.(*DataFrame); ok {
+				if dataLen := c.frameReader.frameLen(); dataLen > 0 {
 					if err = c.connStream.recvFlow.consumeBytes(dataLen); err == nil {
 						err = c.connStream.recvFlow.returnBytes(dataLen)
 					}
@@ -773,9 +2303,18 @@ again:
 
 	switch v := frame.(type) {
 	case *DataFrame:
-		dataLen := v.DataLen + int(v.PadLen)
+		// The entire DATA frame payload is included in flow control,
+		// including the Pad Length and Padding fields if present.
+		dataLen := c.frameReader.frameLen()
 		stream := c.stream(v.StreamID)
 		if stream == nil {
+			// Receiving any frame other than HEADERS or PRIORITY on a stream
+			// in the "idle" state MUST be treated as a connection error
+			// (Section 5.4.1) of type PROTOCOL_ERROR.
+			if !c.usedStreamID(v.StreamID) && !c.remote.usedStreamID(v.StreamID) {
+				err = ConnError{fmt.Errorf("DATA frame on idle stream %d", v.StreamID), ErrCodeProtocol}
+				break
+			}
 			if dataLen > 0 {
 				if err = c.connStream.recvFlow.consumeBytes(dataLen); err == nil {
 					err = c.connStream.recvFlow.returnBytes(dataLen)
@@ -787,11 +2326,6 @@ again:
 			goto again
 		}
 
-		// if dataLen == 0 {
-		// 	_, err = stream.transition(true, FrameData, v.EndStream)
-		// 	break
-		// }
-
 		if _, err = stream.transition(true, FrameData, false); err != nil {
 			switch err.(type) {
 			case ConnError:
@@ -817,46 +2351,184 @@ again:
 			}
 			break
 		}
+		if err = stream.checkContentLength(v.DataLen, v.EndStream); err != nil {
+			if ce, ok := stream.recvFlow.returnBytes(dataLen).(ConnError); ok {
+				err = ce
+			}
+			break
+		}
+		stream.sawData()
+
+		// A DATA frame with no payload, such as one only ending the
+		// stream, is not flow controlled and transitions the stream
+		// right away.
+		if dataLen == 0 {
+			if v.EndStream {
+				_, err = stream.transition(true, FrameData, true)
+			}
+			break
+		}
+		if c.windowTuner != nil {
+			c.windowTuner.received(dataLen)
+		}
 		c.data.stream = stream
 		c.data.src = v.Data
 		c.data.endStream = v.EndStream
 		c.data.processed = 0
 		c.data.sawEOF = false
+		c.data.hold = false
 		c.data.err = nil
 		c.lastData = &c.data
 		v.Data = c.lastData
 	case *HeadersFrame:
 		stream := c.stream(v.StreamID)
 		if stream == nil {
+			// An endpoint MUST ignore frames that it receives on closed
+			// streams after it has sent a RST_STREAM frame. The header
+			// block was decoded, keeping the compression state. The
+			// streams of this endpoint no longer known were reset or
+			// canceled by it.
+			if c.usedStreamID(v.StreamID) || c.resetStream(v.StreamID) {
+				goto again
+			}
 			if stream, err = c.remote.idleStream(v.StreamID); err != nil {
 				break
 			}
+			if goAway, sent := c.remote.goAway.Load().(*GoAwayFrame); sent && c.draining(goAway) {
+				if err = c.refuseStream(stream, v.EndStream); err != nil {
+					break
+				}
+				goto again
+			}
+
+			// An endpoint that receives a HEADERS frame that causes its
+			// advertised concurrent stream limit to be exceeded MUST treat
+			// this as a stream error (Section 5.4.2) of type PROTOCOL_ERROR
+			// or REFUSED_STREAM.
+			if c.NumRemoteStreams()+1 > c.localSettings().MaxConcurrentStreams() {
+				if err = c.refuseStream(stream, v.EndStream); err != nil {
+					break
+				}
+				goto again
+			}
+
+			// A server that receives a larger header block than it is willing
+			// to handle can send an HTTP 431 (Request Header Fields Too Large)
+			// status code, defined in RFC 7540 section 10.5.1. The malformed
+			// ones are reset with PROTOCOL_ERROR (Section 8.1.2.6).
+			if headerErr != nil {
+				switch se, _ := headerErr.(StreamError); {
+				case se.ErrCode == ErrCodeProtocol:
+					err = c.resetNewStream(stream, v.EndStream, ErrCodeProtocol)
+				case c.server:
+					err = c.rejectStream(stream, v.EndStream, "431")
+				default:
+					err = c.refuseStream(stream, v.EndStream)
+				}
+				if err != nil {
+					break
+				}
+				goto again
+			}
+
+			// The requests rejected by OnNewStream are not processed.
+			if f := c.config.OnNewStream; f != nil && c.server {
+				if rejectErr := f(v.StreamID, v.Header); rejectErr != nil {
+					code := ErrCodeRefusedStream
+					if se, ok := rejectErr.(StreamError); ok {
+						code = se.ErrCode
+					}
+					if err = c.resetNewStream(stream, v.EndStream, code); err != nil {
+						break
+					}
+					goto again
+				}
+			}
 		}
+		if headerErr != nil {
+			err = headerErr
+			break
+		}
+
+		// A HEADERS frame carrying trailers is required to have the
+		// END_STREAM flag set, otherwise the stream is malformed.
+		if v.Trailer && !v.EndStream {
+			err = StreamError{errors.New("trailers without END_STREAM"), ErrCodeProtocol, v.StreamID, ReasonProtocol}
+			break
+		}
+
+		opening := !stream.local() && stream.recvFlow == nil
 		if _, err = stream.transition(true, FrameHeaders, v.EndStream); err == nil {
-			if v.HasPriority() {
+			if opening && c.windowTuner != nil {
+				err = c.windowTuner.open(stream)
+			}
+			if err == nil && v.HasPriority() {
 				err = stream.setPriority(v.Priority)
 			}
+
+			// The header blocks of interim responses (1xx)
+			// are followed by the final one.
+			if !v.Trailer && (c.server || !informational(v.Status())) {
+				stream.sawHeaders = true
+				if err == nil {
+					err = stream.setContentLength(v)
+				}
+			} else if err == nil && v.Trailer {
+				err = stream.checkContentLength(0, true)
+			}
 		}
 	case *PriorityFrame:
-		//
+		if stream := c.stream(v.StreamID); stream != nil {
+			err = stream.setPriority(v.Priority)
+		}
 	case *RSTStreamFrame:
 		stream := c.stream(v.StreamID)
 		if stream == nil {
 			goto again
 		}
+		if stream.active() {
+			stream.resetErr = StreamError{fmt.Errorf("stream %d reset by peer", v.StreamID), v.ErrCode, v.StreamID, ReasonPeerReset}
+		}
 		if _, err = stream.transition(true, FrameRSTStream, false); err != nil {
 			goto again
 		}
+
+		// SEE 10.5.  Denial-of-Service Considerations
+		//
+		// Streams that the remote endpoint opens and then resets before any
+		// frame was sent on them cost work without any benefit to the peer,
+		// so they are limited to avoid a rapid reset attack.
+		if !stream.local() && atomic.LoadUint32(&stream.written) == 0 && c.resetRate.incr() {
+			err = ConnError{errors.New("too many streams reset"), ErrCodeEnhanceYourCalm}
+		}
 	case *SettingsFrame:
 		if v.Ack {
+			// The settings take effect before UpdateSettings returns.
+			var acked bool
+			c.settingsAckL.Lock()
 			select {
 			case settings := <-c.settingsCh:
-				if err = c.applySettings(settings); err != nil {
-					goto exit
-				}
+				c.settingsAcknowledged()
+				err = c.applySettings(settings)
+				acked = true
 			default:
 			}
+			c.settingsAckL.Unlock()
+
+			if acked {
+				select {
+				case c.settingsAckCh <- struct{}{}:
+				default:
+				}
+			}
+			if err != nil {
+				goto exit
+			}
 		} else {
+			if c.controlRate.incr() {
+				err = ConnError{errors.New("too many SETTINGS frames"), ErrCodeEnhanceYourCalm}
+				break
+			}
 			if enablePush, exists := v.Settings.value(SettingEnablePush); exists {
 				if enablePush == 1 && !c.server {
 					err = ConnError{
@@ -871,26 +2543,92 @@ again:
 	case *PushPromiseFrame:
 		stream := c.stream(frame.Stream())
 		if stream == nil {
+			// The stream was reset or canceled by this endpoint.
+			if c.usedStreamID(v.StreamID) {
+				goto again
+			}
 			err = ConnError{fmt.Errorf("stream %d does not exist", v.StreamID), ErrCodeProtocol}
 			break
 		}
+		// PUSH_PROMISE frames MUST only be sent on a peer-initiated stream.
+		if !stream.local() {
+			err = ConnError{fmt.Errorf("PUSH_PROMISE on stream %d not initiated by the client", v.StreamID), ErrCodeProtocol}
+			break
+		}
 		if !stream.readable() {
 			err = ConnError{fmt.Errorf("stream %d is not active", v.StreamID), ErrCodeProtocol}
 			break
 		}
-		if !c.Settings().PushEnabled() {
+		if !c.localSettings().PushEnabled() {
 			err = ConnError{errors.New("server push not allowed"), ErrCodeProtocol}
 			break
 		}
-		if stream, err = c.idleStream(v.PromisedStreamID); err == nil {
+		if stream, err = c.remote.idleStream(v.PromisedStreamID); err == nil {
 			_, err = stream.transition(true, FramePushPromise, false)
 		}
+		if err == nil && headerErr != nil {
+			if err = c.writeFrame(&RSTStreamFrame{stream.id, ErrCodeRefusedStream}); err == nil {
+				goto again
+			}
+		}
+	case *AltSvcFrame:
+		// The ALTSVC frame is intended for receipt by clients.  A device
+		// acting as a server MUST ignore it.
+		if c.server {
+			goto again
+		}
+	case *OriginFrame:
+		// The ORIGIN frame is only valid on connections with the "h2"
+		// protocol identifier, and MUST be ignored when received on a
+		// connection with the "h2c" protocol identifier.  A server
+		// receiving it ignores it, as it is sent by servers.
+		if _, overTLS := c.rwc.(*tls.Conn); c.server || !overTLS {
+			goto again
+		}
+	case *PriorityUpdateFrame:
+		// A client that receives a PRIORITY_UPDATE frame MUST respond
+		// with a connection error of type PROTOCOL_ERROR.
+		if !c.server {
+			err = ConnError{errors.New("client received PRIORITY_UPDATE frame"), ErrCodeProtocol}
+			goto exit
+		}
+
+		// The frame may reference a stream that is not yet open, whose
+		// priority is applied when it is opened. Frames referencing
+		// closed streams are ignored.
+		id := v.PrioritizedStreamID
+		if c.stream(id) == nil && (!c.remote.validStreamID(id) || id < c.remote.nextStreamID) {
+			goto again
+		}
+		c.setPriorityParam(id, ParsePriorityParam(v.PriorityFieldValue))
 	case *PingFrame:
 		if !v.Ack {
+			// SEE 10.5.  Denial-of-Service Considerations
+			//
+			// Each PING and SETTINGS frame is acknowledged, so they are
+			// limited to avoid a flood of frames to be written.
+			if c.controlRate.incr() {
+				err = ConnError{errors.New("too many PING frames"), ErrCodeEnhanceYourCalm}
+				break
+			}
 			c.writeQueue.add(&PingFrame{true, v.Data}, true)
+		} else {
+			c.pingL.Lock()
+			if ack, ok := c.pings[v.Data]; ok {
+				close(ack)
+				delete(c.pings, v.Data)
+			}
+			c.pingL.Unlock()
+
+			if c.windowTuner != nil {
+				err = c.windowTuner.ack(v.Data)
+			}
 		}
 	case *GoAwayFrame:
 		c.goAway.Store(v)
+		if v.ErrCode != ErrCodeNo {
+			c.setCause(ConnError{fmt.Errorf("GOAWAY received: %q", v.DebugData), v.ErrCode})
+		}
 
 		var streams []*stream
 
@@ -902,15 +2640,26 @@ again:
 		}
 		c.streamL.RUnlock()
 
+		// The writes of the streams not processed fail with a GoAwayError.
 		for _, stream := range streams {
+			stream.resetErr = GoAwayError{v.ErrCode, v.LastStreamID, stream.id}
 			stream.close()
 		}
-		err = c.Flush()
+		c.queueFlush()
 	case *WindowUpdateFrame:
 		if v.StreamID == 0 {
 			err = c.connStream.sendFlow.incrementWindow(int(v.WindowSizeIncrement))
 		} else if stream := c.stream(v.StreamID); stream != nil {
-			err = stream.sendFlow.incrementWindow(int(v.WindowSizeIncrement))
+			// WINDOW_UPDATE can be received on reserved (local) streams, and
+			// on pushed ones half-closed (local), of which nothing is sent.
+			stream.flowL.Lock()
+			sendFlow := stream.sendFlow
+			stream.flowL.Unlock()
+			if sendFlow != nil {
+				err = sendFlow.incrementWindow(int(v.WindowSizeIncrement))
+			}
+		} else if !c.usedStreamID(v.StreamID) && !c.remote.usedStreamID(v.StreamID) {
+			err = ConnError{fmt.Errorf("WINDOW_UPDATE frame on idle stream %d", v.StreamID), ErrCodeProtocol}
 		}
 	}
 
@@ -921,14 +2670,19 @@ exit:
 		}
 		err = io.ErrUnexpectedEOF
 	}
-	if err != nil {
-		if ne, ok := err.(net.Error); ok {
-
-			// TODO: handle temporary, write deadline
 
-			if ne.Temporary() {
-				goto again
-			}
+	// Reading fails once the connection is closed,
+	// possibly after sending a GOAWAY frame.
+	if err != nil && c.Closed() {
+		return nil, ErrClosed
+	}
+	if err != nil {
+		// An error reading the underlying connection, a timeout of its own
+		// deadline included, may have left a frame partially read, after
+		// which it cannot be read anymore. The write deadline is handled
+		// by handleErr.
+		if _, ok := err.(net.Error); ok {
+			c.setCause(err)
 			return nil, c.close()
 		}
 
@@ -943,7 +2697,8 @@ type data struct {
 
 	processed int
 	endStream,
-	sawEOF bool
+	sawEOF,
+	hold bool
 	err error
 }
 
@@ -968,16 +2723,147 @@ func (r *data) returnBytesLocked() error {
 	r.sawEOF = true
 	if payload, ok := r.src.(*framePayload); ok {
 		r.processed += int(payload.p)
+		if payload.padded {
+			r.processed++
+		}
+	}
+	// The bytes of a stream closed meanwhile, read or not, were
+	// already returned to the connection window when it closed.
+	if !r.hold {
+		r.err = r.stream.recvFlow.returnConsumedBytes(r.processed)
 	}
-	r.err = r.stream.recvFlow.returnBytes(r.processed)
 	if r.err == nil && r.endStream {
 		_, r.err = r.stream.transition(true, FrameData, true)
 	}
 	return r.err
 }
 
+// readHeldData reads the payload of the DATA frame returned last by
+// ReadFrame into w, without returning the flow-controlled bytes to the
+// remote endpoint. It returns the number of processed bytes, including
+// the padding, which are to be returned with releaseData once consumed.
+func (c *Conn) readHeldData(v *DataFrame, w io.Writer) (int, error) {
+	buf := c.getDataBuffer()
+	defer c.putDataBuffer(buf)
+
+	r, ok := v.Data.(*data)
+	if !ok {
+		// The body of an upgrade request is not flow controlled.
+		_, err := io.CopyBuffer(w, v.Data, *buf)
+		return 0, err
+	}
+	if r != c.lastData {
+		return 0, errors.New("DATA frame already processed")
+	}
+
+	r.hold = true
+	_, err := io.CopyBuffer(w, r, *buf)
+	if err == nil {
+		err = r.err
+	}
+	return r.processed, err
+}
+
+// dataBufferPool holds the buffers through which the payloads of
+// received DATA frames are copied.
+var dataBufferPool sync.Pool
+
+// getDataBuffer returns a buffer of the maximum frame size of the
+// connection. It is owned by the caller until given back with
+// putDataBuffer, once the DATA frame payload is copied out of it.
+func (c *Conn) getDataBuffer() *[]byte {
+	n := int(c.localSettings().MaxFrameSize())
+	if !c.config.DisableBufferPool {
+		if buf, ok := dataBufferPool.Get().(*[]byte); ok && cap(*buf) >= n {
+			*buf = (*buf)[:n]
+			return buf
+		}
+	}
+	buf := make([]byte, n)
+	return &buf
+}
+
+func (c *Conn) putDataBuffer(buf *[]byte) {
+	if !c.config.DisableBufferPool {
+		dataBufferPool.Put(buf)
+	}
+}
+
+// releaseData returns n processed bytes of the stream to the remote
+// endpoint. Bytes of closed streams have already been returned.
+func (c *Conn) releaseData(streamID uint32, n int) error {
+	stream := c.stream(streamID)
+	if stream == nil || stream.recvFlow == nil {
+		return nil
+	}
+	return stream.recvFlow.returnConsumedBytes(n)
+}
+
 var errBadConnPreface = errors.New("http2: bad connection preface")
 
+// frameHeaderLen is the length of the header of all frames.
+const frameHeaderLen = 9
+
+// readPrefaceSettings reads the SETTINGS frame ending the connection
+// preface of the remote endpoint, which MUST be the first frame it sends.
+// Any other frame is not processed: clients and servers MUST treat an
+// invalid connection preface as a connection error (Section 5.4.1) of
+// type PROTOCOL_ERROR.
+func (c *Conn) readPrefaceSettings() error {
+	header, err := c.buf.Peek(frameHeaderLen)
+	if err != nil {
+		return err
+	}
+	if frameType := FrameType(header[3]); frameType != FrameSettings || Flags(header[4]).Has(FlagAck) {
+		return ConnError{fmt.Errorf("%w: first received frame was %s, not SETTINGS", errBadConnPreface, frameType), ErrCodeProtocol}
+	}
+	_, err = c.readFrame()
+	return err
+}
+
+// NegotiatedProtocol returns the application protocol of the connection:
+// the one negotiated with ALPN over TLS, which is ProtocolTLS once the
+// handshake is complete, or ProtocolTCP otherwise.
+func (c *Conn) NegotiatedProtocol() string {
+	if tlsConn, ok := c.rwc.(*tls.Conn); ok {
+		return tlsConn.ConnectionState().NegotiatedProtocol
+	}
+	return ProtocolTCP
+}
+
+// TLSConnectionState returns the state of the TLS connection the
+// connection runs over, and false if it does not run over TLS.
+func (c *Conn) TLSConnectionState() (tls.ConnectionState, bool) {
+	if tlsConn, ok := c.rwc.(*tls.Conn); ok {
+		return tlsConn.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}
+
+// checkTLS checks the TLS requirements of HTTP/2 on the state of a
+// completed TLS handshake.
+func (c *Conn) checkTLS(state tls.ConnectionState) error {
+	// Due to deployment limitations, it might not
+	// be possible to fail TLS negotiation when these restrictions are not
+	// met.  An endpoint MAY immediately terminate an HTTP/2 connection that
+	// does not meet these TLS requirements with a connection error
+	// (Section 5.4.1) of type INADEQUATE_SECURITY.
+	if !c.config.AllowLowTLSVersion && state.Version < tls.VersionTLS12 {
+		return ConnError{fmt.Errorf("bad TLS version %x", state.Version), ErrCodeInadequateSecurity}
+	}
+
+	// A deployment of HTTP/2 over TLS 1.2 SHOULD NOT use any of the cipher
+	// suites that are listed in the cipher suite black list (Appendix A).
+	//
+	// Endpoints MAY choose to generate a connection error (Section 5.4.1)
+	// of type INADEQUATE_SECURITY if one of the cipher suites from the
+	// black list is negotiated.
+	if state.Version >= tls.VersionTLS12 && badCipher(state.CipherSuite) {
+		return ConnError{fmt.Errorf("prohibited TLS 1.2 cipher type %x", state.CipherSuite), ErrCodeInadequateSecurity}
+	}
+	return nil
+}
+
 // HandshakeError represents connection handshake error.
 type HandshakeError string
 
@@ -1029,25 +2915,67 @@ func (c *Conn) Handshake() error {
 			return err
 		}
 
-		// Clients and servers MUST treat an invalid connection preface as a
-		// connection error (Section 5.4.1) of type PROTOCOL_ERROR.
-		if err == errBadConnPreface {
-			err = ConnError{err, ErrCodeProtocol}
-		}
 		c.handleErr(err)
 	} else {
 		c.handshakeComplete = true
+
+		if c.config.KeepaliveInterval > 0 {
+			go c.keepalive()
+		}
+		if c.config.IdleTimeout > 0 {
+			go c.idleTimeout()
+		}
+		if c.config.MaxLifetime > 0 {
+			go c.maxLifetime()
+		}
 	}
 
 	return c.handshakeErr
 }
 
+// refuseStream opens a stream initiated by the remote endpoint and resets
+// it with REFUSED_STREAM, indicating that no processing of the stream has
+// occurred and that it can be safely retried, defined in RFC 7540 section 8.1.4.
+func (c *Conn) refuseStream(stream *stream, endStream bool) error {
+	return c.resetNewStream(stream, endStream, ErrCodeRefusedStream)
+}
+
+// resetNewStream opens a stream initiated by the remote endpoint
+// and resets it with the given error code.
+func (c *Conn) resetNewStream(stream *stream, endStream bool, code ErrCode) error {
+	if _, err := stream.transition(true, FrameHeaders, endStream); err != nil {
+		return err
+	}
+	return c.writeFrame(&RSTStreamFrame{stream.id, code})
+}
+
+// rejectStream opens a stream initiated by the remote endpoint and responds
+// with the given status code, ending the stream. If the remote endpoint has
+// not ended the stream, it is requested to abort the transmission of the
+// request without error, defined in RFC 7540 section 8.1.
+func (c *Conn) rejectStream(stream *stream, endStream bool, status string) error {
+	if _, err := stream.transition(true, FrameHeaders, endStream); err != nil {
+		return err
+	}
+	header := make(Header)
+	header.SetStatus(status)
+	if err := c.writeFrame(&HeadersFrame{StreamID: stream.id, Header: header, EndStream: true}); err != nil {
+		return err
+	}
+	if !endStream {
+		return c.writeFrame(&RSTStreamFrame{stream.id, ErrCodeNo})
+	}
+	return nil
+}
+
 func (c *Conn) handleErr(err error) {
 	if err == nil || err == ErrClosed {
 		return
 	}
 
 	switch e := err.(type) {
+	case GoAwayError:
+		// No stream is opened after receiving a GOAWAY frame.
 	case StreamError:
 		c.writeFrame(&RSTStreamFrame{e.StreamID, e.ErrCode})
 	case StreamErrorList:
@@ -1055,8 +2983,67 @@ func (c *Conn) handleErr(err error) {
 			c.writeFrame(&RSTStreamFrame{se.StreamID, se.ErrCode})
 		}
 	case ConnError:
+		c.setCause(e)
 		c.writeFrame(&GoAwayFrame{c.LastStreamID(), e.ErrCode, []byte(e.Error())})
 	default:
+		// A write interrupted by the write deadline may have left a frame
+		// partially written, after which nothing more is written.
+		if errors.Is(e, os.ErrDeadlineExceeded) && c.writeDeadlineExceeded() {
+			c.closeErr.Store(os.ErrDeadlineExceeded)
+			c.close()
+			return
+		}
+		c.setCause(ConnError{e, ErrCodeInternal})
 		c.writeFrame(&GoAwayFrame{c.LastStreamID(), ErrCodeInternal, []byte(e.Error())})
 	}
 }
+
+// rateCounter counts events within a fixed time window.
+type rateCounter struct {
+	sync.Mutex
+	limit  int
+	window time.Duration
+	start  time.Time
+	n      int
+}
+
+func newRateCounter(limit int, window time.Duration, defaultLimit int, defaultWindow time.Duration) *rateCounter {
+	if limit == 0 {
+		limit = defaultLimit
+	}
+	if window <= 0 {
+		window = defaultWindow
+	}
+	return &rateCounter{limit: limit, window: window}
+}
+
+// incr counts an event and reports whether the number of
+// events within the current window exceeds the limit.
+func (r *rateCounter) incr() bool {
+	if r.limit < 0 {
+		return false
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if now := time.Now(); now.Sub(r.start) > r.window {
+		r.start = now
+		r.n = 0
+	}
+	r.n++
+
+	return r.n > r.limit
+}
+
+// configLimit returns the limit of a Config field, defaulting to
+// defaultLimit if zero. Negative values disable the limit, returned as 0.
+func configLimit(limit, defaultLimit int) int {
+	if limit == 0 {
+		return defaultLimit
+	}
+	if limit < 0 {
+		return 0
+	}
+	return limit
+}
@@ -2,13 +2,28 @@ package http2
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
 	"net"
+	"net/http"
+	"os"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -70,13 +85,706 @@ func TestHandshake(t *testing.T) {
 	}
 }
 
+func TestTLSRequirements(t *testing.T) {
+	client, server := pipe(true, true, false)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+	for _, c := range []*Conn{client, server} {
+		if p := c.NegotiatedProtocol(); p != ProtocolTLS {
+			t.Fatalf("expected negotiated protocol %s, got %s", ProtocolTLS, p)
+		}
+		if state, ok := c.TLSConnectionState(); !ok || !state.HandshakeComplete {
+			t.Fatalf("expected completed TLS handshake, got %v %v", state.HandshakeComplete, ok)
+		}
+	}
+
+	client, server = pipe(true, false, true)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+	if p := client.NegotiatedProtocol(); p != ProtocolTCP {
+		t.Fatalf("expected negotiated protocol %s, got %s", ProtocolTCP, p)
+	}
+	if _, ok := client.TLSConnectionState(); ok {
+		t.Fatal("expected no TLS connection state")
+	}
+
+	// A cipher suite of the black list is refused by the client.
+	cert, err := tls.LoadX509KeyPair("testdata/server.pem", "testdata/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		tlsConn := tls.Server(s, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{ProtocolTLS},
+			CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA},
+			MaxVersion:   tls.VersionTLS12,
+		})
+		if tlsConn.Handshake() == nil {
+			io.Copy(io.Discard, tlsConn)
+		}
+	}()
+	client = ClientConn(tls.Client(c, &tls.Config{NextProtos: []string{ProtocolTLS}, InsecureSkipVerify: true}), nil, nil)
+	defer client.CloseTimeout(0)
+	err = client.Handshake()
+	if e, ok := err.(ConnError); !ok || e.ErrCode != ErrCodeInadequateSecurity {
+		t.Fatalf("expected INADEQUATE_SECURITY connection error, got %v", err)
+	}
+}
+
+func TestEncoderTableSize(t *testing.T) {
+	client, server := pipe(true, true, false)
+
+	client.SetEncoderTableSize(0)
+
+	for i := 0; i < 2; i++ {
+		streamID, err := client.NextStreamID()
+		if err != nil {
+			t.Fatalf("error creating new stream: %s", err)
+		}
+
+		expected := &HeadersFrame{StreamID: streamID, Header: Header{}, EndStream: true}
+		expected.Header.Set("Test-A", "a")
+
+		if err = client.WriteFrame(expected); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+		frame, err := server.ReadFrame()
+		if err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+		if !reflect.DeepEqual(expected, frame) {
+			t.Fatalf("expected %v, got %v", expected, frame)
+		}
+	}
+
+	if size := client.frameWriter.MaxHeaderTableSize(); size != 0 {
+		t.Fatalf("expected encoder table size 0, got %d", size)
+	}
+	if size := server.frameReader.MaxHeaderTableSize(); size != 0 {
+		t.Fatalf("expected decoder table size 0, got %d", size)
+	}
+}
+
+func TestUnknownFrame(t *testing.T) {
+	client, server := pipe(true, true, false)
+
+	for _, frameType := range []FrameType{0xfe, 0xff} {
+		expected := []byte("unknown")
+		err := client.WriteFrame(&UnknownFrame{
+			FrameType:  frameType,
+			Payload:    bytes.NewReader(expected),
+			PayloadLen: len(expected),
+		})
+		if err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+		frame, err := server.ReadFrame()
+		if err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+		v, ok := frame.(*UnknownFrame)
+		if !ok || v.Type() != frameType {
+			t.Fatalf("expected frame of type %s, got %v", frameType, frame)
+		}
+		payload := make([]byte, v.PayloadLen)
+		if _, err = io.ReadFull(v.Payload, payload); err != nil {
+			t.Fatalf("error reading payload: %s", err)
+		}
+		if !bytes.Equal(expected, payload) {
+			t.Fatalf("expected payload %q, got %q", expected, payload)
+		}
+	}
+}
+
+func TestMaxHeaderListSize(t *testing.T) {
+	client, server := pipe(true, true, false)
+
+	settings := Settings{}
+	settings.SetMaxHeaderListSize(100)
+	if err := server.WriteFrame(&SettingsFrame{Settings: settings}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if _, err := client.ReadFrame(); err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+	if _, err := server.ReadFrame(); err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+
+	frameCh := make(chan Frame, 1)
+	go func() {
+		for i := 0; i < 2; i++ {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				t.Errorf("error reading frame: %s", err)
+			}
+			frameCh <- frame
+		}
+	}()
+
+	// The field is added to the dynamic table, and is
+	// encoded as an index in the following header blocks.
+	streamID, err := client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error creating new stream: %s", err)
+	}
+	indexed := &HeadersFrame{StreamID: streamID, Header: Header{}, EndStream: true}
+	indexed.Header.Set("Test-B", strings.Repeat("b", 60))
+	if err = client.WriteFrame(indexed); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if frame := <-frameCh; !reflect.DeepEqual(indexed, frame) {
+		t.Fatalf("expected %v, got %v", indexed, frame)
+	}
+
+	streamID, err = client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error creating new stream: %s", err)
+	}
+	large := &HeadersFrame{StreamID: streamID, Header: Header{}}
+	large.Header.Set("Test-A", "a")
+	large.Header.Set("Test-B", strings.Repeat("b", 60))
+	if err = client.WriteFrame(large); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+
+	frame, err := client.ReadFrame()
+	if err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+	if headers, ok := frame.(*HeadersFrame); !ok || headers.Status() != "431" || !headers.EndStream {
+		t.Fatalf("expected 431 response, got %v", frame)
+	}
+	frame, err = client.ReadFrame()
+	if err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+	if rst, ok := frame.(*RSTStreamFrame); !ok || rst.ErrCode != ErrCodeNo {
+		t.Fatalf("expected RST_STREAM with NO_ERROR, got %v", frame)
+	}
+
+	// The dynamic table is kept synchronized.
+	streamID, err = client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error creating new stream: %s", err)
+	}
+	expected := &HeadersFrame{StreamID: streamID, Header: Header{}, EndStream: true}
+	expected.Header.Set("Test-A", "a")
+	if err = client.WriteFrame(expected); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if frame = <-frameCh; !reflect.DeepEqual(expected, frame) {
+		t.Fatalf("expected %v, got %v", expected, frame)
+	}
+}
+
+func TestLocalSettings(t *testing.T) {
+	client, server := pipe(true, true, false)
+
+	settings := Settings{}
+	settings.SetMaxConcurrentStreams(10)
+	if err := server.WriteFrame(&SettingsFrame{Settings: settings}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if _, err := client.ReadFrame(); err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+
+	// The settings are in effect once acknowledged.
+	if got := server.LocalSettings().MaxConcurrentStreams(); got != defaultMaxConcurrentStreams {
+		t.Fatalf("expected %d concurrent streams before ACK, got %d", defaultMaxConcurrentStreams, got)
+	}
+	if _, err := server.ReadFrame(); err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+	if got := server.LocalSettings().MaxConcurrentStreams(); got != 10 {
+		t.Fatalf("expected 10 concurrent streams, got %d", got)
+	}
+	if got := client.RemoteSettings().MaxConcurrentStreams(); got != 10 {
+		t.Fatalf("expected 10 remote concurrent streams, got %d", got)
+	}
+
+	// The returned settings are copies.
+	local, remote := server.LocalSettings(), client.RemoteSettings()
+	local.SetMaxConcurrentStreams(20)
+	remote.SetMaxConcurrentStreams(20)
+	if got := server.LocalSettings().MaxConcurrentStreams(); got != 10 {
+		t.Fatalf("expected 10 concurrent streams, got %d", got)
+	}
+	if got := client.RemoteSettings().MaxConcurrentStreams(); got != 10 {
+		t.Fatalf("expected 10 remote concurrent streams, got %d", got)
+	}
+}
+
+func TestOnSendSettings(t *testing.T) {
+	initial := Settings{}
+	initial.SetMaxConcurrentStreams(10)
+
+	var sent []Settings
+	c, s := net.Pipe()
+	server := ServerConn(s, &Config{
+		InitialSettings: initial,
+		OnSendSettings: func(settings Settings) Settings {
+			sent = append(sent, settings)
+			if len(sent) > 1 {
+				// A value out of range.
+				return append(settings, setting{SettingMaxFrameSize, 100})
+			}
+			// A value not advertised by default, and an unknown identifier.
+			return append(settings, setting{SettingMaxFrameSize, 1 << 15}, setting{0xf0, 7})
+		},
+	})
+	defer c.Close()
+	defer server.CloseTimeout(0)
+
+	go func() {
+		for {
+			if _, err := server.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		c.Write(clientPreface)
+		c.Write(rawFrame(FrameSettings, 0, 0, nil))
+	}()
+
+	// The settings returned by the hook are sent as they are.
+	var header [frameHeaderLen]byte
+	if _, err := io.ReadFull(c, header[:]); err != nil {
+		t.Fatalf("error reading frame header: %s", err)
+	}
+	if FrameType(header[3]) != FrameSettings || header[4] != 0 {
+		t.Fatalf("expected SETTINGS frame, got type %d with flags %#x", header[3], header[4])
+	}
+	payload := make([]byte, int(header[0])<<16|int(header[1])<<8|int(header[2]))
+	if _, err := io.ReadFull(c, payload); err != nil {
+		t.Fatalf("error reading settings: %s", err)
+	}
+	var got []setting
+	for ; len(payload) >= settingLen; payload = payload[settingLen:] {
+		got = append(got, setting{SettingID(binary.BigEndian.Uint16(payload)), binary.BigEndian.Uint32(payload[2:])})
+	}
+	want := []setting{{SettingMaxConcurrentStreams, 10}, {SettingMaxFrameSize, 1 << 15}, {0xf0, 7}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected settings %v, got %v", want, got)
+	}
+	if len(sent) != 1 || !reflect.DeepEqual([]setting(sent[0]), []setting(initial)) {
+		t.Fatalf("expected the hook to be given %v, got %v", initial, sent)
+	}
+
+	// The settings returned by the hook are validated.
+	update := Settings{}
+	update.SetMaxConcurrentStreams(20)
+	if err := server.WriteFrame(&SettingsFrame{Settings: update}); err == nil {
+		t.Fatal("expected an error writing invalid settings")
+	}
+	if err := server.Err(); err != nil {
+		t.Fatalf("expected the connection not to fail, got %s", err)
+	}
+}
+
+func TestSettingsDiff(t *testing.T) {
+	old := Settings{}
+	old.SetMaxConcurrentStreams(100)
+	old.SetInitialWindowSize(1 << 20)
+	old.SetHeaderTableSize(defaultHeaderTableSize)
+
+	tests := []struct {
+		name  string
+		set   func(s *Settings)
+		diff  Settings
+		delta int
+	}{
+		{"unchanged", func(s *Settings) {}, nil, 0},
+		{"added", func(s *Settings) { s.SetMaxFrameSize(1 << 15) }, Settings{{SettingMaxFrameSize, 1 << 15}}, 0},
+		{"changed", func(s *Settings) { s.SetInitialWindowSize(1 << 16) }, Settings{{SettingInitialWindowSize, 1 << 16}}, 1<<16 - 1<<20},
+		{"set to the same value", func(s *Settings) { s.SetMaxConcurrentStreams(100) }, nil, 0},
+		{"removed", func(s *Settings) { *s = (*s)[1:] }, Settings{{SettingMaxConcurrentStreams, defaultMaxConcurrentStreams}}, 0},
+		{"removed default", func(s *Settings) { *s = (*s)[:2] }, nil, 0},
+		{"reset to default", func(s *Settings) { *s = (*s)[:1] }, Settings{{SettingInitialWindowSize, defaultInitialWindowSize}}, defaultInitialWindowSize - 1<<20},
+	}
+	for _, tt := range tests {
+		s := old.clone()
+		tt.set(&s)
+		if diff := s.Diff(old); !reflect.DeepEqual(diff, tt.diff) {
+			t.Errorf("%s: expected diff %v, got %v", tt.name, tt.diff, diff)
+		}
+		if delta := s.InitialWindowSizeDelta(old); delta != tt.delta {
+			t.Errorf("%s: expected delta %d, got %d", tt.name, tt.delta, delta)
+		}
+	}
+}
+
+func TestUpdateSettings(t *testing.T) {
+	client, server := pipe(true, true, false)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	streamID, _ := client.NextStreamID()
+	if err := client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{}}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if _, err := server.ReadFrame(); err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+
+	// Both endpoints read the frames of the other
+	// for the SETTINGS frame to be acknowledged.
+	for _, conn := range []*Conn{client, server} {
+		go func(conn *Conn) {
+			for {
+				if _, err := conn.ReadFrame(); err != nil {
+					if _, ok := err.(StreamError); !ok {
+						return
+					}
+				}
+			}
+		}(conn)
+	}
+
+	rw := server.RecvWindow(streamID)
+
+	settings := Settings{}
+	settings.SetMaxConcurrentStreams(5)
+	settings.SetInitialWindowSize(defaultInitialWindowSize + 1000)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.UpdateSettings(settings); err != nil {
+				t.Errorf("error updating settings: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := server.LocalSettings().MaxConcurrentStreams(); got != 5 {
+		t.Fatalf("expected 5 concurrent streams, got %d", got)
+	}
+	if got := server.RecvWindow(streamID); got != rw+1000 {
+		t.Fatalf("expected recv win: %d, got %d", rw+1000, got)
+	}
+
+	// The settings are applied once UpdateSettings returns.
+	for i := uint32(1); i <= 20; i++ {
+		settings := Settings{}
+		settings.SetMaxConcurrentStreams(5 + i)
+		if err := server.UpdateSettings(settings); err != nil {
+			t.Fatalf("error updating settings: %s", err)
+		}
+		if got := server.LocalSettings().MaxConcurrentStreams(); got != 5+i {
+			t.Fatalf("expected %d concurrent streams, got %d", 5+i, got)
+		}
+	}
+
+	invalid := Settings{{SettingInitialWindowSize, maxInitialWindowSize + 1}}
+	if err := server.UpdateSettings(invalid); err == nil {
+		t.Fatal("expected error updating settings with invalid value")
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	client, server := pipe(true, true, false)
+
+	read := func(c *Conn) Frame {
+		frame, err := c.ReadFrame()
+		if err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+		return frame
+	}
+
+	streamID, err := client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error creating new stream: %s", err)
+	}
+	headers := &HeadersFrame{StreamID: streamID, Header: Header{}}
+	headers.Header.Set("Test-A", "a")
+	if err = client.WriteFrame(headers); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if frame := read(server); !reflect.DeepEqual(headers, frame) {
+		t.Fatalf("expected %v, got %v", headers, frame)
+	}
+	data := []byte("data")
+	if err = client.WriteFrame(&DataFrame{StreamID: streamID, Data: bytes.NewReader(data), DataLen: len(data)}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if frame := read(server); frame.Type() != FrameData {
+		t.Fatalf("expected DATA frame, got %v", frame)
+	}
+
+	trailer := Header{}
+	trailer.Set("Test-Trailer", "t")
+	if err = client.WriteTrailer(streamID, trailer); err != nil {
+		t.Fatalf("error writing trailer: %s", err)
+	}
+	expected := &HeadersFrame{StreamID: streamID, Header: trailer, EndStream: true, Trailer: true}
+	if frame := read(server); !reflect.DeepEqual(expected, frame) {
+		t.Fatalf("expected %v, got %v", expected, frame)
+	}
+
+	// Trailers do not contain pseudo-header fields.
+	streamID, err = client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error creating new stream: %s", err)
+	}
+	if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{}}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	read(server)
+	malformed := Header{}
+	malformed.SetStatus("200")
+	if err = client.WriteTrailer(streamID, malformed); err != errTrailerPseudo {
+		t.Fatalf("expected error %v, got %v", errTrailerPseudo, err)
+	}
+	if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: malformed, EndStream: true}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if _, err = server.ReadFrame(); err == nil {
+		t.Fatal("expected stream error")
+	} else if se, ok := err.(StreamError); !ok || se.ErrCode != ErrCodeProtocol {
+		t.Fatalf("expected stream error PROTOCOL_ERROR, got %v", err)
+	}
+	if rst, ok := read(client).(*RSTStreamFrame); !ok || rst.StreamID != streamID || rst.ErrCode != ErrCodeProtocol {
+		t.Fatalf("expected RST_STREAM with PROTOCOL_ERROR, got %v", rst)
+	}
+}
+
+func TestHeaderClone(t *testing.T) {
+	h := Header{":method": {"GET"}, "Accept": {"text/html", "text/plain"}, "Empty": nil}
+	clone := h.Clone()
+	if !reflect.DeepEqual(h, clone) {
+		t.Fatalf("expected %v, got %v", h, clone)
+	}
+
+	clone["Accept"][0] = "*/*"
+	clone["Accept"] = append(clone["Accept"], "image/png")
+	clone.SetMethod("POST")
+	if h.Method() != "GET" || !reflect.DeepEqual(h["Accept"], []string{"text/html", "text/plain"}) {
+		t.Fatalf("expected the original header to be unchanged, got %v", h)
+	}
+	if Header(nil).Clone() != nil {
+		t.Fatal("expected nil clone of nil header")
+	}
+}
+
+func TestHeaderFields(t *testing.T) {
+	h := Header{
+		"User-Agent": {"test"},
+		":path":      {"/"},
+		"Accept":     {"text/html", "text/plain"},
+		":method":    {"GET"},
+		"cookie":     {"a=1; b=2", "c=3"},
+		":authority": {"example.com"},
+		":scheme":    {"https"},
+	}
+	expected := []HeaderField{
+		{":method", "GET"},
+		{":scheme", "https"},
+		{":authority", "example.com"},
+		{":path", "/"},
+		{"accept", "text/html"},
+		{"accept", "text/plain"},
+		{"cookie", "a=1"},
+		{"cookie", "b=2"},
+		{"cookie", "c=3"},
+		{"user-agent", "test"},
+	}
+	for i := 0; i < 10; i++ {
+		if fields := h.Fields(); !reflect.DeepEqual(fields, expected) {
+			t.Fatalf("expected %v, got %v", expected, fields)
+		}
+	}
+}
+
+func TestHeaderSensitive(t *testing.T) {
+	header := Header{}
+	header.Set("x-secret", "secret")
+	header.Set("x-plain", "plain")
+	header.Set("authorization", "token")
+	sensitive := []string{"X-Secret"}
+	if !sensitiveField(sensitive, "x-secret") || !sensitiveField(sensitive, "Authorization") || sensitiveField(sensitive, "x-plain") {
+		t.Fatalf("unexpected sensitivity of %v", sensitive)
+	}
+
+	// The header fields not sensitive are indexed, and encoded in less
+	// octets the second time, unlike the sensitive ones.
+	plain := Header{}
+	plain.Set("x-secret", "secret")
+	for _, names := range [][]string{nil, sensitive} {
+		buf := new(bytes.Buffer)
+		w := newFrameWriter(buf)
+		for _, streamID := range []uint32{1, 3} {
+			if err := w.WriteFrame(&HeadersFrame{StreamID: streamID, Header: plain, Sensitive: names}); err != nil {
+				t.Fatalf("error writing frame: %s", err)
+			}
+		}
+		b := buf.Bytes()
+		first := int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+		second := int(b[9+first])<<16 | int(b[9+first+1])<<8 | int(b[9+first+2])
+		if indexed := second < first; indexed == (names != nil) {
+			t.Fatalf("unexpected header blocks of %d and %d octets with sensitive fields %v", first, second, names)
+		}
+	}
+
+	// The fields received as never indexed are listed,
+	// without being added to the Header.
+	buf := new(bytes.Buffer)
+	w := newFrameWriter(buf)
+	for _, streamID := range []uint32{1, 3} {
+		if err := w.WriteFrame(&HeadersFrame{StreamID: streamID, Header: header, Sensitive: sensitive}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+	}
+
+	b := buf.Bytes()
+	r := newFrameReader(bytes.NewReader(b), 4096)
+	for i := 0; i < 2; i++ {
+		frame, err := r.ReadFrame()
+		if err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+		got := frame.(*HeadersFrame)
+		sort.Strings(got.Sensitive)
+		if !reflect.DeepEqual(got.Sensitive, []string{"authorization", "x-secret"}) {
+			t.Fatalf("expected sensitive authorization and x-secret header fields, got %v", got.Sensitive)
+		}
+		if n := got.Header.Len(); n != 3 || len(got.Header) != 3 || got.Get("x-secret") != "secret" {
+			t.Fatalf("unexpected header %v", got.Header)
+		}
+	}
+}
+
+func TestHeaderTableSize(t *testing.T) {
+	client, server := pipe(true, true, false)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	headers := make(chan *HeadersFrame, 1)
+	go func() {
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				if _, ok := err.(StreamError); ok {
+					continue
+				}
+				close(headers)
+				return
+			}
+			if v, ok := frame.(*HeadersFrame); ok {
+				headers <- v
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				if _, ok := err.(StreamError); !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	// The client signals the new size at the beginning of the
+	// next header block, without which it cannot be decoded.
+	if err := server.SetDecoderTableSize(0); err != nil {
+		t.Fatalf("error setting decoder table size: %s", err)
+	}
+	header := Header{}
+	header.Set("x-test", "test")
+	for i := 0; i < 2; i++ {
+		streamID, _ := client.NextStreamID()
+		if err := client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: header}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+		v, ok := <-headers
+		if !ok {
+			t.Fatalf("connection closed: %v", server.Err())
+		}
+		if v.Header.Get("x-test") != "test" {
+			t.Fatalf("expected x-test header field, got %v", v.Header)
+		}
+	}
+	if size := server.frameReader.MaxHeaderTableSize(); size != 0 {
+		t.Fatalf("expected decoder table size 0, got %d", size)
+	}
+
+	// Without indexing, the same header block is
+	// encoded in the same octets each time.
+	buf := new(bytes.Buffer)
+	w := newFrameWriter(buf)
+	w.SetIndexing(false)
+	for _, streamID := range []uint32{1, 3} {
+		if err := w.WriteFrame(&HeadersFrame{StreamID: streamID, Header: header}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+	}
+	b := buf.Bytes()
+	n := 9 + (int(b[0])<<16 | int(b[1])<<8 | int(b[2]))
+	if !bytes.Equal(b[9:n], b[n+9:]) {
+		t.Fatalf("expected equal header blocks, got %x and %x", b[9:n], b[n+9:])
+	}
+}
+
+func TestHeaderInvalid(t *testing.T) {
+	tests := []struct{ name, value string }{
+		{"x test", "a"},
+		{"x\x01", "a"},
+		{"x(test)", "a"},
+		{"x-test", "a\r\nb"},
+		{"x-test", "a\x00"},
+		{"x-test", " a"},
+		{"x-test", "a\t"},
+	}
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		w := newFrameWriter(buf)
+		if err := w.WriteFrame(&HeadersFrame{StreamID: 1, Header: Header{tt.name: {tt.value}}}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+		if err := w.WriteFrame(&HeadersFrame{StreamID: 3, Header: Header{"x-valid": {"a b"}}}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+
+		r := newFrameReader(bytes.NewReader(buf.Bytes()), 4096)
+		_, err := r.ReadFrame()
+		if e, ok := err.(StreamError); !ok || e.ErrCode != ErrCodeProtocol || e.StreamID != 1 {
+			t.Fatalf("%q: %q: expected stream error %s, got %v", tt.name, tt.value, ErrCodeProtocol, err)
+		}
+		if _, ok := err.(StreamError).Err.(MalformedError); !ok {
+			t.Fatalf("%q: %q: expected malformed error, got %v", tt.name, tt.value, err)
+		}
+
+		// The decoding of the header blocks goes on.
+		frame, err := r.ReadFrame()
+		if err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+		if v := frame.(*HeadersFrame); v.Header.Get("x-valid") != "a b" {
+			t.Fatalf("expected x-valid header field, got %v", v.Header)
+		}
+	}
+
+	// A server connection resets the malformed requests.
+	p := newRawPeer(t, nil)
+	p.write(rawFrame(FrameHeaders, FlagEndHeaders|FlagEndStream, 1, []byte{0x00, 0x01, 'X', 0x01, 'a'}))
+	p.expectReset(1, ErrCodeProtocol)
+}
+
 func TestHeaders(t *testing.T) {
 	for _, overTLS := range []bool{true, false} {
 		client, server := pipe(true, overTLS, false)
 
 		streamID, err := client.NextStreamID()
 		if err != nil {
-			t.Fatalf("error creating new stream", err)
+			t.Fatalf("error creating new stream: %s", err)
 		}
 		if streamID != 3 {
 			t.Fatalf("%d", streamID)
@@ -176,6 +884,9 @@ func TestData(t *testing.T) {
 				}
 
 				dataLen := uint32(data.DataLen) + uint32(data.PadLen)
+				if data.PadLen > 0 {
+					dataLen++
+				}
 
 				if server.RecvWindow(0) != cw-dataLen {
 					t.Errorf("server stream 0 expected recv win: %d, got %d", cw-dataLen, server.RecvWindow(0))
@@ -263,46 +974,5003 @@ func TestData(t *testing.T) {
 	}
 }
 
-func TestPing(t *testing.T) {
-	for _, overTLS := range []bool{true, false} {
-		client, server := pipe(true, overTLS, false)
-
-		expected := [8]byte{}
-		copy(expected[:], "pingpong")
+func TestPaddingFlowControl(t *testing.T) {
+	client, server := pipe(true, false, false)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
 
-		if err := client.WriteFrame(&PingFrame{Data: expected}); err != nil {
-			t.Fatalf("error writing frame: %s", err)
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Two streams: the DATA frames of the first are returned by
+	// ReadFrame, and the ones of the second read from its body.
+	header := Header{":method": {"POST"}, ":scheme": {"https"}, ":path": {"/"}}
+	var streamIDs [2]uint32
+	for i := range streamIDs {
+		streamID, err := client.NextStreamID()
+		if err != nil {
+			t.Fatalf("error generating stream id: %s", err)
+		}
+		if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: header}); err != nil {
+			t.Fatalf("error writing headers: %s", err)
+		}
+		if _, err = server.ReadFrame(); err != nil {
+			t.Fatalf("error reading headers: %s", err)
+		}
+		streamIDs[i] = streamID
+	}
+	body, err := server.StreamBody(streamIDs[1])
+	if err != nil {
+		t.Fatalf("error reading body: %s", err)
+	}
+
+	// The frames are mostly padding, more than the initial
+	// connection window on each stream, so the writes block unless
+	// the padding is returned, although it is never read.
+	const frames = 300
+	errCh := make(chan error, 1)
+	go func() {
+		for i := 0; i < frames; i++ {
+			for _, streamID := range streamIDs {
+				if err := client.WriteFrame(&DataFrame{StreamID: streamID, Data: strings.NewReader("a"), DataLen: 1, PadLen: 255, EndStream: i == frames-1}); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}
+		errCh <- nil
+	}()
+
+	bodyCh := make(chan int, 1)
+	go func() {
+		b, _ := io.ReadAll(body)
+		bodyCh <- len(b)
+	}()
+
+	dataCh := make(chan int, 1)
+	go func() {
+		var n int
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				return
+			}
+			if v, ok := frame.(*DataFrame); ok {
+				b, _ := io.ReadAll(v.Data)
+				if n += len(b); v.EndStream {
+					dataCh <- n
+				}
+			}
+		}
+	}()
+
+	if err = <-errCh; err != nil {
+		t.Fatalf("error writing data: %s", err)
+	}
+	if got := <-dataCh; got != frames {
+		t.Fatalf("expected %d bytes of DATA frames, got %d", frames, got)
+	}
+	if got := <-bodyCh; got != frames {
+		t.Fatalf("expected a body of %d bytes, got %d", frames, got)
+	}
+
+	// Once the data is read, the connection window is restored.
+	if n := server.connStream.recvFlow.consumedBytes(); n != 0 {
+		t.Fatalf("expected the connection window to be restored, got %d bytes consumed", n)
+	}
+}
+
+func TestPadding(t *testing.T) {
+	client, server := pipe(true, true, false)
+	streamID, _ := client.NextStreamID()
+
+	header := Header{}
+	header.SetMethod("POST")
+	data := []byte("hello")
+
+	errc := make(chan error, 1)
+	go func() {
+		err := client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: header, PadLen: 16})
+		if err == nil {
+			err = client.WriteFrame(&DataFrame{StreamID: streamID, Data: bytes.NewReader(data), DataLen: len(data), PadLen: 20})
+		}
+		errc <- err
+	}()
+
+	frame, err := server.ReadFrame()
+	if err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+	if v, ok := frame.(*HeadersFrame); !ok || v.PadLen != 16 || v.Method() != "POST" {
+		t.Fatalf("expected padded headers frame, got %v", frame)
+	}
+
+	sw := server.RecvWindow(streamID)
+	frame, err = server.ReadFrame()
+	if err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+	v, ok := frame.(*DataFrame)
+	if !ok || v.PadLen != 20 || v.DataLen != len(data) {
+		t.Fatalf("expected padded data frame, got %v", frame)
+	}
+	if err = <-errc; err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+
+	// The Pad Length field and the padding are flow controlled.
+	flowLen := uint32(len(data) + 20 + 1)
+	if got := server.RecvWindow(streamID); got != sw-flowLen {
+		t.Fatalf("expected recv win: %d, got %d", sw-flowLen, got)
+	}
+	client.stream(streamID).sendFlow.cancel()
+	if got := client.SendWindow(streamID); got != sw-flowLen {
+		t.Fatalf("expected send win: %d, got %d", sw-flowLen, got)
+	}
+	if got, _ := io.ReadAll(v.Data); !bytes.Equal(got, data) {
+		t.Fatalf("expected data %q, got %q", data, got)
+	}
+
+	// A pad length equal to or larger than the rest of the payload.
+	frames := [][]byte{
+		{0, 0, 4, byte(FrameData), byte(FlagPadded), 0, 0, 0, 1, 4, 'a', 'b', 'c'},
+		{0, 0, 2, byte(FrameHeaders), byte(FlagPadded | FlagEndHeaders), 0, 0, 0, 1, 2, 0},
+	}
+	for _, b := range frames {
+		r := newFrameReader(bytes.NewReader(b), 4096)
+		if _, err := r.ReadFrame(); err == nil || err.(ConnError).ErrCode != ErrCodeProtocol {
+			t.Fatalf("expected %s, got %v", ErrCodeProtocol, err)
+		}
+	}
+}
+
+func TestWriteFrom(t *testing.T) {
+	client, server := pipe(false, false, false)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	// The client reads the WINDOW_UPDATE frames of the server.
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				if _, ok := err.(StreamError); !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	data := make([]byte, defaultInitialWindowSize*2)
+	rand.Read(data)
+	readErr := errors.New("read error")
+
+	for _, rerr := range []error{nil, readErr} {
+		streamID, _ := client.NextStreamID()
+		if err := client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{}}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+
+		var r io.Reader = iotest.HalfReader(bytes.NewReader(data))
+		if rerr != nil {
+			r = io.MultiReader(r, iotest.ErrReader(rerr))
+		}
+		type result struct {
+			n   int64
+			err error
+		}
+		resc := make(chan result, 1)
+		go func() {
+			n, err := client.WriteFrom(streamID, r)
+			resc <- result{n, err}
+		}()
+
+		got := new(bytes.Buffer)
+		var last Frame
+		for last == nil {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				t.Fatalf("error reading frame: %s", err)
+			}
+			switch v := frame.(type) {
+			case *DataFrame:
+				if v.DataLen > int(server.Settings().MaxFrameSize()) {
+					t.Fatalf("expected frames of at most %d bytes, got %d", server.Settings().MaxFrameSize(), v.DataLen)
+				}
+				io.Copy(got, v.Data)
+				if v.EndStream {
+					last = v
+				}
+			case *RSTStreamFrame:
+				last = v
+			}
+		}
+
+		res := <-resc
+		if rerr == nil {
+			if res.err != nil || res.n != int64(len(data)) {
+				t.Fatalf("expected %d bytes written, got %d, %v", len(data), res.n, res.err)
+			}
+			if !bytes.Equal(got.Bytes(), data) {
+				t.Fatal("data mismatch")
+			}
+		} else {
+			if res.err != rerr {
+				t.Fatalf("expected %v, got %v", rerr, res.err)
+			}
+			if v, ok := last.(*RSTStreamFrame); !ok || v.ErrCode != ErrCodeInternal {
+				t.Fatalf("expected RST_STREAM with INTERNAL_ERROR, got %v", last)
+			}
+		}
+	}
+}
+
+func TestMaxFrameSizeSplit(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := newFrameWriter(buf)
+
+	header := Header{}
+	header.Set("x-large", strings.Repeat("a", 3*defaultMaxFrameSize))
+	if err := w.WriteFrame(&HeadersFrame{StreamID: 1, Header: header}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	n := 3*defaultMaxFrameSize + 100
+	if err := w.WriteFrame(&DataFrame{StreamID: 1, Data: bytes.NewReader(make([]byte, n)), DataLen: n, EndStream: true}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+
+	var types []FrameType
+	b := buf.Bytes()
+	for len(b) > 0 {
+		length := int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+		frameType, flags := FrameType(b[3]), Flags(b[4])
+		if length > defaultMaxFrameSize {
+			t.Fatalf("%s frame length %d exceeds %d", frameType, length, defaultMaxFrameSize)
+		}
+		next := FrameType(0xff)
+		if len(b) > 9+length {
+			next = FrameType(b[9+length+3])
+		}
+		switch frameType {
+		case FrameHeaders, FrameContinuation:
+			if last := next != FrameContinuation; flags.Has(FlagEndHeaders) != last {
+				t.Fatalf("expected END_HEADERS only on the last frame of the header block")
+			}
+		case FrameData:
+			if last := next != FrameData; flags.Has(FlagEndStream) != last {
+				t.Fatalf("expected END_STREAM only on the last DATA frame")
+			}
+		}
+		types = append(types, frameType)
+		b = b[9+length:]
+	}
+	if len(types) < 6 || types[0] != FrameHeaders || types[1] != FrameContinuation || types[len(types)-1] != FrameData {
+		t.Fatalf("expected HEADERS, CONTINUATION and DATA frames, got %v", types)
+	}
+
+	// The frames which cannot be split are rejected.
+	client, server := pipe(true, false, false)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	frames := []Frame{
+		&OriginFrame{Origins: []string{strings.Repeat("a", defaultMaxFrameSize)}},
+		&UnknownFrame{FrameType: 0xff, PayloadLen: defaultMaxFrameSize + 1, Payload: bytes.NewReader(make([]byte, defaultMaxFrameSize+1))},
+	}
+	for _, frame := range frames {
+		if err := server.WriteFrame(frame); err == nil {
+			t.Fatalf("expected error writing %s frame exceeding the max frame size", frame.Type())
+		}
+	}
+}
+
+func TestMaxFrameSizeRead(t *testing.T) {
+	frame := func(frameType FrameType, streamID uint32, length int) []byte {
+		b := []byte{byte(length >> 16), byte(length >> 8), byte(length), byte(frameType), 0, 0, 0, 0, byte(streamID)}
+		return append(b, make([]byte, length)...)
+	}
+	ping := frame(FramePing, 0, 8)
+
+	tests := []struct {
+		name      string
+		frameType FrameType
+		streamID  uint32
+		connErr   bool
+	}{
+		{"DATA", FrameData, 1, false},
+		{"RST_STREAM", FrameRSTStream, 1, false},
+		{"unknown on stream", 0xff, 1, false},
+		{"HEADERS", FrameHeaders, 1, true},
+		{"PUSH_PROMISE", FramePushPromise, 1, true},
+		{"SETTINGS", FrameSettings, 0, true},
+		{"unknown on stream 0", 0xff, 0, true},
+	}
+	for _, tt := range tests {
+		b := append(frame(tt.frameType, tt.streamID, defaultMaxFrameSize+1), ping...)
+		r := newFrameReader(bytes.NewReader(b), 4096)
+
+		_, err := r.ReadFrame()
+		if tt.connErr {
+			if e, ok := err.(ConnError); !ok || e.ErrCode != ErrCodeFrameSize {
+				t.Fatalf("%s: expected connection error %s, got %v", tt.name, ErrCodeFrameSize, err)
+			}
+			continue
+		}
+		if e, ok := err.(StreamError); !ok || e.ErrCode != ErrCodeFrameSize || e.StreamID != tt.streamID {
+			t.Fatalf("%s: expected stream error %s, got %v", tt.name, ErrCodeFrameSize, err)
+		}
+		// The payload of the oversized frame is discarded.
+		if f, err := r.ReadFrame(); err != nil || f.Type() != FramePing {
+			t.Fatalf("%s: expected PING frame, got %v, %v", tt.name, f, err)
+		}
+	}
+}
+
+func TestRawFrames(t *testing.T) {
+	setting := func(id SettingID, value uint32) []byte {
+		return []byte{byte(id >> 8), byte(id), byte(value >> 24), byte(value >> 16), byte(value >> 8), byte(value)}
+	}
+	windowUpdate := func(increment uint32) []byte {
+		return []byte{byte(increment >> 24), byte(increment >> 16), byte(increment >> 8), byte(increment)}
+	}
+
+	tests := []struct {
+		name   string
+		frame  []byte
+		goAway bool
+		code   ErrCode
+	}{
+		{"SETTINGS length not a multiple of 6", rawFrame(FrameSettings, 0, 0, make([]byte, 5)), true, ErrCodeFrameSize},
+		{"SETTINGS ACK with payload", rawFrame(FrameSettings, FlagAck, 0, make([]byte, 6)), true, ErrCodeFrameSize},
+		{"SETTINGS on a stream", rawFrame(FrameSettings, 0, 1, nil), true, ErrCodeProtocol},
+		{"SETTINGS_ENABLE_PUSH above 1", rawFrame(FrameSettings, 0, 0, setting(SettingEnablePush, 2)), true, ErrCodeProtocol},
+		{"SETTINGS_INITIAL_WINDOW_SIZE above the maximum", rawFrame(FrameSettings, 0, 0, setting(SettingInitialWindowSize, 1<<31)), true, ErrCodeFlowControl},
+		{"SETTINGS_MAX_FRAME_SIZE below the minimum", rawFrame(FrameSettings, 0, 0, setting(SettingMaxFrameSize, 1<<14-1)), true, ErrCodeProtocol},
+		{"PING length not 8", rawFrame(FramePing, 0, 0, make([]byte, 7)), true, ErrCodeFrameSize},
+		{"PING on a stream", rawFrame(FramePing, 0, 1, make([]byte, 8)), true, ErrCodeProtocol},
+		{"WINDOW_UPDATE length not 4", rawFrame(FrameWindowUpdate, 0, 0, make([]byte, 3)), true, ErrCodeFrameSize},
+		{"WINDOW_UPDATE of 0 on the connection", rawFrame(FrameWindowUpdate, 0, 0, windowUpdate(0)), true, ErrCodeProtocol},
+		{"WINDOW_UPDATE overflowing the connection window", rawFrame(FrameWindowUpdate, 0, 0, windowUpdate(1<<31-1)), true, ErrCodeFlowControl},
+		{"WINDOW_UPDATE of 0 on a stream", rawFrame(FrameWindowUpdate, 0, 1, windowUpdate(0)), false, ErrCodeProtocol},
+		{"WINDOW_UPDATE overflowing a stream window", rawFrame(FrameWindowUpdate, 0, 1, windowUpdate(1<<31-1)), false, ErrCodeFlowControl},
+		{"DATA on stream 0", rawFrame(FrameData, 0, 0, make([]byte, 1)), true, ErrCodeProtocol},
+		{"DATA on an idle stream", rawFrame(FrameData, 0, 3, make([]byte, 1)), true, ErrCodeProtocol},
+		{"DATA exceeding the max frame size", rawFrame(FrameData, 0, 1, make([]byte, defaultMaxFrameSize+1)), false, ErrCodeFrameSize},
+		{"HEADERS exceeding the max frame size", rawFrame(FrameHeaders, FlagEndHeaders, 3, make([]byte, defaultMaxFrameSize+1)), true, ErrCodeFrameSize},
+		{"RST_STREAM length not 4", rawFrame(FrameRSTStream, 0, 1, make([]byte, 3)), true, ErrCodeFrameSize},
+		{"PRIORITY length not 5", rawFrame(FramePriority, 0, 1, make([]byte, 4)), false, ErrCodeFrameSize},
+		{"CONTINUATION without HEADERS", rawFrame(FrameContinuation, FlagEndHeaders, 1, nil), true, ErrCodeProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newRawPeer(t, nil)
+			p.openStream(1)
+			// The Conn may stop reading before the end of the frame.
+			go p.write(tt.frame)
+			if tt.goAway {
+				p.expectGoAway(tt.code)
+			} else {
+				p.expectReset(1, tt.code)
+			}
+		})
+	}
+}
+
+func TestMisroutedFrames(t *testing.T) {
+	priority := []byte{0, 0, 0, 0, 15}
+	tests := []struct {
+		frameType FrameType
+		flags     Flags
+		streamID  uint32
+		payload   []byte
+	}{
+		{FrameData, 0, 0, []byte("a")},
+		{FrameHeaders, FlagEndHeaders, 0, []byte{0x82}},
+		{FramePriority, 0, 0, priority},
+		{FrameRSTStream, 0, 0, make([]byte, 4)},
+		{FramePushPromise, FlagEndHeaders, 0, make([]byte, 4)},
+		{FrameSettings, 0, 1, nil},
+		{FramePing, 0, 1, make([]byte, 8)},
+		{FrameGoAway, 0, 1, make([]byte, 8)},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s on stream %d", tt.frameType, tt.streamID), func(t *testing.T) {
+			p := newRawPeer(t, nil)
+			p.openStream(1)
+			go p.write(rawFrame(tt.frameType, tt.flags, tt.streamID, tt.payload))
+			goAway := p.expectGoAway(ErrCodeProtocol)
+
+			want := fmt.Sprintf("%s frame on stream %d", tt.frameType, tt.streamID)
+			if !strings.Contains(string(goAway.DebugData), want) {
+				t.Fatalf("expected debug data %q, got %q", want, goAway.DebugData)
+			}
+		})
+	}
+}
+
+func TestSelfDependency(t *testing.T) {
+	newStreams := 0
+	p := newRawPeer(t, &Config{
+		OnNewStream: func(streamID uint32, header Header) error {
+			newStreams++
+			return nil
+		},
+	})
+	p.openStream(1)
+
+	p.writeFrame(&PriorityFrame{1, Priority{StreamDependency: 1, Weight: 15}})
+	p.expectReset(1, ErrCodeProtocol)
+
+	// A HEADERS frame opening a stream is reset without being processed,
+	// its header block still being decoded.
+	header := Header{":method": {"GET"}, ":scheme": {"https"}, ":path": {"/"}, "x-test": {"a"}}
+	p.writeFrame(&HeadersFrame{StreamID: 7, Header: header, Priority: Priority{StreamDependency: 7, Weight: 15}})
+	p.expectReset(7, ErrCodeProtocol)
+	if newStreams != 1 {
+		t.Fatalf("expected 1 stream processed, got %d", newStreams)
+	}
+
+	p.writeFrame(&HeadersFrame{StreamID: 9, Header: header, Priority: Priority{Weight: 100}})
+	p.write(rawFrame(FramePing, 0, 0, []byte("pingpong")))
+	if v, ok := p.readFrame().(*PingFrame); !ok || !v.Ack {
+		t.Fatalf("expected PING ACK, got %v", v)
+	}
+	if priority, ok := p.conn.StreamPriority(9); !ok || priority.Weight != 100 {
+		t.Fatalf("expected stream 9 with weight 100, got %v, %v", priority, ok)
+	}
+}
+
+func TestHalfClosedRemote(t *testing.T) {
+	p := newRawPeer(t, nil)
+	header := Header{":method": {"GET"}, ":scheme": {"https"}, ":path": {"/"}}
+	p.writeFrame(&HeadersFrame{StreamID: 1, Header: header, EndStream: true})
+
+	// WINDOW_UPDATE, PRIORITY and RST_STREAM frames are allowed.
+	expectPing := func() {
+		t.Helper()
+		p.write(rawFrame(FramePing, 0, 0, []byte("pingpong")))
+		if v, ok := p.readFrame().(*PingFrame); !ok || !v.Ack {
+			t.Fatalf("expected PING ACK, got %v", v)
+		}
+	}
+	p.write(rawFrame(FrameWindowUpdate, 0, 1, []byte{0, 0, 0, 1}))
+	p.write(rawFrame(FramePriority, 0, 1, []byte{0, 0, 0, 0, 15}))
+	expectPing()
+
+	// Other frames reset the stream only.
+	p.write(rawFrame(FrameData, FlagEndStream, 1, []byte("a")))
+	p.expectReset(1, ErrCodeStreamClosed)
+	expectPing()
+
+	// WINDOW_UPDATE frames on idle streams are not.
+	p.write(rawFrame(FrameWindowUpdate, 0, 5, []byte{0, 0, 0, 1}))
+	p.expectGoAway(ErrCodeProtocol)
+}
+
+func TestStreamTiming(t *testing.T) {
+	states := make(chan StreamState, 8)
+	p := newRawPeer(t, &Config{OnStateChange: func(streamID uint32, from, to StreamState) {
+		states <- to
+	}})
+	expectState := func(state StreamState) {
+		t.Helper()
+		select {
+		case to := <-states:
+			if to != state {
+				t.Fatalf("expected state %s, got %s", state, to)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for state %s", state)
+		}
+	}
+
+	if _, ok := p.conn.StreamTiming(1); ok {
+		t.Fatal("expected no timing of an idle stream")
+	}
+	p.openStream(1)
+	expectState(StateOpen)
+	timing, ok := p.conn.StreamTiming(1)
+	if !ok || timing.Opened.IsZero() || !timing.FirstData.IsZero() || !timing.Closed.IsZero() {
+		t.Fatalf("unexpected timing of an open stream %+v", timing)
+	}
+
+	p.write(rawFrame(FrameData, FlagEndStream, 1, []byte("a")))
+	expectState(StateHalfClosedRemote)
+	if err := p.conn.WriteFrame(&HeadersFrame{StreamID: 1, Header: Header{":status": {"204"}}, EndStream: true}); err != nil {
+		t.Fatal(err)
+	}
+	expectState(StateClosed)
+
+	// The timing is kept once the stream is closed.
+	timing, ok = p.conn.StreamTiming(1)
+	if !ok || timing.FirstData.Before(timing.Opened) || timing.Closed.Before(timing.FirstData) || timing.Closed.IsZero() {
+		t.Fatalf("unexpected timing of a closed stream %+v", timing)
+	}
+}
+
+func TestOnNewStream(t *testing.T) {
+	opened := make(chan uint32, 3)
+	p := newRawPeer(t, &Config{OnStateChange: func(streamID uint32, from, to StreamState) {
+		if from == StateIdle {
+			opened <- streamID
+		}
+	}, OnNewStream: func(streamID uint32, header Header) error {
+		switch header.Path() {
+		case "/refused":
+			return errors.New("refused")
+		case "/calm":
+			return StreamError{errors.New("calm down"), ErrCodeEnhanceYourCalm, streamID, ReasonProtocol}
+		}
+		return nil
+	}})
+	request := func(streamID uint32, path string) {
+		header := Header{":method": {"GET"}, ":scheme": {"https"}, ":path": {path}}
+		p.writeFrame(&HeadersFrame{StreamID: streamID, Header: header, EndStream: true})
+	}
+
+	request(1, "/refused")
+	p.expectReset(1, ErrCodeRefusedStream)
+	request(3, "/calm")
+	p.expectReset(3, ErrCodeEnhanceYourCalm)
+
+	// The accepted streams are processed.
+	request(5, "/")
+	for streamID := range opened {
+		if streamID == 5 {
+			break
+		}
+	}
+	if err := p.conn.WriteFrame(&HeadersFrame{StreamID: 5, Header: Header{":status": {"204"}}, EndStream: true}); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := p.readFrame().(*HeadersFrame); !ok || v.StreamID != 5 {
+		t.Fatalf("expected HEADERS frame of stream 5, got %v", v)
+	}
+}
+
+func TestExtendedConnect(t *testing.T) {
+	header := Header{":method": {"CONNECT"}, ":protocol": {"websocket"}, ":scheme": {"https"}, ":authority": {"example.com"}, ":path": {"/chat"}}
+
+	// The :protocol pseudo-header field is malformed unless enabled.
+	p := newRawPeer(t, nil)
+	p.writeFrame(&HeadersFrame{StreamID: 1, Header: header})
+	p.expectReset(1, ErrCodeProtocol)
+
+	var settings Settings
+	settings.SetConnectProtocolEnabled(true)
+	received := make(chan Header, 1)
+	p = newRawPeer(t, &Config{InitialSettings: settings, OnNewStream: func(streamID uint32, header Header) error {
+		received <- header.Clone()
+		return nil
+	}})
+	p.writeFrame(&HeadersFrame{StreamID: 1, Header: header})
+	h := <-received
+	if h.Protocol() != "websocket" {
+		t.Fatalf("unexpected :protocol %q", h.Protocol())
+	}
+	req, err := headerToRequest(h, p.conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != "CONNECT" || req.URL.Path != "/chat" || req.Header.Get(":protocol") != "websocket" {
+		t.Fatalf("unexpected request %s %s with :protocol %q", req.Method, req.URL, req.Header.Get(":protocol"))
+	}
+
+	// Clients do not send it unless the server enabled it.
+	client, server := pipe(true, false, false)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+	if err := client.WriteFrame(&HeadersFrame{StreamID: 1, Header: header}); err == nil {
+		t.Fatal("expected error writing :protocol not enabled by the server")
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	var settings Settings
+	settings.SetConnectProtocolEnabled(true)
+
+	headers := make(chan Header, 1)
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true}, nil)
+	server := ServerConn(s, &Config{
+		InitialSettings: settings,
+		WebSocketHandler: func(header Header, conn net.Conn) {
+			headers <- header
+			io.Copy(conn, conn)
+			conn.Close()
+		},
+	})
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	for _, conn := range []*Conn{client, server} {
+		go func(conn *Conn) {
+			for {
+				if _, err := conn.ReadFrame(); err != nil {
+					if _, ok := err.(StreamError); !ok {
+						return
+					}
+				}
+			}
+		}(conn)
+	}
+
+	if _, err := server.DialWebSocket("/chat", nil); err == nil {
+		t.Fatal("expected error dialing a WebSocket from the server")
+	}
+
+	ws, err := client.DialWebSocket("/chat", Header{":authority": {"example.com"}})
+	if err != nil {
+		t.Fatalf("error dialing WebSocket: %s", err)
+	}
+	h := <-headers
+	if h.Method() != "CONNECT" || h.Protocol() != "websocket" || h.Scheme() != "http" || h.Authority() != "example.com" || h.Path() != "/chat" || h.Get("sec-websocket-version") != "13" {
+		t.Fatalf("unexpected request header %v", h)
+	}
+
+	// The bytes written are echoed.
+	if _, err = ws.Write([]byte("hello")); err != nil {
+		t.Fatalf("error writing: %s", err)
+	}
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(ws, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("expected echo %q, got %q, %v", "hello", buf, err)
+	}
+
+	// The deadlines fail the reads and writes.
+	ws.SetDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err = ws.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected read deadline exceeded, got %v", err)
+	}
+	if _, err = ws.Write([]byte("late")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected write deadline exceeded, got %v", err)
+	}
+	ws.SetDeadline(time.Time{})
+
+	if _, err = ws.Write([]byte("bye")); err != nil {
+		t.Fatalf("error writing: %s", err)
+	}
+	if _, err = io.ReadFull(ws, buf[:3]); err != nil || string(buf[:3]) != "bye" {
+		t.Fatalf("expected echo %q, got %q, %v", "bye", buf[:3], err)
+	}
+
+	// Ending the stream ends the one of the server.
+	if err = ws.(*streamConn).tunnel.Close(); err != nil {
+		t.Fatalf("error closing: %s", err)
+	}
+	if _, err = ws.Read(buf); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	ws.Close()
+
+	// Clients do not dial unless the server enabled it.
+	client2, server2 := pipe(true, false, false)
+	defer client2.CloseTimeout(0)
+	defer server2.CloseTimeout(0)
+	if _, err = client2.DialWebSocket("/chat", nil); err == nil {
+		t.Fatal("expected error dialing a WebSocket not enabled by the server")
+	}
+}
+
+func TestCloseSend(t *testing.T) {
+	client, server := pipe(true, false, false)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	header := Header{":method": {"POST"}, ":scheme": {"https"}, ":path": {"/"}}
+	if err := client.WriteFrame(&HeadersFrame{StreamID: 3, Header: header}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if frame, err := server.ReadFrame(); err != nil || frame.Type() != FrameHeaders {
+		t.Fatalf("expected HEADERS frame, got %v, %v", frame, err)
+	}
+
+	if err := client.CloseSend(3); err != nil {
+		t.Fatalf("error closing stream: %s", err)
+	}
+	if frame, err := server.ReadFrame(); err != nil || frame.Type() != FrameData || !frame.EndOfStream() {
+		t.Fatalf("expected DATA frame ending the stream, got %v, %v", frame, err)
+	}
+	if err := client.WriteFrame(&DataFrame{StreamID: 3, Data: strings.NewReader("a"), DataLen: 1}); err == nil {
+		t.Fatal("expected error writing after CloseSend")
+	}
+
+	// The response is still read.
+	if err := server.WriteFrame(&HeadersFrame{StreamID: 3, Header: Header{":status": {"200"}}}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if frame, err := client.ReadFrame(); err != nil || frame.Type() != FrameHeaders {
+		t.Fatalf("expected HEADERS frame, got %v, %v", frame, err)
+	}
+	if err := server.WriteFrame(&DataFrame{StreamID: 3, Data: strings.NewReader("body"), DataLen: 4, EndStream: true}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	frame, err := client.ReadFrame()
+	if err != nil || frame.Type() != FrameData || !frame.EndOfStream() {
+		t.Fatalf("expected DATA frame ending the stream, got %v, %v", frame, err)
+	}
+	if b, _ := io.ReadAll(frame.(*DataFrame).Data); string(b) != "body" {
+		t.Fatalf("unexpected body %q", b)
+	}
+}
+
+func TestReadTimeouts(t *testing.T) {
+	opened := make(chan uint32, 2)
+	p := newRawPeer(t, &Config{
+		ReadHeaderTimeout: 50 * time.Millisecond,
+		ReadBodyTimeout:   50 * time.Millisecond,
+		OnStateChange: func(streamID uint32, from, to StreamState) {
+			if from == StateIdle {
+				opened <- streamID
+			}
+		},
+	})
+
+	// A body waiting for DATA frames resets the stream.
+	p.openStream(1)
+	<-opened
+	body, err := p.conn.StreamBody(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := body.Read(make([]byte, 1)); err == nil || err.(StreamError).Err != ErrReadBodyTimeout {
+		t.Fatalf("expected stream error with %v, got %v", ErrReadBodyTimeout, err)
+	}
+	p.expectReset(1, ErrCodeCancel)
+
+	// A header block not completed in time closes the connection.
+	p.write(rawFrame(FrameHeaders, 0, 3, []byte{0x82}))
+	select {
+	case <-p.conn.Done():
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the connection to be closed")
+	}
+	if err := p.conn.Err(); err != ErrReadHeaderTimeout {
+		t.Fatalf("expected %v, got %v", ErrReadHeaderTimeout, err)
+	}
+}
+
+func TestResetUnreadData(t *testing.T) {
+	opened := make(chan uint32, 1)
+	p := newRawPeer(t, &Config{
+		OnStateChange: func(streamID uint32, from, to StreamState) {
+			if from == StateIdle {
+				opened <- streamID
+			}
+		},
+	})
+
+	const n = 100
+	data := make([]byte, 1000)
+	for i := uint32(0); i < n; i++ {
+		id := 2*i + 1
+		p.openStream(id)
+		<-opened
+		if i%4 < 2 {
+			if _, err := p.conn.StreamBody(id); err != nil {
+				t.Fatal(err)
+			}
+		}
+		p.writeFrame(&DataFrame{StreamID: id, DataLen: len(data), Data: bytes.NewReader(data)})
+		for p.conn.RecvWindow(id) == p.conn.InitialRecvWindow(id) {
+			time.Sleep(time.Millisecond)
+		}
+		// The buffered and unread bytes are returned to the
+		// connection window either side resets the stream.
+		if i%2 == 0 {
+			p.writeFrame(&RSTStreamFrame{id, ErrCodeCancel})
+		} else if err := p.conn.WriteFrame(&RSTStreamFrame{id, ErrCodeCancel}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.openStream(2*n + 1)
+	<-opened
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		consumed := p.conn.connStream.recvFlow.consumedBytes()
+		if consumed == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection window not restored: %d bytes consumed", consumed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.conn.Closed() {
+		t.Fatalf("connection closed: %v", p.conn.Err())
+	}
+
+	// Nor are the bytes read from a DATA frame returned by ReadFrame
+	// returned twice, by the reset and after reading the next frame.
+	client, server := pipe(true, false, false)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	header := Header{":method": {"POST"}, ":scheme": {"https"}, ":path": {"/"}}
+	go func() {
+		client.WriteFrame(&HeadersFrame{StreamID: 3, Header: header})
+		client.WriteFrame(&DataFrame{StreamID: 3, DataLen: len(data), Data: bytes.NewReader(data)})
+	}()
+	if frame, err := server.ReadFrame(); err != nil || frame.Type() != FrameHeaders {
+		t.Fatalf("expected HEADERS frame, got %v, %v", frame, err)
+	}
+	frame, err := server.ReadFrame()
+	if err != nil || frame.Type() != FrameData {
+		t.Fatalf("expected DATA frame, got %v, %v", frame, err)
+	}
+	if _, err := frame.(*DataFrame).Data.Read(make([]byte, len(data)/2)); err != nil {
+		t.Fatalf("error reading data: %s", err)
+	}
+	if err := server.WriteFrame(&RSTStreamFrame{3, ErrCodeCancel}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	go client.WriteFrame(&HeadersFrame{StreamID: 5, Header: header})
+	if frame, err := server.ReadFrame(); err != nil || frame.Type() != FrameHeaders {
+		t.Fatalf("expected HEADERS frame, got %v, %v", frame, err)
+	}
+	if consumed := server.connStream.recvFlow.consumedBytes(); consumed != 0 {
+		t.Fatalf("connection window not restored: %d bytes consumed", consumed)
+	}
+}
+
+func TestRTTAndBandwidth(t *testing.T) {
+	client, server := pipe(true, false, false)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				if _, ok := err.(StreamError); !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	// The server sends a body slowly on each stream.
+	go func() {
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				if _, ok := err.(StreamError); ok {
+					continue
+				}
+				return
+			}
+			if v, ok := frame.(*HeadersFrame); ok {
+				go func() {
+					server.WriteFrame(&HeadersFrame{StreamID: v.StreamID, Header: Header{":status": {"200"}}})
+					for i := 0; i < 20; i++ {
+						time.Sleep(5 * time.Millisecond)
+						server.WriteFrame(&DataFrame{StreamID: v.StreamID, Data: bytes.NewReader(make([]byte, 1000)), DataLen: 1000, EndStream: i == 19})
+					}
+				}()
+			}
+		}
+	}()
+
+	if rtt := client.RTT(); rtt != 0 {
+		t.Fatalf("expected no RTT before any PING, got %s", rtt)
+	}
+	if _, err := client.Ping(context.Background()); err != nil {
+		t.Fatalf("error pinging: %s", err)
+	}
+	if rtt := client.RTT(); rtt <= 0 {
+		t.Fatalf("expected RTT after PING, got %s", rtt)
+	}
+
+	header := Header{":method": {"GET"}, ":scheme": {"https"}, ":path": {"/"}}
+	s, err := client.OpenStream(header)
+	if err != nil {
+		t.Fatalf("error opening stream: %s", err)
+	}
+	if err = s.CloseSend(); err != nil {
+		t.Fatalf("error closing stream: %s", err)
+	}
+
+	// The bandwidth is sampled while the body is read.
+	var rate int64
+	buf := make([]byte, 1000)
+	for {
+		if _, err = s.Read(buf); err != nil {
+			break
+		}
+		if v, ok := client.StreamBandwidth(s.ID()); ok && v > 0 {
+			rate = v
+		}
+	}
+	if err != io.EOF {
+		t.Fatalf("error reading stream: %s", err)
+	}
+	if rate <= 0 {
+		t.Fatal("expected a bandwidth estimate of the stream")
+	}
+	if v, _ := client.StreamBandwidth(0); v <= 0 {
+		t.Fatal("expected a bandwidth estimate of the connection")
+	}
+	if _, ok := client.StreamBandwidth(99); ok {
+		t.Fatal("expected no bandwidth estimate of a missing stream")
+	}
+}
+
+func TestEmptyEndStreamData(t *testing.T) {
+	client, server := pipe(true, false, false)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				if _, ok := err.(StreamError); !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	streamID, err := client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error generating stream id: %s", err)
+	}
+	header := Header{":method": {"POST"}, ":scheme": {"https"}, ":path": {"/"}}
+	if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: header}); err != nil {
+		t.Fatalf("error writing headers: %s", err)
+	}
+	if _, err = server.ReadFrame(); err != nil {
+		t.Fatalf("error reading headers: %s", err)
+	}
+
+	// The body ends with a DATA frame without payload.
+	go client.CloseSend(streamID)
+	frame, err := server.ReadFrame()
+	if err != nil {
+		t.Fatalf("error reading data: %s", err)
+	}
+	if v, ok := frame.(*DataFrame); !ok || v.DataLen != 0 || !v.EndStream {
+		t.Fatalf("expected empty DATA frame with END_STREAM, got %v", frame)
+	}
+
+	// The stream is half-closed before the next frame is read,
+	// and the flow-control windows are left as they are.
+	stream := server.stream(streamID)
+	if stream == nil {
+		t.Fatalf("stream %d closed", streamID)
+	}
+	if state := StreamState(atomic.LoadInt32((*int32)(&stream.state))); state != StateHalfClosedRemote {
+		t.Fatalf("expected stream state %s, got %s", StateHalfClosedRemote, state)
+	}
+	if n := server.connStream.recvFlow.consumedBytes(); n != 0 {
+		t.Fatalf("expected no bytes consumed, got %d", n)
+	}
+
+	if err = server.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{":status": {"200"}}, EndStream: true}); err != nil {
+		t.Fatalf("error writing response: %s", err)
+	}
+	if stream := server.stream(streamID); stream != nil {
+		t.Fatalf("expected stream %d to be closed", streamID)
+	}
+}
+
+func TestStreamWriteDelay(t *testing.T) {
+	client, server := pipe(true, false, false)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	frames := make(chan *DataFrame, 10)
+	go func() {
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				if _, ok := err.(StreamError); ok {
+					continue
+				}
+				return
+			}
+			if v, ok := frame.(*DataFrame); ok {
+				b, _ := io.ReadAll(v.Data)
+				v.Data = bytes.NewReader(b)
+				v.DataLen = len(b)
+				frames <- v
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				if _, ok := err.(StreamError); !ok {
+					return
+				}
+			}
+		}
+	}()
+	expect := func(data string, endStream bool) {
+		t.Helper()
+		select {
+		case v := <-frames:
+			b, _ := io.ReadAll(v.Data)
+			if string(b) != data || v.EndStream != endStream {
+				t.Fatalf("expected DATA %q (END_STREAM %v), got %q (END_STREAM %v)", data, endStream, b, v.EndStream)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected DATA %q", data)
+		}
+	}
+
+	header := Header{":method": {"POST"}, ":scheme": {"https"}, ":path": {"/"}}
+	s, err := client.OpenStream(header)
+	if err != nil {
+		t.Fatalf("error opening stream: %s", err)
+	}
+
+	// The small writes are coalesced until flushed.
+	s.SetWriteDelay(time.Hour)
+	for i := 0; i < 10; i++ {
+		if _, err = s.Write([]byte("ab")); err != nil {
+			t.Fatalf("error writing: %s", err)
+		}
+	}
+	select {
+	case v := <-frames:
+		t.Fatalf("unexpected DATA frame of %d bytes before flush", v.DataLen)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err = s.Flush(); err != nil {
+		t.Fatalf("error flushing: %s", err)
+	}
+	expect(strings.Repeat("ab", 10), false)
+
+	// A write filling a frame is sent at once.
+	big := strings.Repeat("x", int(client.remoteSettings().MaxFrameSize()))
+	if _, err = s.Write([]byte(big)); err != nil {
+		t.Fatalf("error writing: %s", err)
+	}
+	expect(big, false)
+
+	// The held bytes are sent once the delay elapses.
+	s.SetWriteDelay(10 * time.Millisecond)
+	if _, err = s.Write([]byte("cd")); err != nil {
+		t.Fatalf("error writing: %s", err)
+	}
+	expect("cd", false)
+
+	// The held bytes are sent with the END_STREAM flag.
+	s.SetWriteDelay(time.Hour)
+	if _, err = s.Write([]byte("ef")); err != nil {
+		t.Fatalf("error writing: %s", err)
+	}
+	if err = s.CloseSend(); err != nil {
+		t.Fatalf("error closing stream: %s", err)
+	}
+	expect("ef", true)
+}
+
+func TestStopAccepting(t *testing.T) {
+	opened := make(chan uint32, 2)
+	p := newRawPeer(t, &Config{OnStateChange: func(streamID uint32, from, to StreamState) {
+		if from == StateIdle {
+			opened <- streamID
+		}
+	}})
+	p.openStream(1)
+	<-opened
+
+	client, _ := pipe(true, false, false)
+	defer client.CloseTimeout(0)
+	if err := client.StopAccepting(); err == nil {
+		t.Fatal("expected error stopping a client from accepting streams")
+	}
+
+	// The last stream processed is sent, and the new ones are refused.
+	if err := p.conn.StopAccepting(); err != nil {
+		t.Fatalf("error stopping accepting streams: %s", err)
+	}
+	if v := p.expectGoAway(ErrCodeNo); v.LastStreamID != 1 {
+		t.Fatalf("expected GOAWAY with last stream 1, got %d", v.LastStreamID)
+	}
+	p.openStream(3)
+	p.expectReset(3, ErrCodeRefusedStream)
+
+	// The active stream is still served, and the connection
+	// is not closed once it is done.
+	if err := p.conn.WriteFrame(&HeadersFrame{StreamID: 1, Header: Header{":status": {"200"}}, EndStream: true}); err != nil {
+		t.Fatalf("error writing response: %s", err)
+	}
+	p.writeFrame(&DataFrame{StreamID: 1, EndStream: true})
+	select {
+	case <-p.conn.Done():
+		t.Fatal("expected the connection to be kept open")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := p.conn.NumActiveStreams(); n != 0 {
+		t.Fatalf("expected no active stream, got %d", n)
+	}
+
+	// Shutting down closes it at once, with the same last stream.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() { errCh <- p.conn.Shutdown(ctx) }()
+	if v := p.expectGoAway(ErrCodeNo); v.LastStreamID != 1 {
+		t.Fatalf("expected GOAWAY with last stream 1, got %d", v.LastStreamID)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("error shutting down: %s", err)
+	}
+}
+
+func TestConnDeadlines(t *testing.T) {
+	opened := make(chan uint32, 1)
+	p := newRawPeer(t, &Config{OnStateChange: func(streamID uint32, from, to StreamState) {
+		if from == StateIdle {
+			opened <- streamID
+		}
+	}})
+	var settings Settings
+	settings.SetInitialWindowSize(0)
+	p.writeFrame(&SettingsFrame{Settings: settings})
+	p.openStream(1)
+	<-opened
+	<-p.conn.flush()
+
+	// A write waiting for the flow-control window fails once the write
+	// deadline is exceeded, as do the next writes, until it is cleared.
+	if err := p.conn.WriteFrame(&HeadersFrame{StreamID: 1, Header: Header{":status": {"200"}}}); err != nil {
+		t.Fatalf("error writing response: %s", err)
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	data := []byte("hello")
+	if err := p.conn.WriteFrame(&DataFrame{StreamID: 1, Data: bytes.NewReader(data), DataLen: len(data)}); err != os.ErrDeadlineExceeded {
+		t.Fatalf("expected deadline exceeded writing DATA, got %v", err)
+	}
+	if err := p.conn.WriteFrame(&PingFrame{}); err != os.ErrDeadlineExceeded {
+		t.Fatalf("expected deadline exceeded writing PING, got %v", err)
+	}
+	p.conn.SetWriteDeadline(time.Time{})
+	if err := p.conn.WriteFrame(&PingFrame{}); err != nil {
+		t.Fatalf("error writing PING: %s", err)
+	}
+	for {
+		if _, ok := p.readFrame().(*PingFrame); ok {
+			break
+		}
+	}
+
+	// The connection is closed with a GOAWAY frame
+	// once the read deadline is exceeded.
+	p.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	p.expectGoAway(ErrCodeNo)
+	select {
+	case <-p.conn.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the connection to be closed")
+	}
+	if err := p.conn.Err(); err != os.ErrDeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if err := p.conn.SetDeadline(time.Now()); err != ErrClosed {
+		t.Fatalf("expected ErrClosed setting deadline, got %v", err)
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+	defer func(delay time.Duration) { shutdownDelay = delay }(shutdownDelay)
+	shutdownDelay = 10 * time.Millisecond
+
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true, MaxLifetime: 100 * time.Millisecond}, nil)
+	server := ServerConn(s, &Config{})
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	frames := make(chan Frame, 10)
+	for _, conn := range []*Conn{client, server} {
+		go func(conn *Conn) {
+			for {
+				frame, err := conn.ReadFrame()
+				if err != nil {
+					if _, ok := err.(StreamError); ok {
+						continue
+					}
+					return
+				}
+				if conn == server {
+					frames <- frame
+				}
+			}
+		}(conn)
+	}
+
+	streamID, err := client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error generating stream id: %s", err)
+	}
+	header := Header{":method": {"GET"}, ":scheme": {"https"}, ":path": {"/"}}
+	if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: header, EndStream: true}); err != nil {
+		t.Fatalf("error writing headers: %s", err)
+	}
+	if !client.CanOpenStream() {
+		t.Fatal("expected streams to be opened before the lifetime elapses")
+	}
+
+	// Once the lifetime elapses, the client sends a GOAWAY frame
+	// and no longer opens streams.
+	timeout := time.After(time.Second)
+	for {
+		var frame Frame
+		select {
+		case frame = <-frames:
+		case <-timeout:
+			t.Fatal("expected GOAWAY frame")
+		}
+		if v, ok := frame.(*GoAwayFrame); ok {
+			if v.ErrCode != ErrCodeNo {
+				t.Fatalf("expected GOAWAY with NO_ERROR, got %s", v.ErrCode)
+			}
+			break
+		}
+	}
+	if client.CanOpenStream() {
+		t.Fatal("expected no stream to be opened once the lifetime elapsed")
+	}
+
+	// The connection closes once the active stream is done.
+	select {
+	case <-client.Done():
+		t.Fatal("expected the active stream to be drained")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err = server.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{":status": {"200"}}, EndStream: true}); err != nil {
+		t.Fatalf("error writing response: %s", err)
+	}
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+func TestStreamIDExhaustion(t *testing.T) {
+	client, server := pipe(true, false, false)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				if _, ok := err.(StreamError); !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	// The last stream ID of the client is used.
+	client.nextStreamID = maxStreamID
+	streamID, err := client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error generating stream id: %s", err)
+	}
+	if streamID != maxStreamID {
+		t.Fatalf("expected stream id %d, got %d", uint32(maxStreamID), streamID)
+	}
+	header := Header{":method": {"GET"}, ":scheme": {"https"}, ":path": {"/"}}
+	if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: header, EndStream: true}); err != nil {
+		t.Fatalf("error writing headers: %s", err)
+	}
+	if frame, err := server.ReadFrame(); err != nil {
+		t.Fatalf("error reading headers: %s", err)
+	} else if frame.Stream() != maxStreamID {
+		t.Fatalf("expected headers on stream %d, got %v", uint32(maxStreamID), frame)
+	}
+	if client.CanOpenStream() {
+		t.Fatal("expected no stream to be opened once the stream ids are used")
+	}
+
+	// The next stream ID is unavailable, and the connection is retired
+	// with a GOAWAY frame, sent once.
+	for i := 0; i < 2; i++ {
+		if _, err = client.NextStreamID(); err != ErrStreamIDsExhausted {
+			t.Fatalf("expected ErrStreamIDsExhausted, got %v", err)
+		}
+	}
+	frame, err := server.ReadFrame()
+	if err != nil {
+		t.Fatalf("error reading goaway: %s", err)
+	}
+	if v, ok := frame.(*GoAwayFrame); !ok || v.ErrCode != ErrCodeNo {
+		t.Fatalf("expected GOAWAY with NO_ERROR, got %v", frame)
+	}
+
+	// The stream opened before is still served.
+	if err = server.WriteFrame(&HeadersFrame{StreamID: maxStreamID, Header: Header{":status": {"200"}}, EndStream: true}); err != nil {
+		t.Fatalf("error writing response: %s", err)
+	}
+}
+
+func TestOpenStream(t *testing.T) {
+	client, server := pipe(true, false, false)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	if _, err := server.OpenStream(Header{}); err == nil {
+		t.Fatal("expected error opening a stream from the server")
+	}
+
+	// The server echoes the DATA frames of the streams.
+	go func() {
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				if _, ok := err.(StreamError); ok {
+					continue
+				}
+				return
+			}
+			switch v := frame.(type) {
+			case *HeadersFrame:
+				server.WriteFrame(&HeadersFrame{StreamID: v.StreamID, Header: Header{":status": {"200"}}})
+			case *DataFrame:
+				b, _ := io.ReadAll(v.Data)
+				server.WriteFrame(&DataFrame{StreamID: v.StreamID, Data: bytes.NewReader(b), DataLen: len(b), EndStream: v.EndStream})
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				if _, ok := err.(StreamError); !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	settings := Settings{}
+	settings.SetMaxConcurrentStreams(1)
+	if err := server.UpdateSettings(settings); err != nil {
+		t.Fatalf("error updating settings: %s", err)
+	}
+
+	header := Header{":method": {"POST"}, ":scheme": {"https"}, ":path": {"/echo"}}
+	s, err := client.OpenStream(header)
+	if err != nil {
+		t.Fatalf("error opening stream: %s", err)
+	}
+	if s.ID() != 3 {
+		t.Fatalf("expected stream 3, got %d", s.ID())
+	}
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatalf("error writing: %s", err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(s, b); err != nil || string(b) != "hello" {
+		t.Fatalf("expected %q, got %q, %v", "hello", b, err)
+	}
+
+	// The streams are limited by the setting of the server.
+	if _, err := client.OpenStream(header); err != ErrStreamLimit {
+		t.Fatalf("expected %v, got %v", ErrStreamLimit, err)
+	}
+
+	if err := s.Reset(ErrCodeCancel); err != nil {
+		t.Fatalf("error resetting stream: %s", err)
+	}
+	if _, err := s.Read(b); err == nil || err.(StreamError).ErrCode != ErrCodeCancel {
+		t.Fatalf("expected stream error with CANCEL, got %v", err)
+	}
+
+	s, err = client.OpenStream(header)
+	if err != nil {
+		t.Fatalf("error opening stream: %s", err)
+	}
+	if s.ID() != 5 {
+		t.Fatalf("expected stream 5, got %d", s.ID())
+	}
+	if _, err := s.Write([]byte("bye")); err != nil {
+		t.Fatalf("error writing: %s", err)
+	}
+	if err := s.CloseSend(); err != nil {
+		t.Fatalf("error closing stream: %s", err)
+	}
+	if b, err := io.ReadAll(s); err != nil || string(b) != "bye" {
+		t.Fatalf("expected %q, got %q, %v", "bye", b, err)
+	}
+	if _, err := s.Write([]byte("more")); err == nil {
+		t.Fatal("expected error writing after CloseSend")
+	}
+}
+
+func TestAcceptStream(t *testing.T) {
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true}, nil)
+	server := ServerConn(s, &Config{AcceptStreams: true})
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	if _, err := client.AcceptStream(); err == nil {
+		t.Fatal("expected error accepting a stream from the client")
+	}
+
+	frames := make(chan Frame, 10)
+	for _, conn := range []*Conn{client, server} {
+		go func(conn *Conn) {
+			for {
+				frame, err := conn.ReadFrame()
+				if err != nil {
+					if _, ok := err.(StreamError); ok {
+						continue
+					}
+					return
+				}
+				if conn == server {
+					frames <- frame
+				}
+			}
+		}(conn)
+	}
+
+	// The accepted streams are echoed.
+	accepted := make(chan *Stream, 2)
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			s, err := server.AcceptStream()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			accepted <- s
+			go func() {
+				s.WriteHeader(Header{":status": {"200"}})
+				io.Copy(s, s)
+				s.CloseSend()
+			}()
+		}
+	}()
+
+	for i, path := range []string{"/a", "/b"} {
+		s, err := client.OpenStream(Header{":method": {"POST"}, ":scheme": {"https"}, ":path": {path}})
+		if err != nil {
+			t.Fatalf("error opening stream: %s", err)
+		}
+		if v := <-accepted; v.ID() != s.ID() || v.Header().Path() != path {
+			t.Fatalf("expected stream %d with path %s, got %d with %s", s.ID(), path, v.ID(), v.Header().Path())
+		}
+		if i == 1 {
+			// A stream left open for the graceful shutdown.
+			break
+		}
+		s.Write([]byte(path))
+		s.CloseSend()
+		if b, err := io.ReadAll(s); err != nil || string(b) != path {
+			t.Fatalf("expected %q, got %q, %v", path, b, err)
+		}
+	}
+	select {
+	case frame := <-frames:
+		if v, ok := frame.(*HeadersFrame); ok && !v.Trailer {
+			t.Fatalf("unexpected HEADERS frame of stream %d returned by ReadFrame", v.StreamID)
+		}
+	default:
+	}
+
+	// No stream is accepted anymore once the GOAWAY frame is sent.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Shutdown(ctx)
+	select {
+	case err := <-errCh:
+		if err != ErrClosed {
+			t.Fatalf("expected %v, got %v", ErrClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for AcceptStream to return")
+	}
+	if server.Closed() {
+		t.Fatal("connection closed with an active stream")
+	}
+}
+
+func TestPing(t *testing.T) {
+	for _, overTLS := range []bool{true, false} {
+		client, server := pipe(true, overTLS, false)
+
+		expected := [8]byte{}
+		copy(expected[:], "pingpong")
+
+		if err := client.WriteFrame(&PingFrame{Data: expected}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+
+		frame, err := server.ReadFrame()
+		if err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+		got, ok := frame.(*PingFrame)
+		if !ok {
+			t.Fatalf("expected ping frame, got %s", frame.Type())
+		}
+		if got.Ack {
+			t.Fatal("expected SYN ping frame")
+		}
+		if !bytes.Equal(expected[:], got.Data[:]) {
+			t.Fatalf("expected %v, got %v", expected, got.Data[:])
+		}
+
+		frame, err = client.ReadFrame()
+		if err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+		got, ok = frame.(*PingFrame)
+		if !ok {
+			t.Fatalf("expected ACK ping frame, got %s", frame.Type())
+		}
+		if !got.Ack {
+			t.Fatal("expected ACK ping frame")
+		}
+		if !bytes.Equal(expected[:], got.Data[:]) {
+			t.Fatalf("expected %v, got %v", expected, got.Data[:])
+		}
+	}
+}
+
+func TestWindowTuner(t *testing.T) {
+	rwc, _ := net.Pipe()
+	conn := ServerConn(rwc, &Config{AutoTuneWindow: true})
+	defer conn.close()
+
+	open := func(streamID uint32) {
+		stream, err := conn.remote.idleStream(streamID)
+		if err != nil {
+			t.Fatalf("error creating stream: %s", err)
+		}
+		if _, err = stream.transition(true, FrameHeaders, false); err != nil {
+			t.Fatalf("error opening stream: %s", err)
+		}
+		if err = conn.windowTuner.open(stream); err != nil {
+			t.Fatalf("error tuning window: %s", err)
+		}
+	}
+	sample := func(n int) {
+		conn.windowTuner.next = time.Time{}
+		conn.windowTuner.received(n)
+		if err := conn.windowTuner.ack(windowTunerPing); err != nil {
+			t.Fatalf("error tuning window: %s", err)
+		}
+	}
+	expect := func(streamID, win uint32) {
+		if got := conn.InitialRecvWindow(0); got != win {
+			t.Fatalf("expected connection window %d, got %d", win, got)
+		}
+		if got := conn.InitialRecvWindow(streamID); got != win {
+			t.Fatalf("expected stream window %d, got %d", win, got)
+		}
+	}
+
+	open(1)
+
+	// The window is kept while the remote endpoint is not limited by it.
+	sample(30000)
+	expect(1, defaultInitialWindowSize)
+
+	// The window grows when the remote endpoint is limited by it.
+	sample(60000)
+	expect(1, 120000)
+	sample(100000)
+	expect(1, 200000)
+
+	// The next sample is not taken before a few round trips.
+	conn.windowTuner.received(100000)
+	if conn.windowTuner.pinging {
+		t.Fatal("expected no sample")
+	}
+
+	// Streams opened later are given the tuned window.
+	open(3)
+	expect(3, 200000)
+
+	// The window shrinks back when idle.
+	sample(1000)
+	expect(1, defaultInitialWindowSize)
+	expect(3, defaultInitialWindowSize)
+}
+
+func TestRapidReset(t *testing.T) {
+	client, server := pipe(true, true, false)
+	server.resetRate.limit = 2
+
+	reset := func(respond bool) error {
+		streamID, err := client.NextStreamID()
+		if err != nil {
+			t.Fatalf("error creating new stream: %s", err)
+		}
+		if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{}}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+		if _, err = server.ReadFrame(); err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+		if respond {
+			if err = server.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{}}); err != nil {
+				t.Fatalf("error writing frame: %s", err)
+			}
+			if _, err = client.ReadFrame(); err != nil {
+				t.Fatalf("error reading frame: %s", err)
+			}
+		}
+		if err = client.WriteFrame(&RSTStreamFrame{streamID, ErrCodeCancel}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+		_, err = server.ReadFrame()
+		return err
+	}
+
+	// Cancellations of streams that were responded to are not counted.
+	for i := 0; i < 3; i++ {
+		if err := reset(true); err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := reset(false); err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+	}
+	if err, ok := reset(false).(ConnError); !ok || err.ErrCode != ErrCodeEnhanceYourCalm {
+		t.Fatalf("expected ENHANCE_YOUR_CALM connection error, got %v", err)
+	}
+
+	frame, err := client.ReadFrame()
+	if err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+	if goAway, ok := frame.(*GoAwayFrame); !ok || goAway.ErrCode != ErrCodeEnhanceYourCalm {
+		t.Fatalf("expected ENHANCE_YOUR_CALM goaway frame, got %v", frame)
+	}
+}
+
+func TestControlFrameFlood(t *testing.T) {
+	client, server := pipe(true, true, false)
+	// The SETTINGS frame of the client preface is counted.
+	server.controlRate.limit = 3
+
+	// The acknowledgements of the pings of the server are not counted.
+	for i := 0; i < 3; i++ {
+		if err := server.WriteFrame(&PingFrame{Data: [8]byte{byte(i)}}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+		if _, err := client.ReadFrame(); err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+		if _, err := server.ReadFrame(); err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+	}
+
+	ping := func() error {
+		if err := client.WriteFrame(&PingFrame{}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+		_, err := server.ReadFrame()
+		if err == nil {
+			_, err = client.ReadFrame()
+		}
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if err := ping(); err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+	}
+	if err, ok := ping().(ConnError); !ok || err.ErrCode != ErrCodeEnhanceYourCalm {
+		t.Fatalf("expected ENHANCE_YOUR_CALM connection error, got %v", err)
+	}
+
+	frame, err := client.ReadFrame()
+	if err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+	if goAway, ok := frame.(*GoAwayFrame); !ok || goAway.ErrCode != ErrCodeEnhanceYourCalm {
+		t.Fatalf("expected ENHANCE_YOUR_CALM goaway frame, got %v", frame)
+	}
+}
+
+func TestConnDone(t *testing.T) {
+	client, server := pipe(true, true, false)
+
+	if err := client.Err(); err != nil {
+		t.Fatalf("expected nil error before close, got %v", err)
+	}
+
+	// The server closes the connection because of a protocol error.
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				if _, ok := err.(StreamError); !ok {
+					return
+				}
+			}
+		}
+	}()
+	if err := client.WriteFrame(&UnknownFrame{FrameType: FrameWindowUpdate, PayloadLen: 4, Payload: bytes.NewReader([]byte{0, 0, 0, 0})}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if _, err := server.ReadFrame(); err == nil {
+		t.Fatal("expected error reading frame")
+	}
+
+	for _, conn := range []*Conn{client, server} {
+		select {
+		case <-conn.Done():
+		case <-time.After(time.Second):
+			t.Fatal("expected connection to be closed")
+		}
+		if err, ok := conn.Err().(ConnError); !ok || err.ErrCode != ErrCodeProtocol {
+			t.Fatalf("expected PROTOCOL_ERROR connection error, got %v", conn.Err())
+		}
+	}
+
+	// A connection closed locally.
+	client, server = pipe(true, true, false)
+	go server.ReadFrame()
+	client.CloseTimeout(0)
+	<-client.Done()
+	if err := client.Err(); err != ErrClosed {
+		t.Fatalf("expected %v, got %v", ErrClosed, err)
+	}
+	server.CloseTimeout(0)
+}
+
+func TestFlush(t *testing.T) {
+	client, server := pipe(true, true, false)
+
+	streamID, _ := client.NextStreamID()
+	frames := make(chan Frame, 2)
+	go func() {
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- frame
+		}
+	}()
+
+	if err := client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{}}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if err := client.Flush(); err != nil {
+		t.Fatalf("error flushing: %s", err)
+	}
+	if frame := <-frames; frame.Type() != FrameHeaders {
+		t.Fatalf("expected HEADERS frame, got %v", frame)
+	}
+
+	client.CloseTimeout(0)
+	if err := client.Flush(); err != ErrClosed {
+		t.Fatalf("expected %v, got %v", ErrClosed, err)
+	}
+	server.CloseTimeout(0)
+}
+
+func TestShutdown(t *testing.T) {
+	defer func(delay time.Duration) { shutdownDelay = delay }(shutdownDelay)
+	shutdownDelay = 10 * time.Millisecond
+
+	client, server := pipe(true, true, false)
+
+	streamID, err := client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error creating new stream: %s", err)
+	}
+	if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{}}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if _, err = server.ReadFrame(); err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Shutdown(context.Background())
+	}()
+	go func() {
+		for {
+			if _, err := server.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	expectGoAway := func(lastStreamID uint32) {
+		frame, err := client.ReadFrame()
+		if err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+		goAway, ok := frame.(*GoAwayFrame)
+		if !ok || goAway.LastStreamID != lastStreamID || goAway.ErrCode != ErrCodeNo {
+			t.Fatalf("expected GOAWAY with last stream ID %d, got %v", lastStreamID, frame)
+		}
+	}
+
+	// New streams are refused once the first GOAWAY frame is sent.
+	for sent, _ := server.GoAwaySent(); !sent; sent, _ = server.GoAwaySent() {
+		time.Sleep(time.Millisecond)
+	}
+	refusedStreamID, err := client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error creating new stream: %s", err)
+	}
+	if err = client.WriteFrame(&HeadersFrame{StreamID: refusedStreamID, Header: Header{}}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+
+	expectGoAway(maxStreamID)
+
+	frame, err := client.ReadFrame()
+	if err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+	if rst, ok := frame.(*RSTStreamFrame); !ok || rst.StreamID != refusedStreamID || rst.ErrCode != ErrCodeRefusedStream {
+		t.Fatalf("expected REFUSED_STREAM for stream %d, got %v", refusedStreamID, frame)
+	}
+
+	expectGoAway(streamID)
+
+	select {
+	case err := <-errCh:
+		t.Fatalf("shutdown returned with an active stream: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{}, EndStream: true}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err = server.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{}, EndStream: true}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	go client.ReadFrame()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("error from shutdown: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("shutdown timeout")
+	}
+}
+
+func TestGoAway(t *testing.T) {
+	client, server := pipe(true, true, false)
+
+	if goAway := server.LastGoAway(); goAway.LastStreamID != 0 || goAway.ErrCode != ErrCodeNo || goAway.DebugData != nil {
+		t.Fatalf("expected zero value, got %v", goAway)
+	}
+
+	expected := &GoAwayFrame{LastStreamID: 0, ErrCode: ErrCodeEnhanceYourCalm, DebugData: []byte("calm down")}
+	if err := client.WriteFrame(expected); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+
+	frame, err := server.ReadFrame()
+	if err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+	if _, ok := frame.(*GoAwayFrame); !ok {
+		t.Fatalf("expected goaway frame, got %s", frame.Type())
+	}
+
+	server.close()
+
+	if goAway := server.LastGoAway(); !reflect.DeepEqual(*expected, goAway) {
+		t.Fatalf("expected %v, got %v", *expected, goAway)
+	}
+}
+
+func TestAltSvc(t *testing.T) {
+	client, server := pipe(true, true, false)
+
+	if err := client.WriteFrame(&AltSvcFrame{Origin: []byte("https://example.com")}); err == nil {
+		t.Fatal("expected error writing ALTSVC frame from client")
+	}
+	if err := server.WriteFrame(&AltSvcFrame{StreamID: 0}); err == nil {
+		t.Fatal("expected error writing ALTSVC frame with empty origin on stream 0")
+	}
+
+	expected := &AltSvcFrame{
+		Origin:     []byte("https://example.com"),
+		FieldValue: []byte(`h2=":8443"; ma=60`),
+	}
+	if err := server.WriteFrame(expected); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+
+	frame, err := client.ReadFrame()
+	if err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+	got, ok := frame.(*AltSvcFrame)
+	if !ok {
+		t.Fatalf("expected altsvc frame, got %s", frame.Type())
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestRangeStreams(t *testing.T) {
+	client, server := pipe(true, true, false)
+
+	var expected []uint32
+	for i := 0; i < 3; i++ {
+		streamID, err := client.NextStreamID()
+		if err != nil {
+			t.Fatalf("error creating new stream: %s", err)
+		}
+		if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{}, EndStream: i == 2}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+		if _, err = server.ReadFrame(); err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+		expected = append(expected, streamID)
+	}
+
+	var got []uint32
+	client.RangeStreams(func(id uint32, state StreamState, recvWin, sendWin uint32) bool {
+		expectedState := StateOpen
+		if id == expected[2] {
+			expectedState = StateHalfClosedLocal
+		}
+		if state != expectedState {
+			t.Fatalf("stream %d expected state %s, got %s", id, expectedState, state)
+		}
+		if recvWin != defaultInitialWindowSize {
+			t.Fatalf("stream %d expected receive window %d, got %d", id, defaultInitialWindowSize, recvWin)
+		}
+		if expectedState == StateOpen && sendWin != defaultInitialWindowSize {
+			t.Fatalf("stream %d expected send window %d, got %d", id, defaultInitialWindowSize, sendWin)
+		}
+		got = append(got, id)
+		return true
+	})
+	if !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected streams %v, got %v", expected, got)
+	}
+
+	// The iteration stops when false is returned.
+	n := 0
+	server.RangeStreams(func(uint32, StreamState, uint32, uint32) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Fatalf("expected 1 stream, got %d", n)
+	}
+}
+
+func TestStreamContext(t *testing.T) {
+	client, server := pipe(false, false, false)
+
+	streamID, err := client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error creating new stream: %s", err)
+	}
+	if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{}}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err = client.BindStreamContext(streamID, ctx); err != nil {
+		t.Fatalf("error binding context: %s", err)
+	}
+	streamCtx, ok := client.StreamContext(streamID)
+	if !ok {
+		t.Fatalf("stream %d does not exist", streamID)
+	}
+
+	// The write is blocked once the send window is exhausted.
+	errCh := make(chan error, 1)
+	go func() {
+		n := defaultInitialWindowSize + 1
+		errCh <- client.WriteFrame(&DataFrame{StreamID: streamID, Data: bytes.NewReader(make([]byte, n)), DataLen: n})
+	}()
+	for client.SendWindow(streamID) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err = <-errCh; err == nil {
+		t.Fatal("expected error writing frame")
+	}
+	<-streamCtx.Done()
+
+	for {
+		frame, err := server.ReadFrame()
+		if err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+		if rst, ok := frame.(*RSTStreamFrame); ok {
+			if rst.StreamID != streamID || rst.ErrCode != ErrCodeCancel {
+				t.Fatalf("expected RST_STREAM with CANCEL, got %v", rst)
+			}
+			break
+		}
+	}
+}
+
+func TestStreamErrorReason(t *testing.T) {
+	client, server := pipe(false, false, false)
+
+	streamID, err := client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error creating new stream: %s", err)
+	}
+	if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{}}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if _, err = server.ReadFrame(); err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		n := defaultInitialWindowSize + 1
+		errCh <- client.WriteFrame(&DataFrame{StreamID: streamID, Data: bytes.NewReader(make([]byte, n)), DataLen: n})
+	}()
+	for client.SendWindow(streamID) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err = server.WriteFrame(&RSTStreamFrame{streamID, ErrCodeRefusedStream}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if _, err = client.ReadFrame(); err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+
+	se, ok := AsStreamError(fmt.Errorf("write: %w", <-errCh))
+	if !ok {
+		t.Fatal("expected stream error")
+	}
+	if se.Reason != ReasonPeerReset || se.ErrCode != ErrCodeRefusedStream || se.StreamID != streamID {
+		t.Fatalf("expected peer reset of stream %d with REFUSED_STREAM, got %s (%s)", streamID, se, se.Reason)
+	}
+
+	var errors StreamErrorList
+	errors.add(3, ErrCodeFlowControl, io.EOF, ReasonFlowControl)
+	if se, ok = AsStreamError(errors.Err()); !ok || se.StreamID != 3 || se.Reason != ReasonFlowControl {
+		t.Fatalf("expected flow control error of stream 3, got %v", se)
+	}
+	if _, ok = AsStreamError(io.EOF); ok {
+		t.Fatal("expected no stream error")
+	}
+}
+
+func TestStreamErrorUnwrap(t *testing.T) {
+	var list StreamErrorList
+	list.add(3, ErrCodeFlowControl, io.EOF, ReasonFlowControl)
+	list.add(5, ErrCodeCancel, io.ErrUnexpectedEOF, ReasonCanceled)
+	err := fmt.Errorf("settings: %w", list.Err())
+
+	var se StreamError
+	if !errors.As(err, &se) || se.StreamID != 3 || se.ErrCode != ErrCodeFlowControl {
+		t.Fatalf("expected flow control error of stream 3, got %v", se)
+	}
+	for _, target := range []error{io.EOF, io.ErrUnexpectedEOF} {
+		if !errors.Is(err, target) {
+			t.Fatalf("expected %v to be found in %v", target, err)
+		}
+	}
+	if errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("unexpected %v in %v", io.ErrShortWrite, err)
+	}
+}
+
+func TestGoAwayError(t *testing.T) {
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true}, nil)
+	server := ServerConn(s, nil)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	go func() {
+		for {
+			if _, err := server.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	h := Header{}
+	h.SetMethod("POST")
+	h.SetScheme("http")
+	h.SetAuthority("example.com")
+	h.SetPath("/")
+	for _, streamID := range []uint32{1, 3} {
+		if err := client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: h}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+	}
+	for server.NumActiveStreams() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	go server.WriteFrame(&GoAwayFrame{LastStreamID: 1, ErrCode: ErrCodeNo})
+	for {
+		frame, err := client.ReadFrame()
+		if err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+		if frame.Type() == FrameGoAway {
+			break
+		}
+	}
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Stream 3 was not processed, nor is stream 5 opened,
+	// while stream 1 goes on.
+	data := func(streamID uint32) *DataFrame {
+		return &DataFrame{StreamID: streamID, Data: bytes.NewReader([]byte("a")), DataLen: 1}
+	}
+	if err := client.WriteFrame(data(1)); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	var goAway GoAwayError
+	if err := client.WriteFrame(data(3)); !errors.As(err, &goAway) || goAway != (GoAwayError{ErrCodeNo, 1, 3}) {
+		t.Fatalf("expected GOAWAY error of stream 3, got %v", err)
+	}
+	if err := client.WriteFrame(&HeadersFrame{StreamID: 5, Header: h}); !errors.As(err, &goAway) || goAway.StreamID != 5 {
+		t.Fatalf("expected GOAWAY error of stream 5, got %v", err)
+	}
+	if client.Closed() {
+		t.Fatal("expected the connection to remain open")
+	}
+}
+
+func TestUnprocessed(t *testing.T) {
+	tests := []struct {
+		err         error
+		unprocessed bool
+	}{
+		{GoAwayError{ErrCodeNo, 1, 3}, true},
+		{fmt.Errorf("round trip: %w", GoAwayError{ErrCodeNo, 1, 3}), true},
+		{StreamError{io.EOF, ErrCodeRefusedStream, 3, ReasonPeerReset}, true},
+		{StreamErrorList{{io.EOF, ErrCodeRefusedStream, 3, ReasonPeerReset}}, true},
+		{StreamError{io.EOF, ErrCodeRefusedStream, 3, ReasonRefusedStream}, false},
+		{StreamError{io.EOF, ErrCodeCancel, 3, ReasonPeerReset}, false},
+		{ConnError{io.EOF, ErrCodeProtocol}, false},
+		{ErrClosed, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := Unprocessed(tt.err); got != tt.unprocessed {
+			t.Fatalf("%v: expected unprocessed %v, got %v", tt.err, tt.unprocessed, got)
+		}
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	client, server := pipe(true, true, false)
+
+	if err := client.WriteFrame(&OriginFrame{Origins: []string{"https://example.com"}}); err == nil {
+		t.Fatal("expected error writing ORIGIN frame from client")
+	}
+
+	// Frames on a non-zero stream, and frames with a truncated
+	// entry, are ignored.
+	invalid := []struct {
+		streamID uint32
+		payload  []byte
+	}{
+		{1, []byte{0, 3, 'a', 'b', 'c'}},
+		{0, []byte{0, 4, 'a', 'b', 'c'}},
+	}
+	for _, v := range invalid {
+		if err := server.WriteFrame(&UnknownFrame{
+			FrameType:  FrameOrigin,
+			StreamID:   v.streamID,
+			Payload:    bytes.NewReader(v.payload),
+			PayloadLen: len(v.payload),
+		}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+	}
+
+	expected := &OriginFrame{Origins: []string{"https://example.com", "https://www.example.com"}}
+	if err := server.WriteFrame(expected); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+
+	frame, err := client.ReadFrame()
+	if err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+	if !reflect.DeepEqual(expected, frame) {
+		t.Fatalf("expected %v, got %v", expected, frame)
+	}
+}
+
+func TestSettingsFrameValidation(t *testing.T) {
+	frame := func(length int, flags Flags, streamID uint32, payload ...byte) []byte {
+		return append([]byte{0, 0, byte(length), byte(FrameSettings), byte(flags), 0, 0, 0, byte(streamID)}, payload...)
+	}
+	tests := []struct {
+		name    string
+		frame   []byte
+		errCode ErrCode
+		ok      bool
+	}{
+		{"bad length", frame(5, 0, 0, 0, 4, 0, 0, 0), ErrCodeFrameSize, false},
+		{"non-zero stream", frame(0, 0, 1), ErrCodeProtocol, false},
+		{"ACK with payload", frame(6, FlagAck, 0, 0, 4, 0, 0, 0, 1), ErrCodeFrameSize, false},
+		{"bad value before valid one", frame(12, 0, 0, 0, 2, 0, 0, 0, 2, 0, 4, 0, 0, 0, 1), ErrCodeProtocol, false},
+		{"unknown setting", frame(6, 0, 0, 0, 0xff, 0, 0, 0, 1), 0, true},
+	}
+	for _, tt := range tests {
+		r := newFrameReader(bytes.NewReader(tt.frame), 4096)
+		f, err := r.ReadFrame()
+		if tt.ok {
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", tt.name, err)
+			}
+			if v, exists := f.(*SettingsFrame).Settings.value(0xff); !exists || v != 1 {
+				t.Fatalf("%s: expected setting to be kept, got %v", tt.name, f)
+			}
+			continue
+		}
+		if connErr, ok := err.(ConnError); !ok || connErr.ErrCode != tt.errCode {
+			t.Fatalf("%s: expected %s, got %v", tt.name, tt.errCode, err)
+		}
+	}
+}
+
+func TestPingRTT(t *testing.T) {
+	client, server := pipe(true, true, false)
+
+	go func() {
+		for {
+			if _, err := server.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Ping(context.Background()); err != nil {
+				t.Errorf("error from ping: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.Ping(ctx); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+
+	server.close()
+	if _, err := client.Ping(context.Background()); err == nil {
+		t.Fatal("expected error from ping on closed connection")
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	client, server := pipe(true, true, false)
+	client.config = &Config{KeepaliveInterval: 10 * time.Millisecond, KeepaliveTimeout: 50 * time.Millisecond}
+	go client.keepalive()
+
+	stop := make(chan struct{})
+	go func() {
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				return
+			}
+			if _, ok := frame.(*PingFrame); ok {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+			}
+		}
+	}()
+
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+
+	// The connection is kept alive while the keepalive is acknowledged.
+	time.Sleep(100 * time.Millisecond)
+	if client.Closed() {
+		t.Fatal("connection closed while the keepalive was acknowledged")
+	}
+
+	close(stop)
+
+	if err := <-errCh; err != ErrKeepaliveTimeout {
+		t.Fatalf("expected %v, got %v", ErrKeepaliveTimeout, err)
+	}
+}
+
+func TestPriorityUpdate(t *testing.T) {
+	for value, expected := range map[string]PriorityParam{
+		"":             {defaultUrgency, false},
+		"u=1, i":       {1, true},
+		"i=?0, u=7":    {7, false},
+		"u=8, i=?1":    {defaultUrgency, true},
+		"foo, u=0;a=b": {0, false},
+		"u=2, i, u=5":  {5, true},
+	} {
+		if p := ParsePriorityParam(value); p != expected {
+			t.Fatalf("%q: expected %s, got %s", value, expected, p)
+		}
+	}
+
+	client, server := pipe(true, true, false)
+
+	if err := server.WriteFrame(&PriorityUpdateFrame{PrioritizedStreamID: 1}); err == nil {
+		t.Fatal("expected error writing PRIORITY_UPDATE frame from server")
+	}
+
+	streamID, err := client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error creating new stream: %s", err)
+	}
+	write := func(frame Frame) {
+		if err := client.WriteFrame(frame); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+		if _, err := server.ReadFrame(); err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+	}
+
+	// The priority of an idle stream is applied when it is opened.
+	write(&HeadersFrame{StreamID: streamID, Header: Header{}})
+	write(&PriorityUpdateFrame{PrioritizedStreamID: streamID, PriorityFieldValue: "u=1, i"})
+	write(&PriorityUpdateFrame{PrioritizedStreamID: streamID + 2, PriorityFieldValue: "u=5"})
+	if id, err := client.NextStreamID(); err != nil || id != streamID+2 {
+		t.Fatalf("expected stream %d, got %d (%v)", streamID+2, id, err)
+	}
+	write(&HeadersFrame{StreamID: streamID + 2, Header: Header{}})
+
+	for id, expected := range map[uint32]PriorityParam{streamID: {1, true}, streamID + 2: {5, false}} {
+		if p, ok := server.StreamPriorityParam(id); !ok || p != expected {
+			t.Fatalf("stream %d: expected priority %s, got %s", id, expected, p)
+		}
+	}
+
+	// A client receiving PRIORITY_UPDATE closes the connection.
+	payload := []byte{0, 0, 0, 1, 'u', '=', '0'}
+	if err = server.WriteFrame(&UnknownFrame{
+		FrameType:  FramePriorityUpdate,
+		Payload:    bytes.NewReader(payload),
+		PayloadLen: len(payload),
+	}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	_, err = client.ReadFrame()
+	if ce, ok := err.(ConnError); !ok || ce.ErrCode != ErrCodeProtocol {
+		t.Fatalf("expected connection error of type PROTOCOL_ERROR, got %v", err)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testdata/server.pem", "testdata/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server echoes the request body, with the path of the
+	// request in a header field and a trailer. Requests to /hang
+	// are never answered.
+	serve := func(server *Conn) {
+		paths := map[uint32]string{}
+		bodies := map[uint32]*bytes.Buffer{}
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch v := frame.(type) {
+			case *HeadersFrame:
+				paths[v.StreamID] = v.Path()
+				bodies[v.StreamID] = new(bytes.Buffer)
+			case *DataFrame:
+				bodies[v.StreamID].ReadFrom(v.Data)
+			}
+			if streamID := frame.Stream(); frame.EndOfStream() && paths[streamID] != "/hang" {
+				h := Header{"x-path": {paths[streamID]}}
+				h.SetStatus("200")
+				body := bodies[streamID].Bytes()
+				go func() {
+					server.WriteFrame(&HeadersFrame{StreamID: streamID, Header: h})
+					server.WriteFrame(&DataFrame{StreamID: streamID, Data: bytes.NewReader(body), DataLen: len(body)})
+					server.WriteTrailer(streamID, Header{"x-trailer": {"done"}})
+				}()
+			}
+		}
+	}
+
+	var dials int32
+	tr := &Transport{Dialer: &Dialer{
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			c, s := net.Pipe()
+			go serve(ServerConn(tls.Server(s, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				NextProtos:   []string{ProtocolTLS},
+			}), nil))
+			return tls.Client(c, &tls.Config{NextProtos: []string{ProtocolTLS}, InsecureSkipVerify: true}), nil
+		},
+	}}
+	defer tr.CloseIdleConnections()
+
+	client := &http.Client{Transport: tr}
+	for i := 0; i < 2; i++ {
+		body := bytes.Repeat([]byte("a"), 100000)
+		res, err := client.Post("https://example.com/echo", "text/plain", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("error sending request: %s", err)
+		}
+		got, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("error reading body: %s", err)
+		}
+		if res.StatusCode != 200 || res.Header.Get("X-Path") != "/echo" || !bytes.Equal(got, body) {
+			t.Fatalf("unexpected response %d %v with %d bytes", res.StatusCode, res.Header, len(got))
+		}
+		if v := res.Trailer.Get("X-Trailer"); v != "done" {
+			t.Fatalf("expected trailer done, got %q", v)
+		}
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("expected 1 connection, got %d", n)
+	}
+
+	// The request context cancels the stream.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://example.com/hang", nil)
+	if _, err = tr.RoundTrip(req); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestTransportCoalescing(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"a.example", "b.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	// The server sends an ORIGIN frame, if any, before the first response.
+	serve := func(server *Conn, origins []string) {
+		sent := false
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				return
+			}
+			if v, ok := frame.(*HeadersFrame); ok {
+				if origins != nil && !sent {
+					server.WriteFrame(&OriginFrame{Origins: origins})
+					sent = true
+				}
+				h := Header{}
+				h.SetStatus("200")
+				server.WriteFrame(&HeadersFrame{StreamID: v.StreamID, Header: h, EndStream: true})
+			}
+		}
+	}
+
+	tests := []struct {
+		name    string
+		origins []string
+		disable bool
+		dials   int32
+	}{
+		{"no ORIGIN frame", nil, false, 3},
+		{"origin set", []string{"https://b.example"}, false, 2},
+		{"empty origin set", []string{}, false, 3},
+		{"disabled", []string{"https://b.example"}, true, 3},
+	}
+	for _, tt := range tests {
+		var dials int32
+		tr := &Transport{DisableCoalescing: tt.disable, Dialer: &Dialer{
+			DialTLS: func(network, addr string) (net.Conn, error) {
+				atomic.AddInt32(&dials, 1)
+				c, s := net.Pipe()
+				go serve(ServerConn(tls.Server(s, &tls.Config{
+					Certificates: []tls.Certificate{cert},
+					NextProtos:   []string{ProtocolTLS},
+				}), nil), tt.origins)
+				return tls.Client(c, &tls.Config{NextProtos: []string{ProtocolTLS}, InsecureSkipVerify: true}), nil
+			},
+		}}
+
+		// The certificate is not valid for c.example.
+		for _, host := range []string{"a.example", "b.example", "c.example"} {
+			res, err := (&http.Client{Transport: tr}).Get("https://" + host + "/")
+			if err != nil {
+				t.Fatalf("%s: error sending request to %s: %s", tt.name, host, err)
+			}
+			res.Body.Close()
+		}
+		if n := atomic.LoadInt32(&dials); n != tt.dials {
+			t.Fatalf("%s: expected %d connections, got %d", tt.name, tt.dials, n)
+		}
+		tr.CloseIdleConnections()
+	}
+}
+
+func TestTransportStreamLimit(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testdata/server.pem", "testdata/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server allows a single stream,
+	// answering /hold once release is closed.
+	serve := func(server *Conn, release chan struct{}) {
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				return
+			}
+			if v, ok := frame.(*HeadersFrame); ok {
+				hold := v.Path() == "/hold"
+				go func(streamID uint32) {
+					if hold {
+						<-release
+					}
+					h := Header{}
+					h.SetStatus("200")
+					server.WriteFrame(&HeadersFrame{StreamID: streamID, Header: h, EndStream: true})
+				}(v.StreamID)
+			}
+		}
+	}
+	settings := Settings{}
+	settings.SetMaxConcurrentStreams(1)
+
+	for _, policy := range []StreamLimitPolicy{StreamLimitWait, StreamLimitDial, StreamLimitError} {
+		var dials int32
+		release := make(chan struct{})
+		tr := &Transport{StreamLimitPolicy: policy, Dialer: &Dialer{
+			DialTLS: func(network, addr string) (net.Conn, error) {
+				atomic.AddInt32(&dials, 1)
+				c, s := net.Pipe()
+				go serve(ServerConn(tls.Server(s, &tls.Config{
+					Certificates: []tls.Certificate{cert},
+					NextProtos:   []string{ProtocolTLS},
+				}), &Config{InitialSettings: settings}), release)
+				return tls.Client(c, &tls.Config{NextProtos: []string{ProtocolTLS}, InsecureSkipVerify: true}), nil
+			},
+		}}
+
+		held := make(chan error, 1)
+		go func() {
+			req, _ := http.NewRequest("GET", "https://example.com/hold", nil)
+			res, err := tr.RoundTrip(req)
+			if err == nil {
+				res.Body.Close()
+			}
+			held <- err
+		}()
+		full := func() bool {
+			tr.connL.Lock()
+			defer tr.connL.Unlock()
+			tc := tr.conns["https://example.com:https"]
+			return tc != nil && tc.full()
+		}
+		for !full() {
+			time.Sleep(time.Millisecond)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		req, _ := http.NewRequestWithContext(ctx, "GET", "https://example.com/", nil)
+		res, err := tr.RoundTrip(req)
+		cancel()
+		switch policy {
+		case StreamLimitWait:
+			if err != context.DeadlineExceeded {
+				t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+			}
+			// The request is sent once the held one is answered.
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				close(release)
+			}()
+			req, _ = http.NewRequest("GET", "https://example.com/", nil)
+			if res, err = tr.RoundTrip(req); err != nil {
+				t.Fatalf("error sending request: %s", err)
+			}
+			res.Body.Close()
+		case StreamLimitDial:
+			if err != nil {
+				t.Fatalf("error sending request: %s", err)
+			}
+			res.Body.Close()
+			close(release)
+		case StreamLimitError:
+			if err != ErrStreamLimit {
+				t.Fatalf("expected %v, got %v", ErrStreamLimit, err)
+			}
+			close(release)
+		}
+		if err := <-held; err != nil {
+			t.Fatalf("error sending request: %s", err)
+		}
+
+		expected := int32(1)
+		if policy == StreamLimitDial {
+			expected = 2
+		}
+		if n := atomic.LoadInt32(&dials); n != expected {
+			t.Fatalf("policy %d: expected %d connections, got %d", policy, expected, n)
+		}
+		tr.CloseIdleConnections()
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testdata/server.pem", "testdata/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/upper" || r.Host != "example.com" || r.Header.Get("X-Test") != "1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Trailer", "X-Length")
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(bytes.ToUpper(body))
+		w.Header().Set("X-Length", strconv.Itoa(len(body)))
+	})
+
+	tr := &Transport{Dialer: &Dialer{
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			c, s := net.Pipe()
+			go HTTPHandler(handler)(ServerConn(tls.Server(s, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				NextProtos:   []string{ProtocolTLS},
+			}), nil))
+			return tls.Client(c, &tls.Config{NextProtos: []string{ProtocolTLS}, InsecureSkipVerify: true}), nil
+		},
+	}}
+	defer tr.CloseIdleConnections()
+
+	// The request body exceeds the flow control windows, which are
+	// updated as the handler reads it.
+	body := bytes.Repeat([]byte("a"), 4*defaultInitialWindowSize)
+	req, _ := http.NewRequest("PUT", "https://example.com/upper", bytes.NewReader(body))
+	req.Header.Set("X-Test", "1")
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("error sending request: %s", err)
+	}
+	got, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("error reading body: %s", err)
+	}
+	if res.StatusCode != http.StatusCreated || res.Header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("unexpected response %d %v", res.StatusCode, res.Header)
+	}
+	if !bytes.Equal(got, bytes.ToUpper(body)) {
+		t.Fatalf("unexpected body of %d bytes", len(got))
+	}
+	if v := res.Trailer.Get("X-Length"); v != strconv.Itoa(len(body)) {
+		t.Fatalf("expected trailer %d, got %q", len(body), v)
+	}
+
+	// A handler writing nothing ends the stream with the header block.
+	req, _ = http.NewRequest("GET", "https://example.com/", nil)
+	if res, err = tr.RoundTrip(req); err != nil {
+		t.Fatalf("error sending request: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest || res.ContentLength != 0 {
+		t.Fatalf("unexpected response %d with length %d", res.StatusCode, res.ContentLength)
+	}
+}
+
+func TestHTTPHandlerStreamError(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(w, r.Body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	p := newServingRawPeer(t, nil, HTTPHandler(handler))
+
+	header := Header{":method": {"POST"}, ":scheme": {"https"}, ":path": {"/"}}
+	p.writeFrame(&HeadersFrame{StreamID: 1, Header: header})
+	header = Header{":method": {"POST"}, ":scheme": {"https"}, ":path": {"/"}, "content-length": {"5"}}
+	p.writeFrame(&HeadersFrame{StreamID: 3, Header: header})
+
+	// The stream of which the body does not match the content-length
+	// is reset, while the other one is still served.
+	data := []byte("abc")
+	p.writeFrame(&DataFrame{StreamID: 3, Data: bytes.NewReader(data), DataLen: len(data), EndStream: true})
+	p.expectReset(3, ErrCodeProtocol)
+
+	data = []byte("hello")
+	p.writeFrame(&DataFrame{StreamID: 1, Data: bytes.NewReader(data), DataLen: len(data), EndStream: true})
+	for {
+		switch v := p.readFrame().(type) {
+		case nil:
+			t.Fatal("connection closed before the response")
+		case *GoAwayFrame:
+			t.Fatalf("unexpected GOAWAY frame with %s %q", v.ErrCode, v.DebugData)
+		case *HeadersFrame:
+			if v.StreamID != 1 || v.Header.Get(":status") != "200" {
+				t.Fatalf("unexpected response %v on stream %d", v.Header, v.StreamID)
+			}
+			return
+		}
+	}
+}
+
+// readRecorder reports whether its reader was read.
+type readRecorder struct {
+	io.Reader
+	read int32
+}
+
+func (r *readRecorder) Read(p []byte) (int, error) {
+	atomic.StoreInt32(&r.read, 1)
+	return r.Reader.Read(p)
+}
+
+func TestRequestToHeader(t *testing.T) {
+	tests := []struct {
+		method, opaque, host string
+		path, err            string
+	}{
+		{"GET", "", "", "/", ""},
+		{"GET", "", "example.com", "/", ""},
+		{"GET /", "", "", "", `bad :method "GET /"`},
+		{"OPTIONS", "*", "", "*", ""},
+		{"GET", "*", "", "", `:path "*" not allowed for GET requests`},
+		{"GET", "a", "", "", `bad :path "a"`},
+		{"GET", "", "other.example.com", "", `host header "other.example.com" disagrees with :authority "example.com"`},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "https://example.com", nil)
+		req.Method = tt.method
+		req.URL.Opaque = tt.opaque
+		if tt.host != "" {
+			req.Header.Set("Host", tt.host)
+		}
+
+		h, err := requestToHeader(req, false)
+		if tt.err != "" {
+			if _, ok := err.(MalformedError); !ok || err.Error() != "http2: malformed; "+tt.err {
+				t.Fatalf("%s %q: expected error %q, got %v", tt.method, tt.opaque, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s %q: unexpected error: %s", tt.method, tt.opaque, err)
+		}
+		if h.Method() != tt.method || h.Path() != tt.path || h.Authority() != "example.com" {
+			t.Fatalf("%s %q: unexpected header fields %v", tt.method, tt.opaque, h)
+		}
+	}
+}
+
+func TestValidateResponseHeader(t *testing.T) {
+	tests := []struct {
+		header Header
+		err    string
+	}{
+		{Header{":status": {"200"}, "content-type": {"text/plain"}}, ""},
+		{Header{"content-type": {"text/plain"}}, ":status must be specified"},
+		{Header{":status": {"200", "204"}}, `bad :status "200,204"`},
+		{Header{":status": {"2000"}}, `bad :status "2000"`},
+		{Header{":status": {"+20"}}, `bad :status "+20"`},
+		{Header{":status": {"200"}, ":path": {"/"}}, "pseudo-header field :path in response"},
+		{Header{":status": {"200"}, "Connection": {"close"}}, "connection-specific header field Connection in response"},
+		{Header{":status": {"200"}, "transfer-encoding": {"chunked"}}, "connection-specific header field transfer-encoding in response"},
+	}
+	for _, tt := range tests {
+		err := validateResponseHeader(tt.header)
+		if tt.err == "" {
+			if err != nil {
+				t.Fatalf("%v: unexpected error: %s", tt.header, err)
+			}
+			continue
+		}
+		if _, ok := err.(MalformedError); !ok || err.Error() != "http2: malformed; "+tt.err {
+			t.Fatalf("%v: expected error %q, got %v", tt.header, tt.err, err)
+		}
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testdata/server.pem", "testdata/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests to /reject fail without reading the body; the others
+	// read it, which sends the 100 Continue response.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Expect") != "100-continue" || r.URL.Path == "/reject" {
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+
+	tr := &Transport{
+		Dialer: &Dialer{
+			DialTLS: func(network, addr string) (net.Conn, error) {
+				c, s := net.Pipe()
+				go HTTPHandler(handler)(ServerConn(tls.Server(s, &tls.Config{
+					Certificates: []tls.Certificate{cert},
+					NextProtos:   []string{ProtocolTLS},
+				}), nil))
+				return tls.Client(c, &tls.Config{NextProtos: []string{ProtocolTLS}, InsecureSkipVerify: true}), nil
+			},
+		},
+		// The body is sent on the 100 Continue response, long before
+		// the timeout.
+		ExpectContinueTimeout: time.Minute,
+	}
+	defer tr.CloseIdleConnections()
+
+	for _, path := range []string{"/accept", "/reject"} {
+		body := &readRecorder{Reader: strings.NewReader("hello")}
+		req, _ := http.NewRequest("PUT", "https://example.com"+path, body)
+		req.Header.Set("Expect", "100-continue")
+
+		done := make(chan struct{})
+		var res *http.Response
+		go func() {
+			defer close(done)
+			res, err = tr.RoundTrip(req)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for the response", path)
+		}
+		if err != nil {
+			t.Fatalf("%s: error sending request: %s", path, err)
+		}
+		got, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		read := atomic.LoadInt32(&body.read) == 1
+		switch path {
+		case "/accept":
+			if res.StatusCode != http.StatusOK || string(got) != "hello" || !read {
+				t.Fatalf("%s: unexpected response %d %q, body read: %v", path, res.StatusCode, got, read)
+			}
+		case "/reject":
+			if res.StatusCode != http.StatusExpectationFailed || read {
+				t.Fatalf("%s: unexpected response %d, body read: %v", path, res.StatusCode, read)
+			}
+		}
+	}
+}
+
+func TestTrailersAccepted(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Trailer")
+		io.WriteString(w, "body")
+		w.Header().Set("X-Trailer", "done")
+	})
+
+	for _, te := range []string{"", "gzip", "Trailers", "gzip, trailers"} {
+		c, s := net.Pipe()
+		client := ClientConn(c, &Config{PriorKnowledge: true}, nil)
+		go HTTPHandler(handler)(ServerConn(s, nil))
+
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		if te != "" {
+			req.Header.Set("TE", te)
+		}
+		h, _ := requestToHeader(req, false)
+		accepted := strings.Contains(strings.ToLower(te), "trailers")
+		if v := h.Get("te"); (accepted && v != "trailers") || (!accepted && v != "") {
+			t.Fatalf("te %q: unexpected te header field %q", te, v)
+		}
+		go client.WriteFrame(&HeadersFrame{StreamID: 1, Header: h, EndStream: true})
+
+		var trailer Header
+		for {
+			frame, err := client.ReadFrame()
+			if err != nil {
+				t.Fatalf("te %q: error reading frame: %s", te, err)
+			}
+			if v, ok := frame.(*HeadersFrame); ok && v.Trailer {
+				trailer = v.Header
+			}
+			if frame.EndOfStream() {
+				break
+			}
+		}
+		client.CloseTimeout(0)
+
+		if got := trailer.Get("x-trailer"); (accepted && got != "done") || (!accepted && trailer != nil) {
+			t.Fatalf("te %q: unexpected trailers %v", te, trailer)
+		}
+	}
+}
+
+func TestHandlerReset(t *testing.T) {
+	errCh := make(chan error, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "discarded")
+		if err := w.(Resetter).Reset(ErrCodeEnhanceYourCalm); err != nil {
+			errCh <- err
+			return
+		}
+		if _, err := io.WriteString(w, "body"); err == nil {
+			errCh <- errors.New("write after reset succeeded")
+			return
+		}
+		errCh <- w.(Resetter).Reset(ErrCodeCancel)
+	})
+
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true}, nil)
+	defer client.CloseTimeout(0)
+	go HTTPHandler(handler)(ServerConn(s, nil))
+
+	header := Header{":method": {"GET"}, ":scheme": {"http"}, ":authority": {"example.com"}, ":path": {"/"}}
+	go client.WriteFrame(&HeadersFrame{StreamID: 1, Header: header, EndStream: true})
+
+	var body []byte
+	for {
+		frame, err := client.ReadFrame()
+		if err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+		if v, ok := frame.(*DataFrame); ok {
+			b, _ := io.ReadAll(v.Data)
+			body = append(body, b...)
+		}
+		if v, ok := frame.(*RSTStreamFrame); ok {
+			if v.ErrCode != ErrCodeEnhanceYourCalm {
+				t.Fatalf("expected RST_STREAM with %s, got %s", ErrCodeEnhanceYourCalm, v.ErrCode)
+			}
+			break
+		}
+	}
+	if string(body) != "partial" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataBufferPool(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		c, s := net.Pipe()
+		conn := ServerConn(s, &Config{DisableBufferPool: disabled})
+
+		buf := conn.getDataBuffer()
+		if n, max := len(*buf), int(conn.Settings().MaxFrameSize()); n != max {
+			t.Errorf("len(buffer) = %d; want %d", n, max)
+		}
+		conn.putDataBuffer(buf)
+		if disabled && conn.getDataBuffer() == buf {
+			t.Error("buffer reused with DisableBufferPool")
+		}
+		c.Close()
+		conn.CloseTimeout(0)
+	}
+}
+
+func TestStreamBody(t *testing.T) {
+	halfClosed := make(chan struct{})
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true}, nil)
+	server := ServerConn(s, &Config{OnStateChange: func(streamID uint32, from, to StreamState) {
+		if to == StateHalfClosedRemote {
+			close(halfClosed)
+		}
+	}})
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	h := Header{}
+	h.SetMethod("POST")
+	h.SetScheme("http")
+	h.SetAuthority("example.com")
+	h.SetPath("/")
+	go client.WriteFrame(&HeadersFrame{StreamID: 1, Header: h})
+
+	var frame Frame
+	var err error
+	for frame == nil || frame.Type() != FrameHeaders {
+		if frame, err = server.ReadFrame(); err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+	}
+	body, err := server.StreamBody(frame.Stream())
+	if err != nil {
+		t.Fatalf("error getting stream body: %s", err)
+	}
+
+	frames := make(chan Frame, 8)
+	go func() {
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- frame
+		}
+	}()
+
+	expected := bytes.Repeat([]byte("body"), 1000)
+	for i := 0; i < len(expected); i += 1000 {
+		err = client.WriteFrame(&DataFrame{StreamID: 1, Data: bytes.NewReader(expected[i : i+1000]), DataLen: 1000, PadLen: 10, EndStream: i+1000 == len(expected)})
+		if err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+	}
+
+	// The body is read once the stream is half-closed.
+	select {
+	case <-halfClosed:
+	case <-time.After(time.Second):
+		t.Fatal("expected the stream to be half-closed")
+	}
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("error reading body: %s", err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("expected body of %d bytes, got %d", len(expected), len(got))
+	}
+	for len(frames) > 0 {
+		if frame := <-frames; frame.Type() == FrameData {
+			t.Fatalf("unexpected frame %v", frame)
+		}
+	}
+}
+
+func TestStreamBodyDirectRead(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	conn := ServerConn(s, nil)
+	defer conn.CloseTimeout(0)
+
+	b := &requestBody{conn: conn, streamID: 1}
+	b.cond = sync.NewCond(&b.mu)
+
+	type result struct {
+		p   []byte
+		err error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		p := make([]byte, 10)
+		n, err := b.Read(p)
+		resc <- result{p[:n], err}
+	}()
+	for {
+		b.mu.Lock()
+		waiting := b.waiter != nil
+		b.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The payload is read into the buffer of the waiting Read,
+	// and the remainder is buffered.
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	if n, err := b.ReadFrom(bytes.NewReader(data)); err != nil || n != int64(len(data)) {
+		t.Fatalf("expected %d bytes read, got %d, %v", len(data), n, err)
+	}
+	res := <-resc
+	if res.err != nil || !bytes.Equal(res.p, data[:10]) {
+		t.Fatalf("expected %q, got %q, %v", data[:10], res.p, res.err)
+	}
+	if n := b.buf.Len(); n != len(data)-10 {
+		t.Fatalf("expected %d bytes buffered, got %d", len(data)-10, n)
+	}
+
+	b.closeWithError(io.EOF)
+	got, err := io.ReadAll(b)
+	if err != nil || !bytes.Equal(got, data[10:]) {
+		t.Fatalf("expected %q, got %q, %v", data[10:], got, err)
+	}
+}
+
+func TestServerPush(t *testing.T) {
+	pushErr := make(chan error, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			pushErr <- w.(Pusher).Push("GET", "/style.css", Header{"x-push": {"1"}})
+			io.WriteString(w, "index")
+		case "/style.css":
+			if r.Method != "GET" || r.Host != "example.com" || r.Header.Get("X-Push") != "1" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			io.WriteString(w, "style")
+		}
+	})
+
+	for _, enabled := range []bool{true, false} {
+		var settings Settings
+		settings.SetPushEnabled(enabled)
+		c, s := net.Pipe()
+		client := ClientConn(c, &Config{PriorKnowledge: true, InitialSettings: settings}, nil)
+		go HTTPHandler(handler)(ServerConn(s, nil))
+
+		h := Header{}
+		h.SetMethod("GET")
+		h.SetScheme("http")
+		h.SetAuthority("example.com")
+		h.SetPath("/")
+		go client.WriteFrame(&HeadersFrame{StreamID: 1, Header: h, EndStream: true})
+
+		// The pushed response is served on stream 2, promised on stream 1.
+		streams := 1
+		if enabled {
+			streams = 2
+		}
+		var promise *PushPromiseFrame
+		bodies := map[uint32]string{}
+		for streams > 0 {
+			frame, err := client.ReadFrame()
+			if err != nil {
+				t.Fatalf("push %v: error reading frame: %s", enabled, err)
+			}
+			switch v := frame.(type) {
+			case *PushPromiseFrame:
+				promise = v
+			case *DataFrame:
+				b, _ := io.ReadAll(v.Data)
+				bodies[v.StreamID] += string(b)
+			}
+			if frame.EndOfStream() {
+				streams--
+			}
+		}
+		err := <-pushErr
+		client.CloseTimeout(0)
+
+		if !enabled {
+			if err != ErrPushDisabled || promise != nil {
+				t.Fatalf("push disabled: expected %v, got %v with promise %v", ErrPushDisabled, err, promise)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("push failed: %s", err)
+		}
+		if promise == nil || promise.StreamID != 1 || promise.PromisedStreamID != 2 || promise.Path() != "/style.css" {
+			t.Fatalf("unexpected PUSH_PROMISE %+v", promise)
+		}
+		if bodies[1] != "index" || bodies[2] != "style" {
+			t.Fatalf("unexpected bodies %v", bodies)
+		}
+	}
+}
+
+func TestTransportHTTP11Required(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testdata/server.pem", "testdata/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/legacy" {
+			RequireHTTP11(w)
+		}
+	})
+	tr := &Transport{Dialer: &Dialer{
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			c, s := net.Pipe()
+			go HTTPHandler(handler)(ServerConn(tls.Server(s, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				NextProtos:   []string{ProtocolTLS},
+			}), nil))
+			return tls.Client(c, &tls.Config{NextProtos: []string{ProtocolTLS}, InsecureSkipVerify: true}), nil
+		},
+	}}
+	defer tr.CloseIdleConnections()
+
+	req, _ := http.NewRequest("GET", "https://example.com/legacy", nil)
+	_, err = tr.RoundTrip(req)
+	if _, ok := err.(HTTP11RequiredError); !ok {
+		t.Fatalf("expected HTTP11RequiredError, got %v", err)
+	}
+
+	// The connection still serves the other requests.
+	req, _ = http.NewRequest("GET", "https://example.com/", nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("error sending request: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response %d", res.StatusCode)
+	}
+
+	if err := RequireHTTP11(struct{ http.ResponseWriter }{}); err == nil {
+		t.Fatal("expected error requiring HTTP/1.1 without a Resetter")
+	}
+}
+
+func TestTransportStreamError(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testdata/server.pem", "testdata/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server answers /bad with a body shorter than its
+	// content-length, and /hold once release is closed.
+	release := make(chan struct{})
+	serve := func(server *Conn) {
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				if _, ok := err.(StreamError); ok {
+					continue
+				}
+				return
+			}
+			v, ok := frame.(*HeadersFrame)
+			if !ok {
+				continue
+			}
+			go func(streamID uint32, path string) {
+				h := Header{}
+				h.SetStatus("200")
+				switch path {
+				case "/bad":
+					h.Set("content-length", "5")
+					server.WriteFrame(&HeadersFrame{StreamID: streamID, Header: h})
+					server.WriteFrame(&UnknownFrame{FrameType: FrameData, StreamID: streamID, Flags: FlagEndStream, Payload: strings.NewReader("abc"), PayloadLen: 3})
+				case "/hold":
+					<-release
+					fallthrough
+				default:
+					server.WriteFrame(&HeadersFrame{StreamID: streamID, Header: h, EndStream: true})
+				}
+			}(v.StreamID, v.Path())
+		}
+	}
+	var dials int32
+	tr := &Transport{Dialer: &Dialer{
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			c, s := net.Pipe()
+			go serve(ServerConn(tls.Server(s, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				NextProtos:   []string{ProtocolTLS},
+			}), nil))
+			return tls.Client(c, &tls.Config{NextProtos: []string{ProtocolTLS}, InsecureSkipVerify: true}), nil
+		},
+	}}
+	defer tr.CloseIdleConnections()
+
+	held := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "https://example.com/hold", nil)
+		res, err := tr.RoundTrip(req)
+		if err == nil {
+			res.Body.Close()
+		}
+		held <- err
+	}()
+
+	// The malformed response fails its own request only.
+	req, _ := http.NewRequest("GET", "https://example.com/bad", nil)
+	res, err := tr.RoundTrip(req)
+	if err == nil {
+		_, err = io.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	if _, ok := AsStreamError(err); !ok {
+		t.Fatalf("expected stream error, got %v", err)
+	}
+
+	close(release)
+	if err := <-held; err != nil {
+		t.Fatalf("error sending request: %s", err)
+	}
+	req, _ = http.NewRequest("GET", "https://example.com/", nil)
+	if res, err = tr.RoundTrip(req); err != nil {
+		t.Fatalf("error sending request: %s", err)
+	}
+	res.Body.Close()
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("expected the connection to be reused, got %d dials", n)
+	}
+}
+
+func TestTransportFlowControl(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testdata/server.pem", "testdata/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := bytes.Repeat([]byte("a"), 4*defaultInitialWindowSize)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})
+	tr := &Transport{Dialer: &Dialer{
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			c, s := net.Pipe()
+			go HTTPHandler(handler)(ServerConn(tls.Server(s, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				NextProtos:   []string{ProtocolTLS},
+			}), nil))
+			return tls.Client(c, &tls.Config{NextProtos: []string{ProtocolTLS}, InsecureSkipVerify: true}), nil
+		},
+	}}
+	defer tr.CloseIdleConnections()
+
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("error sending request: %s", err)
+	}
+	defer res.Body.Close()
+
+	// The bytes buffered while the body is not read
+	// are limited to the flow-control window.
+	time.Sleep(50 * time.Millisecond)
+	b := res.Body.(*transportBody)
+	b.mu.Lock()
+	n := b.buf.Len()
+	b.mu.Unlock()
+	if n > defaultInitialWindowSize {
+		t.Fatalf("expected at most %d bytes buffered, got %d", defaultInitialWindowSize, n)
+	}
+
+	got, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("error reading body: %s", err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Fatalf("unexpected body of %d bytes", len(got))
+	}
+}
+
+func TestTransportReadBodyTimeout(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testdata/server.pem", "testdata/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	})
+	tr := &Transport{Dialer: &Dialer{
+		Config: &Config{ReadBodyTimeout: 50 * time.Millisecond},
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			c, s := net.Pipe()
+			go HTTPHandler(handler)(ServerConn(tls.Server(s, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				NextProtos:   []string{ProtocolTLS},
+			}), nil))
+			return tls.Client(c, &tls.Config{NextProtos: []string{ProtocolTLS}, InsecureSkipVerify: true}), nil
+		},
+	}}
+	defer tr.CloseIdleConnections()
+	defer close(done)
+
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("error sending request: %s", err)
+	}
+	defer res.Body.Close()
+
+	_, err = res.Body.Read(make([]byte, 1))
+	if se, ok := err.(StreamError); !ok || se.Err != ErrReadBodyTimeout || se.Reason != ReasonTimeout {
+		t.Fatalf("expected stream error with %v, got %v", ErrReadBodyTimeout, err)
+	}
+	if _, err := res.Body.Read(make([]byte, 1)); err == nil || err.(StreamError).Err != ErrReadBodyTimeout {
+		t.Fatalf("expected the error to be returned again, got %v", err)
+	}
+}
+
+func TestTransportPush(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testdata/server.pem", "testdata/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.(Pusher).Push("GET", "/style.css", nil)
+			w.(Pusher).Push("GET", "/script.js", nil)
+		}
+		io.WriteString(w, r.URL.Path)
+	})
+
+	// Only the push of /style.css is accepted.
+	pushed := make(chan *http.Response, 2)
+	tr := &Transport{
+		Dialer: &Dialer{
+			DialTLS: func(network, addr string) (net.Conn, error) {
+				c, s := net.Pipe()
+				go HTTPHandler(handler)(ServerConn(tls.Server(s, &tls.Config{
+					Certificates: []tls.Certificate{cert},
+					NextProtos:   []string{ProtocolTLS},
+				}), nil))
+				return tls.Client(c, &tls.Config{NextProtos: []string{ProtocolTLS}, InsecureSkipVerify: true}), nil
+			},
+		},
+		PushHandler: func(streamID uint32, header Header) func(*http.Response) {
+			if header.Path() != "/style.css" {
+				return nil
+			}
+			return func(res *http.Response) { pushed <- res }
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("error sending request: %s", err)
+	}
+	got, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("error reading body: %s", err)
+	}
+	if res.StatusCode != http.StatusOK || string(got) != "/" {
+		t.Fatalf("unexpected response %d %q", res.StatusCode, got)
+	}
+
+	select {
+	case res = <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the pushed response")
+	}
+	got, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Request.URL.String() != "https://example.com/style.css" || string(got) != "/style.css" {
+		t.Fatalf("unexpected pushed response %d for %s: %q", res.StatusCode, res.Request.URL, got)
+	}
+	select {
+	case res = <-pushed:
+		t.Fatalf("unexpected pushed response for %s", res.Request.URL)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// testPushCache is a PushCache without eviction.
+type testPushCache struct {
+	mu  sync.Mutex
+	res map[string]*http.Response
+	put chan string
+}
+
+func (c *testPushCache) Get(authority, path string) *http.Response {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res := c.res[authority+path]
+	delete(c.res, authority+path)
+	return res
+}
+
+func (c *testPushCache) Put(authority, path string, res *http.Response) {
+	c.mu.Lock()
+	c.res[authority+path] = res
+	c.mu.Unlock()
+	c.put <- authority + path
+}
+
+func TestTransportPushCache(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testdata/server.pem", "testdata/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var served int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.(Pusher).Push("GET", "/private.js", nil)
+			w.(Pusher).Push("GET", "/style.css", nil)
+		case "/private.js":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/style.css":
+			atomic.AddInt32(&served, 1)
+		}
+		io.WriteString(w, r.URL.Path)
+	})
+
+	cache := &testPushCache{res: make(map[string]*http.Response), put: make(chan string, 2)}
+	tr := &Transport{
+		Dialer: &Dialer{
+			DialTLS: func(network, addr string) (net.Conn, error) {
+				c, s := net.Pipe()
+				go HTTPHandler(handler)(ServerConn(tls.Server(s, &tls.Config{
+					Certificates: []tls.Certificate{cert},
+					NextProtos:   []string{ProtocolTLS},
+				}), nil))
+				return tls.Client(c, &tls.Config{NextProtos: []string{ProtocolTLS}, InsecureSkipVerify: true}), nil
+			},
+		},
+		PushCache: cache,
+	}
+	defer tr.CloseIdleConnections()
+
+	get := func(path string) string {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "https://example.com"+path, nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("error sending request: %s", err)
+		}
+		got, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("error reading body: %s", err)
+		}
+		if res.StatusCode != http.StatusOK || res.Request != req {
+			t.Fatalf("unexpected response %d for %v", res.StatusCode, res.Request)
+		}
+		return string(got)
+	}
+	if got := get("/"); got != "/" {
+		t.Fatalf("unexpected body %q", got)
+	}
+
+	// Only the cacheable pushed response is stored,
+	// and serves the request for it.
+	select {
+	case key := <-cache.put:
+		if key != "example.com:https/style.css" {
+			t.Fatalf("unexpected pushed response stored for %s", key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the pushed response")
+	}
+	if got := get("/style.css"); got != "/style.css" {
+		t.Fatalf("unexpected body %q", got)
+	}
+	if n := atomic.LoadInt32(&served); n != 1 {
+		t.Fatalf("expected /style.css to be served once, got %d", n)
+	}
+	select {
+	case key := <-cache.put:
+		t.Fatalf("unexpected pushed response stored for %s", key)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// The stored response is used once.
+	if got := get("/style.css"); got != "/style.css" {
+		t.Fatalf("unexpected body %q", got)
+	}
+	if n := atomic.LoadInt32(&served); n != 2 {
+		t.Fatalf("expected /style.css to be served twice, got %d", n)
+	}
+}
+
+func TestWindowUpdateZeroIncrement(t *testing.T) {
+	frames := make(chan Frame, 8)
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true, FrameLogger: func(dir string, frame Frame) {
+		if t := frame.Type(); dir == "recv" && (t == FrameRSTStream || t == FrameGoAway) {
+			frames <- frame
+		}
+	}}, nil)
+	server := ServerConn(s, nil)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	go func() {
+		for {
+			if _, err := server.ReadFrame(); err != nil {
+				if _, ok := err.(StreamError); !ok {
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	h := Header{}
+	h.SetMethod("POST")
+	h.SetScheme("http")
+	h.SetAuthority("example.com")
+	h.SetPath("/")
+	if err := client.WriteFrame(&HeadersFrame{StreamID: 1, Header: h}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if err := client.WriteFrame(&WindowUpdateFrame{StreamID: 1}); err == nil || err == ErrClosed {
+		t.Fatalf("expected error writing a zero increment, got %v", err)
+	}
+
+	// A zero increment is a stream error on a stream,
+	// and a connection error on stream 0.
+	for _, streamID := range []uint32{1, 0} {
+		if err := client.WriteFrame(&UnknownFrame{
+			FrameType:  FrameWindowUpdate,
+			StreamID:   streamID,
+			Payload:    bytes.NewReader(make([]byte, 4)),
+			PayloadLen: 4,
+		}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+
+		select {
+		case frame := <-frames:
+			switch v := frame.(type) {
+			case *RSTStreamFrame:
+				if streamID != 1 || v.StreamID != 1 || v.ErrCode != ErrCodeProtocol {
+					t.Fatalf("stream %d: unexpected %v", streamID, v)
+				}
+			case *GoAwayFrame:
+				if streamID != 0 || v.ErrCode != ErrCodeProtocol {
+					t.Fatalf("stream %d: unexpected %v", streamID, v)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("stream %d: expected %s error", streamID, ErrCodeProtocol)
+		}
+	}
+}
+
+func TestWindowUpdateOverflow(t *testing.T) {
+	frames := make(chan Frame, 8)
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true, FrameLogger: func(dir string, frame Frame) {
+		if t := frame.Type(); dir == "recv" && (t == FrameRSTStream || t == FrameGoAway) {
+			frames <- frame
+		}
+	}}, nil)
+	server := ServerConn(s, nil)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	go func() {
+		for {
+			if _, err := server.ReadFrame(); err != nil {
+				if _, ok := err.(StreamError); !ok {
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	h := Header{}
+	h.SetMethod("POST")
+	h.SetScheme("http")
+	h.SetAuthority("example.com")
+	h.SetPath("/")
+	for _, streamID := range []uint32{1, 3} {
+		if err := client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: h}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+	}
+
+	// The windows exceed 2^31-1 octets with the initial window. An
+	// overflow resets the stream, and closes the connection on stream 0.
+	for _, streamID := range []uint32{1, 0} {
+		if err := client.WriteFrame(&UnknownFrame{
+			FrameType:  FrameWindowUpdate,
+			StreamID:   streamID,
+			Payload:    bytes.NewReader([]byte{0x7f, 0xff, 0xff, 0xff}),
+			PayloadLen: 4,
+		}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+
+		select {
+		case frame := <-frames:
+			switch v := frame.(type) {
+			case *RSTStreamFrame:
+				if streamID != 1 || v.StreamID != 1 || v.ErrCode != ErrCodeFlowControl {
+					t.Fatalf("stream %d: unexpected %v", streamID, v)
+				}
+				if server.Closed() || server.stream(3) == nil {
+					t.Fatalf("stream %d: expected stream 3 to remain open", streamID)
+				}
+			case *GoAwayFrame:
+				if streamID != 0 || v.ErrCode != ErrCodeFlowControl {
+					t.Fatalf("stream %d: unexpected %v", streamID, v)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("stream %d: expected %s error", streamID, ErrCodeFlowControl)
+		}
+	}
+}
+
+func TestFrameLogger(t *testing.T) {
+	var mu sync.Mutex
+	var logged []string
+	logger := func(prefix string) func(string, Frame) {
+		return func(dir string, frame Frame) {
+			mu.Lock()
+			logged = append(logged, fmt.Sprintf("%s %s %s %d", prefix, dir, frame.Type(), frame.Stream()))
+			mu.Unlock()
+		}
+	}
+
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true, FrameLogger: logger("client")}, nil)
+	server := ServerConn(s, &Config{FrameLogger: logger("server")})
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	go func() {
+		for {
+			if _, err := server.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	h := Header{}
+	h.SetMethod("GET")
+	h.SetScheme("http")
+	h.SetAuthority("example.com")
+	h.SetPath("/")
+	if err := client.WriteFrame(&HeadersFrame{StreamID: 1, Header: h, EndStream: true}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	for server.NumActiveStreams() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	mu.Lock()
+	got := strings.Join(logged, "\n")
+	mu.Unlock()
+	for _, want := range []string{
+		"client send SETTINGS 0",
+		"server recv SETTINGS 0",
+		"client send HEADERS 1",
+		"server recv HEADERS 1",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected %q to be logged, got:\n%s", want, got)
+		}
+	}
+
+	want := `send HEADERS frame <flags=0x05, stream_id=1>
+          ; END_STREAM | END_HEADERS
+          (padlen=0)
+          :method: GET
+          :scheme: http
+          :authority: example.com
+          :path: /`
+	if got := FormatFrame("send", &HeadersFrame{StreamID: 1, Header: h, EndStream: true}); got != want {
+		t.Fatalf("unexpected format:\n%s", got)
+	}
+	want = `recv SETTINGS frame <flags=0x00, stream_id=0>
+          (niv=1)
+          [SETTINGS_MAX_CONCURRENT_STREAMS(0x03):100]`
+	if got := FormatFrame("recv", &SettingsFrame{Settings: Settings{{SettingMaxConcurrentStreams, 100}}}); got != want {
+		t.Fatalf("unexpected format:\n%s", got)
+	}
+}
+
+func TestOnStateChange(t *testing.T) {
+	var mu sync.Mutex
+	var changes []string
+	onStateChange := func(streamID uint32, from, to StreamState) {
+		mu.Lock()
+		changes = append(changes, fmt.Sprintf("%d: %s -> %s", streamID, from, to))
+		mu.Unlock()
+	}
+
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true, OnStateChange: onStateChange}, nil)
+	server := ServerConn(s, nil)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	go func() {
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				return
+			}
+			if frame.EndOfStream() {
+				go server.WriteFrame(&HeadersFrame{StreamID: frame.Stream(), Header: Header{":status": {"200"}}, EndStream: true})
+			}
+		}
+	}()
+	closed := make(chan struct{})
+	go func() {
+		for {
+			frame, err := client.ReadFrame()
+			if err != nil {
+				return
+			}
+			if frame.EndOfStream() {
+				close(closed)
+			}
+		}
+	}()
+
+	h := Header{}
+	h.SetMethod("GET")
+	h.SetScheme("http")
+	h.SetAuthority("example.com")
+	h.SetPath("/")
+	if err := client.WriteFrame(&HeadersFrame{StreamID: 1, Header: h}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if err := client.WriteFrame(&DataFrame{StreamID: 1, EndStream: true}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	<-closed
+	if err := client.WriteFrame(&HeadersFrame{StreamID: 3, Header: h}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if err := client.WriteFrame(&RSTStreamFrame{3, ErrCodeCancel}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+
+	want := []string{
+		"1: Idle -> Open",
+		"1: Open -> HalfClosedLocal",
+		"1: HalfClosedLocal -> Closed",
+		"3: Idle -> Open",
+		"3: Open -> Closed",
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("expected transitions %q, got %q", want, changes)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	// With prior knowledge, the client sends the connection preface
+	// at once, and the server accepts it without upgrade.
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true}, nil)
+	server := ServerConn(s, nil)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- client.Handshake() }()
+	if err := server.Handshake(); err != nil {
+		t.Fatalf("server handshake failed: %s", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("client handshake failed: %s", err)
+	}
+	go client.ReadFrame()
+
+	streamID, err := client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error creating new stream: %s", err)
+	}
+	if streamID != 1 {
+		t.Fatalf("expected stream 1, got %d", streamID)
+	}
+	if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{}, EndStream: true}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	for {
+		frame, err := server.ReadFrame()
+		if err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+		if frame.Type() == FrameHeaders {
+			break
+		}
+	}
+
+	// Cleartext HTTP/2 is rejected by default.
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if _, err = (&Transport{}).RoundTrip(req); err == nil {
+		t.Fatal("expected error sending cleartext request")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go (&Server{Handler: func(c *Conn) { c.Handshake() }}).Serve(l)
+
+	rwc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rwc.Close()
+	rwc.Write(clientPreface)
+	rwc.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = rwc.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected connection closed, got %v", err)
+	}
+}
+
+func TestBadConnPreface(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	server := ServerConn(s, nil)
+
+	// A TLS ClientHello sent over cleartext.
+	hello := append([]byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01}, make([]byte, 32)...)
+	go func() {
+		c.Write(hello)
+		io.Copy(io.Discard, c)
+	}()
+
+	err := server.Handshake()
+	connErr, ok := err.(ConnError)
+	if !ok || connErr.ErrCode != ErrCodeProtocol {
+		t.Fatalf("expected PROTOCOL_ERROR, got %v", err)
+	}
+	if !errors.Is(connErr.Err, errBadConnPreface) {
+		t.Fatalf("expected bad connection preface, got %v", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "16 03 01 02 00 01") || !strings.Contains(msg, "TLS") {
+		t.Fatalf("expected received octets in %q", msg)
+	}
+}
+
+func TestFirstFrameNotSettings(t *testing.T) {
+	for _, first := range [][]byte{
+		rawFrame(FrameData, FlagEndStream, 1, []byte("a")),
+		rawFrame(FrameSettings, FlagAck, 0, nil),
+	} {
+		c, s := net.Pipe()
+		server := ServerConn(s, nil)
+
+		goAway := make(chan *GoAwayFrame, 1)
+		go func() {
+			r := newFrameReader(c, 4096)
+			for {
+				frame, err := r.ReadFrame()
+				if err != nil {
+					close(goAway)
+					return
+				}
+				if v, ok := frame.(*GoAwayFrame); ok {
+					goAway <- v
+				}
+			}
+		}()
+		go func() {
+			c.Write(clientPreface)
+			c.Write(first)
+		}()
+
+		err := server.Handshake()
+		if ce, ok := err.(ConnError); !ok || ce.ErrCode != ErrCodeProtocol {
+			t.Fatalf("expected PROTOCOL_ERROR, got %v", err)
+		}
+		select {
+		case v := <-goAway:
+			if v == nil || v.ErrCode != ErrCodeProtocol {
+				t.Fatalf("expected GOAWAY with PROTOCOL_ERROR, got %v", v)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for GOAWAY frame")
+		}
+		c.Close()
+		server.CloseTimeout(0)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	c, s := net.Pipe()
+	authorities := make(chan string, 1)
+	client := ClientConn(c, &Config{PriorKnowledge: true}, nil)
+	server := ServerConn(s, &Config{ConnectHandler: func(authority string, tunnel io.ReadWriteCloser) {
+		authorities <- authority
+		io.Copy(tunnel, tunnel)
+		tunnel.Close()
+	}})
+	defer client.Close()
+	defer server.Close()
+
+	for _, conn := range []*Conn{client, server} {
+		go func(conn *Conn) {
+			for {
+				if _, err := conn.ReadFrame(); err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+
+	tunnel, err := client.Connect("example.com:443")
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+	if authority := <-authorities; authority != "example.com:443" {
+		t.Fatalf("expected authority example.com:443, got %s", authority)
+	}
+
+	// More than the initial flow-control window in each direction.
+	data := make([]byte, 4*defaultInitialWindowSize)
+	rand.Read(data)
+	go func() {
+		tunnel.Write(data)
+		tunnel.Close()
+	}()
+	echo, err := io.ReadAll(tunnel)
+	if err != nil {
+		t.Fatalf("error reading tunnel: %s", err)
+	}
+	if !bytes.Equal(echo, data) {
+		t.Fatalf("expected %d echoed bytes, got %d", len(data), len(echo))
+	}
+}
+
+func TestContinuationFlood(t *testing.T) {
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true}, nil)
+	server := ServerConn(s, &Config{MaxContinuationFrames: 2})
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		frames := []Frame{&UnknownFrame{FrameType: FrameHeaders, StreamID: 1, Payload: bytes.NewReader(nil)}}
+		for i := 0; i < 3; i++ {
+			frames = append(frames, &UnknownFrame{FrameType: FrameContinuation, StreamID: 1, Payload: bytes.NewReader(nil)})
+		}
+		for _, frame := range frames {
+			if err := client.WriteFrame(frame); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		_, err := server.ReadFrame()
+		if err == nil {
+			continue
+		}
+		if connErr, ok := err.(ConnError); !ok || connErr.ErrCode != ErrCodeEnhanceYourCalm {
+			t.Fatalf("expected ENHANCE_YOUR_CALM, got %v", err)
+		}
+		break
+	}
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	var settings Settings
+	settings.SetMaxConcurrentStreams(1)
+
+	// The client opens the streams with raw frames, ignoring the limit.
+	resets := make(chan *RSTStreamFrame, 1)
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true, FrameLogger: func(dir string, frame Frame) {
+		if v, ok := frame.(*RSTStreamFrame); ok && dir == "recv" {
+			resets <- v
+		}
+	}}, nil)
+	server := ServerConn(s, &Config{InitialSettings: settings})
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+	headers := make(chan *HeadersFrame, 2)
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if v, ok := frame.(*HeadersFrame); ok {
+				headers <- v
+			}
+		}
+	}()
+
+	for server.Settings().MaxConcurrentStreams() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, streamID := range []uint32{1, 3} {
+		if err := client.WriteFrame(&UnknownFrame{FrameType: FrameHeaders, StreamID: streamID, Flags: FlagEndHeaders, Payload: bytes.NewReader(nil)}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+	}
+
+	select {
+	case v := <-resets:
+		if v.StreamID != 3 || v.ErrCode != ErrCodeRefusedStream {
+			t.Fatalf("expected stream 3 refused, got %+v", v)
+		}
+	case err := <-errCh:
+		t.Fatalf("error reading frame: %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for RST_STREAM")
+	}
+	if v := <-headers; v.StreamID != 1 || len(headers) > 0 {
+		t.Fatalf("expected only the HEADERS of stream 1, got stream %d", v.StreamID)
+	}
+	if n := server.NumRemoteStreams(); n != 1 {
+		t.Fatalf("expected 1 remote stream, got %d", n)
+	}
+	if n := server.NumLocalStreams(); n != 0 {
+		t.Fatalf("expected no local stream, got %d", n)
+	}
+}
+
+func TestStreamIDReuse(t *testing.T) {
+	headers := func(streamID uint32) Frame {
+		return &UnknownFrame{FrameType: FrameHeaders, StreamID: streamID, Flags: FlagEndHeaders, Payload: bytes.NewReader(nil)}
+	}
+	// readHeaders returns the stream of the next HEADERS frame.
+	readHeaders := func(server *Conn) (uint32, error) {
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				return 0, err
+			}
+			if v, ok := frame.(*HeadersFrame); ok {
+				return v.StreamID, nil
+			}
+		}
+	}
+
+	for _, test := range []struct {
+		name      string
+		streamIDs []uint32
+	}{
+		{"decreasing", []uint32{5, 3}},
+		{"even", []uint32{4}},
+	} {
+		c, s := net.Pipe()
+		client := ClientConn(c, &Config{PriorKnowledge: true}, nil)
+		server := ServerConn(s, nil)
+		go func() {
+			for {
+				if _, err := client.ReadFrame(); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			for _, streamID := range test.streamIDs {
+				client.WriteFrame(headers(streamID))
+			}
+		}()
+
+		var err error
+		for err == nil {
+			_, err = readHeaders(server)
+		}
+		client.CloseTimeout(0)
+		server.CloseTimeout(0)
+		if connErr, ok := err.(ConnError); !ok || connErr.ErrCode != ErrCodeProtocol {
+			t.Fatalf("%s: expected PROTOCOL_ERROR, got %v", test.name, err)
+		}
+	}
+
+	// The frames in flight on a stream reset by the server are ignored.
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true}, nil)
+	server := ServerConn(s, nil)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	read := make(chan struct{})
+	go func() {
+		client.WriteFrame(headers(3))
+		<-read
+		client.WriteFrame(headers(3))
+		client.WriteFrame(headers(5))
+	}()
+	if streamID, err := readHeaders(server); err != nil || streamID != 3 {
+		t.Fatalf("expected HEADERS of stream 3, got stream %d with %v", streamID, err)
+	}
+	server.WriteFrame(&RSTStreamFrame{3, ErrCodeCancel})
+	close(read)
+	if streamID, err := readHeaders(server); err != nil || streamID != 5 {
+		t.Fatalf("expected HEADERS of stream 5, got stream %d with %v", streamID, err)
+	}
+}
+
+type statsRecorder struct {
+	sync.Mutex
+	opened  []uint32
+	closed  map[uint32]StreamState
+	read    map[FrameType]int
+	written map[FrameType]int
+	stalled int
+}
+
+func (r *statsRecorder) StreamOpened(streamID uint32) {
+	r.Lock()
+	r.opened = append(r.opened, streamID)
+	r.Unlock()
+}
+
+func (r *statsRecorder) StreamClosed(streamID uint32, state StreamState) {
+	r.Lock()
+	r.closed[streamID] = state
+	r.Unlock()
+}
+
+func (r *statsRecorder) FrameRead(frameType FrameType, size int) {
+	r.Lock()
+	r.read[frameType] += size
+	r.Unlock()
+}
+
+func (r *statsRecorder) FrameWritten(frameType FrameType, size int) {
+	r.Lock()
+	r.written[frameType] += size
+	r.Unlock()
+}
+
+func (r *statsRecorder) FlowControlStalled(streamID uint32, d time.Duration) {
+	r.Lock()
+	r.stalled++
+	r.Unlock()
+}
+
+func TestStatsQueueOverflow(t *testing.T) {
+	stats := &statsRecorder{
+		closed:  make(map[uint32]StreamState),
+		read:    make(map[FrameType]int),
+		written: make(map[FrameType]int),
+	}
+	// The events are queued while the recorder is locked. At most one batch
+	// is taken off the queue before its delivery blocks.
+	const n = 3 * maxQueuedStatsEvents
+	stats.Lock()
+	c := &Conn{stats: newStatsQueue(stats)}
+	for i := 0; i < n; i++ {
+		c.stats.frameRead(FramePing, 8)
+	}
+	c.stats.close()
+	dropped := c.DroppedStats()
+	stats.Unlock()
+	if dropped < maxQueuedStatsEvents {
+		t.Fatalf("expected at least %d events dropped, got %d", maxQueuedStatsEvents, dropped)
+	}
+
+	// The events not dropped are delivered.
+	want := 8 * (n - int(dropped))
+	deadline := time.Now().Add(time.Second)
+	for {
+		stats.Lock()
+		got := stats.read[FramePing]
+		stats.Unlock()
+		if got == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d octets read, got %d", want, got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	stats := &statsRecorder{
+		closed:  make(map[uint32]StreamState),
+		read:    make(map[FrameType]int),
+		written: make(map[FrameType]int),
+	}
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true, Stats: stats}, nil)
+	server := ServerConn(s, &Config{InitialSettings: Settings{setting{SettingInitialWindowSize, 100}}})
+	defer server.Close()
+
+	go func() {
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				return
+			}
+			// The window is updated after a delay.
+			if v, ok := frame.(*DataFrame); ok {
+				n, _ := server.readHeldData(v, io.Discard)
+				time.AfterFunc(time.Millisecond, func() { server.releaseData(v.StreamID, n) })
+			}
+			if frame.EndOfStream() {
+				header := Header{}
+				header.SetStatus("200")
+				server.WriteFrame(&HeadersFrame{StreamID: frame.Stream(), Header: header, EndStream: true})
+			}
+		}
+	}()
+
+	streamID, err := client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error creating new stream: %s", err)
+	}
+	if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{":method": {"POST"}}}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+
+	data := make([]byte, 1000)
+	go client.WriteFrame(&DataFrame{StreamID: streamID, Data: bytes.NewReader(data), DataLen: len(data), EndStream: true})
+
+	for {
+		frame, err := client.ReadFrame()
+		if err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+		if frame.Type() == FrameHeaders {
+			break
+		}
+	}
+	client.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		stats.Lock()
+		_, closed := stats.closed[streamID]
+		stats.Unlock()
+		if closed || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	stats.Lock()
+	defer stats.Unlock()
+
+	if !reflect.DeepEqual(stats.opened, []uint32{streamID}) {
+		t.Fatalf("expected opened stream %d, got %v", streamID, stats.opened)
+	}
+	if state := stats.closed[streamID]; state != StateHalfClosedLocal {
+		t.Fatalf("expected stream closed from %s, got %s", StateHalfClosedLocal, state)
+	}
+	if stats.written[FrameData] != len(data) {
+		t.Fatalf("expected %d DATA octets written, got %d", len(data), stats.written[FrameData])
+	}
+	if stats.read[FrameHeaders] == 0 || stats.read[FrameWindowUpdate] == 0 {
+		t.Fatalf("expected HEADERS and WINDOW_UPDATE frames read, got %v", stats.read)
+	}
+	if stats.stalled == 0 {
+		t.Fatal("expected flow control to stall")
+	}
+	if stalls := client.SendWindowStalls(); stalls.Stream+stalls.Conn != uint64(stats.stalled) || stalls.Stream == 0 {
+		t.Fatalf("expected %d stream stalls, got %+v", stats.stalled, stalls)
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	tests := []struct {
+		contentLength []string
+		data          []int
+		reset         bool
+	}{
+		{nil, []int{3}, false},
+		{[]string{"3"}, []int{1, 2}, false},
+		{[]string{"3, 3", "3"}, []int{3}, false},
+		{[]string{"3"}, []int{2}, true},
+		{[]string{"3"}, []int{2, 2}, true},
+		{[]string{"3, 4"}, []int{3}, true},
+		{[]string{"-1"}, []int{0}, true},
+		{[]string{"3"}, nil, true},
+	}
+	for i, tt := range tests {
+		c, s := net.Pipe()
+		client := ClientConn(c, &Config{PriorKnowledge: true}, nil)
+		server := ServerConn(s, nil)
+
+		ended := make(chan bool, 1)
+		go func() {
+			for {
+				frame, err := server.ReadFrame()
+				if err != nil {
+					if _, ok := err.(StreamError); ok {
+						continue
+					}
+					return
+				}
+				if frame.EndOfStream() {
+					ended <- true
+				}
+			}
+		}()
+
+		streamID, _ := client.NextStreamID()
+		header := Header{":method": {"POST"}, ":scheme": {"https"}, ":path": {"/"}}
+		if tt.contentLength != nil {
+			header["content-length"] = tt.contentLength
+		}
+		if err := client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: header, EndStream: tt.data == nil}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
 		}
+		go func() {
+			for j, n := range tt.data {
+				client.WriteFrame(&DataFrame{StreamID: streamID, Data: bytes.NewReader(make([]byte, n)), DataLen: n, EndStream: j == len(tt.data)-1})
+			}
+		}()
 
-		frame, err := server.ReadFrame()
+		if tt.reset {
+			for {
+				frame, err := client.ReadFrame()
+				if err != nil {
+					t.Fatalf("error reading frame: %s", err)
+				}
+				if v, ok := frame.(*RSTStreamFrame); ok {
+					if v.ErrCode != ErrCodeProtocol {
+						t.Fatalf("test %d: expected reset with %s, got %s", i, ErrCodeProtocol, v.ErrCode)
+					}
+					break
+				}
+			}
+		} else {
+			go func() {
+				for {
+					if _, err := client.ReadFrame(); err != nil {
+						return
+					}
+				}
+			}()
+			select {
+			case <-ended:
+			case <-time.After(time.Second):
+				t.Fatalf("test %d: expected the stream to end", i)
+			}
+		}
+
+		client.CloseTimeout(0)
+		server.CloseTimeout(0)
+	}
+}
+
+func TestWindowUpdateRatio(t *testing.T) {
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true}, nil)
+	server := ServerConn(s, &Config{WindowUpdateRatio: 0.9})
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	go func() {
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				return
+			}
+			if v, ok := frame.(*DataFrame); ok {
+				io.Copy(io.Discard, v.Data)
+			}
+		}
+	}()
+
+	streamID, err := client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error creating new stream: %s", err)
+	}
+	if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{":method": {"POST"}}}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+
+	// Less than the half, but more than a tenth of the window
+	// is consumed before it is updated.
+	const dataLen = 8000
+	go client.WriteFrame(&DataFrame{StreamID: streamID, Data: bytes.NewReader(make([]byte, dataLen)), DataLen: dataLen})
+
+	updated := make(map[uint32]uint32)
+	for len(updated) < 2 {
+		frame, err := client.ReadFrame()
 		if err != nil {
 			t.Fatalf("error reading frame: %s", err)
 		}
-		got, ok := frame.(*PingFrame)
-		if !ok {
-			t.Fatalf("expected ping frame, got %s", frame.Type())
+		if v, ok := frame.(*WindowUpdateFrame); ok {
+			updated[v.StreamID] += v.WindowSizeIncrement
 		}
-		if got.Ack {
-			t.Fatal("expected SYN ping frame")
+	}
+	if updated[0] != dataLen || updated[streamID] != dataLen {
+		t.Fatalf("expected window updates of %d, got %v", dataLen, updated)
+	}
+}
+
+func TestMaxStreamBufferSize(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		c, s := net.Pipe()
+		client := ClientConn(c, &Config{PriorKnowledge: true}, nil)
+		server := ServerConn(s, &Config{MaxStreamBufferSize: 1000, StrictStreamBuffer: strict})
+
+		go func() {
+			for {
+				frame, err := server.ReadFrame()
+				if err != nil {
+					if _, ok := err.(StreamError); ok {
+						continue
+					}
+					return
+				}
+				if v, ok := frame.(*DataFrame); ok {
+					io.Copy(io.Discard, v.Data)
+				}
+			}
+		}()
+
+		streamID, err := client.NextStreamID()
+		if err != nil {
+			t.Fatalf("error creating new stream: %s", err)
 		}
-		if !bytes.Equal(expected[:], got.Data[:]) {
-			t.Fatalf("expected %v, got %v", expected, got.Data[:])
+		if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{":method": {"POST"}}}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
 		}
 
-		frame, err = client.ReadFrame()
+		// The whole initial window is consumed, but the stream
+		// window is only restored up to the buffer size, or the
+		// stream is reset once it is exceeded.
+		dataLen := defaultInitialWindowSize
+		if strict {
+			dataLen = 2000
+		}
+		go client.WriteFrame(&DataFrame{StreamID: streamID, Data: bytes.NewReader(make([]byte, dataLen)), DataLen: dataLen})
+
+		for {
+			frame, err := client.ReadFrame()
+			if err != nil {
+				t.Fatalf("error reading frame: %s", err)
+			}
+			if v, ok := frame.(*WindowUpdateFrame); ok && v.StreamID == streamID {
+				if strict || v.WindowSizeIncrement != 1000 {
+					t.Fatalf("unexpected window update of %d", v.WindowSizeIncrement)
+				}
+				break
+			}
+			if v, ok := frame.(*RSTStreamFrame); ok {
+				if !strict || v.ErrCode != ErrCodeFlowControl {
+					t.Fatalf("unexpected reset with %s", v.ErrCode)
+				}
+				break
+			}
+		}
+
+		client.CloseTimeout(0)
+		server.CloseTimeout(0)
+	}
+}
+
+func TestWindowUpdateDelay(t *testing.T) {
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true}, nil)
+	server := ServerConn(s, &Config{WindowUpdateRatio: 0.99, WindowUpdateDelay: 50 * time.Millisecond})
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	go func() {
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				return
+			}
+			if v, ok := frame.(*DataFrame); ok {
+				io.Copy(io.Discard, v.Data)
+			}
+		}
+	}()
+
+	streamID, err := client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error creating new stream: %s", err)
+	}
+	if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{":method": {"POST"}}}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+
+	// Each DATA frame exceeds the ratio of the window, and the
+	// increments are coalesced in a single update per stream.
+	const n, dataLen = 10, 1000
+	go func() {
+		for i := 0; i < n; i++ {
+			client.WriteFrame(&DataFrame{StreamID: streamID, Data: bytes.NewReader(make([]byte, dataLen)), DataLen: dataLen})
+		}
+	}()
+
+	updates := make(map[uint32][]uint32)
+	for len(updates) < 2 {
+		frame, err := client.ReadFrame()
 		if err != nil {
 			t.Fatalf("error reading frame: %s", err)
 		}
-		got, ok = frame.(*PingFrame)
-		if !ok {
-			t.Fatalf("expected ACK ping frame, got %s", frame.Type())
+		if v, ok := frame.(*WindowUpdateFrame); ok {
+			updates[v.StreamID] = append(updates[v.StreamID], v.WindowSizeIncrement)
 		}
-		if !got.Ack {
-			t.Fatal("expected ACK ping frame")
+	}
+	for _, id := range []uint32{0, streamID} {
+		if len(updates[id]) != 1 || updates[id][0] != n*dataLen {
+			t.Fatalf("expected a window update of %d for stream %d, got %v", n*dataLen, id, updates[id])
 		}
-		if !bytes.Equal(expected[:], got.Data[:]) {
-			t.Fatalf("expected %v, got %v", expected, got.Data[:])
+	}
+}
+
+func TestFlowControlTimeout(t *testing.T) {
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true, FlowControlTimeout: 50 * time.Millisecond}, nil)
+	server := ServerConn(s, nil)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	// The server holds the data, without returning it to the windows.
+	held := make(chan int, 16)
+	go func() {
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				return
+			}
+			if v, ok := frame.(*DataFrame); ok {
+				n, _ := server.readHeldData(v, io.Discard)
+				held <- n
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	streamID, _ := client.NextStreamID()
+	if err := client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{":method": {"POST"}}}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+
+	dataLen := defaultInitialWindowSize + 1000
+	err := client.WriteFrame(&DataFrame{StreamID: streamID, Data: bytes.NewReader(make([]byte, dataLen)), DataLen: dataLen})
+	if err != ErrFlowControlTimeout {
+		t.Fatalf("expected %v, got %v", ErrFlowControlTimeout, err)
+	}
+
+	// The window is available again once the server returns the data.
+	var n int
+	for n < dataLen-1000 {
+		n += <-held
+	}
+	server.releaseData(streamID, n)
+	if err = client.WriteFrame(&DataFrame{StreamID: streamID, Data: bytes.NewReader(make([]byte, 1000)), DataLen: 1000}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+}
+
+func TestConnWindowOnStreamClose(t *testing.T) {
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true}, nil)
+	server := ServerConn(s, nil)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	// The server holds the data, without returning it to the windows.
+	held := make(chan int, 16)
+	go func() {
+		for {
+			frame, err := server.ReadFrame()
+			if err != nil {
+				if _, ok := err.(StreamError); ok {
+					continue
+				}
+				return
+			}
+			if v, ok := frame.(*DataFrame); ok {
+				n, _ := server.readHeldData(v, io.Discard)
+				held <- n
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var streams [2]uint32
+	for i := range streams {
+		streams[i], _ = client.NextStreamID()
+		if err := client.WriteFrame(&HeadersFrame{StreamID: streams[i], Header: Header{":method": {"POST"}}}); err != nil {
+			t.Fatalf("error writing frame: %s", err)
+		}
+	}
+
+	// The first stream takes the whole connection window, and the second
+	// one waits for it with the window of the stream taken.
+	const window = defaultInitialWindowSize
+	if err := client.WriteFrame(&DataFrame{StreamID: streams[0], Data: bytes.NewReader(make([]byte, window)), DataLen: window}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- client.WriteFrame(&DataFrame{StreamID: streams[1], Data: bytes.NewReader(make([]byte, 1000)), DataLen: 1000})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := client.WriteFrame(&RSTStreamFrame{streams[1], ErrCodeCancel}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	if err := <-errc; err == nil {
+		t.Fatal("expected error writing to a closed stream")
+	}
+
+	var n int
+	for n < window {
+		n += <-held
+	}
+	server.releaseData(streams[0], n)
+	for deadline := time.Now().Add(time.Second); client.SendWindow(0) < window && time.Now().Before(deadline); {
+		client.connStream.sendFlow.cancel()
+		time.Sleep(time.Millisecond)
+	}
+	if got := client.SendWindow(0); got != window {
+		t.Fatalf("expected connection send window %d, got %d", window, got)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true}, nil)
+	server := ServerConn(s, &Config{IdleTimeout: 50 * time.Millisecond})
+	defer client.CloseTimeout(0)
+
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := server.ReadFrame(); err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+
+	streamID, err := client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error creating new stream: %s", err)
+	}
+	if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{}, EndStream: true}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+
+	// The active stream keeps the connection open.
+	time.Sleep(100 * time.Millisecond)
+	if server.Closed() {
+		t.Fatal("expected connection with an active stream to stay open")
+	}
+	if err = server.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{":status": {"200"}}, EndStream: true}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+
+	for {
+		frame, err := client.ReadFrame()
+		if err != nil {
+			t.Fatalf("error reading frame: %s", err)
+		}
+		if v, ok := frame.(*GoAwayFrame); ok {
+			if v.ErrCode != ErrCodeNo {
+				t.Fatalf("expected GOAWAY with NO_ERROR, got %s", v.ErrCode)
+			}
+			break
+		}
+	}
+	if err = <-errCh; err != ErrIdleTimeout {
+		t.Fatalf("expected %v, got %v", ErrIdleTimeout, err)
+	}
+}
+
+func TestSettingsTimeout(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	server := ServerConn(s, &Config{SettingsTimeout: 50 * time.Millisecond})
+
+	// The client sends its connection preface,
+	// but never acknowledges the server SETTINGS.
+	go func() {
+		c.Write(clientPreface)
+		c.Write([]byte{0, 0, 0, byte(FrameSettings), 0, 0, 0, 0, 0})
+		io.Copy(io.Discard, c)
+	}()
+
+	for {
+		if _, err := server.ReadFrame(); err != nil {
+			break
+		}
+	}
+	sent, goAway := server.GoAwaySent()
+	if !sent || goAway.ErrCode != ErrCodeSettingsTimeout {
+		t.Fatalf("expected GOAWAY with SETTINGS_TIMEOUT, got %v", goAway)
+	}
+}
+
+func TestInterimResponse(t *testing.T) {
+	c, s := net.Pipe()
+	client := ClientConn(c, &Config{PriorKnowledge: true}, nil)
+	server := ServerConn(s, nil)
+	defer client.CloseTimeout(0)
+	defer server.CloseTimeout(0)
+
+	go func() {
+		for {
+			if _, err := server.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	streamID, err := client.NextStreamID()
+	if err != nil {
+		t.Fatalf("error creating new stream: %s", err)
+	}
+	if err = client.WriteFrame(&HeadersFrame{StreamID: streamID, Header: Header{":method": {"GET"}}, EndStream: true}); err != nil {
+		t.Fatalf("error writing frame: %s", err)
+	}
+	for server.NumActiveStreams() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	status := func(code string) Header { return Header{":status": {code}, "link": {"</style.css>; rel=preload"}} }
+	writes := []struct {
+		frame Frame
+		ok    bool
+	}{
+		{&HeadersFrame{StreamID: streamID, Header: status("103")}, true},
+		{&HeadersFrame{StreamID: streamID, Header: status("101")}, false},
+		{&HeadersFrame{StreamID: streamID, Header: status("100"), EndStream: true}, false},
+		{&DataFrame{StreamID: streamID, Data: bytes.NewReader(nil)}, false},
+		{&HeadersFrame{StreamID: streamID, Header: status("103")}, true},
+		{&HeadersFrame{StreamID: streamID, Header: status("200")}, true},
+		{&HeadersFrame{StreamID: streamID, Header: status("200")}, false},
+		{&HeadersFrame{StreamID: streamID, Header: status("100")}, false},
+		{&DataFrame{StreamID: streamID, Data: bytes.NewReader(nil), EndStream: true}, true},
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		for i, w := range writes {
+			if err := server.WriteFrame(w.frame); (err == nil) != w.ok {
+				errCh <- fmt.Errorf("write %d: expected success %v, got %v", i, w.ok, err)
+				return
+			}
+		}
+		errCh <- nil
+	}()
+
+	var statuses []string
+	for {
+		frame, err := client.ReadFrame()
+		if err != nil {
+			t.Fatalf("error reading frame: %s", err)
 		}
+		if v, ok := frame.(*HeadersFrame); ok {
+			statuses = append(statuses, v.Status())
+		}
+		if frame.EndOfStream() {
+			break
+		}
+	}
+	if err = <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"103", "103", "200"}; !reflect.DeepEqual(statuses, expected) {
+		t.Fatalf("expected statuses %v, got %v", expected, statuses)
 	}
 }
 
@@ -351,11 +6019,13 @@ func benchmarkConnReadWrite(b *testing.B, overTLS bool, n, c int) {
 			for range ch {
 				streamID, err := client.NextStreamID()
 				if err != nil {
-					b.Fatal(err)
+					b.Error(err)
+					break
 				}
 				err = client.writeBytes(streamID, n)
 				if err != nil {
-					b.Fatal(err)
+					b.Error(err)
+					break
 				}
 			}
 			wg.Done()
@@ -426,6 +6096,174 @@ func (c *conn) writeBytes(streamID uint32, n int) (err error) {
 	return
 }
 
+// rawFrame returns the octets of a frame with the given header and payload,
+// which need not be valid.
+func rawFrame(frameType FrameType, flags Flags, streamID uint32, payload []byte) []byte {
+	n := len(payload)
+	b := []byte{byte(n >> 16), byte(n >> 8), byte(n), byte(frameType), byte(flags), 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[5:], streamID)
+	return append(b, payload...)
+}
+
+// rawPeer is the client of a server Conn over an in-memory connection,
+// writing raw frames to it and capturing the frames it writes, for the
+// tests of protocol edge cases. The Conn is read in the background, and
+// the SETTINGS frames it writes are acknowledged.
+type rawPeer struct {
+	t    *testing.T
+	conn *Conn
+	c    net.Conn
+
+	writeL sync.Mutex
+	w      *frameWriter
+	wbuf   *bytes.Buffer
+
+	frames chan Frame
+}
+
+func newRawPeer(t *testing.T, config *Config) *rawPeer {
+	return newServingRawPeer(t, config, func(c *Conn) {
+		for {
+			if _, err := c.ReadFrame(); err != nil {
+				if _, ok := err.(StreamError); !ok {
+					return
+				}
+			}
+		}
+	})
+}
+
+// newServingRawPeer returns a rawPeer of which the Conn
+// is served by serve, such as the one of HTTPHandler.
+func newServingRawPeer(t *testing.T, config *Config, serve func(c *Conn)) *rawPeer {
+	c, s := net.Pipe()
+	p := &rawPeer{t: t, conn: ServerConn(s, config), c: c, wbuf: new(bytes.Buffer), frames: make(chan Frame, 100)}
+	p.w = newFrameWriter(p.wbuf)
+
+	go serve(p.conn)
+	go func() {
+		defer close(p.frames)
+		r := newFrameReader(c, 4096)
+		for {
+			frame, err := r.ReadFrame()
+			if err != nil {
+				if _, ok := err.(StreamError); ok {
+					continue
+				}
+				return
+			}
+			switch v := frame.(type) {
+			case *DataFrame:
+				io.Copy(io.Discard, v.Data)
+			case *SettingsFrame:
+				// The net.Pipe writes block until read, so the
+				// frames of the Conn are read while acknowledging.
+				if !v.Ack {
+					go p.write(rawFrame(FrameSettings, FlagAck, 0, nil))
+				}
+			}
+			p.frames <- frame
+		}
+	}()
+
+	p.write(clientPreface)
+	p.writeFrame(&SettingsFrame{})
+	t.Cleanup(func() {
+		c.Close()
+		p.conn.CloseTimeout(0)
+	})
+	return p
+}
+
+// write writes raw octets to the Conn, ignoring the
+// error of a connection closed by the Conn.
+func (p *rawPeer) write(b []byte) {
+	p.writeL.Lock()
+	defer p.writeL.Unlock()
+
+	p.c.Write(b)
+}
+
+// writeFrame encodes a frame, as the header blocks are encoded
+// with the HPACK state of the connection.
+func (p *rawPeer) writeFrame(frame Frame) {
+	p.writeL.Lock()
+	p.wbuf.Reset()
+	err := p.w.WriteFrame(frame)
+	b := append([]byte(nil), p.wbuf.Bytes()...)
+	p.writeL.Unlock()
+
+	if err != nil {
+		p.t.Fatalf("error encoding frame: %s", err)
+	}
+	p.write(b)
+}
+
+// openStream opens a stream with a GET request not ending it.
+func (p *rawPeer) openStream(streamID uint32) {
+	header := Header{":method": {"GET"}, ":scheme": {"https"}, ":path": {"/"}}
+	p.writeFrame(&HeadersFrame{StreamID: streamID, Header: header})
+}
+
+// readFrame returns the next frame written by the Conn, other than the
+// SETTINGS and WINDOW_UPDATE ones, or nil once the connection is closed.
+func (p *rawPeer) readFrame() Frame {
+	p.t.Helper()
+	for {
+		select {
+		case frame, ok := <-p.frames:
+			if !ok {
+				return nil
+			}
+			switch frame.Type() {
+			case FrameSettings, FrameWindowUpdate:
+				continue
+			}
+			return frame
+		case <-time.After(time.Second):
+			p.t.Fatal("timeout reading frame")
+		}
+	}
+}
+
+// expectGoAway fails unless the Conn writes a GOAWAY frame with code,
+// which it returns.
+func (p *rawPeer) expectGoAway(code ErrCode) *GoAwayFrame {
+	p.t.Helper()
+	for {
+		switch v := p.readFrame().(type) {
+		case nil:
+			p.t.Fatalf("expected GOAWAY frame with %s, got connection closed", code)
+		case *GoAwayFrame:
+			if v.ErrCode != code {
+				p.t.Fatalf("expected GOAWAY frame with %s, got %s %q", code, v.ErrCode, v.DebugData)
+			}
+			return v
+		case *RSTStreamFrame:
+			p.t.Fatalf("expected GOAWAY frame with %s, got RST_STREAM frame with %s", code, v.ErrCode)
+		}
+	}
+}
+
+// expectReset fails unless the Conn writes a RST_STREAM frame with code
+// for the stream, without closing the connection.
+func (p *rawPeer) expectReset(streamID uint32, code ErrCode) {
+	p.t.Helper()
+	for {
+		switch v := p.readFrame().(type) {
+		case nil:
+			p.t.Fatalf("expected RST_STREAM frame with %s, got connection closed", code)
+		case *GoAwayFrame:
+			p.t.Fatalf("expected RST_STREAM frame with %s, got GOAWAY frame with %s %q", code, v.ErrCode, v.DebugData)
+		case *RSTStreamFrame:
+			if v.StreamID != streamID || v.ErrCode != code {
+				p.t.Fatalf("expected RST_STREAM frame with %s for stream %d, got %s for %d", code, streamID, v.ErrCode, v.StreamID)
+			}
+			return
+		}
+	}
+}
+
 func pipe(fake, overTLS, skipHandshake bool) (client, server *Conn) {
 	var c, s net.Conn
 
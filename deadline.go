@@ -0,0 +1,163 @@
+package http2
+
+import (
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SetDeadline sets the read and write deadlines of the connection, as
+// SetReadDeadline and SetWriteDeadline.
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for reading the connection, a zero
+// value clearing it. Unlike with a net.Conn, the reads of the underlying
+// connection are not interrupted, which could leave a frame partially read:
+// once the deadline is exceeded, a GOAWAY frame is sent and the connection
+// is closed, after which ReadFrame and Err return os.ErrDeadlineExceeded.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	if c.Closed() {
+		return ErrClosed
+	}
+	c.readDeadline.set(t, c.readDeadlineExceeded)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for writing the connection, a zero
+// value clearing it. Once it is exceeded, WriteFrame fails with
+// os.ErrDeadlineExceeded, as do the writes of DATA frames waiting for the
+// flow-control windows, until the deadline is extended.
+//
+// The deadline is also set on the underlying connection, so that a write
+// blocked on it is interrupted. As a frame may then have been partially
+// written, the connection is closed, and Err returns os.ErrDeadlineExceeded.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	if c.Closed() {
+		return ErrClosed
+	}
+	if nc, ok := c.rwc.(net.Conn); ok {
+		if err := nc.SetWriteDeadline(t); err != nil {
+			return err
+		}
+	}
+	c.writeDeadline.set(t, nil)
+	return nil
+}
+
+// goAwayFlushTimeout is how long the GOAWAY frame sent once the read
+// deadline is exceeded is waited for to be flushed.
+const goAwayFlushTimeout = time.Second
+
+// readDeadlineExceeded closes the connection once the read deadline is
+// exceeded, after flushing a GOAWAY frame if the handshake is complete.
+// A handshake still running is not waited for.
+func (c *Conn) readDeadlineExceeded() {
+	if c.Closed() {
+		return
+	}
+	c.closeErr.Store(os.ErrDeadlineExceeded)
+
+	if atomic.CompareAndSwapInt32(&c.closing, 0, 1) && c.handshakeL.TryLock() {
+		complete := c.handshakeComplete
+		c.handshakeL.Unlock()
+
+		if complete {
+			c.writeFrame(&GoAwayFrame{LastStreamID: c.LastStreamID(), ErrCode: ErrCodeNo})
+
+			timer := time.NewTimer(goAwayFlushTimeout)
+			select {
+			case <-c.flush():
+			case <-c.closeCh:
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+	}
+	c.close()
+}
+
+// writeDeadlineExceeded reports whether the write deadline is exceeded.
+func (c *Conn) writeDeadlineExceeded() bool {
+	select {
+	case <-c.writeDeadline.done():
+		return true
+	default:
+		return false
+	}
+}
+
+// A deadline is a deadline of a connection, of which the done channel is
+// closed once it is exceeded, and replaced when it is extended again. The
+// zero value is a deadline not set.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	doneCh chan struct{}
+}
+
+// set sets the deadline to t, calling exceeded, if not nil, from another
+// goroutine once it is exceeded.
+func (d *deadline) set(t time.Time, exceeded func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if d.doneCh == nil || isClosedChan(d.doneCh) {
+		d.doneCh = make(chan struct{})
+	}
+	if t.IsZero() {
+		return
+	}
+
+	doneCh := d.doneCh
+	expire := func() {
+		d.mu.Lock()
+		current := d.doneCh == doneCh && !isClosedChan(doneCh)
+		if current {
+			close(doneCh)
+		}
+		d.mu.Unlock()
+
+		if current && exceeded != nil {
+			exceeded()
+		}
+	}
+	dur := time.Until(t)
+	if dur > 0 {
+		d.timer = time.AfterFunc(dur, expire)
+		return
+	}
+	close(doneCh)
+	if exceeded != nil {
+		go exceeded()
+	}
+}
+
+func (d *deadline) done() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.doneCh == nil {
+		d.doneCh = make(chan struct{})
+	}
+	return d.doneCh
+}
+
+func isClosedChan(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -2,7 +2,11 @@ package http2
 
 import (
 	"errors"
+	"fmt"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // InitialRecvWindow returns the initial receive flow control
@@ -48,7 +52,7 @@ func (c *Conn) setInitialRecvWindow(delta int) error {
 	for _, stream := range c.streams {
 		if stream.readable() {
 			if err := stream.recvFlow.incrementInitialWindow(delta); err != nil {
-				errors.add(stream.id, ErrCodeFlowControl, err)
+				errors.add(stream.id, ErrCodeFlowControl, err, ReasonFlowControl)
 			}
 		}
 	}
@@ -63,6 +67,9 @@ type flowController struct {
 	winLowerBound,
 	winUpperBound,
 	processedWin int
+
+	// rate estimates the rate at which the received bytes are returned.
+	rate rateEstimator
 }
 
 func (c *flowController) initialWindow() uint32 {
@@ -130,15 +137,27 @@ func (c *flowController) consumeBytes(n int) error {
 		if c.s.id == 0 {
 			return ConnError{errors.New("window size limit exceeded"), ErrCodeFlowControl}
 		}
-		return StreamError{errors.New("window size limit exceeded"), ErrCodeFlowControl, c.s.id}
+		return StreamError{errors.New("window size limit exceeded"), ErrCodeFlowControl, c.s.id, ReasonFlowControl}
+	}
+	if max := c.s.conn.config.MaxStreamBufferSize; c.s.id != 0 && max > 0 &&
+		c.s.conn.config.StrictStreamBuffer && c.processedWin-c.win > max {
+		return StreamError{fmt.Errorf("stream buffer size limit %d exceeded", max), ErrCodeFlowControl, c.s.id, ReasonFlowControl}
 	}
 	return nil
 }
 
 func (c *flowController) returnBytes(delta int) error {
+	if delta <= 0 {
+		return nil
+	}
+
 	c.Lock()
 	defer c.Unlock()
 
+	return c.returnBytesLocked(delta)
+}
+
+func (c *flowController) returnBytesLocked(delta int) error {
 	if c.s.id != 0 {
 		if err := c.s.conn.connStream.recvFlow.returnBytes(delta); err != nil {
 			return err
@@ -148,14 +167,30 @@ func (c *flowController) returnBytes(delta int) error {
 		if c.s.id == 0 {
 			return ConnError{errors.New("attempting to return too many bytes"), ErrCodeInternal}
 		}
-		return StreamError{errors.New("attempting to return too many bytes"), ErrCodeInternal, c.s.id}
+		return StreamError{errors.New("attempting to return too many bytes"), ErrCodeInternal, c.s.id, ReasonFlowControl}
 	}
 	c.processedWin -= delta
+	c.rate.add(delta, c.s.conn.RTT())
 	return c.windowUpdate()
 }
 
+// returnConsumedBytes is like returnBytes, but returns at most
+// the bytes consumed and not returned yet.
+func (c *flowController) returnConsumedBytes(delta int) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if consumed := c.processedWin - c.win; delta > consumed {
+		delta = consumed
+	}
+	if delta <= 0 {
+		return nil
+	}
+	return c.returnBytesLocked(delta)
+}
+
 func (c *flowController) updateWindow(delta int) error {
-	if delta > 0 && maxInitialWindowSize-delta < c.win {
+	if delta > 0 && maxWindowSize-delta < c.win {
 		return errors.New("window size overflow")
 	}
 	c.win += delta
@@ -175,18 +210,28 @@ func (c *flowController) updateInitialWindow(delta int) {
 	if n > maxInitialWindowSize {
 		n = maxInitialWindowSize
 	}
+	if max := c.maxStreamWindow(); n > max {
+		n = max
+	}
 	delta = n - c.winUpperBound
 	c.winUpperBound += delta
 }
 
+// maxStreamWindow returns the size the receive window of the stream is
+// restored up to at most, which is the MaxStreamBufferSize of the Config.
+func (c *flowController) maxStreamWindow() int {
+	if max := c.s.conn.config.MaxStreamBufferSize; c.s.id != 0 && max > 0 {
+		return max
+	}
+	return maxInitialWindowSize
+}
+
 func (c *flowController) windowUpdate() error {
 	if c.winUpperBound <= 0 {
 		return nil
 	}
 
-	const windowUpdateRatio = 0.5
-
-	threshold := int(float32(c.winUpperBound) * windowUpdateRatio)
+	threshold := int(float32(c.winUpperBound) * c.s.conn.windowUpdateRatio)
 	if c.processedWin > threshold {
 		return nil
 	}
@@ -196,15 +241,197 @@ func (c *flowController) windowUpdate() error {
 		return ConnError{errors.New("attempting to return too many bytes"), ErrCodeInternal}
 	}
 
-	c.s.conn.writeQueue.add(&WindowUpdateFrame{c.s.id, uint32(delta)}, true)
+	if c.s.conn.config.WindowUpdateDelay <= 0 {
+		c.s.conn.writeQueue.add(&WindowUpdateFrame{c.s.id, uint32(delta)}, true)
+		return nil
+	}
+
+	c.s.conn.addWindowUpdate(c.s.id, delta, c.winUpperBound)
 
 	return nil
 }
 
+// addWindowUpdate adds delta to the pending window increment of the
+// stream, which is sent within WindowUpdateDelay. The increments of a
+// flowController add up to the returned bytes. They are sent at once
+// when they reach the window size, as the remote endpoint cannot send
+// anything more on the stream until then.
+func (c *Conn) addWindowUpdate(streamID uint32, delta, window int) {
+	c.windowUpdateL.Lock()
+	c.windowUpdates[streamID] += delta
+	flush := c.windowUpdates[streamID] >= window
+	if !flush && c.windowUpdateTimer == nil {
+		c.windowUpdateTimer = time.AfterFunc(c.config.WindowUpdateDelay, c.flushWindowUpdates)
+	}
+	c.windowUpdateL.Unlock()
+
+	if flush {
+		c.flushWindowUpdates()
+	}
+}
+
+// flushWindowUpdates sends the pending window increments, coalesced
+// in a WINDOW_UPDATE frame per stream, the connection one first.
+func (c *Conn) flushWindowUpdates() {
+	c.windowUpdateL.Lock()
+	updates := c.windowUpdates
+	c.windowUpdates = make(map[uint32]int)
+	if c.windowUpdateTimer != nil {
+		c.windowUpdateTimer.Stop()
+		c.windowUpdateTimer = nil
+	}
+	c.windowUpdateL.Unlock()
+
+	if delta, ok := updates[0]; ok {
+		c.writeQueue.add(&WindowUpdateFrame{0, uint32(delta)}, true)
+		delete(updates, 0)
+	}
+	for streamID, delta := range updates {
+		c.writeQueue.add(&WindowUpdateFrame{streamID, uint32(delta)}, true)
+	}
+}
+
+// discardWindowUpdate discards the pending window increment of a closed
+// stream, on which the remote endpoint cannot send anymore. The bytes
+// are still returned to the connection window.
+func (c *Conn) discardWindowUpdate(streamID uint32) {
+	c.windowUpdateL.Lock()
+	delete(c.windowUpdates, streamID)
+	c.windowUpdateL.Unlock()
+}
+
+// windowTunerPing is the payload of the PING frames sent by windowTuner.
+var windowTunerPing = [8]byte{'w', 'i', 'n', 'd', 'o', 'w', 0, 0}
+
+// windowTunerInterval is the minimum number of round trips between the
+// samples of windowTuner, and windowTunerMinInterval the minimum duration.
+const (
+	windowTunerInterval    = 16
+	windowTunerMinInterval = 100 * time.Millisecond
+)
+
+// windowTuner adjusts the receive flow control windows to the measured
+// bandwidth-delay product of the connection. When DATA is received it
+// sends a PING frame, and counts the bytes received until the ACK arrives,
+// one round trip later. If the sampled bytes come close to the connection
+// window, the remote endpoint is limited by it and the windows are grown,
+// up to the maximum window size. If the sample is small, the windows are
+// shrunk back towards their initial size. Samples are taken at most once
+// every windowTunerInterval round trips, so that the remote endpoint is not
+// flooded with PING frames for the whole transfer.
+//
+// A windowTuner is only used by the goroutine reading frames.
+type windowTuner struct {
+	conn    *Conn
+	pinging bool
+	sentAt  time.Time
+	next    time.Time
+	sample  int
+
+	// streamWindow is the tuned stream window size,
+	// or zero if the streams are not tuned.
+	streamWindow int
+}
+
+func (t *windowTuner) received(n int) {
+	if n <= 0 && !t.pinging {
+		return
+	}
+	if !t.pinging {
+		now := time.Now()
+		if now.Before(t.next) {
+			return
+		}
+		t.pinging = true
+		t.sentAt = now
+		t.sample = 0
+		t.conn.writeQueue.add(&PingFrame{Data: windowTunerPing}, true)
+	}
+	t.sample += n
+}
+
+func (t *windowTuner) ack(data [8]byte) error {
+	if !t.pinging || data != windowTunerPing {
+		return nil
+	}
+	t.pinging = false
+
+	now := time.Now()
+	t.conn.sampleRTT(now.Sub(t.sentAt))
+
+	// The samples are spaced by the smoothed round-trip time,
+	// which the other PING frames acknowledged refine too.
+	interval := windowTunerInterval * t.conn.RTT()
+	if interval < windowTunerMinInterval {
+		interval = windowTunerMinInterval
+	}
+	t.next = now.Add(interval)
+
+	c := t.conn
+	win := int(c.connStream.recvFlow.initialWindow())
+
+	// The bytes received within one round trip are the bandwidth-delay
+	// product of the connection.
+	target := win
+	switch {
+	case t.sample >= win*2/3:
+		target = 2 * t.sample
+	case t.sample < win/4:
+		target = 2 * t.sample
+		if target < defaultInitialWindowSize {
+			target = defaultInitialWindowSize
+		}
+	}
+	if target > maxInitialWindowSize {
+		target = maxInitialWindowSize
+	}
+	if target == win {
+		return nil
+	}
+
+	if err := c.connStream.recvFlow.incrementWindow(target - win); err != nil {
+		return err
+	}
+
+	// Streams are never tuned below the initial window size of the settings.
+	t.streamWindow = target
+	if initial := int(c.localSettings().InitialWindowSize()); target <= initial {
+		t.streamWindow = 0
+		target = initial
+	}
+
+	var streams []*stream
+
+	c.streamL.RLock()
+	for _, stream := range c.streams {
+		if stream.readable() {
+			streams = append(streams, stream)
+		}
+	}
+	c.streamL.RUnlock()
+
+	for _, stream := range streams {
+		if err := stream.recvFlow.incrementWindow(target - int(stream.recvFlow.initialWindow())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// open grows the receive window of a stream opened by the remote
+// endpoint to the tuned stream window size.
+func (t *windowTuner) open(stream *stream) error {
+	if t.streamWindow == 0 {
+		return nil
+	}
+	return stream.recvFlow.incrementWindow(t.streamWindow - int(stream.recvFlow.initialWindow()))
+}
+
 // InitialSendWindow returns the initial send flow control
 // window size for the given stream.
 func (c *Conn) InitialSendWindow(uint32) uint32 {
-	return c.RemoteSettings().InitialWindowSize()
+	return c.remoteSettings().InitialWindowSize()
 }
 
 // SendWindow returns the portion of the send flow control
@@ -258,7 +485,7 @@ type remoteFlowController struct {
 }
 
 func (c *remoteFlowController) incrementInitialWindow(delta int) error {
-	return c.updateWindow(delta, true)
+	return c.updateWindow(delta)
 }
 
 func (c *remoteFlowController) window() int {
@@ -269,42 +496,63 @@ func (c *remoteFlowController) window() int {
 	return win
 }
 
+// available returns the window including the part that is waiting in winCh
+// to be taken by a writer.
+func (c *remoteFlowController) available() int {
+	c.Lock()
+	defer c.Unlock()
+
+	win := c.win
+	select {
+	case n := <-c.winCh:
+		win += n
+		c.winCh <- n
+	default:
+	}
+
+	return win
+}
+
 func (c *remoteFlowController) incrementWindow(delta int) error {
-	return c.updateWindow(delta, false)
+	return c.updateWindow(delta)
 }
 
-func (c *remoteFlowController) updateWindow(delta int, reset bool) error {
+func (c *remoteFlowController) updateWindow(delta int) error {
 	c.Lock()
 	defer c.Unlock()
 
-	if delta > 0 && maxInitialWindowSize-delta < c.win {
+	// The part of the window waiting in winCh to be taken by a writer
+	// is included.
+	select {
+	case n := <-c.winCh:
+		c.win += n
+	default:
+	}
+
+	// A sender MUST NOT allow a flow-control window to exceed 2^31-1
+	// octets.  If a sender receives a WINDOW_UPDATE that causes a
+	// flow-control window to exceed this maximum, it MUST terminate
+	// either the stream or the connection, as appropriate.
+	var err error
+	if delta > 0 && maxWindowSize-delta < c.win {
 		if c.s.id == 0 {
-			return ConnError{errors.New("window size overflow"), ErrCodeFlowControl}
+			err = ConnError{errors.New("window size overflow"), ErrCodeFlowControl}
+		} else {
+			err = StreamError{errors.New("window size overflow"), ErrCodeFlowControl, c.s.id, ReasonFlowControl}
 		}
-		return StreamError{errors.New("window size overflow"), ErrCodeFlowControl, c.s.id}
+	} else {
+		c.win += delta
 	}
 
-	if reset {
+	if c.win > 0 {
 		select {
-		case n := <-c.winCh:
-			c.win += n
+		case c.winCh <- c.win:
+			c.win = 0
 		default:
 		}
 	}
 
-	c.win += delta
-
-	if c.win <= 0 {
-		return nil
-	}
-
-	select {
-	case c.winCh <- c.win:
-		c.win = 0
-	default:
-	}
-
-	return nil
+	return err
 }
 
 func (c *remoteFlowController) windowCh() <-chan int {
@@ -322,6 +570,52 @@ func (c *remoteFlowController) cancel() {
 	}
 }
 
+// FlowControlStalls counts the writes of DATA frames that waited for the
+// flow-control window of their stream, or of the connection, and the
+// total time they waited.
+type FlowControlStalls struct {
+	Stream, Conn                 uint64
+	StreamDuration, ConnDuration time.Duration
+}
+
+type stallCounter struct {
+	n, d int64
+}
+
+func (c *stallCounter) add(d time.Duration) {
+	atomic.AddInt64(&c.n, 1)
+	atomic.AddInt64(&c.d, int64(d))
+}
+
+// SendWindowStalls returns the flow-control stalls of the
+// connection, longer than the FlowControlStallThreshold.
+func (c *Conn) SendWindowStalls() FlowControlStalls {
+	return FlowControlStalls{
+		Stream:         uint64(atomic.LoadInt64(&c.streamStalls.n)),
+		Conn:           uint64(atomic.LoadInt64(&c.connStalls.n)),
+		StreamDuration: time.Duration(atomic.LoadInt64(&c.streamStalls.d)),
+		ConnDuration:   time.Duration(atomic.LoadInt64(&c.connStalls.d)),
+	}
+}
+
+// recordStall records the wait for the window of a stream, or of the
+// connection if streamID is 0, since the given time if not zero.
+func (c *Conn) recordStall(streamID uint32, since time.Time) {
+	if since.IsZero() {
+		return
+	}
+	d := time.Since(since)
+	if d < c.config.FlowControlStallThreshold {
+		return
+	}
+	if streamID == 0 {
+		c.connStalls.add(d)
+	} else {
+		c.streamStalls.add(d)
+	}
+	c.stats.flowControlStalled(streamID, d)
+}
+
 func allocateBytes(stream *stream, n int) (int, error) {
 	if n <= 0 {
 		return 0, nil
@@ -329,28 +623,68 @@ func allocateBytes(stream *stream, n int) (int, error) {
 
 	c, s := stream.conn.connStream.sendFlow, stream.sendFlow
 
+	var timeout <-chan time.Time
+	if d := stream.conn.config.FlowControlTimeout; d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
 	s.incrementWindow(0)
 
+	// The window is not available once incremented by zero
+	// when it is exhausted.
+	var stalled time.Time
+	if len(s.winCh) == 0 {
+		stalled = time.Now()
+	}
+
 	var sw int
 	select {
 	case <-stream.closeCh:
-		return 0, errStreamClosed
+		return 0, stream.closedErr()
 	case <-stream.conn.closeCh:
 		return 0, ErrClosed
+	case <-timeout:
+		s.cancel()
+		return 0, ErrFlowControlTimeout
+	case <-stream.conn.writeDeadline.done():
+		s.cancel()
+		return 0, os.ErrDeadlineExceeded
 	case sw = <-s.windowCh():
 	}
+	stream.conn.recordStall(stream.id, stalled)
 
 	c.incrementWindow(0)
 
+	stalled = time.Time{}
+	if len(c.winCh) == 0 {
+		stalled = time.Now()
+	}
+
+	// When failing, the window taken from the stream is returned, while
+	// the one of the connection is left to the writers of other streams.
 	var cw int
 	select {
 	case <-stream.closeCh:
-		c.cancel()
-		return 0, errStreamClosed
+		s.incrementWindow(sw)
+		s.cancel()
+		return 0, stream.closedErr()
 	case <-stream.conn.closeCh:
+		s.incrementWindow(sw)
+		s.cancel()
 		return 0, ErrClosed
+	case <-timeout:
+		s.incrementWindow(sw)
+		s.cancel()
+		return 0, ErrFlowControlTimeout
+	case <-stream.conn.writeDeadline.done():
+		s.incrementWindow(sw)
+		s.cancel()
+		return 0, os.ErrDeadlineExceeded
 	case cw = <-c.windowCh():
 	}
+	stream.conn.recordStall(0, stalled)
 
 	if sw < n {
 		n = sw
@@ -368,3 +702,22 @@ func allocateBytes(stream *stream, n int) (int, error) {
 
 	return n, nil
 }
+
+// dataFlowLen returns the length of a DATA frame counted in flow control.
+// The entire DATA frame payload is included in flow control, including
+// the Pad Length and Padding fields if present.
+func dataFlowLen(dataLen, padLen int) int {
+	if padLen > 0 {
+		return dataLen + padLen + 1
+	}
+	return dataLen
+}
+
+// releaseBytes returns n bytes allocated to a stream and left unused to
+// the flow-control windows of the stream and the connection.
+func releaseBytes(stream *stream, n int) {
+	if n > 0 {
+		stream.sendFlow.incrementWindow(n)
+		stream.conn.connStream.sendFlow.incrementWindow(n)
+	}
+}
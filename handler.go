@@ -0,0 +1,828 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ServeHandler is like Serve, but serves the requests of the accepted
+// connections with h, as returned by HTTPHandler.
+// ServeHandler always returns a non-nil error.
+func (s *Server) ServeHandler(l net.Listener, h http.Handler) error {
+	srv := *s
+	srv.Handler = HTTPHandler(h)
+	return srv.Serve(l)
+}
+
+// HTTPHandler returns a Handler serving the requests of a connection
+// with h. Each stream is served in its own goroutine, with the request
+// body read as the DATA frames are received; the received bytes are
+// returned to the flow control window of the stream when the handler
+// reads them.
+//
+// The response is written with HEADERS and DATA frames. Trailers are
+// sent after the body when they are declared in the "Trailer" header, or
+// set with the http.TrailerPrefix, as with the net/http server, provided
+// the request includes the "te: trailers" header field.
+//
+// A request with the "Expect: 100-continue" header field keeps it in its
+// Header. As with the net/http server, a 100 Continue response is sent
+// when the handler first reads the body, unless a response was written
+// before; the handler can reject the request instead, for example with
+// 417 Expectation Failed, without reading the body.
+//
+// The http.ResponseWriter implements the Pusher interface. Pushed
+// responses are served with h too, as requests without body.
+func HTTPHandler(h http.Handler) Handler {
+	return func(c *Conn) {
+		sc := &serverConn{conn: c, handler: h, bodies: make(map[uint32]*requestBody)}
+		sc.serve()
+	}
+}
+
+type serverConn struct {
+	conn    *Conn
+	handler http.Handler
+
+	bodyL  sync.Mutex
+	bodies map[uint32]*requestBody
+
+	// pushes is the number of pushed responses being served.
+	pushes int32
+}
+
+func (sc *serverConn) serve() {
+	c := sc.conn
+	defer c.Close()
+
+	if err := c.Handshake(); err != nil {
+		return
+	}
+
+	var err error
+
+	for {
+		var frame Frame
+		if frame, err = c.ReadFrame(); err != nil {
+			// The streams failing with a stream error are reset
+			// by ReadFrame, while the others are still served.
+			switch e := err.(type) {
+			case StreamError:
+				sc.closeBody(e.StreamID, e)
+				continue
+			case StreamErrorList:
+				for _, se := range e {
+					sc.closeBody(se.StreamID, *se)
+				}
+				continue
+			}
+			break
+		}
+
+		switch v := frame.(type) {
+		case *HeadersFrame:
+			if v.Trailer {
+				if body := sc.body(v.StreamID); body != nil {
+					body.setTrailer(v.Header)
+				}
+				sc.closeBody(v.StreamID, io.EOF)
+				continue
+			}
+			req, err := headerToRequest(v.Header, c)
+			if err != nil {
+				c.WriteFrame(&RSTStreamFrame{v.StreamID, ErrCodeProtocol})
+				continue
+			}
+			if req.Trailer == nil {
+				req.Trailer = make(http.Header)
+			}
+			body := &requestBody{conn: c, streamID: v.StreamID, trailer: req.Trailer}
+			body.cond = sync.NewCond(&body.mu)
+			if v.EndStream {
+				body.err = io.EOF
+				req.ContentLength = 0
+			} else {
+				sc.bodyL.Lock()
+				sc.bodies[v.StreamID] = body
+				sc.bodyL.Unlock()
+			}
+			req.Body = body
+			go sc.handle(v.StreamID, req, body)
+		case *DataFrame:
+			body := sc.body(v.StreamID)
+			if body == nil {
+				continue
+			}
+			n, err := c.readHeldData(v, body)
+			// The padding is not read by the handler.
+			if pad := n - v.DataLen; pad > 0 {
+				c.releaseData(v.StreamID, pad)
+			}
+			if err != nil {
+				sc.closeBody(v.StreamID, err)
+			} else if v.EndStream {
+				sc.closeBody(v.StreamID, io.EOF)
+			}
+		case *RSTStreamFrame:
+			sc.closeBody(v.StreamID, StreamError{fmt.Errorf("stream %d reset by peer", v.StreamID), v.ErrCode, v.StreamID, ReasonPeerReset})
+		}
+	}
+
+	sc.bodyL.Lock()
+	bodies := sc.bodies
+	sc.bodies = make(map[uint32]*requestBody)
+	sc.bodyL.Unlock()
+
+	for _, body := range bodies {
+		body.closeWithError(err)
+	}
+}
+
+func (sc *serverConn) body(streamID uint32) *requestBody {
+	sc.bodyL.Lock()
+	defer sc.bodyL.Unlock()
+
+	return sc.bodies[streamID]
+}
+
+func (sc *serverConn) closeBody(streamID uint32, err error) {
+	sc.bodyL.Lock()
+	body := sc.bodies[streamID]
+	delete(sc.bodies, streamID)
+	sc.bodyL.Unlock()
+
+	if body != nil {
+		body.closeWithError(err)
+	}
+}
+
+func (sc *serverConn) handle(streamID uint32, req *http.Request, body *requestBody) {
+	c := sc.conn
+
+	if ctx, ok := c.StreamContext(streamID); ok {
+		req = req.WithContext(ctx)
+	}
+
+	rw := &responseWriter{sc: sc, conn: c, streamID: streamID, req: req, header: make(http.Header), status: http.StatusOK}
+	rw.buf = bufio.NewWriterSize(chunkWriter{rw}, defaultMaxFrameSize)
+
+	if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		body.mu.Lock()
+		if body.err == nil {
+			body.expectContinue = rw.writeContinue
+		}
+		body.mu.Unlock()
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			c.WriteFrame(&RSTStreamFrame{streamID, ErrCodeInternal})
+			sc.closeBody(streamID, errClosedBody)
+			return
+		}
+
+		rw.finish()
+
+		// A server can send a complete response prior to the client
+		// sending an entire request if the response does not depend on
+		// any portion of the request that has not been sent and received.
+		// The server can then request that the client abort transmission
+		// of a request without error by sending a RST_STREAM with an
+		// error code of NO_ERROR.
+		if sc.body(streamID) != nil {
+			c.WriteFrame(&RSTStreamFrame{streamID, ErrCodeNo})
+			sc.closeBody(streamID, errClosedBody)
+		}
+	}()
+
+	sc.handler.ServeHTTP(rw, req)
+}
+
+// headerToRequest returns the request of the header block of a stream,
+// defined in RFC 7540 section 8.1.2.3.
+func headerToRequest(h Header, c *Conn) (*http.Request, error) {
+	method, scheme, authority, path := h.Method(), h.Scheme(), h.Authority(), h.Path()
+	protocol := h.Protocol()
+
+	// All HTTP/2 requests MUST include exactly one valid value for the
+	// ":method", ":scheme", and ":path" pseudo-header fields, unless it is
+	// a CONNECT request (Section 8.3). The extended CONNECT requests of RFC
+	// 8441 include them, along with the ":protocol" pseudo-header field.
+	if method == "" || ((method != "CONNECT" || protocol != "") && (scheme == "" || path == "")) {
+		return nil, MalformedError("missing pseudo-header fields")
+	}
+	if protocol != "" && method != "CONNECT" {
+		return nil, MalformedError(fmt.Sprintf(":protocol in %s request", method))
+	}
+	if authority == "" {
+		authority = h.Get("host")
+	}
+
+	var u *url.URL
+	if method == "CONNECT" && protocol == "" {
+		u = &url.URL{Host: authority}
+		path = authority
+	} else {
+		var err error
+		if u, err = url.ParseRequestURI(path); err != nil {
+			return nil, MalformedError(fmt.Sprintf("bad :path %q", path))
+		}
+		u.Scheme = scheme
+		u.Host = authority
+	}
+
+	req := &http.Request{
+		Method:        method,
+		URL:           u,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        make(http.Header, len(h)),
+		ContentLength: -1,
+		Host:          authority,
+		RequestURI:    path,
+		RemoteAddr:    c.RemoteAddr().String(),
+	}
+	if tlsConn, ok := c.rwc.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+
+	for k, vv := range h {
+		if len(k) > 0 && k[0] == ':' {
+			continue
+		}
+		// If there are multiple Cookie header fields after decompression,
+		// these MUST be concatenated into a single octet string using the
+		// two-octet delimiter of 0x3B, 0x20 (the ASCII string "; ").
+		if k == "cookie" {
+			vv = []string{strings.Join(vv, "; ")}
+		}
+		req.Header[http.CanonicalHeaderKey(k)] = vv
+	}
+	// The protocol of an extended CONNECT request, e.g. "websocket",
+	// is kept in the header, as by the http2 package of golang.org/x/net.
+	if protocol != "" {
+		req.Header[":protocol"] = []string{protocol}
+	}
+
+	if n, err := strconv.ParseInt(h.Get("content-length"), 10, 64); err == nil && n >= 0 {
+		req.ContentLength = n
+	}
+	for _, k := range splitHeader(req.Header, "Trailer") {
+		if req.Trailer == nil {
+			req.Trailer = make(http.Header)
+		}
+		req.Trailer[http.CanonicalHeaderKey(k)] = nil
+	}
+
+	return req, nil
+}
+
+// requestBody is the body of a request, buffering the received DATA
+// frames until the handler reads them.
+type requestBody struct {
+	conn     *Conn
+	streamID uint32
+	trailer  http.Header
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	err    error
+	closed bool
+
+	// deadline is the time after which reads fail, if not zero,
+	// waking them up with deadlineTimer.
+	deadline      time.Time
+	deadlineTimer *time.Timer
+
+	// waiter is the Read waiting for bytes while none are buffered,
+	// into the buffer of which DATA frames are read directly.
+	waiter *directRead
+
+	// expectContinue, if set, is called by the first Read,
+	// for a request expecting a 100 Continue response.
+	expectContinue func()
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	if f := b.expectContinue; f != nil {
+		b.expectContinue = nil
+		b.mu.Unlock()
+		f()
+		b.mu.Lock()
+	}
+	dr := directRead{p: p}
+	var (
+		timer    *time.Timer
+		timedOut bool
+	)
+	for dr.filling || (!timedOut && !b.pastDeadline() && dr.n == 0 && b.buf.Len() == 0 && b.err == nil) {
+		if b.waiter == nil && !dr.filling && len(p) > 0 {
+			b.waiter = &dr
+		}
+		if timeout := b.conn.config.ReadBodyTimeout; timer == nil && timeout > 0 {
+			timer = time.AfterFunc(timeout, func() {
+				b.mu.Lock()
+				timedOut = true
+				b.cond.Broadcast()
+				b.mu.Unlock()
+			})
+		}
+		b.cond.Wait()
+	}
+	if timer != nil {
+		timer.Stop()
+	}
+	if b.waiter == &dr {
+		b.waiter = nil
+	}
+	if timedOut && dr.n == 0 && b.buf.Len() == 0 && b.err == nil {
+		err := StreamError{ErrReadBodyTimeout, ErrCodeCancel, b.streamID, ReasonTimeout}
+		b.err = err
+		b.mu.Unlock()
+		b.conn.WriteFrame(&RSTStreamFrame{b.streamID, ErrCodeCancel})
+		return 0, err
+	}
+	if dr.n > 0 {
+		b.mu.Unlock()
+		b.conn.releaseData(b.streamID, dr.n)
+		return dr.n, nil
+	}
+	if b.pastDeadline() {
+		b.mu.Unlock()
+		return 0, os.ErrDeadlineExceeded
+	}
+	if b.buf.Len() == 0 || b.closed {
+		err := b.err
+		b.mu.Unlock()
+		return 0, err
+	}
+	n, _ := b.buf.Read(p)
+	b.mu.Unlock()
+
+	b.conn.releaseData(b.streamID, n)
+	return n, nil
+}
+
+// setReadDeadline sets the time after which reads fail with
+// os.ErrDeadlineExceeded, waking up the ones waiting. A zero time
+// means reads do not time out.
+func (b *requestBody) setReadDeadline(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.deadlineTimer != nil {
+		b.deadlineTimer.Stop()
+		b.deadlineTimer = nil
+	}
+	b.deadline = t
+	if !t.IsZero() {
+		b.deadlineTimer = time.AfterFunc(time.Until(t), func() {
+			b.mu.Lock()
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		})
+	}
+	b.cond.Broadcast()
+}
+
+// pastDeadline reports whether the read deadline is exceeded,
+// called with the lock held.
+func (b *requestBody) pastDeadline() bool {
+	return !b.deadline.IsZero() && !time.Now().Before(b.deadline)
+}
+
+// Write buffers the payload of a DATA frame.
+// The bytes of a closed body are released without being buffered.
+func (b *requestBody) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	closed := b.closed
+	if !closed {
+		b.buf.Write(p)
+		b.cond.Broadcast()
+	}
+	b.mu.Unlock()
+
+	if closed {
+		b.conn.releaseData(b.streamID, len(p))
+	}
+	return len(p), nil
+}
+
+// directRead is the buffer of a Read into which DATA frames are read.
+type directRead struct {
+	p       []byte
+	n       int
+	filling bool
+}
+
+// ReadFrom buffers the payload of a DATA frame read from r. While no bytes
+// are buffered, the payload is read directly into the buffer of a waiting
+// Read, without being copied, and only the remainder is buffered.
+func (b *requestBody) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	for {
+		b.mu.Lock()
+		dr := b.waiter
+		if dr == nil || b.buf.Len() > 0 || b.closed {
+			b.mu.Unlock()
+			break
+		}
+		b.waiter = nil
+		dr.filling = true
+		b.mu.Unlock()
+
+		n, err := r.Read(dr.p)
+
+		b.mu.Lock()
+		dr.n, dr.filling = n, false
+		b.cond.Broadcast()
+		b.mu.Unlock()
+
+		total += int64(n)
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+
+	buf := b.conn.getDataBuffer()
+	defer b.conn.putDataBuffer(buf)
+
+	n, err := io.CopyBuffer(writerOnly{b}, r, *buf)
+	return total + n, err
+}
+
+// writerOnly hides the ReadFrom method of a writer from io.Copy.
+type writerOnly struct {
+	io.Writer
+}
+
+// setTrailer sets the trailers of the request,
+// before the end of the body is read.
+func (b *requestBody) setTrailer(h Header) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for k, vv := range h {
+		b.trailer[http.CanonicalHeaderKey(k)] = vv
+	}
+}
+
+func (b *requestBody) closeWithError(err error) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// Close releases the buffered bytes. Reading a closed body returns an error.
+func (b *requestBody) Close() error {
+	b.mu.Lock()
+	n := b.buf.Len()
+	b.buf.Reset()
+	b.closed = true
+	b.err = errClosedBody
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
+	if n > 0 {
+		b.conn.releaseData(b.streamID, n)
+	}
+	return nil
+}
+
+// A Pusher pushes responses to the client, as defined in RFC 7540
+// section 8.2. It is implemented by the http.ResponseWriter of the
+// handlers served by HTTPHandler.
+type Pusher interface {
+	// Push promises the response of a request with the given method,
+	// path and header fields, with the scheme and authority of the
+	// request being served. It returns once the PUSH_PROMISE frame is
+	// written, the response being served concurrently, so it is to be
+	// called before writing the parts of the response referring to it.
+	//
+	// Push returns ErrPushDisabled if the client disabled server push,
+	// and an error if the number of pushed responses being served
+	// reaches the MaxConcurrentStreams setting of the client.
+	Push(method, path string, header Header) error
+}
+
+// A Resetter aborts responses, as defined in RFC 7540 section 6.4. It is
+// implemented by the http.ResponseWriter of the handlers served by
+// HTTPHandler.
+type Resetter interface {
+	// Reset closes the stream with a RST_STREAM frame of the given error
+	// code, discarding the buffered body. The writes of the response then
+	// fail, as do the ones waiting for the flow-control window. Resetting
+	// a closed stream does nothing.
+	Reset(code ErrCode) error
+}
+
+// RequireHTTP11 resets the stream of the request served by w with
+// HTTP_1_1_REQUIRED, telling the client to retry the request over HTTP/1.1,
+// as for a request the handler cannot serve over HTTP/2. It fails if w is
+// not a Resetter.
+func RequireHTTP11(w http.ResponseWriter) error {
+	r, ok := w.(Resetter)
+	if !ok {
+		return errors.New("http2: ResponseWriter is not a Resetter")
+	}
+	return r.Reset(ErrCodeHTTP11Required)
+}
+
+// ErrPushDisabled is returned by Push when the
+// client disabled server push with its SETTINGS.
+var ErrPushDisabled = errors.New("http2: server push disabled by client")
+
+// A responseWriter writes the response of a stream. The header block is
+// written with the first DATA frame, or when the handler returns.
+type responseWriter struct {
+	sc       *serverConn
+	conn     *Conn
+	streamID uint32
+	req      *http.Request
+	buf      *bufio.Writer
+
+	header      http.Header
+	status      int
+	wroteHeader bool
+	sentHeader  bool
+	continued   bool
+	trailers    []string
+	err         error
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	if rw.wroteHeader {
+		return
+	}
+
+	// Interim responses are written at once, and do not end the header.
+	if code >= 100 && code < 200 {
+		if code == http.StatusContinue {
+			if rw.continued {
+				return
+			}
+			rw.continued = true
+		}
+		h := Header{}
+		h.SetStatus(strconv.Itoa(code))
+		h.addHeader(rw.header)
+		if validateResponseHeader(h) == nil {
+			rw.conn.WriteFrame(&HeadersFrame{StreamID: rw.streamID, Header: h})
+		}
+		return
+	}
+
+	rw.wroteHeader = true
+	rw.status = code
+
+	for _, k := range splitHeader(rw.header, "Trailer") {
+		rw.trailers = append(rw.trailers, http.CanonicalHeaderKey(k))
+	}
+}
+
+// Push implements the Pusher interface.
+func (rw *responseWriter) Push(method, path string, header Header) error {
+	sc, c := rw.sc, rw.conn
+
+	if !c.remoteSettings().PushEnabled() {
+		return ErrPushDisabled
+	}
+
+	// PUSH_PROMISE frames MUST only be sent on a peer-initiated stream
+	// that is in either the "open" or "half-closed (remote)" state.
+	if rw.streamID%2 == 0 {
+		return errors.New("http2: push from a pushed response")
+	}
+
+	// Promised requests MUST be cacheable (see [RFC7231], Section 4.2.3),
+	// MUST be safe (see [RFC7231], Section 4.2.1), and MUST NOT include a
+	// request body.
+	if method != "GET" && method != "HEAD" {
+		return fmt.Errorf("http2: push with method %s", method)
+	}
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("http2: push with bad path %q", path)
+	}
+
+	h := make(Header, len(header)+4)
+	for k, vv := range header {
+		if len(k) > 0 && k[0] == ':' {
+			return fmt.Errorf("http2: push with pseudo-header field %q", k)
+		}
+		h[k] = vv
+	}
+	h.SetMethod(method)
+	h.SetScheme(rw.req.URL.Scheme)
+	h.SetAuthority(rw.req.Host)
+	h.SetPath(path)
+
+	if n := atomic.AddInt32(&sc.pushes, 1); uint32(n) > c.remoteSettings().MaxConcurrentStreams() {
+		atomic.AddInt32(&sc.pushes, -1)
+		return errors.New("http2: maximum concurrent pushes exceeded")
+	}
+
+	promisedID, err := c.NextStreamID()
+	if err == nil {
+		err = c.WriteFrame(&PushPromiseFrame{StreamID: rw.streamID, PromisedStreamID: promisedID, Header: h})
+	}
+	var req *http.Request
+	if err == nil {
+		req, err = headerToRequest(h, c)
+	}
+	if err != nil {
+		atomic.AddInt32(&sc.pushes, -1)
+		return err
+	}
+
+	req.Trailer = make(http.Header)
+	req.ContentLength = 0
+	body := &requestBody{conn: c, streamID: promisedID, trailer: req.Trailer, err: io.EOF}
+	body.cond = sync.NewCond(&body.mu)
+	req.Body = body
+
+	go func() {
+		defer atomic.AddInt32(&sc.pushes, -1)
+		sc.handle(promisedID, req, body)
+	}()
+	return nil
+}
+
+// Reset implements the Resetter interface.
+func (rw *responseWriter) Reset(code ErrCode) error {
+	rw.wroteHeader = true
+	rw.buf.Reset(chunkWriter{rw})
+	if rw.err == nil {
+		rw.err = errStreamClosed
+	}
+	rw.sc.closeBody(rw.streamID, errClosedBody)
+	return rw.conn.WriteFrame(&RSTStreamFrame{rw.streamID, code})
+}
+
+// writeContinue writes a 100 Continue response,
+// unless a response was written before.
+func (rw *responseWriter) writeContinue() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusContinue)
+	}
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.err != nil {
+		return 0, rw.err
+	}
+	return rw.buf.Write(p)
+}
+
+// Flush implements the http.Flusher interface.
+func (rw *responseWriter) Flush() {
+	rw.FlushError()
+}
+
+// FlushError writes the buffered body, or the header if not sent yet, and
+// waits for the frames to be written to the connection, as used by
+// http.ResponseController. It returns the error writing them.
+func (rw *responseWriter) FlushError() error {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.err == nil {
+		rw.buf.Flush()
+		if !rw.sentHeader {
+			rw.writeHeader(false)
+		}
+	}
+	if rw.err != nil {
+		return rw.err
+	}
+	return rw.conn.Flush()
+}
+
+func (rw *responseWriter) writeHeader(endStream bool) {
+	rw.sentHeader = true
+
+	h := make(Header, len(rw.header)+1)
+	h.SetStatus(strconv.Itoa(rw.status))
+	header := make(http.Header, len(rw.header))
+	for k, vv := range rw.header {
+		if !strings.HasPrefix(k, http.TrailerPrefix) {
+			header[k] = vv
+		}
+	}
+	h.addHeader(header)
+
+	if rw.err = validateResponseHeader(h); rw.err != nil {
+		rw.conn.WriteFrame(&RSTStreamFrame{rw.streamID, ErrCodeInternal})
+		return
+	}
+	rw.err = rw.conn.WriteFrame(&HeadersFrame{StreamID: rw.streamID, Header: h, EndStream: endStream})
+}
+
+// finish writes the buffered body, and ends the stream
+// with the trailers, if any.
+func (rw *responseWriter) finish() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.err != nil {
+		return
+	}
+
+	trailer := rw.trailer()
+	if !rw.sentHeader && rw.buf.Buffered() == 0 && len(trailer) == 0 {
+		rw.writeHeader(true)
+		return
+	}
+	if rw.buf.Flush(); rw.err != nil {
+		return
+	}
+	if !rw.sentHeader {
+		if rw.writeHeader(false); rw.err != nil {
+			return
+		}
+	}
+
+	if len(trailer) > 0 {
+		rw.err = rw.conn.WriteTrailer(rw.streamID, trailer)
+	} else {
+		rw.err = rw.conn.WriteFrame(&DataFrame{StreamID: rw.streamID, EndStream: true})
+	}
+}
+
+// trailer returns the declared trailers, and the ones set with
+// the http.TrailerPrefix.
+func (rw *responseWriter) trailer() Header {
+	// Trailers are only sent to clients accepting them
+	// with the "te: trailers" header field.
+	if !hasToken(rw.req.Header["Te"], "trailers") {
+		return nil
+	}
+
+	header := make(http.Header)
+	for _, k := range rw.trailers {
+		if vv := rw.header[k]; len(vv) > 0 {
+			header[k] = vv
+		}
+	}
+	for k, vv := range rw.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			header[strings.TrimPrefix(k, http.TrailerPrefix)] = vv
+		}
+	}
+
+	h := make(Header, len(header))
+	h.addHeader(header)
+	return h
+}
+
+// chunkWriter writes the buffered body of a response as DATA frames,
+// writing the header block first if needed.
+type chunkWriter struct {
+	rw *responseWriter
+}
+
+func (cw chunkWriter) Write(p []byte) (int, error) {
+	rw := cw.rw
+	if !rw.sentHeader {
+		if rw.writeHeader(false); rw.err != nil {
+			return 0, rw.err
+		}
+	}
+	if rw.err = rw.conn.WriteFrame(&DataFrame{StreamID: rw.streamID, Data: bytes.NewReader(p), DataLen: len(p)}); rw.err != nil {
+		return 0, rw.err
+	}
+	return len(p), nil
+}
+
+var (
+	_ http.Flusher = (*responseWriter)(nil)
+	_ Pusher       = (*responseWriter)(nil)
+)
@@ -57,6 +57,10 @@ func (enc *Encoder) SetMaxHeaderTableSize(max uint32) {
 	enc.table.setMaxSize(max)
 }
 
+func (enc *Encoder) SetIndexing(indexing bool) {
+	enc.i = indexing
+}
+
 func (enc *Encoder) EncodeHeaderField(dst []byte, name, value string, sensitive bool) (n uint32, _ []byte) {
 	if enc.sizeChanged {
 		enc.sizeChanged = false
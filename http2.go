@@ -43,18 +43,69 @@ type StreamError struct {
 	Err error
 	ErrCode
 	StreamID uint32
+
+	// Reason tells why the stream was reset, independently of the message of Err.
+	Reason StreamErrorReason
 }
 
+// StreamErrorReason represents the cause of a StreamError.
+type StreamErrorReason uint8
+
+const (
+	// ReasonUnknown is the reason of the errors not telling it.
+	ReasonUnknown StreamErrorReason = iota
+
+	// ReasonProtocol is the reason of a stream reset for a malformed
+	// message or a frame not allowed on it.
+	ReasonProtocol
+
+	// ReasonFlowControl is the reason of a stream reset for exceeding
+	// its flow-control window.
+	ReasonFlowControl
+
+	// ReasonStreamClosed is the reason of a stream reset for a frame
+	// received once it was closed or half-closed by the peer.
+	ReasonStreamClosed
+
+	// ReasonRefusedStream is the reason of a stream refused before
+	// being processed, e.g. one exceeding the header list size.
+	ReasonRefusedStream
+
+	// ReasonPeerReset is the reason of a stream reset by the peer
+	// with a RST_STREAM frame.
+	ReasonPeerReset
+
+	// ReasonCanceled is the reason of a stream reset by this endpoint,
+	// e.g. by closing its body before reading it entirely.
+	ReasonCanceled
+
+	// ReasonTimeout is the reason of a stream reset once a timeout
+	// elapsed, e.g. the ReadBodyTimeout of the Config.
+	ReasonTimeout
+)
+
 // StreamErrorList is a list of *StreamErrors.
 type StreamErrorList []*StreamError
 
+// GoAwayError is the error of a stream the remote endpoint did not
+// process, according to the GOAWAY frame it sent with ErrCode: a stream
+// initiated locally with an identifier higher than LastStreamID, which
+// can safely be retried on a new connection.
+type GoAwayError struct {
+	ErrCode
+	LastStreamID uint32
+	StreamID     uint32
+}
+
 // MalformedError represents Malformed Requests and Responses,
 // defined in RFC 7540 section 8.1.2.6.
 type MalformedError string
 
 const (
+	maxStreamID            = 1<<31 - 1
 	maxConcurrentStreams   = 1<<31 - 1
 	maxInitialWindowSize   = 1<<31 - 1
+	maxWindowSize          = 1<<31 - 1
 	maxFrameSizeLowerBound = 1 << 14
 	maxFrameSizeUpperBound = 1<<24 - 1
 
@@ -63,6 +114,9 @@ const (
 	defaultMaxConcurrentStreams = maxConcurrentStreams
 	defaultInitialWindowSize    = 65535
 	defaultMaxFrameSize         = maxFrameSizeLowerBound
+
+	defaultEnableConnectProtocol = 0
+	defaultNoRFC7540Priorities   = 0
 )
 
 // SettingID represents SETTINGS Parameters, defined in RFC 7540 section 6.5.2.
@@ -75,6 +129,12 @@ const (
 	SettingInitialWindowSize    SettingID = 0x4
 	SettingMaxFrameSize         SettingID = 0x5
 	SettingMaxHeaderListSize    SettingID = 0x6
+
+	// SettingEnableConnectProtocol is defined in RFC 8441 section 3.
+	SettingEnableConnectProtocol SettingID = 0x8
+
+	// SettingNoRFC7540Priorities is defined in RFC 9218 section 2.1.
+	SettingNoRFC7540Priorities SettingID = 0x9
 )
 
 const settingLen = 6
@@ -90,6 +150,11 @@ type Settings []setting
 // Header is A collection of headers sent or received via HTTP/2.
 type Header map[string][]string
 
+// A HeaderField is a name-value pair of a header block.
+type HeaderField struct {
+	Name, Value string
+}
+
 // FrameType represents Frame Type Registry, defined in RFC 7540 section 11.2.
 type FrameType uint8
 
@@ -104,6 +169,15 @@ const (
 	FrameGoAway       FrameType = 0x7
 	FrameWindowUpdate FrameType = 0x8
 	FrameContinuation FrameType = 0x9
+
+	// FrameAltSvc is defined in RFC 7838 section 4.
+	FrameAltSvc FrameType = 0xa
+
+	// FrameOrigin is defined in RFC 8336 section 2.
+	FrameOrigin FrameType = 0xc
+
+	// FramePriorityUpdate is defined in RFC 9218 section 7.1.
+	FramePriorityUpdate FrameType = 0x10
 )
 
 // Flags is An 8-bit field reserved for boolean flags specific to the frame type.
@@ -143,12 +217,28 @@ type Priority struct {
 
 // HeadersFrame represents the HEADERS frame,
 // defined in RFC 7540 section 6.2.
+//
+// Trailer reports whether the header block is a trailing one, sent after
+// the leading header block and the DATA frames of the stream, defined in
+// RFC 7540 section 8.1. Trailers carry END_STREAM and do not contain
+// pseudo-header fields.
 type HeadersFrame struct {
 	StreamID uint32
 	Header
 	Priority
 	PadLen    uint8
 	EndStream bool
+	Trailer   bool
+
+	// Sensitive lists the names of the sensitive header fields, encoded
+	// as literals never indexed, defined in RFC 7541 section 6.2.3. An
+	// encoder does not add them to the dynamic table, and an intermediary
+	// re-encoding them uses the same representation: this protects values
+	// such as short secrets, which could be guessed by observing the size
+	// of the compressed header blocks (RFC 7541 section 7.1.3). It lists
+	// the fields received as never indexed when reading. The authorization,
+	// cookie and set-cookie header fields are always sensitive.
+	Sensitive []string
 }
 
 // PriorityFrame represents the PRIORITY frame,
@@ -179,6 +269,10 @@ type PushPromiseFrame struct {
 	PromisedStreamID uint32
 	Header
 	PadLen uint8
+
+	// Sensitive lists the names of the sensitive header fields,
+	// as for a HeadersFrame.
+	Sensitive []string
 }
 
 // PingFrame represents the PING frame,
@@ -203,6 +297,47 @@ type WindowUpdateFrame struct {
 	WindowSizeIncrement uint32
 }
 
+// AltSvcFrame represents the ALTSVC frame,
+// defined in RFC 7838 section 4.
+type AltSvcFrame struct {
+	StreamID   uint32
+	Origin     []byte
+	FieldValue []byte
+}
+
+// OriginFrame represents the ORIGIN frame,
+// defined in RFC 8336 section 2.
+type OriginFrame struct {
+	Origins []string
+}
+
+// PriorityUpdateFrame represents the PRIORITY_UPDATE frame,
+// defined in RFC 9218 section 7.1.
+type PriorityUpdateFrame struct {
+	PrioritizedStreamID uint32
+
+	// PriorityFieldValue is the priority of the stream, expressed as the
+	// value of the Priority header field (RFC 9218 section 5), e.g. "u=1, i".
+	PriorityFieldValue string
+}
+
+// PriorityParam is the priority of a stream in the Extensible Priority
+// Scheme, defined in RFC 9218 section 4.
+type PriorityParam struct {
+	// Urgency is the urgency of the stream, from 0 to 7, in descending
+	// order of priority. The default urgency is 3.
+	Urgency uint8
+
+	// Incremental tells whether the stream can be processed incrementally,
+	// that is interleaved with the other streams of the same urgency.
+	Incremental bool
+}
+
+const (
+	defaultUrgency = 3
+	maxUrgency     = 7
+)
+
 // UnknownFrame represents not defined by the HTTP/2 spec.
 type UnknownFrame struct {
 	FrameType
@@ -0,0 +1,300 @@
+package http2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OpenStream opens a stream with a HEADERS frame of the given header
+// fields, on which bytes are then exchanged in both directions as DATA
+// frames, using the connection as a multiplexed transport rather than for
+// requests and responses. Only clients open streams, and opening one fails
+// with ErrStreamLimit once the MaxConcurrentStreams setting of the server
+// is reached.
+//
+// The DATA frames received on the stream are read from the returned Stream
+// instead of being returned by ReadFrame, as with StreamBody, so the frames
+// of the connection are to be read concurrently. The HEADERS frames of the
+// stream are still returned by ReadFrame.
+func (c *Conn) OpenStream(header Header) (*Stream, error) {
+	if c.server {
+		return nil, errors.New("http2: stream opened by server")
+	}
+
+	streamID, err := c.NextStreamID()
+	if err != nil {
+		return nil, err
+	}
+
+	// Exceeding the setting of the server is checked before writing the
+	// HEADERS frame, which would otherwise fail the connection. The
+	// stream ID is then given back to be generated again.
+	if c.NumLocalStreams()+1 > c.remoteSettings().MaxConcurrentStreams() {
+		if atomic.CompareAndSwapInt32(&c.idState, 1, 0) {
+			c.idCh <- struct{}{}
+		}
+		return nil, ErrStreamLimit
+	}
+
+	// The body is added before the HEADERS frame is written,
+	// for the DATA frames received right after it.
+	s := &Stream{conn: c, id: streamID, header: header, body: newStreamBody(c, streamID)}
+	c.bodyL.Lock()
+	c.bodies[streamID] = s.body
+	c.bodyL.Unlock()
+
+	if err = c.WriteFrame(&HeadersFrame{StreamID: streamID, Header: header}); err != nil {
+		c.removeBody(streamID)
+		return nil, err
+	}
+	return s, nil
+}
+
+// acceptBacklog is the number of streams waiting for AcceptStream,
+// beyond which the new ones are refused.
+const acceptBacklog = 128
+
+// AcceptStream waits for the next stream opened by the client and returns
+// it, to exchange bytes in both directions as with OpenStream. It requires
+// the AcceptStreams option of the Config, with which the HEADERS frames
+// opening streams are no longer returned by ReadFrame, except for the
+// CONNECT requests served by the ConnectHandler. The frames of the
+// connection are to be read concurrently.
+//
+// It returns ErrClosed once the connection is closed, or once a GOAWAY
+// frame is sent by Shutdown and the streams opened before are accepted.
+// The streams still opened afterwards are refused with REFUSED_STREAM,
+// as are the ones exceeding a backlog of streams waiting to be accepted.
+func (c *Conn) AcceptStream() (*Stream, error) {
+	if !c.server {
+		return nil, errors.New("http2: stream accepted by client")
+	}
+	if !c.config.AcceptStreams {
+		return nil, errors.New("http2: AcceptStreams not enabled")
+	}
+
+	select {
+	case s := <-c.acceptCh:
+		return s, nil
+	case <-c.goAwaySentCh:
+	case <-c.closeCh:
+		return nil, ErrClosed
+	}
+
+	c.acceptL.Lock()
+	defer c.acceptL.Unlock()
+
+	c.acceptClosed = true
+	select {
+	case s := <-c.acceptCh:
+		return s, nil
+	default:
+		return nil, ErrClosed
+	}
+}
+
+// acceptFrame queues the stream opened by a HEADERS frame read by ReadFrame
+// for AcceptStream, reporting whether the frame was consumed.
+func (c *Conn) acceptFrame(frame Frame) bool {
+	v, ok := frame.(*HeadersFrame)
+	if !ok || !c.server || !c.config.AcceptStreams || v.Trailer {
+		return false
+	}
+
+	c.acceptL.Lock()
+	defer c.acceptL.Unlock()
+
+	s := &Stream{conn: c, id: v.StreamID, header: v.Header, body: newStreamBody(c, v.StreamID)}
+	if v.EndStream {
+		s.body.err = io.EOF
+	}
+	if !c.acceptClosed {
+		select {
+		case c.acceptCh <- s:
+			if !v.EndStream {
+				c.bodyL.Lock()
+				c.bodies[v.StreamID] = s.body
+				c.bodyL.Unlock()
+			}
+			return true
+		default:
+		}
+	}
+	c.WriteFrame(&RSTStreamFrame{v.StreamID, ErrCodeRefusedStream})
+	return true
+}
+
+// A Stream is a stream opened with OpenStream or accepted with
+// AcceptStream. Reads return the DATA frames received on it and writes
+// are sent as DATA frames, both within the flow-control windows of the
+// stream and of the connection.
+type Stream struct {
+	conn   *Conn
+	id     uint32
+	header Header
+	body   *requestBody
+
+	// The bytes written are coalesced in buf while writeDelay is set,
+	// and flushed by the timer at the latest. An error flushing them
+	// is returned by the next write.
+	writeL     sync.Mutex
+	writeDelay time.Duration
+	buf        []byte
+	timer      *time.Timer
+	werr       error
+}
+
+// ID returns the identifier assigned to the stream.
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// Header returns the header fields of the HEADERS frame that opened the
+// stream, which were sent with OpenStream or received by AcceptStream.
+func (s *Stream) Header() Header {
+	return s.header
+}
+
+// WriteHeader writes a HEADERS frame on the stream, such as the response
+// of an accepted stream, which is written before its DATA frames.
+func (s *Stream) WriteHeader(header Header) error {
+	return s.conn.WriteFrame(&HeadersFrame{StreamID: s.id, Header: header})
+}
+
+// Read reads the bytes received on the stream, which are returned to the
+// flow-control window as they are read. It returns io.EOF once the remote
+// endpoint ended the stream, or a StreamError if the stream is reset.
+func (s *Stream) Read(p []byte) (int, error) {
+	return s.body.Read(p)
+}
+
+// SetWriteDelay sets how long the bytes written on the stream may be held to
+// be coalesced with the following writes, so that many small writes are sent
+// as few DATA frames of up to the maximum frame size allowed by the remote
+// endpoint, rather than one frame each. The held bytes are sent once they
+// fill a frame, when the delay elapses since the first of them was written,
+// or by Flush and CloseSend, which also sends them with the END_STREAM flag.
+//
+// Coalescing trades the latency of the small writes, delayed up to d, for
+// fewer frames and frame headers, and thus throughput. A zero delay, the
+// default, disables it and sends the held bytes.
+func (s *Stream) SetWriteDelay(d time.Duration) error {
+	s.writeL.Lock()
+	defer s.writeL.Unlock()
+
+	s.writeDelay = d
+	if d > 0 {
+		return nil
+	}
+	return s.flushLocked(false)
+}
+
+// Write writes p as DATA frames, waiting for the flow-control windows
+// to allow it, unless it is held to be coalesced as set by SetWriteDelay.
+// It fails once the stream is half-closed by CloseSend.
+func (s *Stream) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	s.writeL.Lock()
+	defer s.writeL.Unlock()
+
+	if s.werr != nil {
+		return 0, s.werr
+	}
+	if s.writeDelay <= 0 {
+		if err := s.writeData(p, false); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	s.buf = append(s.buf, p...)
+	if len(s.buf) >= int(s.conn.remoteSettings().MaxFrameSize()) {
+		if err := s.flushLocked(false); err != nil {
+			return 0, err
+		}
+	} else if s.timer == nil {
+		s.timer = time.AfterFunc(s.writeDelay, s.flushTimer)
+	}
+	return len(p), nil
+}
+
+// Flush sends the bytes held by Write to be coalesced.
+func (s *Stream) Flush() error {
+	s.writeL.Lock()
+	defer s.writeL.Unlock()
+
+	if s.werr != nil {
+		return s.werr
+	}
+	return s.flushLocked(false)
+}
+
+func (s *Stream) flushTimer() {
+	s.writeL.Lock()
+	defer s.writeL.Unlock()
+
+	s.timer = nil
+	if s.werr == nil {
+		s.werr = s.flushLocked(false)
+	}
+}
+
+// flushLocked sends the held bytes,
+// within a frame with the END_STREAM flag if endStream is set.
+func (s *Stream) flushLocked(endStream bool) error {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if len(s.buf) == 0 && !endStream {
+		return nil
+	}
+	p := s.buf
+	s.buf = nil
+	return s.writeData(p, endStream)
+}
+
+func (s *Stream) writeData(p []byte, endStream bool) error {
+	return s.conn.WriteFrame(&DataFrame{StreamID: s.id, Data: bytes.NewReader(p), DataLen: len(p), EndStream: endStream})
+}
+
+// CloseSend ends the sending side of the stream, which is still read
+// until the remote endpoint ends it too. The bytes held by Write are
+// sent with the END_STREAM flag.
+func (s *Stream) CloseSend() error {
+	s.writeL.Lock()
+	defer s.writeL.Unlock()
+
+	if s.werr != nil {
+		return s.werr
+	}
+	return s.flushLocked(true)
+}
+
+// Reset closes the stream with a RST_STREAM frame of the given error code,
+// discarding the bytes received and not read yet, and the ones held by
+// Write. The reads of the stream then return a StreamError with the code.
+// Resetting a closed stream does nothing.
+func (s *Stream) Reset(code ErrCode) error {
+	err := s.conn.WriteFrame(&RSTStreamFrame{s.id, code})
+	s.conn.removeBody(s.id)
+	s.body.closeWithError(StreamError{fmt.Errorf("stream %d reset", s.id), code, s.id, ReasonCanceled})
+
+	// The writes blocked on the stream failed once it was reset.
+	s.writeL.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.buf = nil
+	s.writeL.Unlock()
+	return err
+}
@@ -0,0 +1,82 @@
+package http2
+
+import (
+	"net/http"
+	"strings"
+)
+
+// A PushCache stores the responses pushed by servers and accepted by a
+// Transport, keyed by the authority and the path of the promised requests,
+// the authority having the scheme as its port if it has none, as in
+// "example.com:https", so that the following requests for the same resources
+// are served from the pushes instead of being sent. The bodies of the
+// stored responses may still be received. Evicting them, and closing the
+// bodies of the ones evicted, is left to the implementation.
+type PushCache interface {
+	// Get removes and returns the response stored for the given
+	// authority and path, or nil if there is none.
+	Get(authority, path string) *http.Response
+
+	// Put stores a pushed response for the given authority and path,
+	// replacing the previous one, if any.
+	Put(authority, path string, res *http.Response)
+}
+
+// cacheablePush reports whether the response of a pushed request can be
+// stored: promised requests MUST be cacheable and safe, as are GET and HEAD
+// ones, and the response MUST be cacheable by default, as defined in RFC
+// 7231 section 6.1, and not forbidden to be stored.
+func cacheablePush(res *http.Response) bool {
+	switch res.Request.Method {
+	case "GET", "HEAD":
+	default:
+		return false
+	}
+
+	switch res.StatusCode {
+	case 200, 203, 204, 206, 300, 301, 404, 405, 410, 414, 501:
+	default:
+		return false
+	}
+
+	for _, v := range res.Header.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			switch strings.ToLower(strings.TrimSpace(directive)) {
+			case "no-store", "private":
+				return false
+			}
+		}
+	}
+	return !strings.Contains(res.Header.Get("Vary"), "*")
+}
+
+// cachedPush returns the response pushed for a GET or HEAD request without
+// a body, if the PushCache of the Transport stores one. A pushed response
+// to a HEAD request does not serve a GET request, and is discarded.
+func (t *Transport) cachedPush(req *http.Request, address string) *http.Response {
+	if t.PushCache == nil || (req.Body != nil && req.Body != http.NoBody) {
+		return nil
+	}
+	switch req.Method {
+	case "GET", "HEAD":
+	default:
+		return nil
+	}
+
+	res := t.PushCache.Get(address, req.URL.RequestURI())
+	if res == nil {
+		return nil
+	}
+	if res.Request.Method != req.Method && req.Method != "HEAD" {
+		res.Body.Close()
+		return nil
+	}
+
+	cached := *res
+	cached.Request = req
+	if req.Method == "HEAD" && res.Request.Method != "HEAD" {
+		res.Body.Close()
+		cached.Body = http.NoBody
+	}
+	return &cached
+}
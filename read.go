@@ -18,6 +18,27 @@ type frameReader struct {
 	*hpack.Decoder
 	maxHeaderListSize uint32
 	pendingHeaders    frameReaderFrom
+	headerListSize    uint32
+	headerErr         error
+
+	// The limits of the CONTINUATION frames and of the header block
+	// octets received before END_HEADERS. Zero means no limit.
+	maxContinuations   int
+	maxHeaderBlockSize int
+	continuations      int
+	headerBlockSize    int
+
+	// trailer reports whether a header block received on
+	// the stream is a trailing one.
+	trailer func(streamID uint32) bool
+
+	// headerBlock, if set, is called when a header block starts being
+	// received, and once it is complete.
+	headerBlock func(start bool)
+
+	// connectProtocol reports whether the received requests can be
+	// extended CONNECT ones, carrying a :protocol pseudo-header field.
+	connectProtocol func() bool
 
 	payloadLen uint32
 	frameType  FrameType
@@ -43,17 +64,24 @@ type frameReaderFrom interface {
 }
 
 var frameCtor = map[FrameType]func() frameReaderFrom{
-	FrameData:         func() frameReaderFrom { return new(DataFrame) },
-	FrameHeaders:      func() frameReaderFrom { return new(HeadersFrame) },
-	FramePriority:     func() frameReaderFrom { return new(PriorityFrame) },
-	FrameRSTStream:    func() frameReaderFrom { return new(RSTStreamFrame) },
-	FrameSettings:     func() frameReaderFrom { return new(SettingsFrame) },
-	FramePushPromise:  func() frameReaderFrom { return new(PushPromiseFrame) },
-	FramePing:         func() frameReaderFrom { return new(PingFrame) },
-	FrameGoAway:       func() frameReaderFrom { return new(GoAwayFrame) },
-	FrameWindowUpdate: func() frameReaderFrom { return new(WindowUpdateFrame) },
+	FrameData:           func() frameReaderFrom { return new(DataFrame) },
+	FrameHeaders:        func() frameReaderFrom { return new(HeadersFrame) },
+	FramePriority:       func() frameReaderFrom { return new(PriorityFrame) },
+	FrameRSTStream:      func() frameReaderFrom { return new(RSTStreamFrame) },
+	FrameSettings:       func() frameReaderFrom { return new(SettingsFrame) },
+	FramePushPromise:    func() frameReaderFrom { return new(PushPromiseFrame) },
+	FramePing:           func() frameReaderFrom { return new(PingFrame) },
+	FrameGoAway:         func() frameReaderFrom { return new(GoAwayFrame) },
+	FrameWindowUpdate:   func() frameReaderFrom { return new(WindowUpdateFrame) },
+	FrameAltSvc:         func() frameReaderFrom { return new(AltSvcFrame) },
+	FrameOrigin:         func() frameReaderFrom { return new(OriginFrame) },
+	FramePriorityUpdate: func() frameReaderFrom { return new(PriorityUpdateFrame) },
 }
 
+// errIgnoreFrame is returned by readFrom when the frame
+// has been consumed and MUST be ignored by the recipient.
+var errIgnoreFrame = errors.New("ignore frame")
+
 func (r *frameReader) ReadFrame() (Frame, error) {
 	if r.lastPayload != nil {
 		err := r.lastPayload.Close()
@@ -64,8 +92,6 @@ func (r *frameReader) ReadFrame() (Frame, error) {
 		}
 	}
 
-	const frameHeaderLen = 9
-
 again:
 	frameHeader, err := r.Peek(frameHeaderLen)
 	if err != nil {
@@ -88,10 +114,20 @@ again:
 	// block (Section 4.3) (that is, HEADERS, PUSH_PROMISE, and
 	// CONTINUATION), SETTINGS, and any frame with a stream identifier of 0.
 	if r.payloadLen > r.maxFrameSize {
-		return nil, ConnError{
-			fmt.Errorf("frame length %d exceeds maximum %d", r.payloadLen, r.maxFrameSize),
-			ErrCodeFrameSize,
+		err := fmt.Errorf("frame length %d exceeds maximum %d", r.payloadLen, r.maxFrameSize)
+		switch r.frameType {
+		case FrameHeaders, FramePushPromise, FrameContinuation, FrameSettings:
+			return nil, ConnError{err, ErrCodeFrameSize}
 		}
+		if r.streamID == 0 || r.pendingHeaders != nil {
+			return nil, ConnError{err, ErrCodeFrameSize}
+		}
+		// The payload of other frames is discarded before being
+		// buffered, so only the stream is reset.
+		if _, err := r.Discard(int(r.payloadLen)); err != nil {
+			return nil, err
+		}
+		return nil, StreamError{err, ErrCodeFrameSize, r.streamID, ReasonProtocol}
 	}
 
 	// A HEADERS frame without the END_HEADERS flag set MUST be followed
@@ -105,8 +141,16 @@ again:
 		}
 	}
 
+	if err := checkFrameStream(r.frameType, r.streamID); err != nil {
+		return nil, err
+	}
+
 	var frame frameReaderFrom
 
+	if r.headerBlock != nil && (r.frameType == FrameHeaders || r.frameType == FramePushPromise) {
+		r.headerBlock(true)
+	}
+
 	if r.frameType == FrameContinuation {
 		// A CONTINUATION frame MUST be preceded by a HEADERS, PUSH_PROMISE or
 		// CONTINUATION frame without the END_HEADERS flag set.  A recipient
@@ -120,6 +164,26 @@ again:
 		}
 
 		frame = r.pendingHeaders
+
+		// SEE 10.5.  Denial-of-Service Considerations
+		//
+		// A header block can be split in any number of CONTINUATION
+		// frames, which are buffered or decoded before END_HEADERS is
+		// received, so they are limited to avoid a CONTINUATION flood.
+		r.continuations++
+		r.headerBlockSize += int(r.payloadLen)
+		if r.maxContinuations > 0 && r.continuations > r.maxContinuations {
+			return nil, ConnError{
+				fmt.Errorf("header block exceeds %d CONTINUATION frames", r.maxContinuations),
+				ErrCodeEnhanceYourCalm,
+			}
+		}
+		if r.maxHeaderBlockSize > 0 && r.headerBlockSize > r.maxHeaderBlockSize {
+			return nil, ConnError{
+				fmt.Errorf("header block exceeds %d octets", r.maxHeaderBlockSize),
+				ErrCodeEnhanceYourCalm,
+			}
+		}
 	} else {
 		if ctor, exists := frameCtor[r.frameType]; exists {
 			frame = ctor()
@@ -128,11 +192,16 @@ again:
 		}
 	}
 
-	if err = frame.readFrom(r); err != nil {
-		// SEE 10.5.  Denial-of-Service Considerations
-		//     10.5.1.  Limits on Header Block Size
-		if err == hpack.ErrHeaderFieldsTooLarge {
-			return nil, ConnError{err, ErrCodeEnhanceYourCalm}
+	err = frame.readFrom(r)
+	if r.headerBlock != nil && r.pendingHeaders == nil {
+		switch r.frameType {
+		case FrameHeaders, FramePushPromise, FrameContinuation:
+			r.headerBlock(false)
+		}
+	}
+	if err != nil {
+		if err == errIgnoreFrame {
+			goto again
 		}
 
 		switch err.(type) {
@@ -149,13 +218,57 @@ again:
 		goto again
 	}
 
+	// A header block exceeding the header list size is returned
+	// along with the stream error, so the stream can be refused.
+	if err = r.headerErr; err != nil {
+		r.headerErr = nil
+		return frame, err
+	}
+
 	return frame, nil
 }
 
+// checkFrameStream returns the connection error of a frame received on a
+// stream it cannot be sent on, which depends on its type.
+func checkFrameStream(frameType FrameType, streamID uint32) error {
+	switch frameType {
+	case FrameData, FrameHeaders, FramePriority, FrameRSTStream, FramePushPromise, FrameContinuation:
+		// These frames MUST be associated with a stream.  If one is
+		// received whose stream identifier field is 0x0, the recipient
+		// MUST respond with a connection error (Section 5.4.1) of type
+		// PROTOCOL_ERROR.
+		if streamID == 0 {
+			return ConnError{fmt.Errorf("%s frame on stream 0", frameType), ErrCodeProtocol}
+		}
+	case FrameSettings, FramePing, FrameGoAway, FramePriorityUpdate:
+		// These frames apply to the connection, not a specific stream.
+		// An endpoint MUST treat one with a stream identifier other than
+		// 0x0 as a connection error (Section 5.4.1) of type PROTOCOL_ERROR.
+		if streamID != 0 {
+			return ConnError{fmt.Errorf("%s frame on stream %d", frameType, streamID), ErrCodeProtocol}
+		}
+	}
+	return nil
+}
+
+// frameLen returns the payload length of the frame returned last by
+// ReadFrame, including the CONTINUATION frames of a header block.
+func (r *frameReader) frameLen() int {
+	switch r.frameType {
+	case FrameHeaders, FramePushPromise, FrameContinuation:
+		return r.headerBlockSize
+	}
+	return int(r.payloadLen)
+}
+
 type framePayload struct {
 	r *frameReader
 	n int
 	p uint8
+
+	// padded reports whether the payload has a Pad Length field,
+	// which is counted in flow control along with the padding.
+	padded bool
 }
 
 func (p *framePayload) Read(dst []byte) (n int, err error) {
@@ -183,13 +296,6 @@ func (p *framePayload) Close() (err error) {
 }
 
 func (f *DataFrame) readFrom(r *frameReader) error {
-	// DATA frames MUST be associated with a stream.  If a DATA frame is
-	// received whose stream identifier field is 0x0, the recipient MUST
-	// respond with a connection error (Section 5.4.1) of type PROTOCOL_ERROR.
-	if r.streamID == 0 {
-		return ConnError{errors.New("stream ID must be > 0"), ErrCodeProtocol}
-	}
-
 	f.DataLen = int(r.payloadLen)
 
 	if r.flags.Has(FlagPadded) {
@@ -211,6 +317,7 @@ func (f *DataFrame) readFrom(r *frameReader) error {
 	r.payload.r = r
 	r.payload.n = f.DataLen
 	r.payload.p = f.PadLen
+	r.payload.padded = r.flags.Has(FlagPadded)
 	r.lastPayload = &r.payload
 	f.Data = r.lastPayload
 
@@ -218,13 +325,6 @@ func (f *DataFrame) readFrom(r *frameReader) error {
 }
 
 func (f *HeadersFrame) readFrom(r *frameReader) error {
-	// HEADERS frames MUST be associated with a stream.  If a HEADERS frame
-	// is received whose stream identifier field is 0x0, the recipient MUST
-	// respond with a connection error (Section 5.4.1) of type PROTOCOL_ERROR.
-	if r.streamID == 0 {
-		return ConnError{errors.New("stream ID must be > 0"), ErrCodeProtocol}
-	}
-
 	fragmentLen := int(r.payloadLen)
 
 	if r.frameType == FrameContinuation {
@@ -241,6 +341,8 @@ func (f *HeadersFrame) readFrom(r *frameReader) error {
 		}
 	} else {
 		f.StreamID = r.streamID
+		f.Trailer = r.trailer != nil && r.trailer(f.StreamID)
+		r.startHeaderBlock()
 
 		if r.flags.Has(FlagPadded) {
 			f.PadLen, _ = r.ReadByte()
@@ -253,6 +355,13 @@ func (f *HeadersFrame) readFrom(r *frameReader) error {
 			f.Exclusive = f.StreamDependency != v
 			f.Weight, _ = r.ReadByte()
 			fragmentLen -= 5
+
+			// A stream cannot depend on itself.  An endpoint MUST treat
+			// this as a stream error (Section 5.4.2) of type PROTOCOL_ERROR.
+			// The header block is still decoded, keeping the compression state.
+			if f.StreamDependency == f.StreamID {
+				r.headerErr = StreamError{fmt.Errorf("stream %d depends on itself", f.StreamID), ErrCodeProtocol, f.StreamID, ReasonProtocol}
+			}
 		}
 
 		f.EndStream = r.flags.Has(FlagEndStream)
@@ -270,6 +379,9 @@ func (f *HeadersFrame) readFrom(r *frameReader) error {
 		err       error
 	)
 
+	connect := r.connectProtocol != nil && r.connectProtocol()
+	handle := r.headerFieldHandler(&f.Header, &f.Sensitive, f.StreamID, headerBlockOptions{trailer: f.Trailer, connect: connect})
+
 	for fragmentLen > 0 {
 		chunkSize = fragmentLen
 		if chunkSize > r.bufSize {
@@ -280,7 +392,7 @@ func (f *HeadersFrame) readFrom(r *frameReader) error {
 			return err
 		}
 
-		if _, err = r.Decode(chunk, r.maxHeaderListSize, f.Header.add); err != nil {
+		if _, err = r.Decode(chunk, 0, handle); err != nil {
 			return err
 		}
 
@@ -303,14 +415,66 @@ func (f *HeadersFrame) readFrom(r *frameReader) error {
 	return err
 }
 
-func (f *PriorityFrame) readFrom(r *frameReader) error {
-	// The PRIORITY frame always identifies a stream.  If a PRIORITY frame
-	// is received with a stream identifier of 0x0, the recipient MUST
-	// respond with a connection error (Section 5.4.1) of type PROTOCOL_ERROR.
-	if r.streamID == 0 {
-		return ConnError{errors.New("stream ID must be > 0"), ErrCodeProtocol}
+func (r *frameReader) startHeaderBlock() {
+	r.headerListSize = 0
+	r.headerErr = nil
+	r.continuations = 0
+	r.headerBlockSize = int(r.payloadLen)
+}
+
+// headerFieldHandler returns the handler adding the decoded header fields
+// to h, and the names of the ones never indexed to sensitive.
+//
+// The size of a header list is calculated based on the uncompressed size of
+// header fields, including the length of the name and value in octets plus
+// an overhead of 32 octets for each header field, defined in RFC 7541
+// section 4.1. Once it exceeds SETTINGS_MAX_HEADER_LIST_SIZE, the remaining
+// fields are still decoded to keep the dynamic table synchronized, but are
+// discarded, and the stream is refused.
+//
+// A header block containing an invalid field name or value, or a trailing
+// one containing pseudo-header fields, is malformed, and is treated the
+// same way, with a stream error of type PROTOCOL_ERROR.
+func (r *frameReader) headerFieldHandler(h *Header, sensitive *[]string, streamID uint32, opts headerBlockOptions) hpack.HeaderFieldHandler {
+	return func(name, value string, neverIndexed bool) error {
+		if r.headerErr != nil {
+			return nil
+		}
+		if r.maxHeaderListSize != 0 {
+			r.headerListSize += hpack.HeaderFieldSize(name, value)
+			if r.headerListSize > r.maxHeaderListSize {
+				*h, *sensitive = nil, nil
+				r.headerErr = StreamError{
+					fmt.Errorf("header list size exceeds %d", r.maxHeaderListSize),
+					ErrCodeRefusedStream,
+					streamID,
+					ReasonRefusedStream,
+				}
+				return nil
+			}
+		}
+		err := h.add(name, value, opts)
+		if err == nil {
+			if neverIndexed {
+				for _, k := range *sensitive {
+					if k == name {
+						return nil
+					}
+				}
+				*sensitive = append(*sensitive, name)
+			}
+			return nil
+		}
+		if _, ok := err.(MalformedError); !ok {
+			return err
+		}
+		*h, *sensitive = nil, nil
+		r.headerErr = StreamError{err, ErrCodeProtocol, streamID, ReasonProtocol}
+		return nil
 	}
+}
 
+func (f *PriorityFrame) readFrom(r *frameReader) error {
 	// A PRIORITY frame with a length other than 5 octets MUST be treated as
 	// a stream error (Section 5.4.2) of type FRAME_SIZE_ERROR.
 	if r.payloadLen != 5 {
@@ -322,6 +486,7 @@ func (f *PriorityFrame) readFrom(r *frameReader) error {
 			fmt.Errorf("bad frame length %d", r.payloadLen),
 			ErrCodeFrameSize,
 			r.streamID,
+			ReasonProtocol,
 		}
 	}
 
@@ -331,17 +496,15 @@ func (f *PriorityFrame) readFrom(r *frameReader) error {
 	f.Exclusive = f.StreamDependency != x
 	f.Weight, _ = r.ReadByte()
 
+	// A stream cannot depend on itself, even one not opened yet.
+	if f.StreamDependency == f.StreamID {
+		return StreamError{fmt.Errorf("stream %d depends on itself", f.StreamID), ErrCodeProtocol, f.StreamID, ReasonProtocol}
+	}
+
 	return nil
 }
 
 func (f *RSTStreamFrame) readFrom(r *frameReader) error {
-	// RST_STREAM frames MUST be associated with a stream.  If a RST_STREAM
-	// frame is received with a stream identifier of 0x0, the recipient MUST
-	// treat this as a connection error (Section 5.4.1) of type PROTOCOL_ERROR.
-	if r.streamID == 0 {
-		return ConnError{errors.New("stream ID must be > 0"), ErrCodeProtocol}
-	}
-
 	// A RST_STREAM frame with a length other than 4 octets MUST be treated
 	// as a connection error (Section 5.4.1) of type FRAME_SIZE_ERROR.
 	if r.payloadLen != 4 {
@@ -355,14 +518,6 @@ func (f *RSTStreamFrame) readFrom(r *frameReader) error {
 }
 
 func (f *SettingsFrame) readFrom(r *frameReader) error {
-	// The stream identifier for a SETTINGS frame MUST be zero (0x0).  If an
-	// endpoint receives a SETTINGS frame whose stream identifier field is
-	// anything other than 0x0, the endpoint MUST respond with a connection
-	// error (Section 5.4.1) of type PROTOCOL_ERROR.
-	if r.streamID != 0 {
-		return ConnError{errors.New("stream ID must be zero"), ErrCodeProtocol}
-	}
-
 	// Receipt of a SETTINGS frame with the ACK flag set and a length
 	// field value other than 0 MUST be treated as a connection error
 	// (Section 5.4.1) of type FRAME_SIZE_ERROR.
@@ -382,46 +537,38 @@ func (f *SettingsFrame) readFrom(r *frameReader) error {
 		return ConnError{fmt.Errorf("bad frame length %d", r.payloadLen), ErrCodeFrameSize}
 	}
 
-	var err error
-
+	// An endpoint that receives a SETTINGS frame with any unknown or
+	// unsupported identifier MUST ignore that setting. Unknown settings
+	// are kept in the frame, and ignored when the settings are applied.
 	for i := 0; i < int(r.payloadLen/settingLen); i++ {
 		setting, _ := r.Peek(settingLen)
 		id := SettingID(binary.BigEndian.Uint16(setting[:2]))
 		value := binary.BigEndian.Uint32(setting[2:6])
 		r.Discard(settingLen)
 
-		if err = f.Settings.SetValue(id, value); err != nil {
+		if err := f.Settings.SetValue(id, value); err != nil {
 			switch id {
 			case SettingInitialWindowSize:
 				// Values above the maximum flow-control window size of 2^31-1 MUST
 				// be treated as a connection error (Section 5.4.1) of type FLOW_CONTROL_ERROR.
-				err = ConnError{err, ErrCodeFlowControl}
+				return ConnError{err, ErrCodeFlowControl}
 			case SettingMaxFrameSize:
 				// The initial value is 2^14 (16,384) octets.  The value advertised
 				// by an endpoint MUST be between this initial value and the maximum
 				// allowed frame size (2^24-1 or 16,777,215 octets), inclusive.
 				// Values outside this range MUST be treated as a connection error
 				// (Section 5.4.1) of type PROTOCOL_ERROR.
-				err = ConnError{err, ErrCodeFrameSize}
+				return ConnError{err, ErrCodeProtocol}
 			default:
-				err = ConnError{err, ErrCodeProtocol}
+				return ConnError{err, ErrCodeProtocol}
 			}
-
-			break
 		}
 	}
 
-	return err
+	return nil
 }
 
 func (f *PushPromiseFrame) readFrom(r *frameReader) error {
-	// The stream identifier of a PUSH_PROMISE frame indicates the stream it is
-	// associated with.  If the stream identifier field specifies the value
-	// 0x0, a recipient MUST respond with a connection error (Section 5.4.1) of type PROTOCOL_ERROR.
-	if r.streamID == 0 {
-		return ConnError{errors.New("stream ID must be > 0"), ErrCodeProtocol}
-	}
-
 	fragmentLen := int(r.payloadLen)
 
 	if r.frameType == FrameContinuation {
@@ -438,6 +585,7 @@ func (f *PushPromiseFrame) readFrom(r *frameReader) error {
 		}
 	} else {
 		f.StreamID = r.streamID
+		r.startHeaderBlock()
 
 		if r.flags.Has(FlagPadded) {
 			f.PadLen, _ = r.ReadByte()
@@ -461,6 +609,8 @@ func (f *PushPromiseFrame) readFrom(r *frameReader) error {
 		err       error
 	)
 
+	handle := r.headerFieldHandler(&f.Header, &f.Sensitive, f.PromisedStreamID, headerBlockOptions{})
+
 	for fragmentLen > 0 {
 		chunkSize = fragmentLen
 		if chunkSize > r.bufSize {
@@ -471,7 +621,7 @@ func (f *PushPromiseFrame) readFrom(r *frameReader) error {
 			return err
 		}
 
-		if _, err = r.Decode(chunk, r.maxHeaderListSize, f.Header.add); err != nil {
+		if _, err = r.Decode(chunk, 0, handle); err != nil {
 			return err
 		}
 
@@ -495,14 +645,6 @@ func (f *PushPromiseFrame) readFrom(r *frameReader) error {
 }
 
 func (f *PingFrame) readFrom(r *frameReader) error {
-	// PING frames are not associated with any individual stream.  If a PING
-	// frame is received with a stream identifier field value other than
-	// 0x0, the recipient MUST respond with a connection error
-	// (Section 5.4.1) of type PROTOCOL_ERROR.
-	if r.streamID != 0 {
-		return ConnError{errors.New("stream ID must be zero"), ErrCodeProtocol}
-	}
-
 	// Receipt of a PING frame with a length field value other than 8 MUST
 	// be treated as a connection error (Section 5.4.1) of type FRAME_SIZE_ERROR.
 	if r.payloadLen != 8 {
@@ -517,13 +659,6 @@ func (f *PingFrame) readFrom(r *frameReader) error {
 }
 
 func (f *GoAwayFrame) readFrom(r *frameReader) error {
-	// The GOAWAY frame applies to the connection, not a specific stream.
-	// An endpoint MUST treat a GOAWAY frame with a stream identifier other
-	// than 0x0 as a connection error (Section 5.4.1) of type PROTOCOL_ERROR.
-	if r.streamID != 0 {
-		return ConnError{errors.New("stream ID must be zero"), ErrCodeProtocol}
-	}
-
 	if r.payloadLen < 8 {
 		return ConnError{fmt.Errorf("bad frame length %d", r.payloadLen), ErrCodeProtocol}
 	}
@@ -556,7 +691,97 @@ func (f *WindowUpdateFrame) readFrom(r *frameReader) error {
 		if f.StreamID == 0 {
 			return ConnError{err, ErrCodeProtocol}
 		}
-		return StreamError{err, ErrCodeProtocol, f.StreamID}
+		return StreamError{err, ErrCodeProtocol, f.StreamID, ReasonProtocol}
+	}
+
+	return nil
+}
+
+func (f *AltSvcFrame) readFrom(r *frameReader) error {
+	if r.payloadLen < 2 {
+		return ConnError{fmt.Errorf("bad frame length %d", r.payloadLen), ErrCodeFrameSize}
+	}
+
+	originLen := uint32(r.readUint16())
+
+	if originLen > r.payloadLen-2 {
+		return ConnError{fmt.Errorf("bad origin length %d", originLen), ErrCodeFrameSize}
+	}
+
+	f.StreamID = r.streamID
+	f.Origin = make([]byte, originLen)
+	f.FieldValue = make([]byte, r.payloadLen-2-originLen)
+
+	if _, err := io.ReadFull(r, f.Origin); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(r, f.FieldValue); err != nil {
+		return err
+	}
+
+	// An ALTSVC frame on stream 0 with empty (length 0) "Origin"
+	// information is invalid and MUST be ignored.  An ALTSVC frame on a
+	// stream other than stream 0 containing non-empty "Origin" information
+	// is invalid and MUST be ignored.
+	if (f.StreamID == 0) == (originLen == 0) {
+		return errIgnoreFrame
+	}
+
+	return nil
+}
+
+func (f *OriginFrame) readFrom(r *frameReader) error {
+	// The ORIGIN frame MUST be sent on stream 0; an ORIGIN frame on any
+	// other stream is invalid and MUST be ignored.
+	if r.streamID != 0 {
+		r.Discard(int(r.payloadLen))
+		return errIgnoreFrame
+	}
+
+	for n := r.payloadLen; n > 0; {
+		// An Origin-Entry is an Origin-Len and an ASCII-Origin of that
+		// length. A truncated entry makes the frame invalid, and it is ignored.
+		if n < 2 {
+			r.Discard(int(n))
+			return errIgnoreFrame
+		}
+		originLen := uint32(r.readUint16())
+		n -= 2
+
+		if originLen > n {
+			r.Discard(int(n))
+			return errIgnoreFrame
+		}
+		origin := make([]byte, originLen)
+		if _, err := io.ReadFull(r, origin); err != nil {
+			return err
+		}
+		f.Origins = append(f.Origins, string(origin))
+		n -= originLen
+	}
+
+	return nil
+}
+
+func (f *PriorityUpdateFrame) readFrom(r *frameReader) error {
+	// A PRIORITY_UPDATE frame with a length less than 4 octets
+	// MUST be treated as a connection error of type FRAME_SIZE_ERROR.
+	if r.payloadLen < 4 {
+		return ConnError{fmt.Errorf("bad frame length %d", r.payloadLen), ErrCodeFrameSize}
+	}
+
+	f.PrioritizedStreamID = r.readUint32() & (1<<31 - 1)
+
+	fieldValue := make([]byte, r.payloadLen-4)
+	if _, err := io.ReadFull(r, fieldValue); err != nil {
+		return err
+	}
+	f.PriorityFieldValue = string(fieldValue)
+
+	// If the Prioritized Stream ID is 0x0, the recipient MUST respond
+	// with a connection error of type PROTOCOL_ERROR.
+	if f.PrioritizedStreamID == 0 {
+		return ConnError{errors.New("prioritized stream ID must be > 0"), ErrCodeProtocol}
 	}
 
 	return nil
@@ -571,12 +796,21 @@ func (f *UnknownFrame) readFrom(r *frameReader) error {
 	r.payload.r = r
 	r.payload.n = f.PayloadLen
 	r.payload.p = 0
+	r.payload.padded = false
 	r.lastPayload = &r.payload
 	f.Payload = r.lastPayload
 
 	return nil
 }
 
+func (r *frameReader) readUint16() (v uint16) {
+	b, _ := r.Peek(2)
+	v = binary.BigEndian.Uint16(b)
+	r.Discard(2)
+
+	return
+}
+
 func (r *frameReader) readUint32() (v uint32) {
 	b, _ := r.Peek(4)
 	v = binary.BigEndian.Uint32(b)
@@ -0,0 +1,551 @@
+package http2
+
+import "sync"
+
+// A WriteScheduler decides the order in which streams that have a DATA
+// frame ready are written to the connection. Control frames, frames that
+// are not associated with a stream, and the HEADERS frames of streams, are
+// always written first.
+//
+// A stream has at most one frame ready at a time. WriteScheduler methods are
+// called serially by the connection, with the write queue locked.
+type WriteScheduler interface {
+	// Push marks the stream as ready to be written.
+	Push(streamID uint32)
+
+	// Pop removes and returns the next stream to be written.
+	// It returns false if no stream is ready.
+	Pop() (streamID uint32, ok bool)
+
+	// Written reports that n bytes of flow-controlled data
+	// of the stream have been scheduled.
+	Written(streamID uint32, n int)
+
+	// Remove reports that the stream has been closed. A stream that was
+	// pushed before being closed must still be returned by Pop.
+	Remove(streamID uint32)
+}
+
+// NewRoundRobinWriteScheduler returns a WriteScheduler that writes ready
+// streams in the order they became ready, ignoring stream priority.
+func NewRoundRobinWriteScheduler(*Conn) WriteScheduler {
+	return &roundRobinWriteScheduler{}
+}
+
+type roundRobinWriteScheduler struct {
+	queue []uint32
+}
+
+func (ws *roundRobinWriteScheduler) Push(streamID uint32) {
+	ws.queue = append(ws.queue, streamID)
+}
+
+func (ws *roundRobinWriteScheduler) Pop() (uint32, bool) {
+	if len(ws.queue) == 0 {
+		return 0, false
+	}
+	streamID := ws.queue[0]
+	ws.queue = ws.queue[1:]
+	return streamID, true
+}
+
+func (ws *roundRobinWriteScheduler) Written(uint32, int) {}
+
+func (ws *roundRobinWriteScheduler) Remove(uint32) {}
+
+// NewPriorityWriteScheduler returns a WriteScheduler that follows the
+// stream dependency tree, defined in RFC 7540 section 5.3.
+//
+// A stream is only scheduled when none of its ancestors are ready.
+// Sibling streams share their parent's resources in proportion to their
+// weight: each stream keeps a virtual time, advanced by the bytes written
+// within its subtree divided by its effective weight, and the sibling with
+// the lowest virtual time is scheduled first. Ties are broken in favor of
+// the lower stream identifier. A stream that becomes ready, or is moved to
+// another parent, starts at the virtual time of the sibling scheduled last,
+// so that its share is recomputed against its current siblings.
+//
+// Streams that have been closed while ready are scheduled before any other.
+func NewPriorityWriteScheduler(c *Conn) WriteScheduler {
+	return &priorityWriteScheduler{
+		conn:   c,
+		ready:  make(map[uint32]bool),
+		closed: make(map[uint32]bool),
+		active: make(map[uint32]int),
+		vt:     make(map[uint32]uint64),
+		parent: make(map[uint32]uint32),
+		clock:  make(map[uint32]uint64),
+	}
+}
+
+type priorityWriteScheduler struct {
+	conn *Conn
+
+	ready  map[uint32]bool
+	closed map[uint32]bool
+
+	// active counts the ready streams within the subtree of each
+	// stream, as of the generation gen of the dependency tree.
+	active map[uint32]int
+	gen    uint64
+
+	vt     map[uint32]uint64
+	parent map[uint32]uint32
+	clock  map[uint32]uint64
+}
+
+func (ws *priorityWriteScheduler) Push(streamID uint32) {
+	if ws.ready[streamID] {
+		return
+	}
+	ws.ready[streamID] = true
+
+	c := ws.conn
+
+	c.priorityL.RLock()
+	defer c.priorityL.RUnlock()
+
+	if s := c.priorityTree[streamID]; s == nil {
+		ws.closed[streamID] = true
+	} else if ws.gen == c.priorityGen {
+		ws.activate(s, 1)
+	}
+}
+
+func (ws *priorityWriteScheduler) Pop() (uint32, bool) {
+	if len(ws.ready) == 0 {
+		return 0, false
+	}
+
+	c := ws.conn
+
+	c.priorityL.RLock()
+	defer c.priorityL.RUnlock()
+
+	if ws.gen != c.priorityGen {
+		ws.rebuild()
+	}
+
+	if len(ws.closed) > 0 {
+		var closed uint32
+		for streamID := range ws.closed {
+			if closed == 0 || streamID < closed {
+				closed = streamID
+			}
+		}
+		delete(ws.closed, closed)
+		delete(ws.ready, closed)
+		return closed, true
+	}
+
+	for s := c.connStream; ; {
+		var next *stream
+		for _, child := range s.children {
+			if ws.active[child.id] == 0 {
+				continue
+			}
+			if ws.parent[child.id] != s.id || ws.vt[child.id] < ws.clock[s.id] {
+				ws.parent[child.id] = s.id
+				ws.vt[child.id] = ws.clock[s.id]
+			}
+			if next == nil || ws.vt[child.id] < ws.vt[next.id] ||
+				(ws.vt[child.id] == ws.vt[next.id] && child.id < next.id) {
+				next = child
+			}
+		}
+		if next == nil {
+			return 0, false
+		}
+		ws.clock[s.id] = ws.vt[next.id]
+		if ws.ready[next.id] {
+			delete(ws.ready, next.id)
+			ws.activate(next, -1)
+			return next.id, true
+		}
+		s = next
+	}
+}
+
+// activate adds delta to the number of ready streams within the
+// subtrees of the stream and its ancestors.
+func (ws *priorityWriteScheduler) activate(s *stream, delta int) {
+	for ; s != nil && s.id != 0; s = s.parent {
+		if ws.active[s.id] += delta; ws.active[s.id] <= 0 {
+			delete(ws.active, s.id)
+		}
+	}
+}
+
+// rebuild recounts the ready streams after the dependency tree changed.
+// Ready streams that are no longer in the tree are marked as closed.
+func (ws *priorityWriteScheduler) rebuild() {
+	c := ws.conn
+
+	ws.active = make(map[uint32]int)
+	ws.gen = c.priorityGen
+
+	for streamID := range ws.ready {
+		if ws.closed[streamID] {
+			continue
+		}
+		if s := c.priorityTree[streamID]; s == nil {
+			ws.closed[streamID] = true
+		} else {
+			ws.activate(s, 1)
+		}
+	}
+}
+
+func (ws *priorityWriteScheduler) Written(streamID uint32, n int) {
+	if n <= 0 {
+		return
+	}
+
+	c := ws.conn
+
+	c.priorityL.RLock()
+	defer c.priorityL.RUnlock()
+
+	for s := c.priorityTree[streamID]; s != nil && s.id != 0; s = s.parent {
+		ws.vt[s.id] += uint64(n) * (maxWeight + 1) / (uint64(s.weight) + 1)
+	}
+}
+
+func (ws *priorityWriteScheduler) Remove(streamID uint32) {
+	if ws.ready[streamID] {
+		ws.closed[streamID] = true
+	}
+	delete(ws.vt, streamID)
+	delete(ws.parent, streamID)
+	delete(ws.clock, streamID)
+}
+
+// NewExtensiblePriorityWriteScheduler returns a WriteScheduler that follows
+// the Extensible Priority Scheme, defined in RFC 9218, ignoring the stream
+// dependency tree.
+//
+// The ready streams of the lowest urgency are scheduled first. Among streams
+// of the same urgency, non-incremental streams are scheduled one after the
+// other in ascending order of stream identifier, before incremental streams,
+// which are scheduled in turn so that they share the connection.
+//
+// Streams that have been closed while ready are scheduled before any other.
+func NewExtensiblePriorityWriteScheduler(c *Conn) WriteScheduler {
+	return &extensiblePriorityWriteScheduler{
+		conn:   c,
+		ready:  make(map[uint32]bool),
+		closed: make(map[uint32]bool),
+	}
+}
+
+type extensiblePriorityWriteScheduler struct {
+	conn *Conn
+
+	ready  map[uint32]bool
+	closed map[uint32]bool
+
+	// last is the incremental stream scheduled last, by urgency.
+	last [maxUrgency + 1]uint32
+}
+
+func (ws *extensiblePriorityWriteScheduler) Push(streamID uint32) {
+	ws.ready[streamID] = true
+}
+
+func (ws *extensiblePriorityWriteScheduler) Pop() (uint32, bool) {
+	if len(ws.ready) == 0 {
+		return 0, false
+	}
+
+	c := ws.conn
+
+	c.priorityL.RLock()
+	defer c.priorityL.RUnlock()
+
+	var (
+		next  uint32
+		nextP PriorityParam
+	)
+	for streamID := range ws.ready {
+		s := c.priorityTree[streamID]
+		if s == nil {
+			ws.closed[streamID] = true
+			continue
+		}
+		if p := s.priorityParam; next == 0 || ws.less(streamID, p, next, nextP) {
+			next, nextP = streamID, p
+		}
+	}
+
+	if len(ws.closed) > 0 {
+		var closed uint32
+		for streamID := range ws.closed {
+			if closed == 0 || streamID < closed {
+				closed = streamID
+			}
+		}
+		delete(ws.closed, closed)
+		delete(ws.ready, closed)
+		return closed, true
+	}
+
+	if nextP.Incremental {
+		ws.last[nextP.Urgency] = next
+	}
+	delete(ws.ready, next)
+	return next, true
+}
+
+// less reports whether the stream a is to be scheduled before the stream b.
+func (ws *extensiblePriorityWriteScheduler) less(a uint32, pa PriorityParam, b uint32, pb PriorityParam) bool {
+	if pa.Urgency != pb.Urgency {
+		return pa.Urgency < pb.Urgency
+	}
+	if pa.Incremental != pb.Incremental {
+		return !pa.Incremental
+	}
+	if !pa.Incremental {
+		return a < b
+	}
+
+	// Incremental streams are taken in turn, starting
+	// after the one scheduled last.
+	last := ws.last[pa.Urgency]
+	if (a > last) != (b > last) {
+		return a > last
+	}
+	return a < b
+}
+
+func (ws *extensiblePriorityWriteScheduler) Written(uint32, int) {}
+
+func (ws *extensiblePriorityWriteScheduler) Remove(streamID uint32) {
+	if ws.ready[streamID] {
+		ws.closed[streamID] = true
+	}
+}
+
+const maxWeight = 255
+
+// writeQueue orders the frames to be written in tiers: the control frames
+// first, then the other frames not associated with a stream, like
+// PUSH_PROMISE frames, then the HEADERS frames of streams, and the DATA
+// frames of streams last, in the order of the WriteScheduler. The frames
+// of each of the first three tiers are written in the order they are
+// queued. A stream has at most one frame queued at a time, so that its
+// HEADERS frame precedes its DATA frames, which precede its trailers, and
+// a promised stream is written after its PUSH_PROMISE frame.
+type writeQueue struct {
+	sync.Mutex
+	cbuf, buf []Frame
+	streams   map[uint32]*stream
+	headers   []uint32
+	barriers  []*flushFrame
+	sched     WriteScheduler
+	ch        chan Frame
+
+	// The frames queued other than the control frames, and the bytes of
+	// the DATA frames among them, limited by maxFrames and maxBytes if
+	// positive. Adders wait on cond for the queue to have room.
+	frames, bytes       int
+	maxFrames, maxBytes int
+	cond                *sync.Cond
+	closed              bool
+}
+
+func newWriteQueue(sched WriteScheduler, maxFrames, maxBytes int) *writeQueue {
+	w := &writeQueue{
+		streams:   make(map[uint32]*stream),
+		sched:     sched,
+		ch:        make(chan Frame, 1),
+		maxFrames: maxFrames,
+		maxBytes:  maxBytes,
+	}
+	w.cond = sync.NewCond(&w.Mutex)
+	return w
+}
+
+// queuedLen returns the bytes of a frame counted in the queue.
+func queuedLen(frame Frame) int {
+	if s, ok := frame.(*stream); ok {
+		frame = s.Frame
+	}
+	if data, ok := frame.(*DataFrame); ok {
+		return data.DataLen + int(data.PadLen)
+	}
+	return 0
+}
+
+// full reports whether the queue has no room for a frame of n bytes.
+// A frame is always queued when no other one is.
+func (w *writeQueue) full(n int) bool {
+	if w.closed || w.frames == 0 {
+		return false
+	}
+	return (w.maxFrames > 0 && w.frames+1 > w.maxFrames) ||
+		(w.maxBytes > 0 && w.bytes+n > w.maxBytes)
+}
+
+// dequeued accounts a frame other than a control frame leaving the queue.
+// Once the frames of the streams a barrier waits for have left, it is
+// queued behind the frames not associated with a stream.
+func (w *writeQueue) dequeued(frame Frame) {
+	w.frames--
+	w.bytes -= queuedLen(frame)
+	w.cond.Broadcast()
+
+	s, ok := frame.(*stream)
+	if !ok || len(w.barriers) == 0 {
+		return
+	}
+	barriers := w.barriers[:0]
+	for _, f := range w.barriers {
+		if delete(f.waiting, s.id); len(f.waiting) == 0 {
+			w.buf = append(w.buf, f)
+		} else {
+			barriers = append(barriers, f)
+		}
+	}
+	w.barriers = barriers
+}
+
+// barrier queues a flushFrame to be written once the frames queued so
+// far are. The control frames and the frames not associated with a
+// stream are written before it, being written in order ahead of the
+// frames of streams, which it waits for.
+func (w *writeQueue) barrier(f *flushFrame) {
+	w.Lock()
+	defer w.Unlock()
+
+	if len(w.streams) > 0 {
+		f.waiting = make(map[uint32]bool, len(w.streams))
+		for streamID := range w.streams {
+			f.waiting[streamID] = true
+		}
+		w.barriers = append(w.barriers, f)
+		return
+	}
+	w.buf = append(w.buf, f)
+	w.push()
+}
+
+// close wakes up the adders waiting for the queue to have room,
+// which no longer wait.
+func (w *writeQueue) close() {
+	w.Lock()
+	w.closed = true
+	w.cond.Broadcast()
+	w.Unlock()
+}
+
+func (w *writeQueue) get() <-chan Frame {
+	return w.ch
+}
+
+func (w *writeQueue) set() bool {
+	w.Lock()
+	defer w.Unlock()
+
+	if len(w.cbuf) == 0 && len(w.buf) == 0 && len(w.streams) == 0 {
+		return len(w.ch) > 0
+	}
+	w.push()
+	return true
+}
+
+func (w *writeQueue) add(frame Frame, control bool) {
+	w.Lock()
+	defer w.Unlock()
+
+	// Control frames are always queued, while the other frames wait
+	// for the queue to have room, applying backpressure to their writers.
+	if !control && frame != nil {
+		n := queuedLen(frame)
+		for w.full(n) {
+			w.cond.Wait()
+		}
+		w.frames++
+		w.bytes += n
+	}
+
+	if control {
+		w.cbuf = append(w.cbuf, frame)
+	} else if s, ok := frame.(*stream); ok {
+		w.streams[s.id] = s
+		if s.Frame.Type() == FrameHeaders {
+			w.headers = append(w.headers, s.id)
+		} else {
+			w.sched.Push(s.id)
+		}
+	} else {
+		w.buf = append(w.buf, frame)
+	}
+	w.push()
+}
+
+// remove drops the stream from the queue, returning it if its frame
+// was waiting to be written.
+func (w *writeQueue) remove(streamID uint32) *stream {
+	w.Lock()
+	defer w.Unlock()
+
+	w.sched.Remove(streamID)
+	s, ok := w.streams[streamID]
+	if ok {
+		delete(w.streams, streamID)
+		w.dequeued(s)
+	}
+	for i, id := range w.headers {
+		if id == streamID {
+			w.headers = append(w.headers[:i], w.headers[i+1:]...)
+			break
+		}
+	}
+	w.push()
+	return s
+}
+
+// push moves the next frame to be written to ch, if ch has room.
+func (w *writeQueue) push() {
+	for len(w.ch) < cap(w.ch) {
+		if len(w.cbuf) > 0 {
+			w.ch <- w.cbuf[0]
+			w.cbuf = w.cbuf[1:]
+			return
+		}
+		if len(w.buf) > 0 {
+			if _, ok := w.buf[0].(*flushFrame); !ok && w.buf[0] != nil {
+				w.dequeued(w.buf[0])
+			}
+			w.ch <- w.buf[0]
+			w.buf = w.buf[1:]
+			return
+		}
+		if len(w.headers) > 0 {
+			s := w.streams[w.headers[0]]
+			delete(w.streams, s.id)
+			w.headers = w.headers[1:]
+			w.dequeued(s)
+			w.ch <- s
+			return
+		}
+		if len(w.streams) == 0 {
+			return
+		}
+		streamID, ok := w.sched.Pop()
+		if !ok {
+			return
+		}
+		s, ok := w.streams[streamID]
+		if !ok {
+			continue
+		}
+		delete(w.streams, streamID)
+		w.dequeued(s)
+		if data, ok := s.Frame.(*DataFrame); ok {
+			w.sched.Written(streamID, data.DataLen+int(data.PadLen))
+		}
+		w.ch <- s
+		return
+	}
+}
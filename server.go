@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 )
 
 // A Handler for reading or writing frames from the connection.
@@ -20,6 +21,11 @@ type Server struct {
 	Handler   Handler     // handler to invoke, cannot be nil
 	Config    *Config     // optional connection config, used by ServerConn
 	TLSConfig *tls.Config // optional TLS config, used by ListenAndServeTLS
+
+	// AllowH2C enables HTTP/2 over cleartext TCP, with the HTTP/1.1
+	// Upgrade or with prior knowledge, defined in RFC 7540 section 3.2
+	// and 3.4. If false, connections that are not TLS ones are closed.
+	AllowH2C bool
 }
 
 // Serve accepts incoming connections on the Listener l, creating a
@@ -33,6 +39,10 @@ func (s *Server) Serve(l net.Listener) error {
 		if err != nil {
 			return err
 		}
+		if _, overTLS := rwc.(*tls.Conn); !overTLS && !s.AllowH2C {
+			rwc.Close()
+			continue
+		}
 		conn := ServerConn(rwc, s.Config)
 		go s.Handler(conn)
 	}
@@ -137,26 +147,10 @@ func (c *Conn) serverHandshake() error {
 		if state.NegotiatedProtocol != ProtocolTLS {
 			return HandshakeError(fmt.Sprintf("bad protocol %s", state.NegotiatedProtocol))
 		}
-
-		// Due to deployment limitations, it might not
-		// be possible to fail TLS negotiation when these restrictions are not
-		// met.  An endpoint MAY immediately terminate an HTTP/2 connection that
-		// does not meet these TLS requirements with a connection error
-		// (Section 5.4.1) of type INADEQUATE_SECURITY.
-		if !c.config.AllowLowTLSVersion && state.Version < tls.VersionTLS12 {
-			return ConnError{fmt.Errorf("bad TLS version %x", state.Version), ErrCodeInadequateSecurity}
-		}
-
-		// A deployment of HTTP/2 over TLS 1.2 SHOULD NOT use any of the cipher
-		// suites that are listed in the cipher suite black list (Appendix A).
-		//
-		// Endpoints MAY choose to generate a connection error (Section 5.4.1)
-		// of type INADEQUATE_SECURITY if one of the cipher suites from the
-		// black list is negotiated.
-		if state.Version >= tls.VersionTLS12 && badCipher(state.CipherSuite) {
-			return ConnError{fmt.Errorf("prohibited TLS 1.2 cipher type %x", state.CipherSuite), ErrCodeInadequateSecurity}
+		if err := c.checkTLS(state); err != nil {
+			return err
 		}
-	} else {
+	} else if !c.priorKnowledge() && !c.tlsRecord() {
 		upgradeFunc := c.upgradeFunc
 		if upgradeFunc == nil {
 			upgradeFunc = func() error {
@@ -183,25 +177,73 @@ func (c *Conn) serverHandshake() error {
 	// The client connection preface starts with a sequence of 24 octets.
 	// This sequence MUST be followed by a
 	// SETTINGS frame (Section 6.5), which MAY be empty.
-	if preface, err := c.buf.Peek(len(ClientPreface)); err == nil {
-		if !bytes.Equal(preface, clientPreface) {
-			return errBadConnPreface
-		}
-	} else {
+	if err := c.readClientPreface(); err != nil {
 		return err
 	}
-	c.buf.Discard(len(ClientPreface))
-	if firstFrame, err := c.readFrame(); err == nil {
-		if settings, ok := firstFrame.(*SettingsFrame); !ok || settings.Ack {
-			return errors.New("first received frame was not SETTINGS")
-		}
-	} else {
-		return err
+	return c.readPrefaceSettings()
+}
+
+// priorKnowledge reports whether the client starts HTTP/2 without upgrade,
+// sending the connection preface at once, defined in RFC 7540 section 3.4.
+// The method of the preface tells it apart from an upgrade request, which
+// uses GET; the whole preface is checked afterwards.
+func (c *Conn) priorKnowledge() bool {
+	if c.upgradeFunc != nil {
+		return false
+	}
+	const method = len("PRI ")
+	preface, err := c.buf.Peek(method)
+	return err == nil && bytes.Equal(preface, clientPreface[:method])
+}
+
+// tlsRecord reports whether the client starts a TLS handshake on the
+// cleartext connection, which is reported as a bad connection preface
+// instead of a malformed upgrade request.
+func (c *Conn) tlsRecord() bool {
+	if c.upgradeFunc != nil {
+		return false
 	}
+	header, err := c.buf.Peek(len(tlsHandshakeRecord))
+	return err == nil && bytes.Equal(header, tlsHandshakeRecord)
+}
 
+// tlsHandshakeRecord is the content type and major version of a TLS
+// record header carrying a handshake message.
+var tlsHandshakeRecord = []byte{0x16, 0x03}
+
+// readClientPreface reads and checks the client connection preface. If the
+// received octets do not match, the returned connection error includes
+// them, so that clients speaking HTTP/1.1 or TLS can be told apart.
+func (c *Conn) readClientPreface() error {
+	preface, err := c.buf.Peek(len(ClientPreface))
+	if !bytes.HasPrefix(clientPreface, preface) {
+		return badConnPreface(preface)
+	}
+	if err != nil {
+		return err
+	}
+	c.buf.Discard(len(ClientPreface))
 	return nil
 }
 
+// maxPrefaceDump bounds the received octets included in a bad
+// connection preface error.
+const maxPrefaceDump = 16
+
+func badConnPreface(received []byte) error {
+	if len(received) > maxPrefaceDump {
+		received = received[:maxPrefaceDump]
+	}
+	var hint string
+	switch {
+	case bytes.HasPrefix(received, tlsHandshakeRecord):
+		hint = " (TLS handshake)"
+	case bytes.Contains(received, []byte(" HTTP/1.")), bytes.Contains(received, []byte(" /")):
+		hint = " (HTTP/1.x request)"
+	}
+	return ConnError{fmt.Errorf("%w: received % x%s", errBadConnPreface, received, hint), ErrCodeProtocol}
+}
+
 func (c *Conn) serverUpgrade(upgrade *http.Request, hijacked bool) error {
 	status := http.StatusBadRequest
 	reason := "bad upgrade request"
@@ -245,7 +287,7 @@ func (c *Conn) serverUpgrade(upgrade *http.Request, hijacked bool) error {
 		// SETTINGS frame.  Explicit acknowledgement of these settings
 		// (Section 6.5.3) is not necessary, since a 101 response serves as
 		// implicit acknowledgement.
-		payload, err := base64.URLEncoding.DecodeString(values[0])
+		payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(values[0], "="))
 		if err != nil {
 			reason = err.Error()
 			goto fail
@@ -290,10 +332,11 @@ fail:
 	// connection, stream 1 is used for the response.
 	stream, _ := c.remote.idleStream(1)
 	stream.transition(true, FrameHeaders, true)
+	stream.sawHeaders = true
 
 	if !hijacked {
 		h, _ := requestToHeader(upgrade, true)
-		headers := &HeadersFrame{1, h, Priority{}, 0, upgrade.ContentLength <= 0}
+		headers := &HeadersFrame{StreamID: 1, Header: h, EndStream: upgrade.ContentLength <= 0}
 		c.upgradeFrames = make([]Frame, 0, 2)
 		c.upgradeFrames = append(c.upgradeFrames, headers)
 		if !headers.EndStream {
@@ -0,0 +1,281 @@
+package http2
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats receives the events of a connection, to collect its metrics.
+// The methods are called in order from a goroutine of the connection,
+// without holding any of its locks, shortly after the events occurred.
+// They should be fast: while they do not keep up, up to 4096 events are
+// queued, and the next ones are dropped, as counted by DroppedStats.
+type ConnStats interface {
+	// StreamOpened is called when a stream is opened or reserved.
+	StreamOpened(streamID uint32)
+
+	// StreamClosed is called when a stream is closed,
+	// with the state it was closed from.
+	StreamClosed(streamID uint32, state StreamState)
+
+	// FrameRead and FrameWritten are called for each frame read or
+	// written, with the size of its payload. The size of a header block
+	// includes the CONTINUATION frames.
+	FrameRead(frameType FrameType, size int)
+	FrameWritten(frameType FrameType, size int)
+
+	// FlowControlStalled is called when writing DATA frames waited for
+	// the flow-control window of a stream to be available, or for the
+	// one of the connection with stream ID 0, longer than the
+	// FlowControlStallThreshold of the Config.
+	FlowControlStalled(streamID uint32, d time.Duration)
+}
+
+// StreamTiming holds the times of the events of a stream, as returned by
+// the StreamTiming method of a Conn. The times not reached yet are zero.
+type StreamTiming struct {
+	// Opened is when the stream was opened by a HEADERS frame.
+	Opened time.Time
+
+	// FirstData is when the first DATA frame of the stream
+	// was sent or received.
+	FirstData time.Time
+
+	// Closed is when the stream was closed.
+	Closed time.Time
+}
+
+// RTT returns the estimated round-trip time of the connection, smoothed
+// over the PING frames acknowledged by the remote endpoint, the ones sent
+// by Ping, for the keepalive or to tune the flow-control windows. It
+// returns zero until the first one is acknowledged.
+func (c *Conn) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+// sampleRTT folds a round-trip time sample into the estimate,
+// weighting it by 1/8 as the smoothed RTT of TCP.
+func (c *Conn) sampleRTT(d time.Duration) {
+	for {
+		old := atomic.LoadInt64(&c.rtt)
+		rtt := int64(d)
+		if old != 0 {
+			rtt = old + (int64(d)-old)/8
+		}
+		if atomic.CompareAndSwapInt64(&c.rtt, old, rtt) {
+			return
+		}
+	}
+}
+
+// StreamBandwidth returns the estimated rate, in bytes per second, at which
+// the bytes received on the given stream are delivered, that is read and
+// returned to its flow-control window, or the one of the connection for
+// stream ID 0. It is sampled over about one round trip, and is zero
+// until the first sample. It returns false if the stream does not exist.
+func (c *Conn) StreamBandwidth(streamID uint32) (int64, bool) {
+	stream := c.connStream
+	if streamID != 0 {
+		if stream = c.stream(streamID); stream == nil {
+			return 0, false
+		}
+	}
+	return stream.recvFlow.rate.bytesPerSecond(), true
+}
+
+// rateEstimatorMinInterval is the minimum duration of the samples of a
+// rateEstimator, and rateEstimatorIdle the number of sample intervals
+// without bytes after which a sample is discarded.
+const (
+	rateEstimatorMinInterval = 10 * time.Millisecond
+	rateEstimatorIdle        = 8
+)
+
+// rateEstimator estimates the rate at which bytes are delivered, counting
+// the bytes added over sample intervals of about one round trip, weighted
+// by 1/4 into the estimate. The samples spanning an idle period are
+// discarded, so that the estimate is the rate while delivering.
+//
+// The calls of add are serialized by the caller, the rate is read
+// atomically.
+type rateEstimator struct {
+	start time.Time
+	last  time.Time
+	n     int
+	rate  int64
+}
+
+func (e *rateEstimator) add(n int, interval time.Duration) {
+	if interval < rateEstimatorMinInterval {
+		interval = rateEstimatorMinInterval
+	}
+
+	now := time.Now()
+	if e.start.IsZero() || now.Sub(e.last) > rateEstimatorIdle*interval {
+		// The bytes delivered before the start of a sample
+		// are not counted.
+		e.start, e.last, e.n = now, now, 0
+		return
+	}
+	e.last = now
+	e.n += n
+
+	elapsed := now.Sub(e.start)
+	if elapsed < interval {
+		return
+	}
+	sample := int64(float64(e.n) / elapsed.Seconds())
+	if old := atomic.LoadInt64(&e.rate); old != 0 {
+		sample = old + (sample-old)/4
+	}
+	atomic.StoreInt64(&e.rate, sample)
+	e.start, e.n = now, 0
+}
+
+func (e *rateEstimator) bytesPerSecond() int64 {
+	return atomic.LoadInt64(&e.rate)
+}
+
+func unixTime(nsec int64) time.Time {
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
+// maxQueuedStatsEvents is the number of events queued for a ConnStats,
+// beyond which they are dropped.
+const maxQueuedStatsEvents = 4096
+
+// DroppedStats returns the number of events of the connection dropped
+// because its ConnStats did not keep up with them.
+func (c *Conn) DroppedStats() uint64 {
+	if c.stats == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.stats.dropped)
+}
+
+type statsEventKind uint8
+
+const (
+	statsStreamOpened statsEventKind = iota
+	statsStreamClosed
+	statsFrameRead
+	statsFrameWritten
+	statsFlowControlStalled
+)
+
+// A statsEvent is an event queued for a ConnStats.
+type statsEvent struct {
+	kind      statsEventKind
+	frameType FrameType
+	state     StreamState
+	streamID  uint32
+	n         int64
+}
+
+func (e *statsEvent) deliver(stats ConnStats) {
+	switch e.kind {
+	case statsStreamOpened:
+		stats.StreamOpened(e.streamID)
+	case statsStreamClosed:
+		stats.StreamClosed(e.streamID, e.state)
+	case statsFrameRead:
+		stats.FrameRead(e.frameType, int(e.n))
+	case statsFrameWritten:
+		stats.FrameWritten(e.frameType, int(e.n))
+	case statsFlowControlStalled:
+		stats.FlowControlStalled(e.streamID, time.Duration(e.n))
+	}
+}
+
+// statsQueue delivers the events of a connection to its ConnStats, up to
+// maxQueuedStatsEvents being queued. A nil queue discards them.
+type statsQueue struct {
+	stats   ConnStats
+	dropped uint64 // accessed atomically
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	events []statsEvent
+	closed bool
+}
+
+func newStatsQueue(stats ConnStats) *statsQueue {
+	if stats == nil {
+		return nil
+	}
+	q := &statsQueue{stats: stats}
+	q.cond = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+func (q *statsQueue) run() {
+	var events []statsEvent
+	for {
+		q.mu.Lock()
+		for len(q.events) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.events) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		events, q.events = q.events, events[:0]
+		q.mu.Unlock()
+
+		for i := range events {
+			events[i].deliver(q.stats)
+		}
+	}
+}
+
+func (q *statsQueue) add(event statsEvent) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	switch {
+	case q.closed:
+	case len(q.events) >= maxQueuedStatsEvents:
+		atomic.AddUint64(&q.dropped, 1)
+	default:
+		q.events = append(q.events, event)
+		q.cond.Signal()
+	}
+	q.mu.Unlock()
+}
+
+// close delivers the queued events and stops the queue.
+func (q *statsQueue) close() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Signal()
+	q.mu.Unlock()
+}
+
+func (q *statsQueue) streamOpened(streamID uint32) {
+	q.add(statsEvent{kind: statsStreamOpened, streamID: streamID})
+}
+
+func (q *statsQueue) streamClosed(streamID uint32, state StreamState) {
+	q.add(statsEvent{kind: statsStreamClosed, streamID: streamID, state: state})
+}
+
+func (q *statsQueue) frameRead(frameType FrameType, size int) {
+	q.add(statsEvent{kind: statsFrameRead, frameType: frameType, n: int64(size)})
+}
+
+func (q *statsQueue) frameWritten(frameType FrameType, size int) {
+	q.add(statsEvent{kind: statsFrameWritten, frameType: frameType, n: int64(size)})
+}
+
+func (q *statsQueue) flowControlStalled(streamID uint32, d time.Duration) {
+	q.add(statsEvent{kind: statsFlowControlStalled, streamID: streamID, n: int64(d)})
+}
@@ -1,9 +1,12 @@
 package http2
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type StreamState int32
@@ -18,7 +21,9 @@ const (
 	StateClosed
 )
 
-const defaultWeight = 16
+// defaultWeight is the default stream weight, as carried on the wire
+// (one less than the effective weight of 16), defined in RFC 7540 section 5.3.5.
+const defaultWeight = 15
 
 type stream struct {
 	conn *Conn
@@ -30,6 +35,14 @@ type stream struct {
 	parent   *stream
 	children map[uint32]*stream
 
+	// priorityParam is the priority of the stream in the
+	// Extensible Priority Scheme, guarded by the priorityL lock
+	// of the connection.
+	priorityParam PriorityParam
+
+	// flowL guards the flow controllers created when a reserved stream
+	// opens, against the stream being closed concurrently.
+	flowL    sync.Mutex
 	recvFlow *flowController
 	sendFlow *remoteFlowController
 
@@ -37,12 +50,46 @@ type stream struct {
 	lastWritten FrameType
 	sawEOS      bool
 
+	// written is set once a frame of the stream is written, and read
+	// by the frame reader for the streams reset by the remote endpoint.
+	written uint32
+
+	// sawHeaders is set once the final header block is received,
+	// the following one being trailers.
+	sawHeaders bool
+
+	// contentLength is the content-length of the message received on the
+	// stream, or -1 if there is none to check the octets of the received
+	// DATA frames against. headRequest is set once a client wrote a HEAD
+	// request on the stream, the response of which has no content.
+	contentLength,
+	dataReceived int64
+	headRequest uint32
+
+	// sentInterim and sentFinal are set once an interim or the final
+	// response is written by a server.
+	sentInterim,
+	sentFinal bool
+
 	resetSent,
 	resetReceived bool
 
+	// resetErr is returned by writes once the stream has been reset by the peer.
+	resetErr error
+
+	// opened, firstData and closed are the times, in Unix nanoseconds,
+	// the stream was opened, sent or received its first DATA frame, and
+	// was closed.
+	opened,
+	firstData,
+	closed int64
+
 	wio     chan struct{}
 	werr    chan error
 	closeCh chan struct{}
+
+	ctx       context.Context
+	cancelCtx context.CancelFunc
 }
 
 func (s *stream) active() bool {
@@ -64,6 +111,9 @@ func (s *stream) readable() bool {
 }
 
 func (s *stream) writable() bool {
+	if s.ctx != nil && s.ctx.Err() != nil {
+		return false
+	}
 	switch StreamState(atomic.LoadInt32((*int32)(&s.state))) {
 	case StateOpen, StateHalfClosedRemote:
 		return true
@@ -74,12 +124,20 @@ func (s *stream) writable() bool {
 
 var errStreamClosed = errors.New("stream closed")
 
+// closedErr returns the error of writes on the closed stream.
+func (s *stream) closedErr() error {
+	if s.resetErr != nil {
+		return s.resetErr
+	}
+	return errStreamClosed
+}
+
 func (s *stream) write(frame Frame) error {
 	select {
 	case <-s.conn.closeCh:
 		return ErrClosed
 	case <-s.closeCh:
-		return errStreamClosed
+		return s.closedErr()
 	case <-s.wio:
 		defer func() { s.wio <- struct{}{} }()
 
@@ -90,7 +148,7 @@ func (s *stream) write(frame Frame) error {
 		if frame.Type() == FrameHeaders {
 			s.Frame = frame
 			s.conn.writeQueue.add(s, false)
-			return <-s.werr
+			return s.wait()
 		}
 
 		data, ok := frame.(*DataFrame)
@@ -98,17 +156,27 @@ func (s *stream) write(frame Frame) error {
 			return fmt.Errorf("bad flow control frame type %s", frame.Type())
 		}
 
+		// Each chunk is limited to the size of a single frame, so that
+		// the write scheduler can interleave the streams.
+		maxFrameSize := int(s.conn.remoteSettings().MaxFrameSize())
+		chunkLen := func(n int) int {
+			if n > maxFrameSize {
+				return maxFrameSize
+			}
+			return n
+		}
+
 		dataLen := data.DataLen
 		padLen := int(data.PadLen)
-		allowed, err := allocateBytes(s, dataLen+padLen)
+		allowed, err := allocateBytes(s, chunkLen(dataFlowLen(dataLen, padLen)))
 		if err != nil {
 			return err
 		}
 
-		if allowed == dataLen+padLen {
+		if allowed == dataFlowLen(dataLen, padLen) {
 			s.Frame = frame
 			s.conn.writeQueue.add(s, false)
-			return <-s.werr
+			return s.wait()
 		}
 
 		chunk := new(DataFrame)
@@ -124,26 +192,37 @@ func (s *stream) write(frame Frame) error {
 			chunk.DataLen = allowed
 		}
 
-		padding = allowed - chunk.DataLen
-		if padding > padLen {
-			padding = padLen
+		// The padding of a chunk is sent along with its Pad Length field,
+		// so it needs at least two bytes of the window left by the data.
+		padding = 0
+		if rest := allowed - chunk.DataLen; rest > 1 {
+			padding = rest - 1
+			if padding > padLen {
+				padding = padLen
+			}
 		}
+		releaseBytes(s, allowed-dataFlowLen(chunk.DataLen, padding))
 
 		dataLen -= chunk.DataLen
 		padLen -= padding
+		if dataLen == 0 && chunk.DataLen+padding == 0 {
+			// The window is too small for the rest of the padding,
+			// which is optional.
+			padLen = 0
+		}
 		lastFrame = dataLen+padLen == 0
 
 		chunk.PadLen = uint8(padding)
 		chunk.EndStream = data.EndStream && lastFrame
 
 		s.conn.writeQueue.add(s, false)
-		err = <-s.werr
+		err = s.wait()
 
 		if lastFrame || err != nil {
 			return err
 		}
 
-		allowed, err = allocateBytes(s, dataLen+padLen)
+		allowed, err = allocateBytes(s, chunkLen(dataFlowLen(dataLen, padLen)))
 		if err != nil {
 			return err
 		}
@@ -152,17 +231,51 @@ func (s *stream) write(frame Frame) error {
 	}
 }
 
+// wait returns the error writing the frame of the stream, or the one
+// closing the stream before it was written.
+func (s *stream) wait() error {
+	select {
+	case err := <-s.werr:
+		return err
+	case <-s.closeCh:
+		return s.closedErr()
+	}
+}
+
 func (s *stream) writeTo(w *frameWriter) error {
 	err := s.Frame.(frameWriterTo).writeTo(w)
 	s.lastWritten = s.Frame.Type()
+	atomic.StoreUint32(&s.written, 1)
+	if s.lastWritten == FrameData {
+		s.sawData()
+	}
 	s.sawEOS = s.Frame.EndOfStream()
-	s.werr <- err
+	// The writer already returned if the stream was closed meanwhile.
+	select {
+	case s.werr <- err:
+	case <-s.closeCh:
+	}
 	if s.sawEOS && err == nil {
 		_, err = s.transition(false, s.lastWritten, true)
 	}
 	return err
 }
 
+// sawData records the time of the first DATA frame of the stream.
+func (s *stream) sawData() {
+	if atomic.LoadInt64(&s.firstData) == 0 {
+		atomic.CompareAndSwapInt64(&s.firstData, 0, time.Now().UnixNano())
+	}
+}
+
+func (s *stream) timing() StreamTiming {
+	return StreamTiming{
+		Opened:    unixTime(atomic.LoadInt64(&s.opened)),
+		FirstData: unixTime(atomic.LoadInt64(&s.firstData)),
+		Closed:    unixTime(atomic.LoadInt64(&s.closed)),
+	}
+}
+
 func (s *stream) cancel(err error) error {
 	select {
 	case s.werr <- err:
@@ -184,10 +297,122 @@ func (s *stream) local() bool {
 	return s.conn.server == ((s.id & 1) == 0)
 }
 
+// setPriority moves the stream within the dependency tree,
+// defined in RFC 7540 section 5.3.3.
 func (s *stream) setPriority(priority Priority) error {
+	// A stream cannot depend on itself.  An endpoint MUST treat this as a
+	// stream error (Section 5.4.2) of type PROTOCOL_ERROR.
+	if priority.StreamDependency == s.id {
+		return StreamError{fmt.Errorf("stream %d depends on itself", s.id), ErrCodeProtocol, s.id, ReasonProtocol}
+	}
+
+	c := s.conn
+
+	c.priorityL.Lock()
+	defer c.priorityL.Unlock()
+
+	parent := c.connStream
+	if priority.StreamDependency != 0 {
+		// A dependency on a stream that is not currently in the tree
+		// results in that stream being given a default priority.
+		if parent = c.priorityTree[priority.StreamDependency]; parent == nil {
+			parent = c.connStream
+			priority = Priority{Weight: defaultWeight}
+		}
+	}
+
+	// If a stream is made dependent on one of its own dependencies, the
+	// formerly dependent stream is first moved to be dependent on the
+	// reprioritized stream's previous parent.  The moved dependency retains
+	// its weight.
+	for p := parent.parent; p != nil; p = p.parent {
+		if p == s {
+			grandparent := s.parent
+			if grandparent == nil {
+				grandparent = c.connStream
+			}
+			parent.detach()
+			parent.attach(grandparent)
+			break
+		}
+	}
+
+	s.detach()
+
+	// An exclusive flag allows for the insertion of a new level of
+	// dependencies.  The exclusive flag causes the stream to become the sole
+	// dependency of its parent stream, causing other dependencies to become
+	// dependent on the exclusive stream.
+	if priority.Exclusive {
+		for _, child := range parent.children {
+			child.detach()
+			child.attach(s)
+		}
+	}
+
+	s.weight = priority.Weight
+	s.attach(parent)
+
 	return nil
 }
 
+// removePriority removes the stream from the dependency tree.
+// The dependencies of the removed stream become dependent on its parent,
+// defined in RFC 7540 section 5.3.4.
+func (s *stream) removePriority() {
+	c := s.conn
+
+	c.priorityL.Lock()
+	defer c.priorityL.Unlock()
+
+	if s.parent == nil {
+		return
+	}
+
+	// The weight of the dependency is redistributed to its dependencies
+	// proportionally based on their weights.
+	sum := 0
+	for _, child := range s.children {
+		sum += int(child.weight) + 1
+	}
+
+	parent := s.parent
+	for _, child := range s.children {
+		weight := (int(s.weight) + 1) * (int(child.weight) + 1) / sum
+		if weight < 1 {
+			weight = 1
+		}
+		child.detach()
+		child.weight = uint8(weight - 1)
+		child.attach(parent)
+	}
+
+	s.detach()
+	delete(c.priorityTree, s.id)
+}
+
+func (s *stream) inTree() bool {
+	return s.id == 0 || s.parent != nil
+}
+
+func (s *stream) attach(parent *stream) {
+	if parent.children == nil {
+		parent.children = make(map[uint32]*stream)
+	}
+	parent.children[s.id] = s
+	s.parent = parent
+	s.conn.priorityTree[s.id] = s
+	s.conn.priorityGen++
+}
+
+func (s *stream) detach() {
+	if s.parent != nil {
+		delete(s.parent.children, s.id)
+		s.parent = nil
+		s.conn.priorityGen++
+	}
+}
+
 func (s *stream) compareAndSwapState(from, to StreamState) bool {
 	if atomic.CompareAndSwapInt32((*int32)(&s.state), int32(from), int32(to)) {
 		switch to {
@@ -198,20 +423,26 @@ func (s *stream) compareAndSwapState(from, to StreamState) bool {
 		case StateOpen, StateHalfClosedLocal, StateHalfClosedRemote:
 			switch from {
 			case StateIdle, StateReservedLocal, StateReservedRemote:
+				atomic.StoreInt64(&s.opened, time.Now().UnixNano())
 				if s.local() {
 					atomic.AddUint32(&s.conn.numStreams, 1)
 				} else {
 					atomic.AddUint32(&s.conn.remote.numStreams, 1)
 				}
 
-				w := int(s.conn.Settings().InitialWindowSize())
+				s.flowL.Lock()
+				w := int(s.conn.localSettings().InitialWindowSize())
 				s.recvFlow = &flowController{s: s, win: w, winUpperBound: w, processedWin: w}
+				if max := s.recvFlow.maxStreamWindow(); w > max {
+					s.recvFlow.winUpperBound = max
+				}
 
 				if to != StateHalfClosedLocal {
-					w = int(s.conn.RemoteSettings().InitialWindowSize())
+					w = int(s.conn.remoteSettings().InitialWindowSize())
 					s.sendFlow = &remoteFlowController{s: s, winCh: make(chan int, 1)}
 					s.sendFlow.incrementInitialWindow(w)
 				}
+				s.flowL.Unlock()
 
 				if from == StateIdle {
 					s.conn.addStream(s)
@@ -234,20 +465,33 @@ func (s *stream) compareAndSwapState(from, to StreamState) bool {
 			}
 
 			if from != StateClosed {
+				atomic.StoreInt64(&s.closed, time.Now().UnixNano())
 				close(s.closeCh)
+				s.cancelCtx()
 
-				s.cancel(errStreamClosed)
+				s.cancel(s.closedErr())
+				s.flowL.Lock()
 				if s.sendFlow != nil {
 					s.sendFlow.cancel()
 					s.sendFlow.incrementWindow(-s.sendFlow.window())
 				}
+				// The bytes received and not returned yet, including the
+				// ones buffered and unread, go back to the connection.
 				if s.recvFlow != nil {
-					s.recvFlow.returnBytes(s.recvFlow.consumedBytes())
+					s.recvFlow.returnConsumedBytes(s.recvFlow.consumedBytes())
 				}
+				s.flowL.Unlock()
 
+				s.removePriority()
+				s.conn.addClosedTiming(s.id, s.timing())
 				s.conn.removeStream(s)
+				s.conn.discardWindowUpdate(s.id)
+				s.conn.stats.streamClosed(s.id, from)
 			}
 		}
+		if f := s.conn.config.OnStateChange; f != nil && from != to {
+			f(s.id, from, to)
+		}
 		return true
 	}
 	return false
@@ -276,7 +520,7 @@ func (s *stream) transition(recv bool, frameType FrameType, endStream bool) (Str
 			// after receiving a RST_STREAM MUST treat that as a stream error
 			// (Section 5.4.2) of type STREAM_CLOSED.
 			if s.resetReceived {
-				return from, StreamError{fmt.Errorf("stream %d already closed", s.id), ErrCodeStreamClosed, s.id}
+				return from, StreamError{fmt.Errorf("stream %d already closed", s.id), ErrCodeStreamClosed, s.id, ReasonStreamClosed}
 			}
 
 			if s.resetSent {
@@ -289,15 +533,16 @@ func (s *stream) transition(recv bool, frameType FrameType, endStream bool) (Str
 				// 	return from, ignoreFrame
 				// }
 
-				return from, StreamError{fmt.Errorf("stream %d already closed", s.id), ErrCodeStreamClosed, s.id}
+				return from, StreamError{fmt.Errorf("stream %d already closed", s.id), ErrCodeStreamClosed, s.id, ReasonStreamClosed}
 			}
 
 			switch from {
 			case StateHalfClosedRemote:
-				// An endpoint that receives any frames after receiving a frame with the
-				// END_STREAM flag set MUST treat that as a connection error
-				// (Section 5.4.1) of type STREAM_CLOSED.
-				return from, ConnError{fmt.Errorf("stream %d already closed", s.id), ErrCodeStreamClosed}
+				// If an endpoint receives additional frames, other than
+				// WINDOW_UPDATE, PRIORITY, or RST_STREAM, for a stream that is in
+				// this state, it MUST respond with a stream error (Section 5.4.2) of
+				// type STREAM_CLOSED.
+				return from, StreamError{fmt.Errorf("stream %d half-closed by peer", s.id), ErrCodeStreamClosed, s.id, ReasonStreamClosed}
 			case StateClosed:
 				// WINDOW_UPDATE or RST_STREAM frames can be received in this state
 				// for a short period after a DATA or HEADERS frame containing an
@@ -310,17 +555,20 @@ func (s *stream) transition(recv bool, frameType FrameType, endStream bool) (Str
 				// (Section 5.4.1) of type PROTOCOL_ERROR.
 				switch frameType {
 				case FrameRSTStream, FrameWindowUpdate:
-
-					// if time.Since(s.closed) <= time.Duration(5)*time.Second {
-					// 	return from, ignoreFrame
-					// }
-
-					return from, ConnError{fmt.Errorf("stream %d already closed", s.id), ErrCodeProtocol}
+					return from, nil
 				}
+
+				// An endpoint that receives any frames after receiving a frame with the
+				// END_STREAM flag set MUST treat that as a connection error
+				// (Section 5.4.1) of type STREAM_CLOSED.
+				return from, ConnError{fmt.Errorf("stream %d already closed", s.id), ErrCodeStreamClosed}
 			}
 			return from, ConnError{fmt.Errorf("bad stream state %s", s.state), ErrCodeProtocol}
 		}
 
+		if to == StateClosed && frameType == FrameRSTStream && !recv && !s.local() {
+			s.conn.addResetStream(s.id)
+		}
 		if s.compareAndSwapState(from, to) {
 			if to == StateClosed && frameType == FrameRSTStream {
 				if recv {
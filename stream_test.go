@@ -1,8 +1,335 @@
 package http2
 
 import (
+	"net"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestStreamLifecycle(t *testing.T) {
 }
+
+func TestStreamPriority(t *testing.T) {
+	rwc, _ := net.Pipe()
+	conn := ServerConn(rwc, nil)
+	defer conn.close()
+
+	for _, streamID := range []uint32{1, 3, 5, 7} {
+		stream, err := conn.remote.idleStream(streamID)
+		if err != nil {
+			t.Fatalf("error creating stream %d: %s", streamID, err)
+		}
+		if _, err = stream.transition(true, FrameHeaders, false); err != nil {
+			t.Fatalf("error opening stream %d: %s", streamID, err)
+		}
+	}
+
+	expect := func(streamID, parent uint32, weight uint8) {
+		priority, ok := conn.StreamPriority(streamID)
+		if !ok {
+			t.Fatalf("stream %d is not in the dependency tree", streamID)
+		}
+		if priority.StreamDependency != parent || priority.Weight != weight {
+			t.Fatalf("stream %d expected parent %d weight %d, got parent %d weight %d",
+				streamID, parent, weight, priority.StreamDependency, priority.Weight)
+		}
+	}
+	setPriority := func(streamID uint32, priority Priority) {
+		if err := conn.stream(streamID).setPriority(priority); err != nil {
+			t.Fatalf("error setting priority of stream %d: %s", streamID, err)
+		}
+	}
+
+	// All streams are initially dependent on stream 0x0.
+	for _, streamID := range []uint32{1, 3, 5, 7} {
+		expect(streamID, 0, defaultWeight)
+	}
+
+	setPriority(3, Priority{StreamDependency: 1, Weight: 31})
+	setPriority(5, Priority{StreamDependency: 1, Weight: 63})
+	expect(3, 1, 31)
+	expect(5, 1, 63)
+
+	// 7 becomes the sole dependency of 1, and 3 and 5 depend on 7.
+	setPriority(7, Priority{StreamDependency: 1, Weight: 7, Exclusive: true})
+	expect(7, 1, 7)
+	expect(3, 7, 31)
+	expect(5, 7, 63)
+	if n := len(conn.stream(1).children); n != 1 {
+		t.Fatalf("stream 1 expected 1 dependency, got %d", n)
+	}
+
+	// 1 depends on its own descendant 5, so 5 is first moved to 1's parent.
+	setPriority(1, Priority{StreamDependency: 5, Weight: defaultWeight})
+	expect(5, 0, 63)
+	expect(1, 5, defaultWeight)
+	expect(7, 1, 7)
+	expect(3, 7, 31)
+
+	// A dependency on a stream that is not in the tree results in the
+	// default priority.
+	setPriority(3, Priority{StreamDependency: 99, Weight: 255, Exclusive: true})
+	expect(3, 0, defaultWeight)
+
+	// A stream cannot depend on itself.
+	err := conn.stream(1).setPriority(Priority{StreamDependency: 1, Weight: 255})
+	if se, ok := err.(StreamError); !ok || se.ErrCode != ErrCodeProtocol || se.StreamID != 1 {
+		t.Fatalf("expected stream error PROTOCOL_ERROR, got %v", err)
+	}
+	expect(1, 5, defaultWeight)
+
+	// The dependencies of a closed stream move to its parent.
+	setPriority(3, Priority{StreamDependency: 7, Weight: 3})
+	conn.stream(7).close()
+	if _, ok := conn.StreamPriority(7); ok {
+		t.Fatal("closed stream 7 is still in the dependency tree")
+	}
+	expect(3, 1, 7)
+}
+
+func TestPriorityWriteScheduler(t *testing.T) {
+	rwc, _ := net.Pipe()
+	conn := ServerConn(rwc, nil)
+	defer conn.close()
+
+	for _, streamID := range []uint32{1, 3, 5} {
+		stream, err := conn.remote.idleStream(streamID)
+		if err != nil {
+			t.Fatalf("error creating stream %d: %s", streamID, err)
+		}
+		if _, err = stream.transition(true, FrameHeaders, false); err != nil {
+			t.Fatalf("error opening stream %d: %s", streamID, err)
+		}
+	}
+	conn.stream(1).setPriority(Priority{Weight: 255})
+	conn.stream(3).setPriority(Priority{Weight: 63})
+	conn.stream(5).setPriority(Priority{StreamDependency: 1, Weight: defaultWeight})
+
+	ws := NewPriorityWriteScheduler(conn)
+	pop := func() uint32 {
+		streamID, ok := ws.Pop()
+		if !ok {
+			t.Fatal("no stream is ready")
+		}
+		ws.Written(streamID, 1024)
+		return streamID
+	}
+
+	// Ties are broken in favor of the lower stream identifier.
+	ws.Push(3)
+	ws.Push(1)
+	if streamID := pop(); streamID != 1 {
+		t.Fatalf("expected stream 1, got %d", streamID)
+	}
+
+	// Siblings are scheduled in proportion to their weights,
+	// 256:64 for streams 1 and 3.
+	ws.Push(1)
+	n := map[uint32]int{}
+	for i := 0; i < 100; i++ {
+		streamID := pop()
+		n[streamID]++
+		ws.Push(streamID)
+	}
+	if n[1] != 80 || n[3] != 20 {
+		t.Fatalf("expected 80:20 writes, got %d:%d", n[1], n[3])
+	}
+
+	// A stream is not scheduled while its parent is ready.
+	ws.Push(5)
+	for i := 0; i < 10; i++ {
+		streamID := pop()
+		if streamID == 5 {
+			t.Fatal("stream 5 scheduled before its parent")
+		}
+		ws.Push(streamID)
+	}
+	var order []uint32
+	for streamID, ok := ws.Pop(); ok; streamID, ok = ws.Pop() {
+		order = append(order, streamID)
+	}
+	if len(order) != 3 {
+		t.Fatalf("expected 3 streams, got %v", order)
+	}
+	for _, streamID := range order {
+		if streamID == 5 {
+			t.Fatalf("expected stream 5 after stream 1, got %v", order)
+		}
+		if streamID == 1 {
+			break
+		}
+	}
+
+	// Streams closed while ready are scheduled first.
+	ws.Push(1)
+	ws.Push(3)
+	conn.stream(3).removePriority()
+	ws.Remove(3)
+	if streamID := pop(); streamID != 3 {
+		t.Fatalf("expected stream 3, got %d", streamID)
+	}
+	if streamID := pop(); streamID != 1 {
+		t.Fatalf("expected stream 1, got %d", streamID)
+	}
+}
+
+func TestExtensiblePriorityWriteScheduler(t *testing.T) {
+	rwc, _ := net.Pipe()
+	conn := ServerConn(rwc, nil)
+	defer conn.close()
+
+	params := map[uint32]PriorityParam{
+		1: {Urgency: 3},
+		3: {Urgency: 1, Incremental: true},
+		5: {Urgency: 1, Incremental: true},
+		7: {Urgency: 1},
+		9: {Urgency: 1},
+	}
+	for _, streamID := range []uint32{1, 3, 5, 7, 9} {
+		stream, err := conn.remote.idleStream(streamID)
+		if err != nil {
+			t.Fatalf("error creating stream %d: %s", streamID, err)
+		}
+		if _, err = stream.transition(true, FrameHeaders, false); err != nil {
+			t.Fatalf("error opening stream %d: %s", streamID, err)
+		}
+		conn.setPriorityParam(streamID, params[streamID])
+	}
+
+	ws := NewExtensiblePriorityWriteScheduler(conn)
+	for _, streamID := range []uint32{1, 3, 5, 7, 9} {
+		ws.Push(streamID)
+	}
+
+	// A non-incremental stream is written until it is no longer ready,
+	// before the next one of the same urgency. Incremental streams of the
+	// same urgency are then written in turn, and lower urgencies last.
+	var order []uint32
+	for _, again := range []bool{true, false, false, true, true, false, false, false} {
+		streamID, ok := ws.Pop()
+		if !ok {
+			t.Fatal("no stream is ready")
+		}
+		order = append(order, streamID)
+		if again {
+			ws.Push(streamID)
+		}
+	}
+	if expected := []uint32{7, 7, 9, 3, 5, 3, 5, 1}; !reflect.DeepEqual(order, expected) {
+		t.Fatalf("expected order %v, got %v", expected, order)
+	}
+	if streamID, ok := ws.Pop(); ok {
+		t.Fatalf("expected no stream, got %d", streamID)
+	}
+
+	// Streams closed while ready are scheduled first.
+	ws.Push(3)
+	ws.Push(5)
+	conn.stream(5).removePriority()
+	ws.Remove(5)
+	for _, expected := range []uint32{5, 3} {
+		if streamID, _ := ws.Pop(); streamID != expected {
+			t.Fatalf("expected stream %d, got %d", expected, streamID)
+		}
+	}
+}
+
+func TestWriteQueueLimit(t *testing.T) {
+	w := newWriteQueue(NewRoundRobinWriteScheduler(nil), 1, 0)
+
+	frame := func(i int) Frame { return &UnknownFrame{FrameType: FrameType(0xf0 + i)} }
+
+	// The first frame is moved out of the queue to be written.
+	w.add(frame(0), false)
+	w.add(frame(1), false)
+
+	added := make(chan struct{})
+	go func() {
+		w.add(frame(2), false)
+		close(added)
+	}()
+
+	// Control frames are queued while the queue is full.
+	ping := &PingFrame{}
+	w.add(ping, true)
+
+	select {
+	case <-added:
+		t.Fatal("expected frame to wait for the queue to have room")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	var order []Frame
+	for i := 0; i < 4; i++ {
+		order = append(order, <-w.get())
+		w.set()
+	}
+	<-added
+	if expected := []Frame{frame(0), ping, frame(1), frame(2)}; !reflect.DeepEqual(order, expected) {
+		t.Fatalf("expected order %v, got %v", expected, order)
+	}
+
+	// Adders no longer wait once the queue is closed.
+	w.add(frame(3), false)
+	w.add(frame(4), false)
+	w.close()
+	w.add(frame(5), false)
+}
+
+func TestWriteQueueOrder(t *testing.T) {
+	w := newWriteQueue(NewRoundRobinWriteScheduler(nil), 0, 0)
+
+	// The first frame is moved out of the queue to be written.
+	first := &UnknownFrame{FrameType: 0xf0}
+	w.add(first, false)
+
+	data := &stream{id: 1, Frame: &DataFrame{StreamID: 1}}
+	headers := &stream{id: 3, Frame: &HeadersFrame{StreamID: 3}}
+	pushPromise := &PushPromiseFrame{StreamID: 1, PromisedStreamID: 2}
+	promised := &stream{id: 2, Frame: &HeadersFrame{StreamID: 2}}
+	rst := &RSTStreamFrame{StreamID: 5}
+	ping := &PingFrame{}
+
+	w.add(data, false)
+	w.add(headers, false)
+	w.add(pushPromise, false)
+	w.add(promised, false)
+	w.add(rst, true)
+	w.add(ping, true)
+
+	var order []Frame
+	for i := 0; i < 7; i++ {
+		order = append(order, <-w.get())
+		w.set()
+	}
+	expected := []Frame{first, rst, ping, pushPromise, headers, promised, data}
+	if !reflect.DeepEqual(order, expected) {
+		t.Fatalf("expected order %v, got %v", expected, order)
+	}
+}
+
+func TestWriteQueueBarrier(t *testing.T) {
+	w := newWriteQueue(NewRoundRobinWriteScheduler(nil), 0, 0)
+
+	// The first frame is moved out of the queue to be written.
+	first := &UnknownFrame{FrameType: 0xf0}
+	w.add(first, false)
+
+	data := &stream{id: 1, Frame: &DataFrame{StreamID: 1}}
+	w.add(data, false)
+	f := &flushFrame{done: make(chan struct{})}
+	w.barrier(f)
+	ping := &PingFrame{}
+	w.add(ping, true)
+
+	// The barrier waits for the frames of streams queued before it.
+	var order []Frame
+	for i := 0; i < 4; i++ {
+		order = append(order, <-w.get())
+		w.set()
+	}
+	if expected := []Frame{first, ping, data, f}; !reflect.DeepEqual(order, expected) {
+		t.Fatalf("expected order %v, got %v", expected, order)
+	}
+}
@@ -0,0 +1,145 @@
+package http2
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// FrameFlags returns the flags of the frame, as set in its frame header.
+// The header blocks of HEADERS and PUSH_PROMISE frames always carry
+// END_HEADERS, even when they are sent with CONTINUATION frames.
+func FrameFlags(frame Frame) Flags {
+	var flags Flags
+	switch v := frame.(type) {
+	case *DataFrame:
+		if v.EndStream {
+			flags |= FlagEndStream
+		}
+		if v.PadLen > 0 {
+			flags |= FlagPadded
+		}
+	case *HeadersFrame:
+		flags |= FlagEndHeaders
+		if v.EndStream {
+			flags |= FlagEndStream
+		}
+		if v.PadLen > 0 {
+			flags |= FlagPadded
+		}
+		if v.HasPriority() {
+			flags |= FlagPriority
+		}
+	case *PushPromiseFrame:
+		flags |= FlagEndHeaders
+		if v.PadLen > 0 {
+			flags |= FlagPadded
+		}
+	case *SettingsFrame:
+		if v.Ack {
+			flags |= FlagAck
+		}
+	case *PingFrame:
+		if v.Ack {
+			flags |= FlagAck
+		}
+	case *UnknownFrame:
+		flags = v.Flags
+	}
+	return flags
+}
+
+// FormatFrame formats a frame sent or received, as reported with the
+// direction "send" or "recv" to the FrameLogger of a Config, like the
+// verbose output of the nghttp client: a line with the type, the flags
+// and the stream of the frame, followed by indented lines naming its
+// flags and listing its fields. The payload of DATA frames is not read.
+func FormatFrame(dir string, frame Frame) string {
+	const indent = "\n          "
+
+	buf := new(bytes.Buffer)
+	flags := FrameFlags(frame)
+	fmt.Fprintf(buf, "%s %s frame <flags=0x%02x, stream_id=%d>", dir, frame.Type(), uint8(flags), frame.Stream())
+
+	var names []string
+	switch frame.Type() {
+	case FrameData, FrameHeaders:
+		if flags.Has(FlagEndStream) {
+			names = append(names, "END_STREAM")
+		}
+	case FrameSettings, FramePing:
+		if flags.Has(FlagAck) {
+			names = append(names, "ACK")
+		}
+	}
+	if flags.Has(FlagEndHeaders) {
+		names = append(names, "END_HEADERS")
+	}
+	if flags.Has(FlagPadded) {
+		names = append(names, "PADDED")
+	}
+	if flags.Has(FlagPriority) {
+		names = append(names, "PRIORITY")
+	}
+	if len(names) > 0 {
+		buf.WriteString(indent + "; " + strings.Join(names, " | "))
+	}
+
+	var header Header
+	switch v := frame.(type) {
+	case *DataFrame:
+		fmt.Fprintf(buf, indent+"(data_len=%d, padlen=%d)", v.DataLen, v.PadLen)
+	case *HeadersFrame:
+		if v.HasPriority() {
+			fmt.Fprintf(buf, indent+"(padlen=%d, dep_stream_id=%d, weight=%d, exclusive=%d)",
+				v.PadLen, v.StreamDependency, int(v.Weight)+1, boolToInt(v.Exclusive))
+		} else {
+			fmt.Fprintf(buf, indent+"(padlen=%d)", v.PadLen)
+		}
+		if v.Trailer {
+			buf.WriteString(indent + "; Trailer")
+		}
+		header = v.Header
+	case *PriorityFrame:
+		fmt.Fprintf(buf, indent+"(dep_stream_id=%d, weight=%d, exclusive=%d)",
+			v.StreamDependency, int(v.Weight)+1, boolToInt(v.Exclusive))
+	case *RSTStreamFrame:
+		fmt.Fprintf(buf, indent+"(error_code=%s(0x%02x))", v.ErrCode, uint32(v.ErrCode))
+	case *SettingsFrame:
+		fmt.Fprintf(buf, indent+"(niv=%d)", len(v.Settings))
+		for _, s := range v.Settings {
+			fmt.Fprintf(buf, indent+"[SETTINGS_%s(0x%02x):%d]", s.ID, uint16(s.ID), s.Value)
+		}
+	case *PushPromiseFrame:
+		fmt.Fprintf(buf, indent+"(padlen=%d, promised_stream_id=%d)", v.PadLen, v.PromisedStreamID)
+		header = v.Header
+	case *PingFrame:
+		fmt.Fprintf(buf, indent+"(opaque_data=%x)", v.Data)
+	case *GoAwayFrame:
+		fmt.Fprintf(buf, indent+"(last_stream_id=%d, error_code=%s(0x%02x), opaque_data(%d)=[%s])",
+			v.LastStreamID, v.ErrCode, uint32(v.ErrCode), len(v.DebugData), v.DebugData)
+	case *WindowUpdateFrame:
+		fmt.Fprintf(buf, indent+"(window_size_increment=%d)", v.WindowSizeIncrement)
+	case *AltSvcFrame:
+		fmt.Fprintf(buf, indent+"(origin=%q, field_value=%q)", v.Origin, v.FieldValue)
+	case *OriginFrame:
+		for _, origin := range v.Origins {
+			buf.WriteString(indent + origin)
+		}
+	case *PriorityUpdateFrame:
+		fmt.Fprintf(buf, indent+"(prioritized_stream_id=%d, priority_field_value=%q)", v.PrioritizedStreamID, v.PriorityFieldValue)
+	case *UnknownFrame:
+		fmt.Fprintf(buf, indent+"(payload_len=%d)", v.PayloadLen)
+	}
+	for _, f := range header.Fields() {
+		buf.WriteString(indent + f.Name + ": " + f.Value)
+	}
+	return buf.String()
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
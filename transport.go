@@ -0,0 +1,1038 @@
+package http2
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Transport is an http.RoundTripper sending requests over HTTP/2
+// connections. Connections are dialed with "h2" for "https" URLs and,
+// if AllowH2C is set, "h2c" for "http" URLs. They are reused by the
+// requests of the same scheme and authority, and the "h2" ones by the
+// requests of the other authorities they are authoritative for, unless
+// DisableCoalescing is set.
+type Transport struct {
+	// Dialer specifies the options for connecting to HTTP/2 servers.
+	// If nil, the default options are used.
+	Dialer *Dialer
+
+	// AllowH2C enables "http" URLs, sent over cleartext TCP with the
+	// HTTP/1.1 Upgrade, or with prior knowledge if the PriorKnowledge
+	// field of the Dialer Config is set. If false, they are rejected.
+	AllowH2C bool
+
+	// ExpectContinueTimeout, if non-zero, specifies the amount of time
+	// to wait for the 100 Continue response of a request with the
+	// "Expect: 100-continue" header field before sending its body.
+	// Zero means the body is sent at once, without waiting.
+	ExpectContinueTimeout time.Duration
+
+	// PushHandler, if non-nil, is called when a PUSH_PROMISE frame is
+	// received, with the ID of the reserved stream and the header block
+	// of the promised request. It returns a function called with the
+	// pushed response once it is received, or nil to reject the push,
+	// the reserved stream being reset with CANCEL.
+	// If PushHandler is nil, all the pushes are rejected.
+	PushHandler func(streamID uint32, header Header) func(*http.Response)
+
+	// PushCache, if non-nil, stores the pushed responses the PushHandler
+	// does not accept, if their promised requests are GET or HEAD ones and
+	// the responses are cacheable, and serves the following requests for
+	// the same resources, which are then not sent.
+	PushCache PushCache
+
+	// DisableCoalescing disables the reuse of a connection for the
+	// requests of an authority other than the one it was dialed for,
+	// defined in RFC 7540 section 9.1.1. A connection is otherwise reused
+	// for an "https" origin when the certificate presented by the server
+	// is valid for its host, and either the origin is in the origin set
+	// received with ORIGIN frames, defined in RFC 8336, or no ORIGIN
+	// frame was received and the host resolves to the IP address the
+	// connection is established to. Disabling it keeps the servers from
+	// learning that the requests of different origins come from the same
+	// client.
+	DisableCoalescing bool
+
+	// StreamLimitPolicy specifies what is done with a request once the
+	// connection it is sent over reaches the maximum number of concurrent
+	// streams allowed by the server.
+	StreamLimitPolicy StreamLimitPolicy
+
+	connL sync.Mutex
+	conns map[string]*transportConn
+}
+
+// A StreamLimitPolicy specifies what a Transport does with a request when
+// the streams it initiated on a connection reach the value of the
+// SETTINGS_MAX_CONCURRENT_STREAMS sent by the server, as updated by the
+// SETTINGS frames received.
+type StreamLimitPolicy int
+
+const (
+	// StreamLimitWait waits for a stream of the connection to close, or
+	// for the server to allow more streams, until the request context is
+	// done.
+	StreamLimitWait StreamLimitPolicy = iota
+
+	// StreamLimitDial dials a new connection, which replaces the one
+	// reaching the limit for the following requests. The replaced
+	// connection is closed once it carries no request.
+	StreamLimitDial
+
+	// StreamLimitError fails the request with ErrStreamLimit.
+	StreamLimitError
+)
+
+// ErrStreamLimit is returned by the Transport when a connection reaches
+// the maximum number of concurrent streams, with StreamLimitError.
+var ErrStreamLimit = errors.New("http2: maximum concurrent streams reached")
+
+// HTTP11RequiredError is returned by the Transport when the server resets
+// the stream of a request with HTTP_1_1_REQUIRED, which is to be retried
+// over HTTP/1.1 rather than handled as a failure.
+type HTTP11RequiredError struct {
+	StreamID uint32
+}
+
+func (e HTTP11RequiredError) Error() string {
+	return fmt.Sprintf("http2: stream %d requires HTTP/1.1", e.StreamID)
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL == nil {
+		closeRequestBody(req)
+		return nil, errors.New("http2: nil Request.URL")
+	}
+
+	var protocol string
+	switch req.URL.Scheme {
+	case "https":
+		protocol = ProtocolTLS
+	case "http":
+		if !t.AllowH2C {
+			closeRequestBody(req)
+			return nil, errors.New("http2: cleartext HTTP/2 is not allowed")
+		}
+		protocol = ProtocolTCP
+	default:
+		closeRequestBody(req)
+		return nil, fmt.Errorf("http2: unsupported protocol scheme %q", req.URL.Scheme)
+	}
+
+	address := joinHostPort(req.URL.Host, req.URL.Scheme)
+	if res := t.cachedPush(req, address); res != nil {
+		return res, nil
+	}
+
+	for {
+		tc, err := t.conn(protocol, req.URL.Scheme+"://"+address, address)
+		if err != nil {
+			closeRequestBody(req)
+			return nil, err
+		}
+		if err = tc.reserve(req.Context()); err != nil {
+			if err == ErrStreamLimit && t.StreamLimitPolicy == StreamLimitDial {
+				continue
+			}
+			closeRequestBody(req)
+			return nil, err
+		}
+		res, err := tc.roundTrip(req)
+		if err == ErrStreamIDsExhausted {
+			continue
+		}
+		return res, err
+	}
+}
+
+// CloseIdleConnections closes the connections that carry no request.
+func (t *Transport) CloseIdleConnections() {
+	t.connL.Lock()
+	var idle []*transportConn
+	for key, tc := range t.conns {
+		if tc.idle() {
+			// A coalesced connection is closed once.
+			if tc.key == key {
+				idle = append(idle, tc)
+			}
+			delete(t.conns, key)
+		}
+	}
+	t.connL.Unlock()
+
+	for _, tc := range idle {
+		tc.conn.Close()
+	}
+}
+
+// conn returns the connection for the given key, dialing a new one if no
+// usable connection exists. Requests with the same key wait for a single
+// dial in progress.
+func (t *Transport) conn(protocol, key, address string) (*transportConn, error) {
+	if protocol == ProtocolTLS && !t.DisableCoalescing {
+		if tc := t.coalescedConn(key, address); tc != nil {
+			return tc, nil
+		}
+	}
+
+	t.connL.Lock()
+	tc := t.conns[key]
+	if tc == nil || !tc.usable() || (t.StreamLimitPolicy == StreamLimitDial && tc.full()) {
+		if tc != nil && tc.key == key {
+			tc.retire()
+		}
+		tc = &transportConn{
+			t:       t,
+			key:     key,
+			ready:   make(chan struct{}),
+			streams: make(map[uint32]*transportStream),
+		}
+		if t.conns == nil {
+			t.conns = make(map[string]*transportConn)
+		}
+		t.conns[key] = tc
+		t.connL.Unlock()
+
+		tc.conn, tc.err = t.Dialer.Dial(protocol, address, nil)
+		close(tc.ready)
+		if tc.err != nil {
+			t.removeConn(tc)
+		} else {
+			go tc.readLoop()
+		}
+	} else {
+		t.connL.Unlock()
+	}
+
+	<-tc.ready
+	if tc.err != nil {
+		return nil, tc.err
+	}
+	return tc, nil
+}
+
+func (t *Transport) removeConn(tc *transportConn) {
+	t.connL.Lock()
+	for key, v := range t.conns {
+		if v == tc {
+			delete(t.conns, key)
+		}
+	}
+	t.connL.Unlock()
+}
+
+// coalescedConn returns an established "h2" connection dialed for another
+// authority which can be reused for the origin of the given key, or nil.
+// The connection is then used for the following requests with that key.
+func (t *Transport) coalescedConn(key, address string) *transportConn {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil
+	}
+
+	t.connL.Lock()
+	if tc := t.conns[key]; tc != nil && tc.usable() {
+		t.connL.Unlock()
+		return nil
+	}
+	var conns []*transportConn
+	for k, tc := range t.conns {
+		if t.StreamLimitPolicy == StreamLimitDial && tc.full() {
+			continue
+		}
+		if k == tc.key && strings.HasPrefix(k, "https://") && tc.established() && tc.usable() && tc.covers(host) {
+			conns = append(conns, tc)
+		}
+	}
+	t.connL.Unlock()
+
+	var addrs []string
+	origin := originOf(key)
+	for _, tc := range conns {
+		if origins, received := tc.originSet(); received {
+			if !origins[origin] {
+				continue
+			}
+		} else {
+			// The host must resolve to the address of the connection.
+			if addrs == nil {
+				if addrs, err = net.DefaultResolver.LookupHost(context.Background(), host); err != nil {
+					return nil
+				}
+			}
+			ip, _, err := net.SplitHostPort(tc.conn.rwc.(*tls.Conn).RemoteAddr().String())
+			if err != nil || !containsAddr(addrs, ip) {
+				continue
+			}
+		}
+
+		t.connL.Lock()
+		if v := t.conns[key]; v == nil || !v.usable() {
+			t.conns[key] = tc
+		}
+		t.connL.Unlock()
+		return tc
+	}
+	return nil
+}
+
+// handleOrigin adds the origins of an ORIGIN frame to the origin set of the
+// connection. When the first frame is received, the set is defined to
+// contain the origin the connection was dialed for, and the coalesced
+// requests of the other origins no longer use it.
+func (tc *transportConn) handleOrigin(v *OriginFrame) {
+	tc.originL.Lock()
+	if tc.origins == nil {
+		tc.origins = map[string]bool{originOf(tc.key): true}
+	}
+	for _, origin := range v.Origins {
+		if u, err := url.Parse(origin); err == nil && u.Host != "" {
+			tc.origins[originOf(u.Scheme+"://"+joinHostPort(u.Host, u.Scheme))] = true
+		}
+	}
+	origins := tc.origins
+	tc.originL.Unlock()
+
+	tc.t.connL.Lock()
+	for key, v := range tc.t.conns {
+		if v == tc && !origins[originOf(key)] {
+			delete(tc.t.conns, key)
+		}
+	}
+	tc.t.connL.Unlock()
+}
+
+// originSet returns the origin set of the connection,
+// reporting whether an ORIGIN frame was received.
+func (tc *transportConn) originSet() (map[string]bool, bool) {
+	tc.originL.Lock()
+	defer tc.originL.Unlock()
+
+	origins := make(map[string]bool, len(tc.origins))
+	for origin := range tc.origins {
+		origins[origin] = true
+	}
+	return origins, tc.origins != nil
+}
+
+// established reports whether the connection is dialed without error.
+func (tc *transportConn) established() bool {
+	select {
+	case <-tc.ready:
+		return tc.err == nil
+	default:
+		return false
+	}
+}
+
+// covers reports whether the certificate presented by the server of the
+// connection is valid for the host.
+func (tc *transportConn) covers(host string) bool {
+	tlsConn, ok := tc.conn.rwc.(*tls.Conn)
+	if !ok {
+		return false
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	return len(certs) > 0 && certs[0].VerifyHostname(host) == nil
+}
+
+// originOf returns the origin of the key of a connection, with the port
+// numbers of the default ports of its scheme.
+func originOf(key string) string {
+	i := strings.Index(key, "://")
+	if i < 0 {
+		return key
+	}
+	scheme, address := strings.ToLower(key[:i]), key[i+3:]
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return key
+	}
+	switch port {
+	case "https":
+		port = "443"
+	case "http":
+		port = "80"
+	}
+	return scheme + "://" + net.JoinHostPort(strings.ToLower(host), port)
+}
+
+func containsAddr(addrs []string, ip string) bool {
+	for _, addr := range addrs {
+		if addr == ip {
+			return true
+		}
+	}
+	return false
+}
+
+type transportConn struct {
+	t   *Transport
+	key string
+
+	// ready is closed once the connection is dialed,
+	// conn and err being set.
+	ready chan struct{}
+	conn  *Conn
+	err   error
+
+	streamL sync.Mutex
+	streams map[uint32]*transportStream
+
+	// requests is the number of streams initiated by the requests, or
+	// reserved for them, which is limited by the maximum concurrent
+	// streams of the server. slotCh, if not nil, is closed once another
+	// stream may be initiated. retired is set once the connection is
+	// replaced by another one for the next requests.
+	requests uint32
+	slotCh   chan struct{}
+	retired  bool
+
+	// origins is the origin set received with ORIGIN frames,
+	// nil until one is received.
+	originL sync.Mutex
+	origins map[string]bool
+}
+
+type transportStream struct {
+	req  *http.Request
+	body *transportBody
+
+	// ready is closed once res or err is set, and done once the
+	// stream is no longer handled by the connection.
+	ready, done chan struct{}
+	res         *http.Response
+	err         error
+
+	// continueCh is closed once a 100 Continue response is received,
+	// for a request expecting it.
+	continueCh   chan struct{}
+	continueOnce sync.Once
+}
+
+func (tc *transportConn) usable() bool {
+	select {
+	case <-tc.ready:
+	default:
+		return true
+	}
+	return tc.err == nil && tc.conn.CanOpenStream()
+}
+
+func (tc *transportConn) idle() bool {
+	select {
+	case <-tc.ready:
+	default:
+		return false
+	}
+	if tc.err != nil {
+		return false
+	}
+	tc.streamL.Lock()
+	defer tc.streamL.Unlock()
+	return len(tc.streams) == 0
+}
+
+// full reports whether the streams of the established connection reach the
+// maximum concurrent streams of the server.
+func (tc *transportConn) full() bool {
+	if !tc.established() {
+		return false
+	}
+	tc.streamL.Lock()
+	defer tc.streamL.Unlock()
+	return tc.requests >= tc.conn.remoteSettings().MaxConcurrentStreams()
+}
+
+// reserve reserves a stream for a request, according to the StreamLimitPolicy
+// of the Transport when the connection reaches the maximum concurrent streams.
+func (tc *transportConn) reserve(ctx context.Context) error {
+	for {
+		tc.streamL.Lock()
+		if tc.requests < tc.conn.remoteSettings().MaxConcurrentStreams() {
+			tc.requests++
+			tc.streamL.Unlock()
+			return nil
+		}
+		if tc.t.StreamLimitPolicy != StreamLimitWait {
+			tc.streamL.Unlock()
+			return ErrStreamLimit
+		}
+		if tc.slotCh == nil {
+			tc.slotCh = make(chan struct{})
+		}
+		slotCh := tc.slotCh
+		tc.streamL.Unlock()
+
+		select {
+		case <-slotCh:
+		case <-tc.conn.Done():
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release releases a stream reserved for a request,
+// closing the retired connection carrying no request.
+func (tc *transportConn) release() {
+	tc.streamL.Lock()
+	tc.requests--
+	tc.notifySlot()
+	closing := tc.retired && tc.requests == 0
+	tc.streamL.Unlock()
+
+	if closing {
+		tc.conn.Close()
+	}
+}
+
+// notifySlot wakes up the requests waiting for a stream, with streamL held.
+func (tc *transportConn) notifySlot() {
+	if tc.slotCh != nil {
+		close(tc.slotCh)
+		tc.slotCh = nil
+	}
+}
+
+// retire marks the connection replaced in the pool of the Transport,
+// closing it if it carries no request.
+func (tc *transportConn) retire() {
+	if !tc.established() {
+		return
+	}
+	tc.streamL.Lock()
+	tc.retired = true
+	closing := tc.requests == 0
+	tc.streamL.Unlock()
+
+	if closing {
+		go tc.conn.Close()
+	}
+}
+
+func (tc *transportConn) roundTrip(req *http.Request) (*http.Response, error) {
+	h, err := requestToHeader(req, false)
+	if err != nil {
+		tc.release()
+		closeRequestBody(req)
+		return nil, err
+	}
+	// The trailers of the response are accepted.
+	h.Set("te", "trailers")
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	if hasBody && req.ContentLength > 0 {
+		h.Set("content-length", strconv.FormatInt(req.ContentLength, 10))
+	}
+
+	conn := tc.conn
+
+	streamID, err := conn.NextStreamID()
+	if err != nil {
+		tc.release()
+		// The request is retried on a new connection.
+		if err != ErrStreamIDsExhausted {
+			closeRequestBody(req)
+		}
+		return nil, err
+	}
+
+	s := &transportStream{
+		req:   req,
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if hasBody && tc.t.ExpectContinueTimeout > 0 && strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		s.continueCh = make(chan struct{})
+	}
+	s.body = &transportBody{tc: tc, streamID: streamID}
+	s.body.cond = sync.NewCond(&s.body.mu)
+
+	tc.streamL.Lock()
+	tc.streams[streamID] = s
+	tc.streamL.Unlock()
+
+	if err = conn.WriteFrame(&HeadersFrame{StreamID: streamID, Header: h, EndStream: !hasBody}); err != nil {
+		tc.fail(streamID, err)
+		closeRequestBody(req)
+		return nil, err
+	}
+
+	// The stream is reset with CANCEL when the request context is done.
+	ctx := req.Context()
+	if err = conn.BindStreamContext(streamID, ctx); err == nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				tc.fail(streamID, ctx.Err())
+			case <-s.done:
+			}
+		}()
+	}
+
+	if hasBody {
+		go tc.writeBody(s, streamID, req.Body)
+	}
+
+	select {
+	case <-s.ready:
+	case <-ctx.Done():
+		tc.fail(streamID, ctx.Err())
+		<-s.ready
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.res, nil
+}
+
+// writeBody writes the request body as DATA frames, each one being
+// sent as the flow control windows allow.
+func (tc *transportConn) writeBody(s *transportStream, streamID uint32, body io.ReadCloser) {
+	defer body.Close()
+
+	if s.continueCh != nil && !tc.awaitContinue(s, streamID) {
+		return
+	}
+
+	buf := make([]byte, maxFrameSizeLowerBound)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if werr := tc.conn.WriteFrame(&DataFrame{StreamID: streamID, Data: bytes.NewReader(buf[:n]), DataLen: n}); werr != nil {
+				tc.fail(streamID, werr)
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			tc.conn.WriteFrame(&RSTStreamFrame{streamID, ErrCodeCancel})
+			tc.fail(streamID, err)
+			return
+		}
+	}
+
+	if err := tc.conn.WriteFrame(&DataFrame{StreamID: streamID, EndStream: true}); err != nil {
+		tc.fail(streamID, err)
+	}
+}
+
+// awaitContinue waits for the 100 Continue response of a request expecting
+// it, or for the ExpectContinueTimeout to elapse, reporting whether the
+// body is to be sent. It is not sent once the stream fails, or once a
+// final response other than 2xx is received; the stream is then reset
+// with CANCEL after the response is received entirely.
+func (tc *transportConn) awaitContinue(s *transportStream, streamID uint32) bool {
+	timer := time.NewTimer(tc.t.ExpectContinueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-s.continueCh:
+	case <-timer.C:
+	case <-s.ready:
+		if s.err != nil {
+			return false
+		}
+		if s.res.StatusCode >= 300 {
+			<-s.done
+			tc.conn.WriteFrame(&RSTStreamFrame{streamID, ErrCodeCancel})
+			return false
+		}
+	case <-s.done:
+		return false
+	}
+	return true
+}
+
+func (tc *transportConn) readLoop() {
+	var err error
+
+	for {
+		var frame Frame
+		if frame, err = tc.conn.ReadFrame(); err != nil {
+			// The streams failing with a stream error are reset
+			// by ReadFrame, while the others are still read.
+			switch e := err.(type) {
+			case StreamError:
+				tc.fail(e.StreamID, e)
+				continue
+			case StreamErrorList:
+				for _, se := range e {
+					tc.fail(se.StreamID, *se)
+				}
+				continue
+			}
+			break
+		}
+
+		switch v := frame.(type) {
+		case *HeadersFrame:
+			tc.handleHeaders(v)
+		case *DataFrame:
+			tc.handleData(v)
+		case *RSTStreamFrame:
+			if v.ErrCode == ErrCodeHTTP11Required {
+				tc.fail(v.StreamID, HTTP11RequiredError{v.StreamID})
+				break
+			}
+			tc.fail(v.StreamID, StreamError{fmt.Errorf("stream %d reset by peer", v.StreamID), v.ErrCode, v.StreamID, ReasonPeerReset})
+		case *PushPromiseFrame:
+			tc.handlePushPromise(v)
+		case *OriginFrame:
+			tc.handleOrigin(v)
+		case *SettingsFrame:
+			// The server may allow more concurrent streams.
+			tc.streamL.Lock()
+			tc.notifySlot()
+			tc.streamL.Unlock()
+		case *GoAwayFrame:
+			// The streams above the last stream identifier were not
+			// processed, and can be retried on a new connection.
+			tc.t.removeConn(tc)
+
+			tc.streamL.Lock()
+			var unprocessed []uint32
+			for streamID := range tc.streams {
+				if streamID%2 == 1 && streamID > v.LastStreamID {
+					unprocessed = append(unprocessed, streamID)
+				}
+			}
+			tc.streamL.Unlock()
+
+			for _, streamID := range unprocessed {
+				tc.fail(streamID, GoAwayError{v.ErrCode, v.LastStreamID, streamID})
+			}
+		}
+	}
+
+	tc.t.removeConn(tc)
+
+	tc.streamL.Lock()
+	streams := make([]uint32, 0, len(tc.streams))
+	for streamID := range tc.streams {
+		streams = append(streams, streamID)
+	}
+	tc.streamL.Unlock()
+
+	for _, streamID := range streams {
+		tc.fail(streamID, err)
+	}
+
+	// The connection is no longer read once failed.
+	tc.conn.CloseTimeout(0)
+}
+
+func (tc *transportConn) handleHeaders(v *HeadersFrame) {
+	tc.streamL.Lock()
+	s := tc.streams[v.StreamID]
+	tc.streamL.Unlock()
+
+	if s == nil {
+		return
+	}
+
+	if s.res != nil {
+		for k, vv := range v.Header {
+			s.res.Trailer[http.CanonicalHeaderKey(k)] = vv
+		}
+		tc.finish(v.StreamID, io.EOF)
+		return
+	}
+
+	status := v.Header.Status()
+	code, err := strconv.Atoi(status)
+	if err != nil || len(status) != 3 {
+		tc.conn.WriteFrame(&RSTStreamFrame{v.StreamID, ErrCodeProtocol})
+		tc.fail(v.StreamID, MalformedError(fmt.Sprintf("bad :status %q", status)))
+		return
+	}
+
+	// Interim responses are not returned. A 100 Continue response
+	// lets the body of the request be sent.
+	if informational(status) {
+		if code == http.StatusContinue && s.continueCh != nil {
+			s.continueOnce.Do(func() { close(s.continueCh) })
+		}
+		return
+	}
+
+	res := &http.Response{
+		Status:        status + " " + http.StatusText(code),
+		StatusCode:    code,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        make(http.Header, len(v.Header)),
+		Trailer:       make(http.Header),
+		ContentLength: -1,
+		Body:          s.body,
+		Request:       s.req,
+	}
+	for k, vv := range v.Header {
+		if len(k) > 0 && k[0] == ':' {
+			continue
+		}
+		res.Header[http.CanonicalHeaderKey(k)] = vv
+	}
+	if n, err := strconv.ParseInt(v.Header.Get("content-length"), 10, 64); err == nil && n >= 0 {
+		res.ContentLength = n
+	}
+	if v.EndStream {
+		res.ContentLength = 0
+	}
+
+	tc.streamL.Lock()
+	if s.err == nil {
+		s.res = res
+		close(s.ready)
+	}
+	tc.streamL.Unlock()
+
+	if v.EndStream {
+		tc.finish(v.StreamID, io.EOF)
+	}
+}
+
+// handlePushPromise reserves the stream of a pushed response if the
+// PushHandler of the Transport accepts it, or the PushCache stores it,
+// or resets it with CANCEL.
+func (tc *transportConn) handlePushPromise(v *PushPromiseFrame) {
+	var onResponse func(*http.Response)
+	if tc.t.PushHandler != nil {
+		onResponse = tc.t.PushHandler(v.PromisedStreamID, v.Header)
+	}
+	if onResponse == nil && tc.t.PushCache != nil && (v.Method() == "GET" || v.Method() == "HEAD") {
+		authority := joinHostPort(v.Authority(), v.Scheme())
+		path := v.Path()
+		onResponse = func(res *http.Response) {
+			if !cacheablePush(res) {
+				res.Body.Close()
+				return
+			}
+			tc.t.PushCache.Put(authority, path, res)
+		}
+	}
+	if onResponse == nil {
+		tc.conn.WriteFrame(&RSTStreamFrame{v.PromisedStreamID, ErrCodeCancel})
+		return
+	}
+
+	u, err := url.Parse(v.Scheme() + "://" + v.Authority() + v.Path())
+	if err != nil || v.Method() == "" || v.Path() == "" {
+		tc.conn.WriteFrame(&RSTStreamFrame{v.PromisedStreamID, ErrCodeProtocol})
+		return
+	}
+	req := &http.Request{
+		Method:     v.Method(),
+		URL:        u,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     make(http.Header, len(v.Header)),
+		Host:       v.Authority(),
+	}
+	for k, vv := range v.Header {
+		if len(k) > 0 && k[0] != ':' {
+			req.Header[http.CanonicalHeaderKey(k)] = vv
+		}
+	}
+
+	s := &transportStream{
+		req:   req,
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	s.body = &transportBody{tc: tc, streamID: v.PromisedStreamID}
+	s.body.cond = sync.NewCond(&s.body.mu)
+
+	tc.streamL.Lock()
+	tc.streams[v.PromisedStreamID] = s
+	tc.streamL.Unlock()
+
+	// The pushed response is not delivered if the stream fails first.
+	go func() {
+		<-s.ready
+		if s.err == nil {
+			onResponse(s.res)
+		}
+	}()
+}
+
+func (tc *transportConn) handleData(v *DataFrame) {
+	tc.streamL.Lock()
+	s := tc.streams[v.StreamID]
+	tc.streamL.Unlock()
+
+	if s == nil {
+		return
+	}
+
+	// The payload is held in the body, and returned to the
+	// flow-control windows as it is read.
+	n, err := tc.conn.readHeldData(v, s.body)
+	// The padding is not read from the body.
+	if pad := n - v.DataLen; pad > 0 {
+		tc.conn.releaseData(v.StreamID, pad)
+	}
+
+	if err != nil {
+		tc.fail(v.StreamID, err)
+	} else if v.EndStream {
+		tc.finish(v.StreamID, io.EOF)
+	}
+}
+
+// finish removes the stream, its body returning err once read entirely.
+func (tc *transportConn) finish(streamID uint32, err error) {
+	tc.streamL.Lock()
+	s := tc.streams[streamID]
+	delete(tc.streams, streamID)
+	tc.streamL.Unlock()
+
+	if s != nil {
+		s.body.closeWithError(err)
+		close(s.done)
+		if streamID%2 == 1 {
+			tc.release()
+		}
+	}
+}
+
+// fail removes the stream, returning err to the pending round trip,
+// or from the response body.
+func (tc *transportConn) fail(streamID uint32, err error) {
+	tc.streamL.Lock()
+	s := tc.streams[streamID]
+	delete(tc.streams, streamID)
+	if s != nil && s.res == nil {
+		s.err = err
+		close(s.ready)
+	}
+	tc.streamL.Unlock()
+
+	if s != nil {
+		s.body.closeWithError(err)
+		close(s.done)
+		if streamID%2 == 1 {
+			tc.release()
+		}
+	}
+}
+
+var errClosedBody = errors.New("http2: response body closed")
+
+// transportBody is the body of a response, buffering the received
+// DATA frames until they are read.
+type transportBody struct {
+	tc       *transportConn
+	streamID uint32
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	err  error
+}
+
+func (b *transportBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	var (
+		timer    *time.Timer
+		timedOut bool
+	)
+	for !timedOut && b.buf.Len() == 0 && b.err == nil {
+		if timeout := b.tc.conn.config.ReadBodyTimeout; timer == nil && timeout > 0 {
+			timer = time.AfterFunc(timeout, func() {
+				b.mu.Lock()
+				timedOut = true
+				b.cond.Broadcast()
+				b.mu.Unlock()
+			})
+		}
+		b.cond.Wait()
+	}
+	if timer != nil {
+		timer.Stop()
+	}
+	if timedOut && b.buf.Len() == 0 && b.err == nil {
+		err := StreamError{ErrReadBodyTimeout, ErrCodeCancel, b.streamID, ReasonTimeout}
+		b.err = err
+		b.mu.Unlock()
+		b.tc.conn.WriteFrame(&RSTStreamFrame{b.streamID, ErrCodeCancel})
+		b.tc.fail(b.streamID, err)
+		return 0, err
+	}
+	if b.buf.Len() == 0 {
+		err := b.err
+		b.mu.Unlock()
+		return 0, err
+	}
+	n, _ := b.buf.Read(p)
+	b.mu.Unlock()
+
+	b.tc.conn.releaseData(b.streamID, n)
+	return n, nil
+}
+
+// Write buffers the payload of a DATA frame.
+// The bytes of a closed body are released without being buffered.
+func (b *transportBody) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	closed := b.err != nil
+	if !closed {
+		b.buf.Write(p)
+		b.cond.Broadcast()
+	}
+	b.mu.Unlock()
+
+	if closed {
+		b.tc.conn.releaseData(b.streamID, len(p))
+	}
+	return len(p), nil
+}
+
+func (b *transportBody) closeWithError(err error) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// Close resets the stream with CANCEL if the response
+// has not been received entirely.
+func (b *transportBody) Close() error {
+	b.mu.Lock()
+	complete := b.err != nil
+	if !complete {
+		b.err = errClosedBody
+	}
+	b.buf.Reset()
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
+	if !complete {
+		b.tc.conn.WriteFrame(&RSTStreamFrame{b.streamID, ErrCodeCancel})
+		b.tc.fail(b.streamID, errClosedBody)
+	}
+	return nil
+}
+
+func closeRequestBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
@@ -0,0 +1,276 @@
+package http2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connect opens a tunnel to the given authority with the CONNECT method,
+// defined in RFC 7540 section 8.3. It returns once a 2xx response is
+// received, so the frames of the connection are to be read concurrently
+// with ReadFrame. Writes to the tunnel are sent as DATA frames and reads
+// return the received ones; closing the tunnel ends the stream in the
+// sending direction.
+func (c *Conn) Connect(authority string) (io.ReadWriteCloser, error) {
+	if c.server {
+		return nil, errors.New("http2: CONNECT request sent by server")
+	}
+
+	streamID, err := c.NextStreamID()
+	if err != nil {
+		return nil, err
+	}
+
+	// A CONNECT request is constructed with the ":method" pseudo-header
+	// field set to "CONNECT" and the ":authority" pseudo-header field
+	// containing the host and port to connect to.  The ":scheme" and
+	// ":path" pseudo-header fields MUST be omitted.
+	header := Header{}
+	header.SetMethod("CONNECT")
+	header.SetAuthority(authority)
+
+	t, err := c.connect(streamID, header)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// connect opens the tunnel of a CONNECT request with the given header on
+// a new stream, once a 2xx response is received.
+func (c *Conn) connect(streamID uint32, header Header) (*tunnel, error) {
+	t := newTunnel(c, streamID)
+	t.respCh = make(chan struct{})
+	c.addTunnel(t)
+
+	err := c.WriteFrame(&HeadersFrame{StreamID: streamID, Header: header})
+	if err == nil {
+		select {
+		case <-t.respCh:
+			err = t.err
+		case <-c.closeCh:
+			err = ErrClosed
+		}
+	}
+
+	// Any 2xx series response indicates that the connection is
+	// established; any other response indicates that it failed.
+	if err == nil && (len(t.status) != 3 || t.status[0] != '2') {
+		c.WriteFrame(&RSTStreamFrame{streamID, ErrCodeCancel})
+		target := header.Authority()
+		if protocol := header.Protocol(); protocol != "" {
+			target = protocol + " " + header.Path()
+		}
+		err = fmt.Errorf("http2: CONNECT %s failed with status %s", target, t.status)
+	}
+	if err != nil {
+		c.removeTunnel(streamID)
+		return nil, err
+	}
+	return t, nil
+}
+
+// A tunnel is the stream of a CONNECT request. The received DATA frames
+// are buffered until read, and their bytes are returned to the remote
+// endpoint as they are read.
+type tunnel struct {
+	conn     *Conn
+	streamID uint32
+	body     *requestBody
+
+	// The response of a client tunnel, or the error that
+	// failed it, set before respCh is closed.
+	respCh   chan struct{}
+	respOnce sync.Once
+	status   string
+	err      error
+
+	closeOnce sync.Once
+
+	// writeDeadline is the time, in Unix nanoseconds, after which
+	// writes fail, or zero if there is none.
+	writeDeadline int64
+}
+
+func newTunnel(c *Conn, streamID uint32) *tunnel {
+	t := &tunnel{conn: c, streamID: streamID}
+	t.body = &requestBody{conn: c, streamID: streamID}
+	t.body.cond = sync.NewCond(&t.body.mu)
+	return t
+}
+
+func (t *tunnel) Read(p []byte) (int, error) {
+	return t.body.Read(p)
+}
+
+func (t *tunnel) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if d := atomic.LoadInt64(&t.writeDeadline); d != 0 && time.Now().UnixNano() >= d {
+			return n, os.ErrDeadlineExceeded
+		}
+		chunk := p
+		if len(chunk) > maxFrameSizeLowerBound {
+			chunk = chunk[:maxFrameSizeLowerBound]
+		}
+		if err = t.conn.WriteFrame(&DataFrame{StreamID: t.streamID, Data: bytes.NewReader(chunk), DataLen: len(chunk)}); err != nil {
+			return
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return
+}
+
+// Close ends the stream with an empty DATA frame. The tunnel is still
+// read until the remote endpoint ends the stream too.
+func (t *tunnel) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		err = t.conn.WriteFrame(&DataFrame{StreamID: t.streamID, EndStream: true})
+		if t.conn.stream(t.streamID) == nil {
+			t.conn.removeTunnel(t.streamID)
+		}
+	})
+	return err
+}
+
+func (t *tunnel) respond(status string, err error) {
+	if t.respCh == nil {
+		return
+	}
+	t.respOnce.Do(func() {
+		t.status, t.err = status, err
+		close(t.respCh)
+	})
+}
+
+func (t *tunnel) fail(err error) {
+	t.respond("", err)
+	t.body.closeWithError(err)
+}
+
+func (c *Conn) addTunnel(t *tunnel) {
+	c.tunnelL.Lock()
+	c.tunnels[t.streamID] = t
+	c.tunnelL.Unlock()
+}
+
+func (c *Conn) removeTunnel(streamID uint32) {
+	c.tunnelL.Lock()
+	delete(c.tunnels, streamID)
+	c.tunnelL.Unlock()
+}
+
+func (c *Conn) tunnel(streamID uint32) *tunnel {
+	c.tunnelL.Lock()
+	defer c.tunnelL.Unlock()
+
+	return c.tunnels[streamID]
+}
+
+// closeTunnels fails the tunnels of the connection with err.
+func (c *Conn) closeTunnels(err error) {
+	c.tunnelL.Lock()
+	tunnels := c.tunnels
+	c.tunnels = make(map[uint32]*tunnel)
+	c.tunnelL.Unlock()
+
+	for _, t := range tunnels {
+		t.fail(err)
+	}
+}
+
+// tunnelFrame handles a frame read by ReadFrame if it belongs to a
+// CONNECT tunnel, or opens one for a CONNECT request, reporting
+// whether the frame was consumed.
+func (c *Conn) tunnelFrame(frame Frame) bool {
+	t := c.tunnel(frame.Stream())
+	if t == nil {
+		v, ok := frame.(*HeadersFrame)
+		if !ok || !c.server || v.Trailer || v.Method() != "CONNECT" {
+			return false
+		}
+		switch v.Protocol() {
+		case "":
+			if c.config.ConnectHandler != nil {
+				return c.acceptTunnel(v)
+			}
+		case "websocket":
+			if c.config.WebSocketHandler != nil {
+				return c.acceptTunnel(v)
+			}
+		}
+		return false
+	}
+
+	switch v := frame.(type) {
+	case *HeadersFrame:
+		if !c.server && !v.Trailer {
+			if informational(v.Status()) {
+				return true
+			}
+			t.respond(v.Status(), nil)
+		}
+		if v.EndStream {
+			t.fail(io.EOF)
+		}
+	case *DataFrame:
+		n, err := c.readHeldData(v, t.body)
+		// The padding is not read from the tunnel.
+		if pad := n - v.DataLen; pad > 0 {
+			c.releaseData(v.StreamID, pad)
+		}
+		if err != nil {
+			t.fail(err)
+		} else if v.EndStream {
+			t.fail(io.EOF)
+		}
+	case *RSTStreamFrame:
+		t.fail(StreamError{fmt.Errorf("stream %d reset by peer", v.StreamID), v.ErrCode, v.StreamID, ReasonPeerReset})
+	default:
+		return false
+	}
+
+	if c.stream(t.streamID) == nil {
+		c.removeTunnel(t.streamID)
+	}
+	return true
+}
+
+// acceptTunnel establishes the tunnel of a CONNECT request with a 200
+// response, and calls the ConnectHandler of the connection, or its
+// WebSocketHandler for an extended CONNECT request of a WebSocket.
+func (c *Conn) acceptTunnel(v *HeadersFrame) bool {
+	// The ":scheme" and ":path" pseudo-header fields are omitted from
+	// CONNECT requests, and included in extended ones.
+	extended := v.Protocol() != ""
+	if v.Authority() == "" || (v.Scheme() != "") != extended || (v.Path() != "") != extended {
+		c.WriteFrame(&RSTStreamFrame{v.StreamID, ErrCodeProtocol})
+		return true
+	}
+
+	t := newTunnel(c, v.StreamID)
+	if v.EndStream {
+		t.body.err = io.EOF
+	}
+	c.addTunnel(t)
+
+	header := Header{}
+	header.SetStatus("200")
+	if err := c.WriteFrame(&HeadersFrame{StreamID: v.StreamID, Header: header}); err != nil {
+		c.removeTunnel(v.StreamID)
+		return true
+	}
+	if extended {
+		go c.config.WebSocketHandler(v.Header.Clone(), &streamConn{t})
+	} else {
+		go c.config.ConnectHandler(v.Authority(), t)
+	}
+	return true
+}
@@ -3,8 +3,10 @@ package http2
 import (
 	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 )
 
@@ -51,8 +53,74 @@ func (e StreamError) Error() string {
 	return fmt.Sprintf("stream error(stream ID=%d; %s): %s", e.StreamID, e.ErrCode, e.Err.Error())
 }
 
-func (e *StreamErrorList) add(streamID uint32, errCode ErrCode, err error) {
-	*e = append(*e, &StreamError{err, errCode, streamID})
+// Unwrap returns the error of the stream.
+func (e StreamError) Unwrap() error {
+	return e.Err
+}
+
+func (e GoAwayError) Error() string {
+	return fmt.Sprintf("http2: stream %d not processed after GOAWAY(%s) with last stream ID %d", e.StreamID, e.ErrCode, e.LastStreamID)
+}
+
+func (r StreamErrorReason) String() string {
+	switch r {
+	case ReasonUnknown:
+		return "unknown"
+	case ReasonProtocol:
+		return "protocol"
+	case ReasonFlowControl:
+		return "flow control"
+	case ReasonStreamClosed:
+		return "stream closed"
+	case ReasonRefusedStream:
+		return "refused stream"
+	case ReasonPeerReset:
+		return "peer reset"
+	case ReasonCanceled:
+		return "canceled"
+	case ReasonTimeout:
+		return "timeout"
+	default:
+		return fmt.Sprintf("unknown reason %d", uint8(r))
+	}
+}
+
+// AsStreamError finds the first StreamError in err, looking into
+// StreamErrorLists and wrapped errors.
+func AsStreamError(err error) (*StreamError, bool) {
+	for err != nil {
+		switch e := err.(type) {
+		case StreamError:
+			return &e, true
+		case *StreamError:
+			return e, e != nil
+		case StreamErrorList:
+			if len(e) == 0 {
+				return nil, false
+			}
+			return e[0], true
+		}
+		err = errors.Unwrap(err)
+	}
+	return nil, false
+}
+
+// Unprocessed reports whether err tells that the remote endpoint did not
+// process a stream, which can then be retried on a new connection, even if
+// its request is not idempotent: a GoAwayError, or the StreamError of a
+// stream reset by the peer with REFUSED_STREAM. Any other error leaves it
+// unknown whether the stream was processed.
+func Unprocessed(err error) bool {
+	var goAway GoAwayError
+	if errors.As(err, &goAway) {
+		return true
+	}
+	se, ok := AsStreamError(err)
+	return ok && se.ErrCode == ErrCodeRefusedStream && se.Reason == ReasonPeerReset
+}
+
+func (e *StreamErrorList) add(streamID uint32, errCode ErrCode, err error, reason StreamErrorReason) {
+	*e = append(*e, &StreamError{err, errCode, streamID, reason})
 }
 
 func (e StreamErrorList) Error() string {
@@ -65,6 +133,18 @@ func (e StreamErrorList) Error() string {
 	return fmt.Sprintf("%s (and %d more stream errors)", e[0], len(e)-1)
 }
 
+// Unwrap returns the StreamErrors of the list, as values, for errors.Is
+// and errors.As to look into them.
+func (e StreamErrorList) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, se := range e {
+		if se != nil {
+			errs = append(errs, *se)
+		}
+	}
+	return errs
+}
+
 // Err returns the error.
 func (e StreamErrorList) Err() error {
 	if len(e) == 0 {
@@ -91,6 +171,10 @@ func (id SettingID) String() string {
 		return "MAX_FRAME_SIZE"
 	case SettingMaxHeaderListSize:
 		return "MAX_HEADER_LIST_SIZE"
+	case SettingEnableConnectProtocol:
+		return "ENABLE_CONNECT_PROTOCOL"
+	case SettingNoRFC7540Priorities:
+		return "NO_RFC7540_PRIORITIES"
 	default:
 		return fmt.Sprintf("UNKNOWN_SETTING_%d", uint16(id))
 	}
@@ -160,6 +244,34 @@ func (s *Settings) SetMaxHeaderListSize(value uint32) error {
 	return s.SetValue(SettingMaxHeaderListSize, value)
 }
 
+// ConnectProtocolEnabled returns the SettingEnableConnectProtocol value.
+func (s Settings) ConnectProtocolEnabled() bool {
+	return s.Value(SettingEnableConnectProtocol) != 0
+}
+
+// SetConnectProtocolEnabled sets the SettingEnableConnectProtocol value.
+func (s *Settings) SetConnectProtocolEnabled(enabled bool) error {
+	var value uint32
+	if enabled {
+		value = 1
+	}
+	return s.SetValue(SettingEnableConnectProtocol, value)
+}
+
+// NoRFC7540Priorities returns the SettingNoRFC7540Priorities value.
+func (s Settings) NoRFC7540Priorities() bool {
+	return s.Value(SettingNoRFC7540Priorities) != 0
+}
+
+// SetNoRFC7540Priorities sets the SettingNoRFC7540Priorities value.
+func (s *Settings) SetNoRFC7540Priorities(enabled bool) error {
+	var value uint32
+	if enabled {
+		value = 1
+	}
+	return s.SetValue(SettingNoRFC7540Priorities, value)
+}
+
 // Value returns the setting value for the given setting ID.
 // If not present, returns default value.
 func (s Settings) Value(id SettingID) uint32 {
@@ -179,6 +291,10 @@ func (s Settings) Value(id SettingID) uint32 {
 		return defaultMaxFrameSize
 	case SettingMaxHeaderListSize:
 		return 0
+	case SettingEnableConnectProtocol:
+		return defaultEnableConnectProtocol
+	case SettingNoRFC7540Priorities:
+		return defaultNoRFC7540Priorities
 	default:
 		return 0
 	}
@@ -188,7 +304,7 @@ func (s Settings) Value(id SettingID) uint32 {
 func (s *Settings) SetValue(id SettingID, value uint32) error {
 	ok := true
 	switch id {
-	case SettingEnablePush:
+	case SettingEnablePush, SettingEnableConnectProtocol, SettingNoRFC7540Priorities:
 		ok = value < 2
 	case SettingInitialWindowSize:
 		ok = value <= maxInitialWindowSize
@@ -217,6 +333,30 @@ func (s *Settings) SetValue(id SettingID, value uint32) error {
 	return nil
 }
 
+// Diff returns the settings of s whose values differ from the ones of old,
+// as a SETTINGS frame changing old into s is to carry. The settings set in
+// old but not in s are included with their default values, being reset.
+func (s Settings) Diff(old Settings) Settings {
+	var diff Settings
+	for _, x := range append(s.clone(), old...) {
+		if _, dup := diff.value(x.ID); !dup && s.Value(x.ID) != old.Value(x.ID) {
+			diff = append(diff, setting{x.ID, s.Value(x.ID)})
+		}
+	}
+	return diff
+}
+
+// InitialWindowSizeDelta returns the change of the SettingInitialWindowSize
+// value from old to s, by which the flow-control windows of the existing
+// streams are adjusted (RFC 7540 section 6.9.2). It can be negative.
+func (s Settings) InitialWindowSizeDelta(old Settings) int {
+	return int(s.InitialWindowSize()) - int(old.InitialWindowSize())
+}
+
+func (s Settings) clone() Settings {
+	return append(Settings(nil), s...)
+}
+
 func (s Settings) value(id SettingID) (uint32, bool) {
 	for _, x := range s {
 		if x.ID == id {
@@ -261,46 +401,100 @@ func (t FrameType) String() string {
 		return "WINDOW_UPDATE"
 	case FrameContinuation:
 		return "CONTINUATION"
+	case FrameAltSvc:
+		return "ALTSVC"
+	case FrameOrigin:
+		return "ORIGIN"
+	case FramePriorityUpdate:
+		return "PRIORITY_UPDATE"
 	default:
 		return fmt.Sprintf("UNKNOWN_FRAME_TYPE_%d", uint8(t))
 	}
 }
 
-func (f *DataFrame) Type() FrameType         { return FrameData }
-func (f *HeadersFrame) Type() FrameType      { return FrameHeaders }
-func (f *PriorityFrame) Type() FrameType     { return FramePriority }
-func (f *RSTStreamFrame) Type() FrameType    { return FrameRSTStream }
-func (f *SettingsFrame) Type() FrameType     { return FrameSettings }
-func (f *PushPromiseFrame) Type() FrameType  { return FramePushPromise }
-func (f *PingFrame) Type() FrameType         { return FramePing }
-func (f *GoAwayFrame) Type() FrameType       { return FrameGoAway }
-func (f *WindowUpdateFrame) Type() FrameType { return FrameWindowUpdate }
-func (f *UnknownFrame) Type() FrameType      { return f.FrameType }
-
-func (f *DataFrame) Stream() uint32         { return f.StreamID }
-func (f *HeadersFrame) Stream() uint32      { return f.StreamID }
-func (f *PriorityFrame) Stream() uint32     { return f.StreamID }
-func (f *RSTStreamFrame) Stream() uint32    { return f.StreamID }
-func (f *SettingsFrame) Stream() uint32     { return 0 }
-func (f *PushPromiseFrame) Stream() uint32  { return f.StreamID }
-func (f *PingFrame) Stream() uint32         { return 0 }
-func (f *GoAwayFrame) Stream() uint32       { return 0 }
-func (f *WindowUpdateFrame) Stream() uint32 { return f.StreamID }
-func (f *UnknownFrame) Stream() uint32      { return f.StreamID }
-
-func (f *DataFrame) EndOfStream() bool         { return f.EndStream }
-func (f *HeadersFrame) EndOfStream() bool      { return f.EndStream }
-func (f *PriorityFrame) EndOfStream() bool     { return false }
-func (f *RSTStreamFrame) EndOfStream() bool    { return false }
-func (f *SettingsFrame) EndOfStream() bool     { return false }
-func (f *PushPromiseFrame) EndOfStream() bool  { return false }
-func (f *PingFrame) EndOfStream() bool         { return false }
-func (f *GoAwayFrame) EndOfStream() bool       { return false }
-func (f *WindowUpdateFrame) EndOfStream() bool { return false }
-func (f *UnknownFrame) EndOfStream() bool      { return f.Flags.Has(FlagEndStream) }
+func (f *DataFrame) Type() FrameType           { return FrameData }
+func (f *HeadersFrame) Type() FrameType        { return FrameHeaders }
+func (f *PriorityFrame) Type() FrameType       { return FramePriority }
+func (f *RSTStreamFrame) Type() FrameType      { return FrameRSTStream }
+func (f *SettingsFrame) Type() FrameType       { return FrameSettings }
+func (f *PushPromiseFrame) Type() FrameType    { return FramePushPromise }
+func (f *PingFrame) Type() FrameType           { return FramePing }
+func (f *GoAwayFrame) Type() FrameType         { return FrameGoAway }
+func (f *WindowUpdateFrame) Type() FrameType   { return FrameWindowUpdate }
+func (f *AltSvcFrame) Type() FrameType         { return FrameAltSvc }
+func (f *OriginFrame) Type() FrameType         { return FrameOrigin }
+func (f *PriorityUpdateFrame) Type() FrameType { return FramePriorityUpdate }
+func (f *UnknownFrame) Type() FrameType        { return f.FrameType }
+
+func (f *DataFrame) Stream() uint32           { return f.StreamID }
+func (f *HeadersFrame) Stream() uint32        { return f.StreamID }
+func (f *PriorityFrame) Stream() uint32       { return f.StreamID }
+func (f *RSTStreamFrame) Stream() uint32      { return f.StreamID }
+func (f *SettingsFrame) Stream() uint32       { return 0 }
+func (f *PushPromiseFrame) Stream() uint32    { return f.StreamID }
+func (f *PingFrame) Stream() uint32           { return 0 }
+func (f *GoAwayFrame) Stream() uint32         { return 0 }
+func (f *WindowUpdateFrame) Stream() uint32   { return f.StreamID }
+func (f *AltSvcFrame) Stream() uint32         { return f.StreamID }
+func (f *OriginFrame) Stream() uint32         { return 0 }
+func (f *PriorityUpdateFrame) Stream() uint32 { return 0 }
+func (f *UnknownFrame) Stream() uint32        { return f.StreamID }
+
+func (f *DataFrame) EndOfStream() bool           { return f.EndStream }
+func (f *HeadersFrame) EndOfStream() bool        { return f.EndStream }
+func (f *PriorityFrame) EndOfStream() bool       { return false }
+func (f *RSTStreamFrame) EndOfStream() bool      { return false }
+func (f *SettingsFrame) EndOfStream() bool       { return false }
+func (f *PushPromiseFrame) EndOfStream() bool    { return false }
+func (f *PingFrame) EndOfStream() bool           { return false }
+func (f *GoAwayFrame) EndOfStream() bool         { return false }
+func (f *WindowUpdateFrame) EndOfStream() bool   { return false }
+func (f *AltSvcFrame) EndOfStream() bool         { return false }
+func (f *OriginFrame) EndOfStream() bool         { return false }
+func (f *PriorityUpdateFrame) EndOfStream() bool { return false }
+func (f *UnknownFrame) EndOfStream() bool        { return f.Flags.Has(FlagEndStream) }
 
 func (f *HeadersFrame) HasPriority() bool { return f.Priority != Priority{} }
 
+// ParsePriorityParam parses the value of the Priority header field, or of
+// a PRIORITY_UPDATE frame, defined in RFC 9218 section 5. It is a Structured
+// Fields Dictionary, where "u" is the urgency and "i" the incremental flag.
+// Unknown parameters, and parameters with an invalid value, are ignored
+// and their default value is used.
+func ParsePriorityParam(value string) PriorityParam {
+	p := PriorityParam{Urgency: defaultUrgency}
+
+	for _, member := range strings.Split(value, ",") {
+		// The parameters of a member are not used.
+		if i := strings.IndexByte(member, ';'); i >= 0 {
+			member = member[:i]
+		}
+		key, val, hasVal := strings.Cut(strings.TrimSpace(member), "=")
+		switch key {
+		case "u":
+			if len(val) == 1 && '0' <= val[0] && val[0] <= '0'+maxUrgency {
+				p.Urgency = val[0] - '0'
+			}
+		case "i":
+			switch {
+			case !hasVal, val == "?1":
+				p.Incremental = true
+			case val == "?0":
+				p.Incremental = false
+			}
+		}
+	}
+
+	return p
+}
+
+func (p PriorityParam) String() string {
+	if p.Incremental {
+		return fmt.Sprintf("u=%d, i", p.Urgency)
+	}
+	return fmt.Sprintf("u=%d", p.Urgency)
+}
+
 func (f Flags) Has(v Flags) bool { return (f & v) == v }
 
 func (state StreamState) String() string {
@@ -364,6 +558,17 @@ func (h Header) SetPath(value string) {
 	h[":path"] = []string{value}
 }
 
+// Protocol returns the protocol header of an extended CONNECT request,
+// defined in RFC 8441 section 4.
+func (h Header) Protocol() string {
+	return h.get(":protocol")
+}
+
+// SetProtocol sets the protocol header of an extended CONNECT request.
+func (h Header) SetProtocol(value string) {
+	h[":protocol"] = []string{value}
+}
+
 // Status returns the status header.
 func (h Header) Status() string {
 	return h.get(":status")
@@ -415,6 +620,81 @@ func (h Header) Len() (n int) {
 	return
 }
 
+// Clone returns a copy of header, including the pseudo-header fields,
+// whose values do not share memory with header, or nil if header is nil.
+func (h Header) Clone() Header {
+	if h == nil {
+		return nil
+	}
+
+	// The values are copied into a single slice.
+	values := make([]string, h.Len())
+	clone := make(Header, len(h))
+	for k, vv := range h {
+		if vv == nil {
+			clone[k] = nil
+			continue
+		}
+		n := copy(values, vv)
+		clone[k] = values[:n:n]
+		values = values[n:]
+	}
+	return clone
+}
+
+// Fields returns the header fields in the order they are to be encoded:
+// the pseudo-header fields first, in the :method, :scheme, :authority,
+// :path and :status order, followed by the regular fields sorted by name,
+// with their values in order. A cookie header field is split into one
+// field per cookie-pair, defined in RFC 7540 section 8.1.2.5.
+func (h Header) Fields() []HeaderField {
+	fields := make([]HeaderField, 0, h.Len())
+	for _, k := range pseudoHeaderOrder {
+		for _, v := range h[k] {
+			fields = append(fields, HeaderField{k, v})
+		}
+	}
+
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		if _, pseudo := pseudoHeader[k]; !pseudo {
+			keys = append(keys, k)
+		}
+	}
+	name := func(k string) string {
+		if k[0] == ':' {
+			return k
+		}
+		return CanonicalHTTP2HeaderKey(k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ki, kj := name(keys[i]), name(keys[j])
+		if pi, pj := ki[0] == ':', kj[0] == ':'; pi != pj {
+			return pi
+		}
+		if ki != kj {
+			return ki < kj
+		}
+		return keys[i] < keys[j]
+	})
+
+	for _, k := range keys {
+		n := name(k)
+		for _, v := range h[k] {
+			if n != "cookie" {
+				fields = append(fields, HeaderField{n, v})
+				continue
+			}
+			for _, c := range strings.Split(v, ";") {
+				if c = strings.TrimSpace(c); c != "" {
+					fields = append(fields, HeaderField{n, c})
+				}
+			}
+		}
+	}
+	return fields
+}
+
 func (h Header) get(key string) string {
 	if v := h[key]; len(v) > 0 {
 		return v[0]
@@ -422,20 +702,46 @@ func (h Header) get(key string) string {
 	return ""
 }
 
-var errMalformedHeader = MalformedError("invalid header field")
+var (
+	errMalformedHeader = MalformedError("invalid header field")
+	errMalformedValue  = MalformedError("invalid header field value")
+	errTrailerPseudo   = MalformedError("pseudo-header field in trailers")
+)
+
+// headerBlockOptions are the properties of the header block
+// of which the fields are checked by Header.add.
+type headerBlockOptions struct {
+	// trailer is set for trailers.
+	trailer bool
+
+	// connect is set once the extended CONNECT
+	// protocol is enabled.
+	connect bool
+}
 
-func (h *Header) add(key, value string, _ bool) error {
-	if key[0] == ':' {
+func (h *Header) add(key, value string, opts headerBlockOptions) error {
+	if len(key) > 0 && key[0] == ':' {
+		// Pseudo-header fields MUST NOT appear in trailers.
+		if opts.trailer {
+			return errTrailerPseudo
+		}
 		if h.Len() > 5 {
 			return errMalformedHeader
 		}
 		if _, pseudo := pseudoHeader[key]; !pseudo {
 			return errMalformedHeader
 		}
-	}
-	if !validHeaderKey(key) {
+		// The :protocol pseudo-header field is only allowed once the
+		// extended CONNECT protocol is enabled.
+		if key == ":protocol" && !opts.connect {
+			return errMalformedHeader
+		}
+	} else if !validHeaderKey(key) {
 		return errMalformedHeader
 	}
+	if !validHeaderValue(value) {
+		return errMalformedValue
+	}
 
 	if *h == nil {
 		*h = make(Header)
@@ -445,7 +751,7 @@ func (h *Header) add(key, value string, _ bool) error {
 	return nil
 }
 
-func (h *Header) addHeader(header map[string][]string) error {
+func (h *Header) addHeader(header map[string][]string) {
 	for k, vv := range header {
 		k = CanonicalHTTP2HeaderKey(k)
 
@@ -466,25 +772,52 @@ func (h *Header) addHeader(header map[string][]string) error {
 			continue
 		}
 
-		if k == "te" && len(vv) != 1 && strings.ToLower(vv[0]) != "trailers" {
-			return MalformedError(fmt.Sprintf("bad value for te: %s", vv[0]))
+		// The only exception to this is the TE header field, which MAY be
+		// present in an HTTP/2 request; when it is, it MUST NOT contain any
+		// value other than "trailers".
+		if k == "te" {
+			if hasToken(vv, "trailers") {
+				h.Set(k, "trailers")
+			}
+			continue
 		}
 
 		for _, v := range vv {
 			h.Add(k, v)
 		}
 	}
-	return nil
+}
+
+// hasToken reports whether the comma-separated values contain
+// the token, compared case-insensitively.
+func hasToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func requestToHeader(req *http.Request, skipVerify bool) (Header, error) {
 	h := make(Header, len(req.Header))
 
+	method := req.Method
+	if method == "" {
+		method = "GET"
+	}
+	if !skipVerify && !validMethod(method) {
+		return nil, MalformedError(fmt.Sprintf("bad :method %q", method))
+	}
+
+	h.SetMethod(method)
+
 	// All HTTP/2 requests MUST include exactly one valid value for the
 	// ":method", ":scheme", and ":path" pseudo-header fields, unless it is
 	// a CONNECT request (Section 8.3).
-	if req.Method != "CONNECT" {
-		h.SetMethod(req.Method)
+	if method != "CONNECT" {
 
 		if scheme := req.URL.Scheme; scheme != "" {
 			h.SetScheme(scheme)
@@ -505,27 +838,122 @@ func requestToHeader(req *http.Request, skipVerify bool) (Header, error) {
 			}
 		}
 
-		if path := req.URL.RequestURI(); path != "" {
-			if req.URL.Fragment != "" {
-				path += "#" + req.URL.Fragment
+		// This pseudo-header field MUST NOT be empty for "http" or "https"
+		// URIs; "http" or "https" URIs that do not contain a path component
+		// MUST include a value of '/'.  The exception to this rule is an
+		// OPTIONS request for an "http" or "https" URI that does not include
+		// a path component; these MUST include a ":path" pseudo-header field
+		// with a value of '*' (see [RFC7230], Section 5.3.4).
+		path := req.URL.RequestURI()
+		if req.URL.Fragment != "" {
+			path += "#" + req.URL.Fragment
+		}
+		switch {
+		case skipVerify:
+			if path == "" {
+				path = "/"
 			}
-			h.SetPath(path)
-		} else if !skipVerify {
+		case path == "":
 			return nil, MalformedError(":path must be specified")
-		} else {
-			h.SetPath("/")
+		case path == "*":
+			if method != "OPTIONS" {
+				return nil, MalformedError(fmt.Sprintf(":path \"*\" not allowed for %s requests", method))
+			}
+		case path[0] != '/':
+			return nil, MalformedError(fmt.Sprintf("bad :path %q", path))
 		}
+		h.SetPath(path)
 	}
 
-	h.SetAuthority(req.URL.Host)
-
-	if err := h.addHeader(req.Header); err != nil {
-		return nil, err
+	// Clients that generate HTTP/2 requests directly SHOULD use the
+	// ":authority" pseudo-header field instead of the Host header field.
+	authority := req.URL.Host
+	if req.Host != "" {
+		authority = req.Host
 	}
+	if !skipVerify {
+		for k, vv := range req.Header {
+			if CanonicalHTTP2HeaderKey(k) != "host" {
+				continue
+			}
+			for _, v := range vv {
+				if v != authority {
+					return nil, MalformedError(fmt.Sprintf("host header %q disagrees with :authority %q", v, authority))
+				}
+			}
+		}
+	}
+	h.SetAuthority(authority)
+	h.addHeader(req.Header)
 
 	return h, nil
 }
 
+// validateResponseHeader verifies that the header block of a response
+// carries exactly one :status pseudo-header field with a three-digit
+// status code, and neither other pseudo-header fields nor the
+// connection-specific header fields, defined in RFC 7540 section 8.1.2.
+func validateResponseHeader(h Header) error {
+	status, ok := h[":status"]
+	if !ok {
+		return MalformedError(":status must be specified")
+	}
+	if len(status) != 1 || !validStatus(status[0]) {
+		return MalformedError(fmt.Sprintf("bad :status %q", strings.Join(status, ",")))
+	}
+	for k := range h {
+		// Pseudo-header fields defined for requests MUST NOT appear
+		// in responses.
+		if len(k) > 0 && k[0] == ':' {
+			if k != ":status" {
+				return MalformedError(fmt.Sprintf("pseudo-header field %s in response", k))
+			}
+			continue
+		}
+
+		// An endpoint MUST NOT generate an HTTP/2 message containing
+		// connection-specific header fields.
+		if badHeader(CanonicalHTTP2HeaderKey(k)) {
+			return MalformedError(fmt.Sprintf("connection-specific header field %s in response", k))
+		}
+	}
+	return nil
+}
+
+func validStatus(status string) bool {
+	if len(status) != 3 {
+		return false
+	}
+	for i := 0; i < len(status); i++ {
+		if status[i] < '0' || status[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// validMethod reports whether the method is a token, as defined in RFC
+// 7230 section 3.2.6.
+func validMethod(method string) bool {
+	if method == "" {
+		return false
+	}
+	for i := 0; i < len(method); i++ {
+		if !tokenChar(method[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func tokenChar(c byte) bool {
+	switch c {
+	case '!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~':
+		return true
+	}
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
 // CanonicalHTTP2HeaderKey returns the canonical format of the
 // header key s.
 func CanonicalHTTP2HeaderKey(s string) string {
@@ -538,19 +966,39 @@ func CanonicalHTTP2HeaderKey(s string) string {
 	return strings.ToLower(s)
 }
 
+// validHeaderKey reports whether v is a valid header field name: a token,
+// defined in RFC 9110 section 5.6.2, of lowercase characters. A field name
+// MUST NOT contain characters in the ranges 0x00-0x20, 0x41-0x5a or
+// 0x7f-0xff (RFC 9113 section 8.2.1).
 func validHeaderKey(v string) bool {
 	if len(v) == 0 {
 		return false
 	}
 	for i := 0; i < len(v); i++ {
 		c := v[i]
-		if c >= 127 || ('A' <= c && c <= 'Z') {
+		switch {
+		case 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
 			return false
 		}
 	}
 	return true
 }
 
+// validHeaderValue reports whether v is a valid header field value, which
+// MUST NOT contain a NUL, LF or CR character, nor start or end with a
+// whitespace character (RFC 9113 section 8.2.1).
+func validHeaderValue(v string) bool {
+	if strings.ContainsAny(v, "\x00\n\r") {
+		return false
+	}
+	if n := len(v); n > 0 && (v[0] == ' ' || v[0] == '\t' || v[n-1] == ' ' || v[n-1] == '\t') {
+		return false
+	}
+	return true
+}
+
 func splitHeader(header map[string][]string, key string) (values []string) {
 	for k, v := range header {
 		if strings.EqualFold(key, k) {
@@ -619,19 +1067,47 @@ func badCipher(cipher uint16) bool {
 	}
 }
 
+// sensitiveField reports whether the header fields of the given header
+// key are sensitive: always sensitive, or listed in names.
+func sensitiveField(names []string, key string) bool {
+	key = CanonicalHTTP2HeaderKey(key)
+	if _, ok := sensitiveHeader[key]; ok {
+		return true
+	}
+	for _, k := range names {
+		if CanonicalHTTP2HeaderKey(k) == key {
+			return true
+		}
+	}
+	return false
+}
+
 var (
 	pseudoHeader = make(map[string]struct{})
 	commonHeader = make(map[string]string)
-)
 
-func init() {
-	for _, v := range []string{
+	// sensitiveHeader is the set of header fields always encoded
+	// as never indexed.
+	sensitiveHeader = map[string]struct{}{
+		"authorization": {},
+		"cookie":        {},
+		"set-cookie":    {},
+	}
+
+	// pseudoHeaderOrder is the order of the pseudo-header fields
+	// of a header block returned by Header.Fields.
+	pseudoHeaderOrder = []string{
 		":method",
 		":scheme",
 		":authority",
 		":path",
+		":protocol",
 		":status",
-	} {
+	}
+)
+
+func init() {
+	for _, v := range pseudoHeaderOrder {
 		pseudoHeader[v] = struct{}{}
 	}
 
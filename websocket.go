@@ -0,0 +1,118 @@
+package http2
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DialWebSocket opens a WebSocket on a stream of the connection with an
+// extended CONNECT request for the given path, defined in RFC 8441, once
+// a 2xx response is received. The :authority pseudo-header field is the
+// one of the given header fields, or else the remote address, and the
+// :scheme the one of the connection. The Sec-WebSocket-Version header
+// field is 13 unless given. The server is to enable the extended CONNECT
+// protocol with SETTINGS_ENABLE_CONNECT_PROTOCOL, and the frames of the
+// connection are to be read concurrently with ReadFrame.
+//
+// The returned net.Conn carries the bytes of the WebSocket protocol, the
+// framing of which is left to a WebSocket library, as DATA frames.
+func (c *Conn) DialWebSocket(path string, header Header) (net.Conn, error) {
+	if c.server {
+		return nil, errors.New("http2: WebSocket dialed by server")
+	}
+
+	// The settings of the server apply once acknowledged,
+	// which follows the handshake.
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	select {
+	case <-c.flush():
+	case <-c.closeCh:
+		return nil, ErrClosed
+	}
+	if !c.remoteSettings().ConnectProtocolEnabled() {
+		return nil, errors.New("http2: extended CONNECT protocol not enabled by the server")
+	}
+
+	h := header.Clone()
+	if h == nil {
+		h = Header{}
+	}
+	h.SetMethod("CONNECT")
+	h.SetProtocol("websocket")
+	h.SetPath(path)
+	if h.Scheme() == "" {
+		if _, ok := c.rwc.(*tls.Conn); ok {
+			h.SetScheme("https")
+		} else {
+			h.SetScheme("http")
+		}
+	}
+	if addr := c.RemoteAddr(); h.Authority() == "" && addr != nil {
+		h.SetAuthority(addr.String())
+	}
+	if h.Get("sec-websocket-version") == "" {
+		h.Set("sec-websocket-version", "13")
+	}
+
+	streamID, err := c.NextStreamID()
+	if err != nil {
+		return nil, err
+	}
+	t, err := c.connect(streamID, h)
+	if err != nil {
+		return nil, err
+	}
+	return &streamConn{t}, nil
+}
+
+// streamConn is the net.Conn of the tunnel of a WebSocket. The deadlines
+// fail the reads waiting for DATA frames, and the writes not started yet,
+// but not the ones waiting for the flow-control windows.
+type streamConn struct {
+	*tunnel
+}
+
+// Close ends the stream in the sending direction, and releases the bytes
+// received and not read. The stream is reset with CANCEL if the remote
+// endpoint has not ended it.
+func (c *streamConn) Close() error {
+	err := c.tunnel.Close()
+	c.body.Close()
+	if s := c.conn.stream(c.streamID); s != nil && s.readable() {
+		c.conn.WriteFrame(&RSTStreamFrame{c.streamID, ErrCodeCancel})
+	}
+	c.conn.removeTunnel(c.streamID)
+	return err
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.body.setReadDeadline(t)
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	var d int64
+	if !t.IsZero() {
+		d = t.UnixNano()
+	}
+	atomic.StoreInt64(&c.writeDeadline, d)
+	return nil
+}
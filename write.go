@@ -1,38 +1,69 @@
 package http2
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 
 	"github.com/nekolunar/http2/hpack"
 )
 
 type frameWriter struct {
 	io.Writer
+	// direct is the writer under the buffered Writer, to which the DATA
+	// chunks not fitting in the buffer are written directly.
+	direct       io.Writer
 	buf          []byte
 	maxFrameSize uint32
 	err          error
 
+	// The payload octets written by the last WriteFrame.
+	written int
+
 	*hpack.Encoder
 	hpackBuf          []byte
 	maxHeaderListSize uint32
+
+	headerTableSize,
+	headerTableSizeLimit uint32
 }
 
 func newFrameWriter(w io.Writer) *frameWriter {
 	return &frameWriter{
-		Writer:       w,
-		maxFrameSize: defaultMaxFrameSize,
-		Encoder:      hpack.NewEncoder(defaultHeaderTableSize),
+		Writer:               w,
+		maxFrameSize:         defaultMaxFrameSize,
+		Encoder:              hpack.NewEncoder(defaultHeaderTableSize),
+		headerTableSize:      defaultHeaderTableSize,
+		headerTableSizeLimit: ^uint32(0),
+	}
+}
+
+// setHeaderTableSize sets the maximum size of the dynamic table allowed by
+// the remote endpoint. The encoder uses at most headerTableSizeLimit.
+func (w *frameWriter) setHeaderTableSize(size uint32) {
+	w.headerTableSize = size
+	if size > w.headerTableSizeLimit {
+		size = w.headerTableSizeLimit
+	}
+	if size != w.Encoder.MaxHeaderTableSize() {
+		w.Encoder.SetMaxHeaderTableSize(size)
 	}
 }
 
+func (w *frameWriter) setHeaderTableSizeLimit(limit uint32) {
+	w.headerTableSizeLimit = limit
+	w.setHeaderTableSize(w.headerTableSize)
+}
+
 type frameWriterTo interface {
 	Frame
 	writeTo(*frameWriter) error
 }
 
 func (w *frameWriter) WriteFrame(frame Frame) error {
+	w.written = 0
 	return frame.(frameWriterTo).writeTo(w)
 }
 
@@ -83,6 +114,11 @@ func (f *DataFrame) writeTo(w *frameWriter) error {
 			writeFrameHeader(w, dataLen, FrameData, flags, f.StreamID)
 		}
 
+		if chunk, ok := f.Data.(*dataChunk); ok {
+			w.writeChunk(chunk.next(int(dataLen)), zeroBuf[:padLen])
+			continue
+		}
+
 		w.Write(w.buf)
 
 		if dataLen > 0 {
@@ -95,11 +131,57 @@ func (f *DataFrame) writeTo(w *frameWriter) error {
 	return w.err
 }
 
+// dataChunk is a DATA frame payload held in memory, which is written
+// along with the frame header without being copied into the buffer of
+// the writer when it does not fit.
+type dataChunk struct {
+	p []byte
+}
+
+func (r *dataChunk) Read(p []byte) (int, error) {
+	if len(r.p) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.p)
+	r.p = r.p[n:]
+	return n, nil
+}
+
+// next returns the next n bytes of the chunk.
+func (r *dataChunk) next(n int) []byte {
+	if n > len(r.p) {
+		n = len(r.p)
+	}
+	p := r.p[:n]
+	r.p = r.p[n:]
+	return p
+}
+
+// writeChunk writes the frame header in buf, followed by the data and the
+// padding of a chunk. A chunk not fitting in the buffer is written with a
+// single vectored write once the buffer is flushed.
+func (w *frameWriter) writeChunk(p, padding []byte) {
+	if w.err != nil {
+		return
+	}
+	bw, ok := w.Writer.(*bufio.Writer)
+	if !ok || w.direct == nil || len(w.buf)+len(p)+len(padding) <= bw.Available() {
+		w.Write(w.buf)
+		w.Write(p)
+		w.Write(padding)
+		return
+	}
+	if w.err = bw.Flush(); w.err == nil {
+		bufs := net.Buffers{w.buf, p, padding}
+		_, w.err = bufs.WriteTo(w.direct)
+	}
+}
+
 func (f *HeadersFrame) writeTo(w *frameWriter) error {
 	if !validStreamID(f.StreamID) {
 		return fmt.Errorf("bad stream ID: %d", f.StreamID)
 	}
-	if f.HasPriority() && !validStreamID(f.StreamDependency) {
+	if f.HasPriority() && f.StreamDependency&(1<<31) != 0 {
 		return fmt.Errorf("bad stream dependency: %d", f.StreamDependency)
 	}
 
@@ -162,7 +244,12 @@ func (f *HeadersFrame) writeTo(w *frameWriter) error {
 
 	for k, vv := range f.Header {
 		if _, pseudo := pseudoHeader[k]; pseudo {
-			continue
+			// A header block consisting only of pseudo-header
+			// fields is written once all of them are encoded.
+			if remainingHeader > 0 || firstFrameSent {
+				continue
+			}
+			goto write
 		}
 
 		if k == "" || k[0] == ':' {
@@ -172,7 +259,7 @@ func (f *HeadersFrame) writeTo(w *frameWriter) error {
 		k = CanonicalHTTP2HeaderKey(k)
 
 		for _, v := range vv {
-			n, w.hpackBuf = w.EncodeHeaderField(w.hpackBuf, k, v, false)
+			n, w.hpackBuf = w.EncodeHeaderField(w.hpackBuf, k, v, sensitiveField(f.Sensitive, k))
 			written += n
 			remainingHeader--
 
@@ -253,7 +340,7 @@ func (f *PriorityFrame) writeTo(w *frameWriter) error {
 	if !validStreamID(f.StreamID) {
 		return fmt.Errorf("bad stream ID: %d", f.StreamID)
 	}
-	if !validStreamID(f.StreamDependency) {
+	if f.StreamDependency&(1<<31) != 0 {
 		return fmt.Errorf("bad stream dependency: %d", f.StreamDependency)
 	}
 
@@ -284,6 +371,10 @@ func (f *RSTStreamFrame) writeTo(w *frameWriter) error {
 }
 
 func (f *SettingsFrame) writeTo(w *frameWriter) error {
+	if err := checkFrameLen(f, w.maxFrameSize); err != nil {
+		return err
+	}
+
 	if f.Ack {
 		if len(f.Settings) > 0 {
 			return fmt.Errorf("ACK settings frame must have an empty payload")
@@ -359,7 +450,12 @@ func (f *PushPromiseFrame) writeTo(w *frameWriter) error {
 
 	for k, vv := range f.Header {
 		if _, pseudo := pseudoHeader[k]; pseudo {
-			continue
+			// A header block consisting only of pseudo-header
+			// fields is written once all of them are encoded.
+			if remainingHeader > 0 || firstFrameSent {
+				continue
+			}
+			goto write
 		}
 
 		if k == "" || k[0] == ':' {
@@ -369,7 +465,7 @@ func (f *PushPromiseFrame) writeTo(w *frameWriter) error {
 		k = CanonicalHTTP2HeaderKey(k)
 
 		for _, v := range vv {
-			n, w.hpackBuf = w.EncodeHeaderField(w.hpackBuf, k, v, false)
+			n, w.hpackBuf = w.EncodeHeaderField(w.hpackBuf, k, v, sensitiveField(f.Sensitive, k))
 			written += n
 			remainingHeader--
 
@@ -453,12 +549,18 @@ func (f *PingFrame) writeTo(w *frameWriter) error {
 }
 
 func (f *GoAwayFrame) writeTo(w *frameWriter) error {
-	writeFrameHeader(w, uint32(8+len(f.DebugData)), f.Type(), 0, 0)
+	// The debug data is truncated to fit in a single frame.
+	debugData := f.DebugData
+	if max := int(w.maxFrameSize) - 8; len(debugData) > max {
+		debugData = debugData[:max]
+	}
+
+	writeFrameHeader(w, uint32(8+len(debugData)), f.Type(), 0, 0)
 	writeUint32(w, f.LastStreamID&(1<<31-1))
 	writeUint32(w, uint32(f.ErrCode))
 
 	w.Write(w.buf)
-	w.Write(f.DebugData)
+	w.Write(debugData)
 
 	return w.err
 }
@@ -476,10 +578,103 @@ func (f *WindowUpdateFrame) writeTo(w *frameWriter) error {
 	return w.err
 }
 
+func (f *AltSvcFrame) validate() error {
+	if f.StreamID == 0 && len(f.Origin) == 0 {
+		return errors.New("origin must be non-empty on stream 0")
+	}
+	if f.StreamID != 0 && len(f.Origin) > 0 {
+		return fmt.Errorf("origin must be empty on stream %d", f.StreamID)
+	}
+	if len(f.Origin) > 1<<16-1 {
+		return fmt.Errorf("origin too long: %d", len(f.Origin))
+	}
+	return nil
+}
+
+func (f *AltSvcFrame) writeTo(w *frameWriter) error {
+	if err := f.validate(); err != nil {
+		return err
+	}
+
+	payloadLen, _ := frameLen(f)
+	if err := checkFrameLen(f, w.maxFrameSize); err != nil {
+		return err
+	}
+
+	writeFrameHeader(w, payloadLen, f.Type(), 0, f.StreamID)
+	writeUint16(w, uint16(len(f.Origin)))
+
+	w.Write(w.buf)
+	w.Write(f.Origin)
+	w.Write(f.FieldValue)
+
+	return w.err
+}
+
+func (f *OriginFrame) validate() error {
+	for _, origin := range f.Origins {
+		if len(origin) > 1<<16-1 {
+			return fmt.Errorf("origin too long: %d", len(origin))
+		}
+	}
+	return nil
+}
+
+func (f *OriginFrame) writeTo(w *frameWriter) error {
+	if err := f.validate(); err != nil {
+		return err
+	}
+
+	payloadLen, _ := frameLen(f)
+	if err := checkFrameLen(f, w.maxFrameSize); err != nil {
+		return err
+	}
+
+	writeFrameHeader(w, payloadLen, f.Type(), 0, 0)
+	w.Write(w.buf)
+
+	for _, origin := range f.Origins {
+		w.buf = w.buf[:0]
+		writeUint16(w, uint16(len(origin)))
+		w.Write(w.buf)
+		w.Write([]byte(origin))
+	}
+
+	return w.err
+}
+
+func (f *PriorityUpdateFrame) validate() error {
+	if !validStreamID(f.PrioritizedStreamID) {
+		return fmt.Errorf("bad prioritized stream id %d", f.PrioritizedStreamID)
+	}
+	return nil
+}
+
+func (f *PriorityUpdateFrame) writeTo(w *frameWriter) error {
+	if err := f.validate(); err != nil {
+		return err
+	}
+
+	payloadLen, _ := frameLen(f)
+	if err := checkFrameLen(f, w.maxFrameSize); err != nil {
+		return err
+	}
+
+	writeFrameHeader(w, payloadLen, f.Type(), 0, 0)
+	writeUint32(w, f.PrioritizedStreamID)
+	w.Write(w.buf)
+	w.Write([]byte(f.PriorityFieldValue))
+
+	return w.err
+}
+
 func (f *UnknownFrame) writeTo(w *frameWriter) error {
 	if f.PayloadLen < 0 || (f.PayloadLen > 0 && f.Payload == nil) {
 		return errors.New("bad payload")
 	}
+	if err := checkFrameLen(f, w.maxFrameSize); err != nil {
+		return err
+	}
 
 	writeFrameHeader(w, uint32(f.PayloadLen), f.Type(), f.Flags, f.StreamID)
 
@@ -492,6 +687,39 @@ func (f *UnknownFrame) writeTo(w *frameWriter) error {
 	return w.err
 }
 
+// frameLen returns the payload length of a frame which cannot be split
+// into several frames to fit in the maximum frame size, reporting false
+// for the other frames. The DATA frames and the header blocks are split,
+// and the debug data of GOAWAY frames is truncated.
+func frameLen(frame Frame) (uint32, bool) {
+	switch v := frame.(type) {
+	case *SettingsFrame:
+		return uint32(settingLen * len(v.Settings)), true
+	case *AltSvcFrame:
+		return uint32(2 + len(v.Origin) + len(v.FieldValue)), true
+	case *OriginFrame:
+		var n uint32
+		for _, origin := range v.Origins {
+			n += uint32(2 + len(origin))
+		}
+		return n, true
+	case *PriorityUpdateFrame:
+		return uint32(4 + len(v.PriorityFieldValue)), true
+	case *UnknownFrame:
+		return uint32(v.PayloadLen), true
+	}
+	return 0, false
+}
+
+// checkFrameLen returns an error if the payload of a frame which cannot be
+// split exceeds maxFrameSize.
+func checkFrameLen(frame Frame, maxFrameSize uint32) error {
+	if n, ok := frameLen(frame); ok && n > maxFrameSize {
+		return fmt.Errorf("frame length %d exceeds maximum %d", n, maxFrameSize)
+	}
+	return nil
+}
+
 func (w *frameWriter) Write(src []byte) (int, error) {
 	if w.err != nil {
 		return 0, w.err
@@ -502,6 +730,7 @@ func (w *frameWriter) Write(src []byte) (int, error) {
 }
 
 func writeFrameHeader(w *frameWriter, payloadLen uint32, frameType FrameType, flags Flags, streamID uint32) {
+	w.written += int(payloadLen)
 	w.buf = append(w.buf[:0],
 		byte(payloadLen>>16),
 		byte(payloadLen>>8),